@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// A Cassandra or Scylla cluster managed by ccm, the Cassandra Cluster
+// Manager: yacht creates it for the suite in the lane directory,
+// starts, stops and removes it with ccm
+type CCMCluster struct {
+	CQLServerURI
+	// The ccm command, "ccm" by default
+	command string
+	// The version ccm installs, e.g. release:5.2 or 4.1.3, or a
+	// directory with an installation or a source tree
+	version    string
+	installDir string
+	// Create a Scylla cluster, true by default
+	scylla bool
+	nodes  int
+	// More options of ccm create, e.g. --vnodes
+	options []string
+	// What the suite requires of the nodes, see Requirements
+	requires Requirements
+	// The ccm configuration directory, in the lane directory, so
+	// that lanes don't share clusters
+	configDir string
+}
+
+const CCM_CLUSTER_NAME = "yacht"
+
+// Settings of a ccm mode in suite.yaml, e.g. version: release:5.2
+func (server *CCMCluster) Configure(mode map[string]string) error {
+	server.command = mode["command"]
+	if server.command == "" {
+		server.command = "ccm"
+	}
+	server.version = mode["version"]
+	server.installDir = mode["install_dir"]
+	if server.version == "" && server.installDir == "" {
+		return merry.New("ccm mode requires a version or an install_dir")
+	}
+	server.scylla = true
+	if scylla, found := mode["scylla"]; found {
+		value, err := strconv.ParseBool(scylla)
+		if err != nil {
+			return merry.Errorf("malformed scylla '%s'", scylla)
+		}
+		server.scylla = value
+	}
+	server.nodes = 3
+	if nodes, found := mode["nodes"]; found {
+		n, err := strconv.Atoi(nodes)
+		if err != nil || n <= 0 {
+			return merry.Errorf("malformed nodes '%s'", nodes)
+		}
+		server.nodes = n
+	}
+	server.options = strings.Fields(mode["options"])
+	return nil
+}
+
+func (server *CCMCluster) ModeName() string {
+	return "ccm"
+}
+
+func (server *CCMCluster) Environment() []string {
+	return []string{
+		"YACHT_MODE=" + server.ModeName(),
+		"YACHT_URIS=" + server.uri,
+		"YACHT_KEYSPACE=" + server.keyspace,
+		"YACHT_CCM_CONFIG_DIR=" + server.configDir,
+		"YACHT_LOG_FILES=" + strings.Join(server.LogFiles(), ","),
+	}
+}
+
+func (server *CCMCluster) nodeDir(i int) string {
+	return path.Join(server.configDir, CCM_CLUSTER_NAME, fmt.Sprintf("node%d", i))
+}
+
+func (server *CCMCluster) LogFiles() []string {
+	if server.configDir == "" {
+		return nil
+	}
+	var logs []string
+	for i := 1; i <= server.nodes; i++ {
+		logs = append(logs, path.Join(server.nodeDir(i), "logs", "system.log"))
+	}
+	return logs
+}
+
+// Run a ccm command against the cluster of the lane
+func (server *CCMCluster) run(args ...string) (string, error) {
+	args = append(args, "--config-dir="+server.configDir)
+	ylog.Debugf("running %s %s", server.command, strings.Join(args, " "))
+	out, err := exec.Command(server.command, args...).CombinedOutput()
+	if err != nil {
+		return "", merry.Errorf("%s %s: %v: %s", server.command, strings.Join(args, " "),
+			err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// Stop the nodes, on exit too
+type CCMCluster_stop_artefact struct {
+	server *CCMCluster
+	lane   *Lane
+}
+
+func (a *CCMCluster_stop_artefact) Remove() error {
+	a.lane.Log().Printf("Stopping ccm cluster in %s", a.server.configDir)
+	_, err := a.server.run("stop")
+	return err
+}
+
+// Remove the cluster before the next suite, keeping the node logs in
+// the lane directory
+type CCMCluster_remove_artefact struct {
+	server *CCMCluster
+	dir    string
+}
+
+func (a *CCMCluster_remove_artefact) Remove() error {
+	for i, log := range a.server.LogFiles() {
+		if data, err := ioutil.ReadFile(log); err == nil {
+			ioutil.WriteFile(path.Join(a.dir, fmt.Sprintf("ccm-node%d.log", i+1)), data, 0644)
+		}
+	}
+	_, err := a.server.run("remove")
+	return err
+}
+
+func (server *CCMCluster) Start(lane *Lane) error {
+	server.configDir = path.Join(lane.Dir(), "ccm")
+	if err := os.MkdirAll(server.configDir, 0750); err != nil {
+		return merry.Wrap(err)
+	}
+	// Nodes of different lanes must not share addresses
+	prefix, err := lane.LeaseURIPrefix()
+	if err != nil {
+		return err
+	}
+	var release = &ReleaseURIPrefix_artefact{prefix: prefix, lane: lane}
+	lane.AddSuiteArtefact(release)
+	var create = []string{"create", CCM_CLUSTER_NAME, "-n", strconv.Itoa(server.nodes),
+		"-i", prefix}
+	if server.scylla {
+		create = append(create, "--scylla")
+	}
+	if server.version != "" {
+		create = append(create, "-v", server.version)
+	}
+	if server.installDir != "" {
+		create = append(create, "--install-dir="+server.installDir)
+	}
+	create = append(create, server.options...)
+	lane.Log().Printf("Creating ccm cluster in %s", server.configDir)
+	if _, err := server.run(create...); err != nil {
+		return err
+	}
+	if server.requires.UDF {
+		if _, err := server.run("updateconf", "enable_user_defined_functions:true"); err != nil {
+			return err
+		}
+	}
+	// Experimental features are a list, which only a literal yaml
+	// setting can express. Cassandra has none.
+	if features := server.requires.ExperimentalFeatures(); server.scylla && len(features) > 0 {
+		if _, err := server.run("updateconf", "--yaml", fmt.Sprintf("experimental_features: [%s]",
+			strings.Join(features, ", "))); err != nil {
+			return err
+		}
+	}
+	var remove = &CCMCluster_remove_artefact{server: server, dir: lane.Dir()}
+	// The nodes keep their addresses until the cluster is removed
+	lane.AddSuiteArtefact(remove, release)
+	var stop = &CCMCluster_stop_artefact{server: server, lane: lane}
+	lane.AddExitArtefact(stop, remove)
+	server.process = stop
+	if _, err := server.run("start", "--wait-for-binary-proto"); err != nil {
+		return err
+	}
+	out, err := server.run("liveset")
+	if err != nil {
+		return err
+	}
+	server.uri = strings.TrimSpace(out)
+	if server.uri == "" {
+		return merry.Errorf("ccm cluster in %s has no live nodes", server.configDir)
+	}
+	server.replicationFactor = server.nodes
+	return server.CQLServerURI.Start(lane)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Returned when a node of a cluster is down or doesn't see the
+// other nodes, an infrastructure failure
+var ErrNodeDown = merry.New("node down")
+
+// A server of several nodes which can tell whether they are all up
+type HealthChecker interface {
+	// Return ErrNodeDown naming the node and its log if a node is
+	// down or some node sees another one as down
+	CheckHealth() error
+}
+
+// How long to wait for the nodes of a started cluster to see each
+// other as UP
+const CLUSTER_HEALTH_TIMEOUT = 60 * time.Second
+
+// The addresses of the nodes the node considers alive, from the
+// gossiper, via the REST API
+func liveEndpoints(server *CQLServer) ([]string, error) {
+	url := server.apiURL("/gossiper/endpoint/live/")
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, merry.Errorf("%s: %s", url, resp.Status)
+	}
+	var live []string
+	if err := json.NewDecoder(resp.Body).Decode(&live); err != nil {
+		return nil, merry.Prepend(err, url)
+	}
+	return live, nil
+}
+
+func (server *CQLServer) apiURL(resource string) string {
+	var port = SCYLLA_API_PORT
+	if server.cfg.APIPort != 0 {
+		port = server.cfg.APIPort
+	}
+	return fmt.Sprintf("http://%s%s", joinHostPort(server.cfg.URI, port), resource)
+}
+
+func nodeDown(server *CQLServer, format string, a ...interface{}) error {
+	return merry.WithMessagef(ErrNodeDown, "node %s is down: %s, check its log at %s",
+		server.cfg.URI, fmt.Sprintf(format, a...), palette.Path(server.logFileName))
+}
+
+func (cluster *CQLCluster) CheckHealth() error {
+	for _, server := range cluster.servers {
+		if server == nil {
+			continue
+		}
+		live, err := liveEndpoints(server)
+		if err != nil {
+			return nodeDown(server, "REST API is not responding (%v)", err)
+		}
+		for _, peer := range cluster.servers {
+			if peer == nil || peer == server {
+				continue
+			}
+			var found bool
+			for _, endpoint := range live {
+				if strings.TrimPrefix(endpoint, "/") == peer.cfg.URI {
+					found = true
+					break
+				}
+			}
+			if found == false {
+				return nodeDown(peer, "node %s doesn't see it as UP", server.cfg.URI)
+			}
+		}
+	}
+	return nil
+}
+
+// Wait until the nodes of a freshly started server see each other
+// as UP, if it has several nodes
+func waitHealthy(server Server) error {
+	checker, ok := server.(HealthChecker)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	for {
+		err := checker.CheckHealth()
+		if err == nil || time.Now().Sub(start) > CLUSTER_HEALTH_TIMEOUT {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Check that no node of a server went down while the previous
+// test ran
+func checkHealth(server Server) error {
+	if checker, ok := server.(HealthChecker); ok {
+		return checker.CheckHealth()
+	}
+	return nil
+}
+
+// Stop a node and bootstrap a new one with another address in its
+// place, which takes over the tokens of the stopped node and
+// streams its data from the other nodes
+func (cluster *CQLCluster) ReplaceNode(lane *Lane, i int) error {
+	var old = cluster.servers[i]
+	lane.Log().Printf("Replacing server %s", old.name())
+	if err := old.process.Remove(); err != nil {
+		return err
+	}
+	uri, err := lane.LeaseURI()
+	if err != nil {
+		return err
+	}
+	lane.AddSuiteArtefact(&ReleaseURI_artefact{uri: uri, lane: lane})
+	var seeds []string
+	for j, server := range cluster.servers {
+		if j != i {
+			seeds = append(seeds, server.cfg.URI)
+		}
+	}
+	server := cluster.newServer(uri, strings.Join(seeds, ", "))
+	server.cfg.ReplaceAddressFirstBoot = old.cfg.URI
+	// The keyspace is already there, only connect to it
+	server.CQLServerURI = old.CQLServerURI
+	server.CQLServerURI.uri = uri
+	if err := server.FindScyllaExecutable(); err != nil {
+		return err
+	}
+	if err := server.Install(lane); err != nil {
+		return err
+	}
+	// The node reports initialization completed once streaming
+	// is over
+	if err := server.DoStart(lane); err != nil {
+		return err
+	}
+	if err := server.CQLServerURI.newCluster(); err != nil {
+		return err
+	}
+	server.cluster.Keyspace = server.keyspace
+	cluster.servers[i] = server
+	lane.Log().Printf("Replaced server %s with %s", old.name(), server.name())
+	return waitHealthy(cluster)
+}
+
+// Replace a node of the cluster, to test node replacement:
+//
+//	-- replace-node: <number>
+//
+// The node, 1 to 3, is stopped and a new node with another address
+// bootstraps with replace_address_first_boot in its place. The
+// directive returns when the data is streamed to the new node and
+// all nodes see each other as UP. Requires cluster mode.
+func replaceNodeDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	cluster, i, err := directiveNode(run, stmt)
+	if err != nil {
+		return err
+	}
+	return merry.Prepend(cluster.ReplaceNode(run.lane, i), "replace-node")
+}
+
+// The cluster and the index of the node given by its number, 1 to 3,
+// in the directive arguments
+func directiveNode(run *cqlTestRun, stmt *cqlStatement) (*CQLCluster, int, error) {
+	cluster, ok := run.server.(*CQLCluster)
+	if !ok {
+		return nil, 0, merry.Errorf("%s: requires cluster mode, not %s",
+			stmt.directive, run.server.ModeName())
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(stmt.text))
+	if err != nil || n < 1 || n > len(cluster.servers) {
+		return nil, 0, merry.Errorf("%s: malformed node number '%s', expected 1 to %d",
+			stmt.directive, stmt.text, len(cluster.servers))
+	}
+	return cluster, n - 1, nil
+}
+
+// How long a repair of the test keyspace may take
+const REPAIR_TIMEOUT = 10 * time.Minute
+
+// Run a full repair of the keyspace on the node and wait for it
+// to finish
+func repairKeyspace(server *CQLServer, keyspace string) error {
+	var url = server.apiURL("/storage_service/repair_async/" + keyspace)
+	client := http.Client{Timeout: time.Minute}
+	resp, err := client.Post(url, "application/json", nil)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return merry.Errorf("%s: %s %s", url, resp.Status, body)
+	}
+	var id = strings.TrimSpace(string(body))
+	start := time.Now()
+	for {
+		resp, err := client.Get(url + "?id=" + id)
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		var status string
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			return merry.Prepend(err, url)
+		}
+		switch status {
+		case "SUCCESSFUL":
+			return nil
+		case "RUNNING":
+		default:
+			return merry.Errorf("repair of %s on %s: %s, check its log at %s",
+				keyspace, server.cfg.URI, status, palette.Path(server.logFileName))
+		}
+		if time.Now().Sub(start) > REPAIR_TIMEOUT {
+			return merry.Errorf("repair of %s on %s timed out", keyspace, server.cfg.URI)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Execute the query at CL=ONE coordinated by the node and return the
+// result as printed in test output
+func queryNode(server *CQLServer, keyspace string, query string) (string, error) {
+	var cluster = gocql.NewCluster(server.cfg.URI)
+	cluster.Timeout = 30 * time.Second
+	if err := server.driver.Apply(cluster); err != nil {
+		return "", err
+	}
+	cluster.HostFilter = gocql.WhiteListHostFilter(server.cfg.URI)
+	cluster.Consistency = gocql.One
+	cluster.Keyspace = keyspace
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return "", merry.Prepend(err, "when connecting to '"+server.cfg.URI+"'")
+	}
+	c := &CQLConnection{session: session, cluster: cluster}
+	defer c.Close()
+	result, err := c.Execute(query, nil)
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// Repair the test keyspace on every node, then execute each query at
+// CL=ONE on every node and return the differences of their results
+// from those of the first node, a cheap check that replicas converge
+func (cluster *CQLCluster) CheckConsistency(queries []string) ([]string, error) {
+	for _, server := range cluster.servers {
+		if err := repairKeyspace(server, cluster.keyspace); err != nil {
+			return nil, err
+		}
+	}
+	var divergent []string
+	for _, query := range queries {
+		query = expandVars(query, cluster.Environment())
+		var results = make([]string, len(cluster.servers))
+		for i, server := range cluster.servers {
+			result, err := queryNode(server, cluster.keyspace, query)
+			if err != nil {
+				return nil, merry.Prependf(err, "'%.40s' on %s", query, server.cfg.URI)
+			}
+			results[i] = result
+		}
+		for i := 1; i < len(results); i++ {
+			if results[i] == results[0] {
+				continue
+			}
+			diff := difflib.UnifiedDiff{
+				A:        difflib.SplitLines(results[0]),
+				B:        difflib.SplitLines(results[i]),
+				FromFile: cluster.servers[0].cfg.URI,
+				ToFile:   cluster.servers[i].cfg.URI,
+				Context:  3,
+			}
+			text, _ := difflib.GetUnifiedDiffString(diff)
+			divergent = append(divergent, fmt.Sprintf("%s\n%s", query, TrimAndColorizeDiff(text)))
+		}
+	}
+	return divergent, nil
+}
+
+// Freeze or thaw a node of the cluster, to test hinted handoff:
+//
+//	-- pause-node: <number>
+//	-- resume-node: <number>
+//
+// A paused node, 1 to 3, doesn't answer the other nodes, so they
+// store hints for writes which time out on it. A node the test
+// leaves paused is resumed when the test ends, see resumeNodes().
+func pauseNodeDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	cluster, i, err := directiveNode(run, stmt)
+	if err != nil {
+		return err
+	}
+	var signal = syscall.SIGSTOP
+	if stmt.directive == "resume-node" {
+		signal = syscall.SIGCONT
+	}
+	var server = cluster.servers[i]
+	if server.cmd.Process == nil {
+		return merry.Errorf("%s: node %s is not running", stmt.directive, server.cfg.URI)
+	}
+	if err := server.cmd.Process.Signal(signal); err != nil {
+		return merry.Prependf(err, "%s: node %s", stmt.directive, server.cfg.URI)
+	}
+	run.lane.Log().Printf("%s %s", stmt.directive, server.name())
+	if run.paused == nil {
+		run.paused = make(map[*CQLServer]bool)
+	}
+	if signal == syscall.SIGSTOP {
+		run.paused[server] = true
+	} else {
+		delete(run.paused, server)
+	}
+	return nil
+}
+
+// Resume the nodes a test left paused, e.g. because it failed before
+// its resume-node directive, so that they don't stay frozen for the
+// next tests of the lane
+func (run *cqlTestRun) resumeNodes() {
+	for server := range run.paused {
+		if server.cmd.Process == nil {
+			continue
+		}
+		if err := server.cmd.Process.Signal(syscall.SIGCONT); err != nil {
+			run.lane.Log().Warnf("resume-node %s: %v", server.name(), err)
+			continue
+		}
+		run.lane.Log().Printf("resume-node %s: the test left it paused", server.name())
+	}
+	run.paused = nil
+}
+
+// Scylla Prometheus port
+const SCYLLA_PROMETHEUS_PORT = 9180
+
+// Counters of hints, summed over shards
+var hintMetricRE = regexp.MustCompile(`^scylla_hints_manager_(written|sent|dropped)(?:_total)?\{.*\}\s+(\S+)$`)
+
+// The number of hints the node stored and hasn't sent yet, from its
+// metrics
+func pendingHints(server *CQLServer) (int64, error) {
+	var port = SCYLLA_PROMETHEUS_PORT
+	if server.cfg.PrometheusPort != 0 {
+		port = server.cfg.PrometheusPort
+	}
+	url := fmt.Sprintf("http://%s/metrics", joinHostPort(server.cfg.URI, port))
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	var pending float64
+	for _, line := range strings.Split(string(data), "\n") {
+		m := hintMetricRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		if m[1] == "written" {
+			pending += value
+		} else {
+			pending -= value
+		}
+	}
+	return int64(pending), nil
+}
+
+// Wait until every node has delivered the hints it stored:
+//
+//	-- wait-for-hints: [timeout <duration>]
+//
+// Hints are stored for writes which timed out on a paused node, and
+// delivered once it is resumed and seen as UP again. The default
+// timeout is 60 seconds. In other modes than cluster the directive
+// does nothing.
+func waitForHintsDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	var timeout = 60 * time.Second
+	args := strings.Fields(stmt.text)
+	if len(args) == 2 && args[0] == "timeout" {
+		var err error
+		if timeout, err = time.ParseDuration(args[1]); err != nil {
+			return merry.Prepend(err, "wait-for-hints")
+		}
+	} else if len(args) != 0 {
+		return merry.Errorf("wait-for-hints: malformed arguments '%s'", stmt.text)
+	}
+	cluster, ok := run.server.(*CQLCluster)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	for {
+		var pending int64
+		for _, server := range cluster.servers {
+			n, err := pendingHints(server)
+			if err != nil {
+				return merry.Prependf(err, "wait-for-hints: node %s", server.cfg.URI)
+			}
+			pending += n
+		}
+		if pending <= 0 {
+			return nil
+		}
+		if time.Now().Sub(start) > timeout {
+			return merry.Errorf("wait-for-hints: %d hints not delivered after %v",
+				pending, timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/ansel1/merry"
 	"github.com/fatih/color"
 )
 
@@ -43,30 +45,157 @@ type Palette struct {
 	Info ColoredSprintf
 }
 
-var palette = Palette{
-	Pass:    CreateColor(color.FgGreen),
-	Fail:    CreateColor(color.FgRed),
-	New:     CreateColor(color.FgBlue),
-	Skip:    CreateColor(color.Faint),
-	Path:    CreateColor(color.Bold),
-	DiffIn:  CreateColor(color.FgGreen),
-	DiffOut: CreateColor(color.FgRed),
-	Warn:    CreateColor(color.FgYellow),
-	Crit:    CreateColor(color.FgRed),
+// The palette section of the configuration file: a theme, and the
+// colors and attributes of individual roles to override in it, e.g.
+// "bright-blue bold" or "white on-red underline"
+type PaletteConfig struct {
+	Theme   string
+	Pass    string
+	Fail    string
+	New     string
+	Skip    string
+	Path    string
+	DiffIn  string `mapstructure:"diff_in"`
+	DiffOut string `mapstructure:"diff_out"`
+	Warn    string
+	Crit    string
 }
 
-func PrintSuiteBeginBlurb() {
-	fmt.Printf("%s\n", strings.Repeat("=", 80))
-	fmt.Printf("LANE ")
+var themes = map[string]PaletteConfig{
+	"default": {
+		Pass:    "green",
+		Fail:    "red",
+		New:     "blue",
+		Skip:    "faint",
+		Path:    "bold",
+		DiffIn:  "green",
+		DiffOut: "red",
+		Warn:    "yellow",
+		Crit:    "red",
+	},
+	// Bright colors which stay readable on dark and light
+	// backgrounds, and no faint text
+	"high-contrast": {
+		Pass:    "bright-green bold",
+		Fail:    "bright-red bold",
+		New:     "bright-cyan bold",
+		Skip:    "plain",
+		Path:    "bold underline",
+		DiffIn:  "bright-green",
+		DiffOut: "bright-red",
+		Warn:    "bright-yellow bold",
+		Crit:    "bright-white on-red bold",
+	},
+}
+
+var colorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// Colors and attributes by name, built before palette is initialized
+var colorAttributes = func() map[string]color.Attribute {
+	var attributes = map[string]color.Attribute{
+		"bold":      color.Bold,
+		"faint":     color.Faint,
+		"italic":    color.Italic,
+		"underline": color.Underline,
+		"blink":     color.BlinkSlow,
+		"reverse":   color.ReverseVideo,
+	}
+	for i, name := range colorNames {
+		attributes[name] = color.FgBlack + color.Attribute(i)
+		attributes["bright-"+name] = color.FgHiBlack + color.Attribute(i)
+		attributes["on-"+name] = color.BgBlack + color.Attribute(i)
+		attributes["on-bright-"+name] = color.BgHiBlack + color.Attribute(i)
+	}
+	return attributes
+}()
+
+// Parse a list of colors and attributes, e.g. "bright-red bold", or
+// "plain" for none
+func parseColor(spec string) ([]color.Attribute, error) {
+	var attributes []color.Attribute
+	for _, name := range strings.Fields(strings.Replace(strings.ToLower(spec), ",", " ", -1)) {
+		if name == "plain" {
+			continue
+		}
+		attribute, found := colorAttributes[name]
+		if !found {
+			var known []string
+			for name := range colorAttributes {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return nil, merry.Errorf("unknown color or attribute '%s', must be plain or "+
+				"one of %s", name, strings.Join(known, ", "))
+		}
+		attributes = append(attributes, attribute)
+	}
+	return attributes, nil
+}
+
+// Create a palette from a theme and role overrides of the
+// configuration file
+func NewPalette(cfg PaletteConfig) (Palette, error) {
+	var p Palette
+	var name = cfg.Theme
+	if name == "" {
+		name = "default"
+	}
+	theme, found := themes[name]
+	if !found {
+		var known []string
+		for name := range themes {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return p, merry.Errorf("palette.theme: unknown theme '%s', must be one of %s",
+			name, strings.Join(known, ", "))
+	}
+	var roles = []struct {
+		name     string
+		spec     string
+		override string
+		sprintf  *ColoredSprintf
+	}{
+		{"pass", theme.Pass, cfg.Pass, &p.Pass},
+		{"fail", theme.Fail, cfg.Fail, &p.Fail},
+		{"new", theme.New, cfg.New, &p.New},
+		{"skip", theme.Skip, cfg.Skip, &p.Skip},
+		{"path", theme.Path, cfg.Path, &p.Path},
+		{"diff_in", theme.DiffIn, cfg.DiffIn, &p.DiffIn},
+		{"diff_out", theme.DiffOut, cfg.DiffOut, &p.DiffOut},
+		{"warn", theme.Warn, cfg.Warn, &p.Warn},
+		{"crit", theme.Crit, cfg.Crit, &p.Crit},
+	}
+	for _, role := range roles {
+		var spec = role.spec
+		if role.override != "" {
+			spec = role.override
+		}
+		attributes, err := parseColor(spec)
+		if err != nil {
+			return p, merry.Prependf(err, "palette.%s", role.name)
+		}
+		*role.sprintf = CreateColor(attributes...)
+	}
+	return p, nil
+}
+
+var palette, _ = NewPalette(PaletteConfig{})
+
+// Suite blurbs are prefixed with the lane id if several lanes print
+// them at once
+func PrintSuiteBeginBlurb(prefix string) {
+	fmt.Printf("%s%s\n", prefix, strings.Repeat("=", 80))
+	fmt.Printf("%sLANE ", prefix)
 	fmt.Printf("%-52s", "TEST")
 	fmt.Printf(palette.Warn("%-11s", "MODE"))
 	fmt.Printf(palette.Pass("RESULT"))
 	fmt.Printf("\n")
-	fmt.Printf("%s\n", strings.Repeat("-", 75))
+	fmt.Printf("%s%s\n", prefix, strings.Repeat("-", 75))
 }
 
-func PrintSuiteEndBlurb() {
-	fmt.Printf("%s\n", strings.Repeat("-", 75))
+func PrintSuiteEndBlurb(prefix string) {
+	fmt.Printf("%s%s\n", prefix, strings.Repeat("-", 75))
 }
 
 func PrintTestBlurb(lane string, name string, mode string, result string) {
@@ -77,6 +206,12 @@ func PrintTestBlurb(lane string, name string, mode string, result string) {
 		result = palette.Fail("[ %s ]", result)
 	case "new":
 		result = palette.New("[ %s  ]", result)
+	case "broken", "too-large":
+		result = palette.Fail("[%s]", result)
+	case "not-run":
+		result = palette.Skip("[%s]", result)
+	case "skip":
+		result = palette.Skip("[ %s ]", result)
 	default:
 		result = palette.Skip(result)
 	}
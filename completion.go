@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// The commit yacht is built from, set by the Makefile
+var commit string
+
+// Suite types and modes yacht supports, see --version
+var suiteTypes = []string{"cql", "harness", "python", "exe", "unit"}
+var modeNames = []string{"uri", "single", "cluster", "mock", "k8s", "compose", "ccm"}
+
+var commands = []string{"accept", "minimize", "shell", "replay", "regen", "setup-net",
+	"config", "serve", "clean", "completion"}
+
+// Whether the first argument is taken for a command rather than
+// a pattern. __complete is a command too, but isn't advertised.
+func isCommand(name string) bool {
+	if name == "__complete" {
+		return true
+	}
+	for _, command := range commands {
+		if command == name {
+			return true
+		}
+	}
+	return false
+}
+
+func printVersion() {
+	var revision = commit
+	if info, ok := debug.ReadBuildInfo(); ok && revision == "" {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	if revision == "" {
+		revision = "unknown commit"
+	}
+	fmt.Printf("yacht %s, built with %s %s/%s\n", revision, runtime.Version(),
+		runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("Suite types: %s\n", strings.Join(suiteTypes, ", "))
+	fmt.Printf("Modes: %s\n", strings.Join(modeNames, ", "))
+}
+
+// Commands whose output is read by the shell, and which must print
+// nothing else
+func quietCommand() bool {
+	return len(os.Args) > 1 && (os.Args[1] == "__complete" || os.Args[1] == "completion")
+}
+
+const BASH_COMPLETION = `_yacht() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    local prev=${COMP_WORDS[COMP_CWORD-1]}
+    COMPREPLY=($(compgen -W "$(yacht __complete -- "$prev" 2>/dev/null)" -- "$cur"))
+}
+complete -F _yacht yacht
+`
+
+const ZSH_COMPLETION = `#compdef yacht
+_yacht() {
+    local -a candidates
+    candidates=(${(f)"$(yacht __complete -- ${words[CURRENT-1]} 2>/dev/null)"})
+    compadd -- $candidates
+}
+compdef _yacht yacht
+`
+
+const FISH_COMPLETION = `complete -c yacht -f -a '(yacht __complete -- (commandline -opc)[-1] 2>/dev/null)'
+`
+
+// yacht completion bash|zsh|fish prints a completion script, which
+// calls yacht __complete -- <previous word> to get the candidates
+func (env *Env) Completion() int {
+	if env.command == "__complete" {
+		var prev string
+		if len(env.patterns) > 0 {
+			prev = env.patterns[0]
+		}
+		for _, word := range env.completions(prev) {
+			fmt.Println(word)
+		}
+		return 0
+	}
+	var shell string
+	if len(env.patterns) > 0 {
+		shell = env.patterns[0]
+	}
+	switch shell {
+	case "bash":
+		fmt.Print(BASH_COMPLETION)
+	case "zsh":
+		fmt.Print(ZSH_COMPLETION)
+	case "fish":
+		fmt.Print(FISH_COMPLETION)
+	default:
+		fmt.Println("Usage: yacht completion bash|zsh|fish")
+		return 1
+	}
+	return 0
+}
+
+// Candidates for the word after prev: modes after --mode and shell,
+// otherwise commands, options, suite names and suite/test names found
+// in srcdir
+func (env *Env) completions(prev string) []string {
+	if prev == "--mode" || prev == "shell" {
+		return modeNames
+	}
+	if prev == "completion" {
+		return []string{"bash", "zsh", "fish"}
+	}
+	var words = append([]string{}, commands...)
+	pflag.VisitAll(func(flag *pflag.Flag) {
+		words = append(words, "--"+flag.Name)
+	})
+	files, _ := filepath.Glob(path.Join(env.srcdir, "*", "suite.*"))
+	for _, file := range files {
+		suite := path.Base(path.Dir(file))
+		words = append(words, suite)
+		tests, _ := filepath.Glob(path.Join(path.Dir(file), "*.test.cql"))
+		for _, test := range tests {
+			words = append(words, suite+"/"+strings.TrimSuffix(path.Base(test), ".test.cql"))
+		}
+	}
+	sort.Strings(words)
+	return words
+}
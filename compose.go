@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/google/uuid"
+)
+
+const COMPOSE_DEFAULT_TIMEOUT = 5 * time.Minute
+
+// Scylla nodes of a topology described by a docker-compose file, e.g.
+// nodes, networks and monitoring, brought up for the suite and torn
+// down when it ends
+type ComposeCluster struct {
+	CQLServerURI
+	// The docker-compose file, relative to the suite directory in
+	// suite.yaml
+	file string
+	// The command, "docker compose" by default
+	command []string
+	// The services of Scylla nodes, by default those with a Scylla
+	// or Cassandra image
+	services []string
+	// How the driver reaches the nodes: ip, by container addresses,
+	// or published, through the host ports published for 9042
+	access  string
+	timeout time.Duration
+	// The compose project, unique per suite run
+	project string
+	// Container addresses of the nodes
+	ips []string
+}
+
+// Settings of a compose mode in suite.yaml, e.g. file: topology.yml
+func (server *ComposeCluster) Configure(mode map[string]string, suiteDir string) error {
+	server.file = mode["file"]
+	if server.file == "" {
+		return merry.New("compose mode requires a file")
+	}
+	if !path.IsAbs(server.file) {
+		server.file = path.Join(suiteDir, server.file)
+	}
+	server.command = strings.Fields(mode["command"])
+	if len(server.command) == 0 {
+		server.command = []string{"docker", "compose"}
+	}
+	if services := mode["services"]; services != "" {
+		for _, service := range strings.Split(services, ",") {
+			server.services = append(server.services, strings.TrimSpace(service))
+		}
+	}
+	server.access = mode["access"]
+	if server.access == "" {
+		server.access = "ip"
+	} else if server.access != "ip" && server.access != "published" {
+		return merry.Errorf("malformed access '%s', must be ip or published", server.access)
+	}
+	server.timeout = COMPOSE_DEFAULT_TIMEOUT
+	if timeout, found := mode["timeout"]; found {
+		var err error
+		if server.timeout, err = time.ParseDuration(timeout); err != nil {
+			return merry.Errorf("malformed timeout '%s'", timeout)
+		}
+	}
+	return nil
+}
+
+func (server *ComposeCluster) ModeName() string {
+	return "compose"
+}
+
+func (server *ComposeCluster) Environment() []string {
+	return []string{
+		"YACHT_MODE=" + server.ModeName(),
+		"YACHT_URIS=" + strings.Join(server.ips, ","),
+		"YACHT_KEYSPACE=" + server.keyspace,
+		"YACHT_COMPOSE_FILE=" + server.file,
+		"YACHT_COMPOSE_PROJECT=" + server.project,
+	}
+}
+
+// Container logs are saved to the lane directory when the stack is
+// torn down
+func (server *ComposeCluster) LogFiles() []string {
+	return nil
+}
+
+// Run docker compose for the project, return its output
+func (server *ComposeCluster) run(args ...string) (string, error) {
+	args = append(append(append([]string{}, server.command[1:]...),
+		"-p", server.project, "-f", server.file), args...)
+	ylog.Debugf("running %s %s", server.command[0], strings.Join(args, " "))
+	out, err := exec.Command(server.command[0], args...).CombinedOutput()
+	if err != nil {
+		return "", merry.Errorf("%s %s: %v: %s", strings.Join(server.command, " "),
+			strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// Save the logs of the containers to the lane directory and tear the
+// stack down, with its volumes
+type ComposeCluster_artefact struct {
+	server *ComposeCluster
+	lane   *Lane
+}
+
+func (a *ComposeCluster_artefact) Remove() error {
+	if logs, err := a.server.run("logs", "--no-color"); err != nil {
+		a.lane.Log().Warnf("failed to save container logs: %v", err)
+	} else {
+		ioutil.WriteFile(path.Join(a.lane.Dir(), a.server.project+".log"), []byte(logs), 0644)
+	}
+	a.lane.Log().Printf("Tearing down compose project %s", a.server.project)
+	_, err := a.server.run("down", "--volumes", "--remove-orphans")
+	return err
+}
+
+// Images of nodes, e.g. scylladb/scylla:5.4 or cassandra, but not
+// scylladb/scylla-manager
+var nodeImageRE = regexp.MustCompile(`(^|/)(scylla|cassandra)(:|$)`)
+
+// A container of the stack
+type composeContainer struct {
+	service string
+	image   string
+	ip      string
+	// The host port published for 9042, 0 if none
+	port int
+}
+
+const COMPOSE_INSPECT_FORMAT = `{{index .Config.Labels "com.docker.compose.service"}} ` +
+	`{{.Config.Image}} {{with index .NetworkSettings.Ports "9042/tcp"}}{{(index . 0).HostPort}}{{else}}0{{end}}` +
+	`{{range .NetworkSettings.Networks}} {{.IPAddress}}{{end}}`
+
+// The containers of the node services
+func (server *ComposeCluster) nodes() ([]composeContainer, error) {
+	out, err := server.run("ps", "-q")
+	if err != nil {
+		return nil, err
+	}
+	var ids = strings.Fields(out)
+	if len(ids) == 0 {
+		return nil, merry.Errorf("compose project %s has no containers", server.project)
+	}
+	args := append([]string{"inspect", "-f", COMPOSE_INSPECT_FORMAT}, ids...)
+	inspect, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		return nil, merry.Errorf("docker inspect: %v: %s", err, strings.TrimSpace(string(inspect)))
+	}
+	var nodes []composeContainer
+	for _, line := range strings.Split(strings.TrimSpace(string(inspect)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		var c = composeContainer{service: fields[0], image: fields[1], ip: fields[3]}
+		c.port, _ = strconv.Atoi(fields[2])
+		var isNode = nodeImageRE.MatchString(c.image)
+		if len(server.services) > 0 {
+			isNode = false
+			for _, service := range server.services {
+				isNode = isNode || service == c.service
+			}
+		}
+		if isNode {
+			nodes = append(nodes, c)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, merry.Errorf("no Scylla nodes in compose project %s, set services "+
+			"of the mode", server.project)
+	}
+	return nodes, nil
+}
+
+// Wait until the nodes accept CQL connections
+func waitForCQL(addrs []string, timeout time.Duration) error {
+	var deadline = time.Now().Add(timeout)
+	for _, addr := range addrs {
+		for {
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				return merry.Errorf("%s doesn't accept CQL connections after %v", addr, timeout)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	return nil
+}
+
+func (server *ComposeCluster) Start(lane *Lane) error {
+	server.project = fmt.Sprintf("yacht-%s-%s", lane.id,
+		strings.Replace(uuid.New().String(), "-", "", -1)[:8])
+	lane.Log().Printf("Bringing up compose project %s from %s", server.project, server.file)
+	var stack = &ComposeCluster_artefact{server: server, lane: lane}
+	lane.AddExitArtefact(stack)
+	server.process = stack
+	if _, err := server.run("up", "--detach"); err != nil {
+		return err
+	}
+	nodes, err := server.nodes()
+	if err != nil {
+		return err
+	}
+	var addrs []string
+	var ports = make(map[string]int)
+	server.ips = nil
+	for _, node := range nodes {
+		server.ips = append(server.ips, node.ip)
+		if server.access == "ip" {
+			addrs = append(addrs, net.JoinHostPort(node.ip, "9042"))
+			continue
+		}
+		if node.port == 0 {
+			return merry.Errorf("service %s doesn't publish port 9042, required by "+
+				"access: published", node.service)
+		}
+		ports[node.ip] = node.port
+		addrs = append(addrs, net.JoinHostPort("127.0.0.1", strconv.Itoa(node.port)))
+	}
+	if err := waitForCQL(addrs, server.timeout); err != nil {
+		return merry.Prepend(err, "compose nodes are not ready, their logs are saved to "+
+			lane.Dir())
+	}
+	server.replicationFactor = len(nodes)
+	server.uri = strings.Join(server.ips, ",")
+	if server.access == "published" {
+		server.uri = "127.0.0.1"
+		server.port = nodes[0].port
+		server.translator = localPortTranslator(ports)
+	}
+	return server.CQLServerURI.Start(lane)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// The configuration keys a structure is read from: the mapstructure
+// tag or the lower case field name, and the type of each
+func configKeys(t reflect.Type) map[string]reflect.Type {
+	var keys = make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported, not read from configuration
+			continue
+		}
+		name := strings.ToLower(field.Name)
+		if tag := field.Tag.Get("mapstructure"); tag != "" {
+			name = tag
+		}
+		keys[name] = field.Type
+	}
+	return keys
+}
+
+// Find keys of a configuration file which the structure it is read
+// into doesn't have, e.g. misspelled ones, which would be silently
+// ignored. Return a message for each, with the closest known key as
+// a suggestion.
+func unknownKeys(settings map[string]interface{}, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		// A map, e.g. builds, takes any keys
+		return nil
+	}
+	var known = configKeys(t)
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		keyType, found := known[name]
+		if !found && name == "" {
+			// YAML reads keys such as null and ~ as no key
+			problems = append(problems, fmt.Sprintf("a null key in '%s', quote "+
+				"the key, e.g. \"null\":", strings.TrimSuffix(prefix, ".")))
+			continue
+		} else if !found {
+			msg := fmt.Sprintf("unknown key '%s%s'", prefix, name)
+			if suggestion := closestKey(name, known); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean '%s%s'?", prefix, suggestion)
+			} else if suggestion := closestNestedKey(name, known); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean '%s%s'?", prefix, suggestion)
+			}
+			problems = append(problems, msg)
+			continue
+		}
+		for keyType.Kind() == reflect.Ptr {
+			keyType = keyType.Elem()
+		}
+		switch value := settings[name].(type) {
+		case map[string]interface{}:
+			problems = append(problems, unknownKeys(value, keyType, prefix+name+".")...)
+		case []interface{}:
+			if keyType.Kind() != reflect.Slice {
+				continue
+			}
+			for i, elem := range value {
+				if m, ok := elem.(map[string]interface{}); ok {
+					problems = append(problems, unknownKeys(m, keyType.Elem(),
+						fmt.Sprintf("%s%s[%d].", prefix, name, i))...)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// The known key most similar to the given one, if any is similar
+// enough to be a likely typo
+func closestKey(name string, known map[string]reflect.Type) string {
+	var best string
+	var bestDistance = len(name)/2 + 1
+	for key := range known {
+		if d := editDistance(name, key); d < bestDistance || (d == bestDistance && key < best) {
+			best, bestDistance = key, d
+		}
+	}
+	return best
+}
+
+// A likely misplaced key: the most similar key of a nested section,
+// e.g. scylla.builddir for builddir at the top level
+func closestNestedKey(name string, known map[string]reflect.Type) string {
+	var sections []string
+	for section := range known {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		t := known[section]
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			continue
+		}
+		if key := closestKey(name, configKeys(t)); key != "" {
+			return section + "." + key
+		}
+	}
+	return ""
+}
+
+// Levenshtein distance
+func editDistance(a string, b string) int {
+	var prev = make([]int, len(b)+1)
+	var cur = make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// yacht config validate: the configuration file is already checked
+// at start, check every suite file in srcdir
+func (yacht *Yacht) validateSuites() int {
+	yacht.findSuites()
+	if yacht.configProblems != 0 {
+		fmt.Printf("%s\n", palette.Crit("Found %d configuration problems", yacht.configProblems))
+		return 1
+	}
+	fmt.Printf("%s\n", palette.Pass("Configuration is valid"))
+	return 0
+}
+
+// A configuration setting, its effective value and where it comes
+// from: default, the configuration file, an environment variable
+// in it or the command line, see yacht config show
+type configSetting struct {
+	key    string
+	value  string
+	source string
+}
+
+// List the settings of a configuration structure, with the keys it
+// is read from
+func flattenConfig(v reflect.Value, prefix string, settings *[]configSetting) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			*settings = append(*settings, configSetting{key: strings.TrimSuffix(prefix, ".")})
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		var t = v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.ToLower(field.Name)
+			if tag := field.Tag.Get("mapstructure"); tag != "" {
+				name = tag
+			}
+			flattenConfig(v.Field(i), prefix+name+".", settings)
+		}
+	case reflect.Map:
+		var keys []string
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flattenConfig(v.MapIndex(reflect.ValueOf(key)), prefix+key+".", settings)
+		}
+	default:
+		*settings = append(*settings, configSetting{
+			key:   strings.TrimSuffix(prefix, "."),
+			value: fmt.Sprintf("%v", v.Interface()),
+		})
+	}
+}
+
+// Tell where each setting comes from, given the configuration read
+// with environment variables expanded and as is
+func configSources(settings []configSetting, cfg *viper.Viper, raw *viper.Viper) {
+	for i := range settings {
+		var setting = &settings[i]
+		if cfg.ConfigFileUsed() == "" || cfg.IsSet(setting.key) == false {
+			setting.source = "default"
+			continue
+		}
+		setting.source = "config file"
+		for _, m := range envVarRE.FindAllStringSubmatch(raw.GetString(setting.key), -1) {
+			if _, found := os.LookupEnv(m[1]); found {
+				setting.source = "environment ${" + m[1] + "}"
+				break
+			}
+		}
+	}
+}
+
+// Set the effective value of a setting changed after the
+// configuration file is read, e.g. made absolute or overridden by
+// a command line option
+func (env *Env) setConfigValue(key string, value string, flag string) {
+	for i := range env.settings {
+		if env.settings[i].key == key {
+			env.settings[i].value = value
+			if flag != "" && pflag.CommandLine.Changed(flag) {
+				env.settings[i].source = "command line --" + flag
+			}
+		}
+	}
+}
+
+// Print the effective configuration: the configuration file settings
+// and the command line options, with their sources
+func (env *Env) ShowConfig() {
+	if env.configFile != "" {
+		fmt.Printf("Configuration file %s:\n", palette.Path(env.configFile))
+	} else {
+		fmt.Printf("No configuration file, using defaults:\n")
+	}
+	for _, setting := range env.settings {
+		fmt.Printf("  %-30s %-40s %s\n", setting.key, setting.value, palette.Skip(setting.source))
+	}
+	fmt.Printf("Command line options:\n")
+	pflag.VisitAll(func(flag *pflag.Flag) {
+		var source = "default"
+		if flag.Changed {
+			source = "command line"
+		}
+		fmt.Printf("  --%-28s %-40s %s\n", flag.Name, flag.Value.String(), palette.Skip(source))
+	})
+}
+
+// yacht config validate or yacht config show
+func (yacht *Yacht) Config() int {
+	if yacht.env.subcommand == "show" {
+		yacht.env.ShowConfig()
+		return 0
+	}
+	return yacht.validateSuites()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// Coverage collection settings, set in 'coverage' section of
+// .yacht.yaml
+type CoverageConfig struct {
+	// Collect .profraw files of launched servers. Coverage is
+	// also collected if builddir is a coverage build, i.e. its
+	// name is "coverage"
+	Collect bool
+	// Merge the collected files into vardir/coverage/yacht.profdata
+	// with llvm-profdata and write a report with llvm-cov when done
+	Merge bool
+}
+
+func (cfg *CoverageConfig) Enabled(builddir string) bool {
+	return cfg.Collect || filepath.Base(builddir) == "coverage"
+}
+
+// The name pattern of profile files of a server, see LLVM_PROFILE_FILE
+// in clang documentation: %p is replaced with the pid
+func profileFilePattern(lane *Lane, uri string) string {
+	return path.Join(lane.Dir(), uri+"-%p.profraw")
+}
+
+// Move profile files of a stopped server from the lane directory to
+// the coverage directory, where they survive lane cleanup
+type CollectCoverage_artefact struct {
+	lane *Lane
+	uri  string
+}
+
+func (a *CollectCoverage_artefact) Remove() error {
+	files, _ := filepath.Glob(path.Join(a.lane.Dir(), a.uri+"-*.profraw"))
+	for _, file := range files {
+		var dest = path.Join(a.lane.coverageDir, path.Base(file))
+		for i := 1; ; i++ {
+			if _, err := os.Stat(dest); os.IsNotExist(err) {
+				break
+			}
+			dest = path.Join(a.lane.coverageDir,
+				fmt.Sprintf("%s.%d.profraw", strings.TrimSuffix(path.Base(file), ".profraw"), i))
+		}
+		if err := moveFile(file, dest); err != nil {
+			return merry.Prepend(err, "failed to collect coverage")
+		}
+	}
+	return nil
+}
+
+// Merge the collected profile files and write a coverage report of
+// the server executable
+func mergeCoverage(dir string, exe string) error {
+	files, _ := filepath.Glob(path.Join(dir, "*.profraw"))
+	if len(files) == 0 {
+		return merry.Errorf("no coverage data in %s", dir)
+	}
+	var profdata = path.Join(dir, "yacht.profdata")
+	args := append([]string{"merge", "-sparse", "-o", profdata}, files...)
+	if out, err := exec.Command("llvm-profdata", args...).CombinedOutput(); err != nil {
+		return merry.Errorf("llvm-profdata failed: %v: %.200s", err, out)
+	}
+	out, err := exec.Command("llvm-cov", "report", exe, "-instr-profile="+profdata).Output()
+	if err != nil {
+		return merry.Prepend(err, "llvm-cov failed")
+	}
+	var report = path.Join(dir, "coverage.txt")
+	if err := ioutil.WriteFile(report, out, 0644); err != nil {
+		return merry.Wrap(err)
+	}
+	fmt.Printf("Coverage report written to %s\n", palette.Path(report))
+	return nil
+}
@@ -2,18 +2,23 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"io"
 	"os"
 
 	"io/ioutil"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ansel1/merry"
 	"github.com/pmezard/go-difflib/difflib"
-	"github.com/udhos/equalfile"
 )
 
 // A suite with CQL tests
@@ -23,6 +28,60 @@ type CQLTestSuite struct {
 	name        string
 	tests       []*CQLTestFile
 	servers     []Server
+	// Where to store reject and newly generated result files,
+	// empty to store them next to the test in srcdir
+	outdir string
+	// How to print statement results
+	format FormatConfig
+	// A command to run after each failed test
+	onFailure string
+	// Suites with higher priority run first
+	priority int
+	// Suites which must run before this one
+	dependsOn []string
+	// How many times to run each test, see --repeat
+	repeat int
+	// Durations of the tests in previous runs
+	history *History
+	// gc_grace_seconds of tables created by the tests, nil to
+	// keep the server default
+	gcGraceSeconds *int
+	// Maximal size of the output of a test, 0 for no limit
+	maxOutputSize int64
+	// Stop a test at the first difference from the result file
+	stopAtDiff bool
+	// Warn about statements which take longer, 0 for no warnings
+	slowStatement time.Duration
+	// Print statement latency histograms of tests
+	verbose bool
+	// Start a shell connected to the server after a failed test
+	failureShell bool
+	// Where to store recordings of test runs, empty to not record
+	recordDir string
+	// Queries to compare across nodes after a repair at the end of
+	// the suite, in cluster mode
+	consistencyCheck []string
+	// Check after each test that the schema is the same as before
+	// the first test
+	checkSchema bool
+	// Server capabilities the tests need
+	requires Requirements
+	// Run the modes at once, each on an own lane, see RunModes()
+	parallelModes bool
+	// The suite runs in several modes, see CQLTestFile.Golden()
+	modeRejects bool
+}
+
+func (suite *CQLTestSuite) Name() string {
+	return suite.name
+}
+
+func (suite *CQLTestSuite) Priority() int {
+	return suite.priority
+}
+
+func (suite *CQLTestSuite) DependsOn() []string {
+	return suite.dependsOn
 }
 
 func (suite *CQLTestSuite) AddMode(server Server) {
@@ -41,31 +100,86 @@ func (suite *CQLTestSuite) FindTests(suite_path string, patterns []string) error
 	if err != nil {
 		return merry.Wrap(err)
 	}
-	fmt.Printf("Collecting tests in %-14s ", fmt.Sprintf("'%.12s'", suite.name))
 	for _, file := range files {
 		for _, pattern := range patterns {
 			if strings.Contains(file, pattern) {
 				test := CQLTestFile{
-					path: file,
+					path:   file,
+					outdir: suite.outdir,
+					format: &suite.format,
+
+					gcGraceSeconds: suite.gcGraceSeconds,
+					maxOutputSize:  suite.maxOutputSize,
+					stopAtDiff:     suite.stopAtDiff,
+					slowStatement:  suite.slowStatement,
+					modeRejects:    suite.modeRejects,
 				}
 				test.Init()
 				suite.tests = append(suite.tests, &test)
 			}
 		}
 	}
-	fmt.Printf("(Found %3d tests): %.26s\n", len(suite.tests), suite.description)
 	return nil
 }
 
+func (suite *CQLTestSuite) Path() string {
+	return suite.path
+}
+
+// Only keep the tests for which keep() is true
+func (suite *CQLTestSuite) Filter(keep func(path string) bool) {
+	var tests []*CQLTestFile
+	for _, test := range suite.tests {
+		if keep(test.path) {
+			tests = append(tests, test)
+		}
+	}
+	suite.tests = tests
+}
+
+func (suite *CQLTestSuite) Tests() []string {
+	var names []string
+	for _, test := range suite.tests {
+		names = append(names, test.name)
+	}
+	return names
+}
+
 func (suite *CQLTestSuite) IsEmpty() bool {
 	return len(suite.tests) == 0
 }
 
+// Experimental features any of the tests needs, which servers the
+// suite starts enable
+func (suite *CQLTestSuite) RequiredFeatures() []string {
+	var features []string
+	var seen = make(map[string]bool)
+	for _, test := range suite.tests {
+		for _, feature := range test.RequiredFeatures() {
+			if !seen[feature] {
+				seen[feature] = true
+				features = append(features, feature)
+			}
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
 func (suite *CQLTestSuite) PrepareLane(lane *Lane, server Server) error {
-	return server.Start(lane)
+	if err := server.Start(lane); err != nil {
+		return err
+	}
+	return waitHealthy(server)
 }
 
 func (suite *CQLTestSuite) RunSuite(force bool, lane *Lane, server Server) (int, error) {
+	if reason, err := suite.requires.Unmet(server); err != nil {
+		return 0, err
+	} else if reason != "" {
+		skipSuite(lane, server, suite.name, suite.Tests(), reason)
+		return 0, nil
+	}
 	c, err := server.Connect()
 	if err != nil {
 		// 'force' affects .result/reject mismatch,
@@ -75,26 +189,231 @@ func (suite *CQLTestSuite) RunSuite(force bool, lane *Lane, server Server) (int,
 	defer c.Close()
 
 	var suite_rc int = 0
-	for _, test := range suite.tests {
+	var tests = suite.Schedule()
+	// Keyspaces of other runs sharing the cluster come and go in
+	// uri mode, only check the keyspace of the lane
+	var schemaKeyspace string
+	if server.ModeName() == "uri" {
+		schemaKeyspace = envValue(server.Environment(), "YACHT_KEYSPACE")
+	}
+	var schema []string
+	if _, mock := server.(*mockServer); suite.checkSchema && !mock {
+		if schema, err = schemaSnapshot(c, schemaKeyspace); err != nil {
+			return 0, merry.Prepend(err, suite.name+": check_schema")
+		}
+	}
+	// Features of the server, probed for the first test which needs
+	// any
+	var features *serverFeatures
+	for i, test := range tests {
 		var full_name = path.Join(suite.name, test.name)
-		test_rc, err := test.RunTest(force, c, lane)
+		if lane.TimedOut() {
+			suite.notRun(lane, server, tests[i:])
+			break
+		}
+		if lane.Stopped() {
+			return suite_rc, nil
+		}
+		if err := lane.CheckDiskSpace(); err != nil {
+			return 1, err
+		}
+		// A node which silently died would fail the rest of the
+		// tests in confusing ways
+		if err := checkHealth(server); err != nil {
+			suite.notRun(lane, server, tests[i:])
+			return 1, merry.Prepend(err, full_name)
+		}
+		if required := test.RequiredFeatures(); len(required) > 0 {
+			if features == nil {
+				if features, err = probeFeatures(c, server); err != nil {
+					return 0, merry.Prepend(err, full_name)
+				}
+			}
+			if missing := features.Missing(required); len(missing) > 0 {
+				skipTest(lane, server, full_name, fmt.Sprintf(
+					"experimental features %s are not enabled", strings.Join(missing, ", ")))
+				continue
+			}
+		}
+		// Run the test repeatedly against the same server, to
+		// catch leaks and non-determinism
+		var repeat = test.Repeat()
+		if suite.repeat > 1 {
+			repeat *= suite.repeat
+		}
+		for iteration := 1; iteration <= repeat; iteration++ {
+			if iteration > 1 && lane.TimedOut() {
+				break
+			}
+			var blurb_name = full_name
+			if repeat > 1 {
+				blurb_name = fmt.Sprintf("%s #%d", full_name, iteration)
+			}
+			lane.Log().Section("test %s, mode %s", blurb_name, server.ModeName())
+			events.Emit("test-start", map[string]interface{}{"lane": lane.id,
+				"test": blurb_name, "mode": server.ModeName()})
+			offsets := logOffsets(server)
+			start := time.Now()
+			var recorder *Recorder
+			if suite.recordDir != "" {
+				recorder = startRecording(c)
+			}
+			test_rc, err := test.RunTest(force, c, lane, server)
+			if recorder != nil {
+				stopRecording(c)
+				if err := recorder.Save(recordingPath(suite.recordDir, suite.name,
+					test.name, server.ModeName())); err != nil {
+					return 0, err
+				}
+			}
+			if err != nil {
+				if merry.Is(err, ErrConnectionLost, ErrAccessDenied) {
+					// An infrastructure failure: the test didn't
+					// fail, but neither it nor the rest of the suite
+					// can run, with or without --force
+					suite.notRun(lane, server, tests[i:])
+					test.PrintLogSlices(lane, offsets)
+					return 1, merry.Prependf(err, "%s: %s", full_name,
+						checkServerHealth(server))
+				}
+				return 0, merry.Wrap(err)
+			}
+			if suite.history != nil {
+				suite.history.Tests[full_name] = time.Now().Sub(start).Seconds()
+			}
+			if err := lane.MonitorFailure(); err != nil {
+				return 1, err
+			}
+			if err := c.Reset(); err != nil {
+				return 0, merry.Wrap(err)
+			}
+			if schema != nil {
+				current, err := schemaSnapshot(c, schemaKeyspace)
+				if err != nil {
+					return 0, merry.Prepend(err, full_name+": check_schema")
+				}
+				if changes := schemaChanges(schema, current); len(changes) != 0 {
+					test.failures = append(test.failures, fmt.Sprintf(
+						"%s: schema is not restored after the test: %s", test.name,
+						strings.Join(changes, ", ")))
+					if test_rc == "pass" || test_rc == "new" {
+						test_rc = "fail"
+					}
+					// Only fail the test which changed the schema
+					schema = current
+				}
+			}
+			lane.Log().Printf("%s: %s in %v", blurb_name, test_rc, time.Now().Sub(start))
+			PrintTestBlurb(lane.id, blurb_name, server.ModeName(), test_rc)
+			events.Emit("test-end", map[string]interface{}{"lane": lane.id,
+				"test": blurb_name, "mode": server.ModeName(), "result": test_rc,
+				"duration_ms": milliseconds(time.Now().Sub(start))})
+			test.latency.PrintSlow()
+			if suite.verbose {
+				if md := test.Metadata(); md.Description != "" {
+					fmt.Printf("      %s\n", md.Description)
+				}
+				test.latency.PrintHistogram()
+			}
+			if test_rc == "fail" || test_rc == "broken" || test_rc == "too-large" {
+				test.PrintFailures(server.ModeName())
+				slices := test.PrintLogSlices(lane, offsets)
+				if suite.onFailure != "" {
+					env := append(lane.Environment(), server.Environment()...)
+					env = append(env, test.FailureEnvironment(full_name, test_rc,
+						server.ModeName(), slices)...)
+					runFailureHook(suite.onFailure, env, lane.Dir())
+				}
+				if suite.failureShell && server.ModeName() != "uri" {
+					failureShell(server, lane)
+				}
+				suite_rc = 1
+				// Record the failed test name
+				lane.AddFailedTest(full_name)
+				lane.AddTestMetadata(full_name, test.Metadata())
+				if force == false || lane.TooManyFailures() {
+					return suite_rc, nil
+				}
+				// The reject file is from this iteration, keep it
+				break
+			} else {
+				lane.passed++
+			}
+		}
+	}
+	if cluster, ok := server.(*CQLCluster); ok && len(suite.consistencyCheck) != 0 {
+		divergent, err := cluster.CheckConsistency(suite.consistencyCheck)
 		if err != nil {
-			return 0, merry.Wrap(err)
+			return 1, merry.Prepend(err, suite.name+": consistency check")
 		}
-		PrintTestBlurb(lane.id, full_name, server.ModeName(), test_rc)
-		if test_rc == "fail" {
-			test.PrintUniDiff()
+		for _, diff := range divergent {
+			fmt.Printf("%s%s\n", palette.Crit("consistency check failed: "), diff)
 			suite_rc = 1
-			// Record the failed test name
-			lane.failed = append(lane.failed, full_name)
-			if force == false {
-				return suite_rc, nil
-			}
 		}
 	}
 	return suite_rc, nil
 }
 
+// Check whether the server still responds after a lost connection,
+// to tell a server crash or hang from a network or driver problem
+func checkServerHealth(server Server) string {
+	c, err := server.Connect()
+	if err != nil {
+		return fmt.Sprintf("server is not responding (%v)", err)
+	}
+	defer c.Close()
+	result, err := c.Execute("SELECT release_version FROM system.local", nil)
+	if err != nil || result.status != "OK" {
+		return "server doesn't execute queries"
+	}
+	return "server is up"
+}
+
+// Order the tests longest first, by the durations of their previous
+// runs or by file size. There is a single lane yet, so all tests are
+// scheduled to it.
+func (suite *CQLTestSuite) Schedule() []*CQLTestFile {
+	var names = make([]string, len(suite.tests))
+	var sizes = make([]int64, len(suite.tests))
+	for i, test := range suite.tests {
+		names[i] = path.Join(suite.name, test.name)
+		if st, err := os.Stat(test.path); err == nil {
+			sizes[i] = st.Size()
+		}
+	}
+	durations := suite.history.EstimateDurations(names, sizes)
+	var tests []*CQLTestFile
+	for _, i := range scheduleLPT(durations, 1)[0] {
+		tests = append(tests, suite.tests[i])
+	}
+	return tests
+}
+
+func (suite *CQLTestSuite) NotRun(lane *Lane, server Server) {
+	suite.notRun(lane, server, suite.tests)
+}
+
+func (suite *CQLTestSuite) notRun(lane *Lane, server Server, tests []*CQLTestFile) {
+	for _, test := range tests {
+		PrintTestBlurb(lane.id, path.Join(suite.name, test.name), server.ModeName(), "not-run")
+		lane.notRun++
+	}
+}
+
+// Replace result files with reject files left by failed tests
+func (suite *CQLTestSuite) Accept(server Server) error {
+	for _, test := range suite.tests {
+		result, accepted, err := test.Accept(server.ModeName())
+		if err != nil {
+			return err
+		}
+		if accepted {
+			fmt.Printf("Accepted %s\n", palette.Path(result))
+		}
+	}
+	return nil
+}
+
 type CQLTestFile struct {
 	// Temp name
 	name string
@@ -102,12 +421,46 @@ type CQLTestFile struct {
 	path string
 	// Path to result file in srcdir
 	result string
-	// Path to reject file in srcdir
+	// Path to reject file in srcdir or outdir
 	reject string
+	// Path to a newly generated result file in srcdir or outdir
+	generated string
+	// Where to store reject and generated result files,
+	// empty to store them in srcdir
+	outdir string
+	// Failed assertions of the last run
+	failures []string
+	// Set if the output of the last run didn't match the result file
+	rejected bool
+	// How to print statement results
+	format *FormatConfig
+	// gc_grace_seconds of created tables, see CQLTestSuite
+	gcGraceSeconds *int
+	// Maximal size of the test output, 0 for no limit
+	maxOutputSize int64
+	// Stop the test at the first difference from the result file
+	stopAtDiff bool
+	// Warn about statements which take longer, 0 for no warnings
+	slowStatement time.Duration
+	// Statement latencies of the last run
+	latency latencyStats
+	// Name reject files after the mode, so that the rejects of
+	// one mode don't overwrite those of another one
+	modeRejects bool
+	// Directives which apply to the whole test, parsed from the
+	// test file by Init(), see parseDirectives()
+	repeat        int
+	features      []string
+	metadata      TestMetadata
+	digest        bool
+	resultPerMode bool
 }
 
 // matches comments and whitespace
 var commentRE = regexp.MustCompile(`^\s*((--|\/\/).*)?$`)
+
+// matches directives, e.g. -- assert: rows 3, or -- sleep: 1s
+var directiveRE = regexp.MustCompile(`^\s*--\s*([a-z][a-z-]*):\s*(.*?)\s*$`)
 var delimiterRE = regexp.MustCompile(`;[[:space:]]*$`)
 var testCQLRE = regexp.MustCompile(`test\.cql$`)
 var resultRE = regexp.MustCompile(`result$`)
@@ -116,14 +469,286 @@ func (test *CQLTestFile) Init() {
 	test.name = path.Base(test.path)
 	test.result = testCQLRE.ReplaceAllString(test.path, `result`)
 	test.reject = resultRE.ReplaceAllString(test.result, `reject`)
+	test.generated = test.result
+	if test.outdir != "" {
+		test.reject = path.Join(test.outdir, path.Base(test.reject))
+		test.generated = path.Join(test.outdir, path.Base(test.result))
+	}
+	test.parseDirectives()
+}
+
+// Collect the directives which apply to the whole test and must be
+// known before it runs, so that the test file is read only once
+func (test *CQLTestFile) parseDirectives() {
+	test.repeat = 1
+	test.features = nil
+	test.metadata = TestMetadata{}
+	test.digest = false
+	test.resultPerMode = false
+	file, err := os.Open(test.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		m := directiveRE.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		var arg = m[2]
+		switch m[1] {
+		case "repeat":
+			if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+				test.repeat = n
+			}
+		case "requires-feature":
+			for _, feature := range strings.Split(arg, ",") {
+				if feature = strings.ToLower(strings.TrimSpace(feature)); feature != "" {
+					test.features = append(test.features, feature)
+				}
+			}
+		case "description":
+			test.metadata.Description = arg
+		case "author":
+			test.metadata.Author = arg
+		case "tags":
+			for _, tag := range strings.Split(arg, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					test.metadata.Tags = append(test.metadata.Tags, tag)
+				}
+			}
+		case "issue":
+			test.metadata.Issues = append(test.metadata.Issues, arg)
+		case "digest":
+			test.digest = true
+		case "result-per-mode":
+			test.resultPerMode = true
+		}
+	}
+}
+
+// The number of times to run the test in a row, set with
+// -- repeat: <count> directive anywhere in the test file
+func (test *CQLTestFile) Repeat() int {
+	return test.repeat
+}
+
+// Experimental features the test needs, in lower case, set with
+// -- requires-feature: cdc, raft anywhere in the test file
+func (test *CQLTestFile) RequiredFeatures() []string {
+	return test.features
+}
+
+// Descriptive header of a test file, set with directives at its top:
+//
+//	-- description: conditional updates of static columns
+//	-- author: kostja
+//	-- tags: lwt, static
+//	-- issue: https://github.com/scylladb/scylla/issues/1234
+//
+// The issue directive may be repeated.
+type TestMetadata struct {
+	Description string   `json:",omitempty"`
+	Author      string   `json:",omitempty"`
+	Tags        []string `json:",omitempty"`
+	Issues      []string `json:",omitempty"`
+}
+
+func (test *CQLTestFile) Metadata() TestMetadata {
+	return test.metadata
+}
+
+// Whether the output of the test is compared by digest: set with
+// -- digest: directive anywhere in the test file, or declared by a
+// result file with only the digest of the output
+func (test *CQLTestFile) Digest(result string) bool {
+	if test.digest {
+		return true
+	}
+	f, err := os.Open(result)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var head = make([]byte, len(digestPrefix)+sha256.Size*2+2)
+	n, _ := io.ReadFull(f, head)
+	return digestResultRE.Match(head[:n])
+}
+
+// Passes the test output through until it grows over the limit,
+// and then discards it, so that a runaway test doesn't fill the disk
+type limitWriter struct {
+	w       io.Writer
+	limit   int64
+	written int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	var keep = int64(len(p))
+	if lw.limit > 0 && lw.written+keep > lw.limit {
+		keep = lw.limit - lw.written
+		if keep < 0 {
+			keep = 0
+		}
+	}
+	lw.written += int64(len(p))
+	if _, err := lw.w.Write(p[:keep]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (lw *limitWriter) Exceeded() bool {
+	return lw.limit > 0 && lw.written > lw.limit
+}
+
+const digestPrefix = "sha256: "
+
+// A result file with the digest of the output
+var digestResultRE = regexp.MustCompile(`^sha256: [0-9a-f]{64}\n$`)
+
+// Compares the test output with the result file as it is written,
+// and remembers the line of the first difference
+type compareWriter struct {
+	w io.Writer
+	// The result file, nil if there is nothing to compare with
+	expected *bufio.Reader
+	// The result file again, to look ahead of what the output
+	// matched so far, see ExpectedTable()
+	file *os.File
+	// The number of bytes of the result file the output matched
+	offset int64
+	// The current line of the output
+	line int
+	// The line of the first difference, 0 if there is none
+	diverged int
+}
+
+func (cw *compareWriter) Write(p []byte) (int, error) {
+	if cw.expected != nil && cw.diverged == 0 {
+		for _, b := range p {
+			if e, err := cw.expected.ReadByte(); err != nil || e != b {
+				cw.diverged = cw.line
+				break
+			}
+			cw.offset++
+			if b == '\n' {
+				cw.line++
+			}
+		}
+	}
+	return cw.w.Write(p)
+}
+
+// Whether the output written so far is the same as the result file
+func (cw *compareWriter) Equal() bool {
+	if cw.expected == nil || cw.diverged != 0 {
+		return false
+	}
+	_, err := cw.expected.ReadByte()
+	return err == io.EOF
+}
+
+// The contents of the result file of a test compared by digest
+func digestResult(hash hash.Hash) string {
+	return fmt.Sprintf("%s%x\n", digestPrefix, hash.Sum(nil))
+}
+
+// Rename a file, falling back to copying if the source and
+// destination are on different file systems
+func moveFile(from string, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if err := ioutil.WriteFile(to, data, 0644); err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(os.Remove(from))
+}
+
+// Whether the test has a result file per mode, requested with
+// -- result-per-mode:, even if there is no result file for some mode
+// yet
+func (test *CQLTestFile) ResultPerMode() bool {
+	return test.resultPerMode
+}
+
+// Find the result file to compare the output with when running
+// in the given mode, and the reject file to store mismatching output
+// in. A mode-qualified result file, e.g. foo.result.cluster, takes
+// precedence over foo.result. The reject file is mode-qualified,
+// e.g. foo.reject.cluster, if the result file is, if the test asks
+// for a result file per mode, or if the suite runs in several modes.
+func (test *CQLTestFile) Golden(mode string) (string, string) {
+	var result = test.result + "." + mode
+	if _, err := os.Stat(result); err == nil {
+		return result, test.reject + "." + mode
+	}
+	if test.modeRejects || test.ResultPerMode() {
+		if test.ResultPerMode() {
+			if _, err := os.Stat(test.result); os.IsNotExist(err) {
+				// Nothing to compare with yet
+				return result, test.reject + "." + mode
+			}
+		}
+		return test.result, test.reject + "." + mode
+	}
+	return test.result, test.reject
+}
+
+// Where a new result file of the mode is generated
+func (test *CQLTestFile) Generated(mode string) string {
+	if test.ResultPerMode() {
+		return test.generated + "." + mode
+	}
+	return test.generated
+}
+
+// Overwrite the result file with the reject file, if there is one.
+// The reject of a test with a result file per mode becomes the result
+// file of the mode, even if the run compared the output with the
+// result file shared by all modes. If the test has no result file in
+// srcdir, copy the result file generated in outdir.
+func (test *CQLTestFile) Accept(mode string) (string, bool, error) {
+	result, reject := test.Golden(mode)
+	if test.ResultPerMode() {
+		result = test.result + "." + mode
+	}
+	if _, err := os.Stat(reject); err == nil {
+		return result, true, moveFile(reject, result)
+	} else if !os.IsNotExist(err) {
+		return result, false, merry.Wrap(err)
+	}
+	var generated = test.Generated(mode)
+	if generated == result {
+		return result, false, nil
+	}
+	if _, err := os.Stat(result); err == nil {
+		return result, false, nil
+	}
+	if _, err := os.Stat(generated); os.IsNotExist(err) {
+		return result, false, nil
+	} else if err != nil {
+		return result, false, merry.Wrap(err)
+	}
+	return result, true, moveFile(generated, result)
 }
 
 // Open a file and read it line-by-line, splitting into test cases.
-func (test *CQLTestFile) RunTest(force bool, c Connection, lane *Lane) (string, error) {
+func (test *CQLTestFile) RunTest(force bool, c Connection, lane *Lane, server Server) (string, error) {
 
 	tmpfile_name := path.Join(lane.Dir(), testCQLRE.ReplaceAllString(test.name, `result`))
 	var isEqualResult bool
 	var isNew bool
+	result, reject := test.Golden(server.ModeName())
+	test.failures = nil
+	test.rejected = false
+	test.latency = latencyStats{}
 	// Open input file
 	test_file, err := os.Open(test.path)
 	if err != nil {
@@ -139,22 +764,289 @@ func (test *CQLTestFile) RunTest(force bool, c Connection, lane *Lane) (string,
 	}
 	defer tmp_file.Close()
 
-	input := bufio.NewScanner(test_file)
-	output := bufio.NewWriter(tmp_file)
+	var digest = test.Digest(result)
+	limited := limitWriter{w: tmp_file, limit: test.maxOutputSize}
+	// Compare the output with the result file as it is produced
+	compared := compareWriter{w: &limited, line: 1}
+	if !digest {
+		if expected, err := os.Open(result); err == nil {
+			defer expected.Close()
+			compared.expected = bufio.NewReader(expected)
+			compared.file = expected
+		} else if !os.IsNotExist(err) {
+			return "", merry.Wrap(err)
+		}
+	}
+	output := bufio.NewWriter(&compared)
+	// Hash the output as it is produced, keeping only its beginning,
+	// up to max_output_size, in the lane directory for inspection
+	var outputHash = sha256.New()
+	if digest {
+		output = bufio.NewWriter(io.MultiWriter(outputHash, &limited))
+	}
+
+	run := cqlTestRun{test: test, c: c, lane: lane, server: server, output: output}
+	if compared.expected != nil {
+		run.compared = &compared
+	}
+	scanner := newCQLScanner(test_file, test.path, output)
+	scanner.ids = test.format.StatementIds
+	scanner.idsOnly = test.format.Echo == "ids"
+	if err := run.Run(scanner); err != nil {
+		output.Flush()
+		return "", err
+	}
+	output.Flush()
+
+	if run.statements == 0 {
+		// A file with only comments is most likely a mistake
+		os.Remove(tmpfile_name)
+		test.failures = append(test.failures,
+			fmt.Sprintf("%s: no statements found", test.name))
+		return "broken", nil
+	}
+	if limited.Exceeded() && !digest {
+		os.Remove(tmpfile_name)
+		test.failures = append(test.failures,
+			fmt.Sprintf("%s: output too large: over %s, see max_output_size, or compare "+
+				"the output by digest with -- digest:", test.name, formatSize(limited.limit)))
+		return "too-large", nil
+	}
+	var output_name = tmpfile_name
+	if digest {
+		// Compare and store the digest of the output instead of
+		// the output
+		tmpfile_name += ".sha256"
+		if err := ioutil.WriteFile(tmpfile_name, []byte(digestResult(outputHash)), 0644); err != nil {
+			return "", merry.Wrap(err)
+		}
+	}
+
+	if _, err := os.Stat(result); err == nil {
+		if digest {
+			expected, err := ioutil.ReadFile(result)
+			if err != nil {
+				return "", merry.Wrap(err)
+			}
+			isEqualResult = string(expected) == digestResult(outputHash)
+		} else {
+			isEqualResult = compared.Equal()
+		}
+	} else if os.IsNotExist(err) {
+		isNew = true
+	} else {
+		return "", merry.Wrap(err)
+	}
+
+	if isEqualResult {
+		os.Remove(tmpfile_name)
+		os.Remove(output_name)
+		if len(test.failures) != 0 {
+			return "fail", nil
+		}
+		return "pass", nil
+	}
+	if isNew && len(test.failures) == 0 {
+		// Create a result file when running for the first time,
+		// unless the test failed: the output of a failed test
+		// goes to the reject file, not the result file
+		var generated = test.Generated(server.ModeName())
+		if err := os.MkdirAll(path.Dir(generated), 0750); err != nil {
+			return "", merry.Wrap(err)
+		}
+		if err := moveFile(tmpfile_name, generated); err != nil {
+			return "", err
+		}
+		if digest {
+			os.Remove(output_name)
+		}
+		return "new", nil
+	}
+	if err := os.MkdirAll(path.Dir(reject), 0750); err != nil {
+		return "", merry.Wrap(err)
+	}
+	if err := moveFile(tmpfile_name, reject); err != nil {
+		return "", err
+	}
+	test.rejected = true
+	if digest && !isNew {
+		test.failures = append(test.failures,
+			fmt.Sprintf("%s: output digest mismatch, the output is in %s, up to max_output_size", test.name, output_name))
+	}
+	// Result content mismatch, or failures of a new test
+	return "fail", nil
+}
+
+// A CQL statement or a harness directive read from a test file
+type cqlStatement struct {
+	// Statement text or directive arguments
+	text string
+	// Directive name, empty for CQL statements
+	directive string
+	// Location of the statement, for error messages
+	file string
+	line int
+	// Sequence number of the statement in the test
+	id int
+}
+
+func (stmt *cqlStatement) Location() string {
+	return fmt.Sprintf("%s:%d", path.Base(stmt.file), stmt.line)
+}
+
+// Statement id prefix of the statement text and result lines
+func (stmt *cqlStatement) Prefix(ids bool) string {
+	if ids == false {
+		return ""
+	}
+	return fmt.Sprintf("[%d] ", stmt.id)
+}
 
-	// @todo: fail if found no test cases in a file
-	for input.Scan() {
-		line := input.Text()
-		fmt.Fprintln(output, line)
+// Prefix every line of the text
+func prefixLines(text string, prefix string) string {
+	if prefix == "" {
+		return text
+	}
+	lines := strings.SplitAfter(text, "\n")
+	buf := new(strings.Builder)
+	for _, line := range lines {
+		if line != "" {
+			buf.WriteString(prefix + line)
+		}
+	}
+	return buf.String()
+}
+
+// A file read by the scanner: the test file or a file included
+// into it with the source directive
+type cqlScannerFrame struct {
+	input *bufio.Scanner
+	file  string
+	line  int
+	// Set for included files, which are closed by the scanner
+	closer io.Closer
+}
+
+// Reads a test file statement by statement, echoing everything
+// read to the test output
+type cqlScanner struct {
+	// Included files, the test file is at the bottom
+	stack  []*cqlScannerFrame
+	output io.Writer
+	err    error
+	// Prefix every statement with its sequence number
+	ids bool
+	seq int
+	// Don't echo anything, see the echo directive
+	quiet bool
+	// Echo statement sequence numbers instead of statement text
+	idsOnly bool
+}
+
+func newCQLScanner(input io.Reader, file string, output io.Writer) *cqlScanner {
+	frame := &cqlScannerFrame{input: bufio.NewScanner(input), file: file}
+	return &cqlScanner{stack: []*cqlScannerFrame{frame}, output: output}
+}
+
+func (scanner *cqlScanner) top() *cqlScannerFrame {
+	return scanner.stack[len(scanner.stack)-1]
+}
+
+// Read the next line, continuing with the including file
+// at the end of an included file
+func (scanner *cqlScanner) scan() bool {
+	for len(scanner.stack) > 0 {
+		frame := scanner.top()
+		if frame.input.Scan() {
+			frame.line++
+			return true
+		}
+		if err := frame.input.Err(); err != nil && scanner.err == nil {
+			scanner.err = merry.Prepend(err, frame.file)
+		}
+		if frame.closer != nil {
+			frame.closer.Close()
+		}
+		scanner.stack = scanner.stack[:len(scanner.stack)-1]
+	}
+	return false
+}
+
+func (scanner *cqlScanner) text() string {
+	return scanner.top().input.Text()
+}
+
+// Copy the line just read to the output
+func (scanner *cqlScanner) echo(prefix string) {
+	if scanner.quiet {
+		return
+	}
+	fmt.Fprintf(scanner.output, "%s%s\n", prefix, scanner.text())
+}
+
+// Copy a line of a statement just read to the output, or only the
+// statement sequence number for the first line if ids only are echoed
+func (scanner *cqlScanner) echoStatement(stmt *cqlStatement, first bool) {
+	if scanner.idsOnly {
+		if first && !scanner.quiet {
+			fmt.Fprintf(scanner.output, "[%d]\n", stmt.id)
+		}
+		return
+	}
+	if first {
+		scanner.echo(stmt.Prefix(scanner.ids))
+	} else {
+		scanner.echo("")
+	}
+}
+
+// Continue reading from the given file, and return to the current
+// file when it ends
+func (scanner *cqlScanner) Include(file string) error {
+	for _, frame := range scanner.stack {
+		if frame.file == file {
+			return merry.Errorf("source: %s includes itself", path.Base(file))
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return merry.Prepend(err, "source")
+	}
+	frame := &cqlScannerFrame{input: bufio.NewScanner(f), file: file, closer: f}
+	scanner.stack = append(scanner.stack, frame)
+	return nil
+}
+
+// Return the next statement or directive, or nil at end of file
+func (scanner *cqlScanner) Next() (*cqlStatement, error) {
+	for scanner.scan() {
+		line := scanner.text()
+		stmt := &cqlStatement{file: scanner.top().file, line: scanner.top().line}
+		if m := directiveRE.FindStringSubmatch(line); m != nil {
+			if _, found := cqlDirectives[m[1]]; found {
+				if m[1] == "echo" && scanner.quiet {
+					// Show where the output is turned back on
+					fmt.Fprintf(scanner.output, "%s\n", line)
+				}
+				scanner.echo("")
+				stmt.directive = m[1]
+				stmt.text = m[2]
+				return stmt, nil
+			}
+		}
 		if commentRE.MatchString(line) {
+			scanner.echo("")
 			continue
 		}
+		scanner.seq++
+		stmt.id = scanner.seq
+		scanner.echoStatement(stmt, true)
 		// Complete multiline statements, skipping comments
 		if delimiterRE.MatchString(line) == false {
 			multiline_statement := []string{line}
-			for input.Scan() {
-				line := input.Text()
-				fmt.Fprintln(output, line)
+			for scanner.scan() {
+				line := scanner.text()
+				scanner.echoStatement(stmt, false)
 				if commentRE.MatchString(line) {
 					continue
 				}
@@ -165,61 +1057,415 @@ func (test *CQLTestFile) RunTest(force bool, c Connection, lane *Lane) (string,
 			}
 			line = strings.Join(multiline_statement, "\n")
 		}
-		if response, err := c.Execute(line); err == nil {
-			fmt.Fprint(output, response)
-		} else {
-			// @todo: access denied, lost connection
-			// should not trigger test failure with 'force'
-			output.Flush()
-			return "", merry.Wrap(err)
+		stmt.text = line
+		return stmt, nil
+	}
+	return nil, scanner.err
+}
+
+// State of a single test file run
+type cqlTestRun struct {
+	test   *CQLTestFile
+	c      Connection
+	lane   *Lane
+	server Server
+	output *bufio.Writer
+	// Used by the source directive to include files
+	scanner *cqlScanner
+	// Options for the next statement, set by directives
+	next QueryOptions
+	// The number of executed statements
+	statements int
+	// Called after every executed statement, if set
+	trace func(stmt *cqlStatement, result *CQLResult)
+	// The last executed statement and its result, checked
+	// by assertions
+	last       *cqlStatement
+	lastResult *CQLResult
+	// How many times to retry a statement failed with a transient
+	// error, and the delay before the first retry, which doubles
+	// with every next one. Set by the retry-transient directive.
+	retries    int
+	retryDelay time.Duration
+	// Don't record statement results in the output, see the echo
+	// directive
+	quietResults bool
+	// Compares the output with the result file, nil if there is
+	// nothing to compare with
+	compared *compareWriter
+	// Fail the test if a statement takes longer, see the
+	// max-latency directive
+	maxLatency time.Duration
+	// Print column types of results, nil for the suite default, see
+	// the column-types directive
+	columnTypes *bool
+	// Print columns in the order of the result file, nil for the
+	// suite default, see the any-column-order directive
+	anyColumnOrder *bool
+	// Numbers in results within this tolerance of the result file
+	// match it, 0 to compare them as text, see the float-tolerance
+	// directive
+	floatTolerance float64
+	// Summarize the rows of the next statement, see the mask-rows
+	// directive
+	mask *rowMask
+	// Print how many times the driver sent each statement, see the
+	// attempts directive
+	showAttempts bool
+	// The cleanup section of the test is reached, see the cleanup
+	// directive
+	inCleanup bool
+	// Nodes paused by the pause-node directive and not resumed yet,
+	// resumed when the test ends whatever its outcome
+	paused map[*CQLServer]bool
+}
+
+// Execute all statements and directives of a test file, and the
+// cleanup section of the file if the test stops before it
+func (run *cqlTestRun) Run(scanner *cqlScanner) error {
+	run.scanner = scanner
+	err := run.run()
+	if !run.inCleanup {
+		run.cleanup()
+	}
+	run.resumeNodes()
+	return err
+}
+
+func (run *cqlTestRun) run() error {
+	for {
+		stmt, err := run.scanner.Next()
+		if err != nil {
+			return err
+		}
+		if stmt == nil {
+			return nil
+		}
+		if stmt.directive != "" {
+			var expanded = *stmt
+			expanded.text = run.Expand(stmt.text)
+			if err := cqlDirectives[stmt.directive](run, &expanded); err != nil {
+				run.Fail(stmt, err)
+			}
+		} else if err := run.Execute(stmt); err != nil {
+			return err
+		}
+		if run.checkDiff(stmt) && run.test.stopAtDiff {
+			return nil
 		}
 	}
-	output.Flush()
+}
 
-	if _, err := os.Stat(test.result); err == nil {
-		// Compare output
-		isEqualResult, _ = equalfile.New(nil, equalfile.Options{}).CompareFile(
-			tmpfile_name, test.result)
-	} else if os.IsNotExist(err) {
-		isNew = true
-	} else {
-		return "", merry.Wrap(err)
+// Skip to the cleanup section of a test which stopped early, e.g. at
+// the first difference from the result file or on a lost connection,
+// and execute it. The output of the section is not recorded, it's too
+// late to compare it.
+func (run *cqlTestRun) cleanup() {
+	run.scanner.quiet, run.quietResults = true, true
+	for {
+		stmt, err := run.scanner.Next()
+		if err != nil || stmt == nil {
+			return
+		}
+		if stmt.directive == "cleanup" {
+			run.lane.Log().Printf("%s: the test stopped early, running the cleanup section",
+				stmt.Location())
+			break
+		}
+	}
+	run.inCleanup = true
+	for {
+		stmt, err := run.scanner.Next()
+		if err != nil || stmt == nil {
+			return
+		}
+		if stmt.directive != "" {
+			var expanded = *stmt
+			expanded.text = run.Expand(stmt.text)
+			if err := cqlDirectives[stmt.directive](run, &expanded); err != nil {
+				run.Fail(stmt, err)
+			}
+		} else if err := run.Execute(stmt); err != nil {
+			run.lane.Log().Warnf("%s: cleanup failed: %v", stmt.Location(), err)
+			return
+		}
 	}
+}
 
-	if isEqualResult {
-		os.Remove(tmpfile_name)
-		return "pass", nil
+// Report the first difference of the output from the result file
+// as soon as it's produced. Return true if the output differs.
+func (run *cqlTestRun) checkDiff(stmt *cqlStatement) bool {
+	if run.compared == nil {
+		return false
 	}
-	if isNew {
-		// Create a result file when running for the first time
-		if err := os.Rename(tmpfile_name, test.result); err != nil {
-			return "", merry.Wrap(err)
+	if run.compared.diverged != 0 {
+		return true
+	}
+	run.output.Flush()
+	if run.compared.diverged == 0 {
+		return false
+	}
+	var msg = fmt.Sprintf("output differs from the result file at line %d",
+		run.compared.diverged)
+	if run.test.stopAtDiff {
+		msg += ", stopping the test"
+	}
+	run.lane.Log().Printf("%s: %s", stmt.Location(), msg)
+	run.Fail(stmt, merry.New(msg))
+	return true
+}
+
+// Variables of the lane and the server, e.g. ${YACHT_KEYSPACE}, which
+// are replaced with their values in statements and directives
+var yachtVarRE = regexp.MustCompile(`\$\{(YACHT_\w+)\}`)
+
+func (run *cqlTestRun) Expand(text string) string {
+	if strings.Contains(text, "${YACHT_") == false {
+		return text
+	}
+	return expandVars(text, run.Environment())
+}
+
+// Replace ${YACHT_...} variables set in env, keep the rest as is
+func expandVars(text string, env []string) string {
+	return yachtVarRE.ReplaceAllStringFunc(text, func(ref string) string {
+		if value := envValue(env, yachtVarRE.FindStringSubmatch(ref)[1]); value != "" {
+			return value
 		}
-		return "new", nil
+		return ref
+	})
+}
+
+// Print the keyspace of the run as "yacht" in the output, so that
+// the output doesn't depend on the keyspace name
+func (run *cqlTestRun) maskKeyspace(text string) string {
+	var keyspace = envValue(run.server.Environment(), "YACHT_KEYSPACE")
+	if keyspace == "" || keyspace == "yacht" {
+		return text
 	}
-	if err := os.Rename(tmpfile_name, test.reject); err != nil {
-		return "", merry.Wrap(err)
+	return strings.Replace(text, keyspace, "yacht", -1)
+}
+
+func (run *cqlTestRun) Execute(stmt *cqlStatement) error {
+	run.next.format = run.test.format
+	start := time.Now()
+	var cql = run.Expand(stmt.text)
+	result, err := run.c.Execute(cql, &run.next)
+	latency := time.Now().Sub(start)
+	var delay = run.retryDelay
+	for retry := 1; retry <= run.retries && isTransient(result, err); retry++ {
+		run.lane.Log().Warnf("%s: transient error, retry %d of %d in %v", stmt.Location(),
+			retry, run.retries, delay)
+		time.Sleep(delay)
+		delay *= 2
+		result, err = run.c.Execute(cql, &run.next)
 	}
-	// Result content mismatch
-	return "fail", nil
+	run.next = QueryOptions{}
+	if err != nil {
+		run.lane.Log().Errorf("%s: %.200s: %v", stmt.Location(), cql, err)
+		// A lost connection or denied access, not a test failure
+		return merry.Wrap(err)
+	}
+	run.lane.Log().Debugf("%s: %s in %v: %.200s", stmt.Location(), result.status, latency, cql)
+	events.Emit("statement", map[string]interface{}{"lane": run.lane.id,
+		"test":     path.Join(path.Base(path.Dir(run.test.path)), run.test.name),
+		"location": stmt.Location(), "status": result.status,
+		"latency_ms": milliseconds(latency)})
+	result.columnTypes = run.test.format.ColumnTypes
+	if run.columnTypes != nil {
+		result.columnTypes = *run.columnTypes
+	}
+	result.showAttempts = run.showAttempts
+	// Assertions check the rows of the result, not their summary
+	var printed = result
+	if run.mask != nil {
+		var masked = *result
+		if err := run.mask.Apply(run, cql, &masked); err != nil {
+			run.Fail(stmt, err)
+		}
+		run.mask = nil
+		printed = &masked
+	}
+	var anyColumnOrder = run.test.format.AnyColumnOrder
+	if run.anyColumnOrder != nil {
+		anyColumnOrder = *run.anyColumnOrder
+	}
+	if (anyColumnOrder || run.floatTolerance > 0) && run.compared != nil && !run.quietResults {
+		// The result file is matched up to the result of the statement
+		run.output.Flush()
+		if table := run.compared.ExpectedTable(stmt.Prefix(run.test.format.StatementIds)); table != nil {
+			if anyColumnOrder {
+				printed.ReorderColumns(table.header)
+			}
+			if run.floatTolerance > 0 {
+				printed.ApplyTolerance(table.rows, run.floatTolerance)
+			}
+		}
+	}
+	if !run.quietResults {
+		fmt.Fprint(run.output, prefixLines(run.maskKeyspace(printed.String()),
+			stmt.Prefix(run.test.format.StatementIds)))
+	}
+	run.last = stmt
+	run.lastResult = result
+	run.statements++
+	run.test.latency.Add(stmt, latency, run.test.slowStatement)
+	if run.maxLatency > 0 && latency > run.maxLatency {
+		run.Fail(stmt, merry.Errorf("statement took %v, max-latency is %v",
+			latency.Round(time.Millisecond), run.maxLatency))
+	}
+	if run.trace != nil {
+		run.trace(stmt, result)
+	}
+	if result.status == "OK" {
+		if err := awaitCreatedIndex(run, cql); err != nil {
+			run.Fail(stmt, err)
+		}
+		if err := applyGcGrace(run, cql); err != nil {
+			run.Fail(stmt, err)
+		}
+	}
+	return nil
+}
+
+// Environment of commands run by the test: describes the lane
+// and the server
+func (run *cqlTestRun) Environment() []string {
+	return append(run.lane.Environment(), run.server.Environment()...)
+}
+
+// The keyspace unqualified names of the test refer to, empty if
+// unknown
+func (run *cqlTestRun) Keyspace() string {
+	if c, ok := run.c.(KeyspaceConnection); ok {
+		return c.Keyspace()
+	}
+	return envValue(run.Environment(), "YACHT_KEYSPACE")
+}
+
+// Record a test failure at the given statement or directive
+func (run *cqlTestRun) Fail(stmt *cqlStatement, err error) {
+	run.test.failures = append(run.test.failures,
+		fmt.Sprintf("%s: %v", stmt.Location(), err))
+}
+
+// Print failed assertions and the diff between the result and the
+// reject file
+func (test *CQLTestFile) PrintFailures(mode string) {
+	var md = test.Metadata()
+	if md.Description != "" {
+		fmt.Printf("%s\n", md.Description)
+	}
+	for _, issue := range md.Issues {
+		fmt.Printf("See %s\n", palette.Path(issue))
+	}
+	for _, failure := range test.failures {
+		fmt.Printf("%s\n", palette.Crit("%s", failure))
+	}
+	if test.rejected {
+		test.PrintUniDiff(mode)
+	}
+}
+
+// Remember the sizes of server log files, to be able to extract
+// the part of the logs written during a test
+func logOffsets(server Server) map[string]int64 {
+	offsets := make(map[string]int64)
+	for _, name := range server.LogFiles() {
+		if st, err := os.Stat(name); err == nil {
+			offsets[name] = st.Size()
+		}
+	}
+	return offsets
+}
+
+// Save the part of server logs written during the test to the lane
+// directory and print its last lines. Return the names of the saved
+// files.
+func (test *CQLTestFile) PrintLogSlices(lane *Lane, offsets map[string]int64) []string {
+	return printLogSlices(lane, test.name, offsets)
+}
+
+// How many last lines of a log to print for a failed test
+const TAIL_LINES = 20
+
+func printLogSlices(lane *Lane, name string, offsets map[string]int64) []string {
+	var logs, slices []string
+	for log := range offsets {
+		logs = append(logs, log)
+	}
+	sort.Strings(logs)
+	for _, log := range logs {
+		f, err := os.Open(log)
+		if err != nil {
+			continue
+		}
+		f.Seek(offsets[log], io.SeekStart)
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if len(data) == 0 {
+			continue
+		}
+		slice := path.Join(lane.Dir(), name+"."+path.Base(log))
+		if ioutil.WriteFile(slice, data, 0644) == nil {
+			slices = append(slices, slice)
+		}
+		lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		if len(lines) > TAIL_LINES {
+			lines = lines[len(lines)-TAIL_LINES:]
+		}
+		fmt.Printf("Last lines of server log written during the test, see %s:\n",
+			palette.Path(slice))
+		for _, line := range lines {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	return slices
+}
+
+// Environment variables describing a failed test, for the
+// on_failure command
+func (test *CQLTestFile) FailureEnvironment(name string, status string, mode string,
+	slices []string) []string {
+
+	var env = []string{
+		"YACHT_TEST=" + name,
+		"YACHT_TEST_PATH=" + test.path,
+		"YACHT_TEST_STATUS=" + status,
+		"YACHT_LOG_SLICES=" + strings.Join(slices, ","),
+	}
+	var md = test.Metadata()
+	env = append(env,
+		"YACHT_TEST_DESCRIPTION="+md.Description,
+		"YACHT_TEST_TAGS="+strings.Join(md.Tags, ","),
+		"YACHT_TEST_ISSUES="+strings.Join(md.Issues, ","))
+	if test.rejected {
+		_, reject := test.Golden(mode)
+		env = append(env, "YACHT_REJECT_PATH="+reject)
+	}
+	return env
+}
+
+func (test *CQLTestFile) PrintUniDiff(mode string) {
+	printUniDiff(test.Golden(mode))
 }
 
-func (test *CQLTestFile) PrintUniDiff() {
+func printUniDiff(result_name string, reject_name string) {
 
 	var result, reject []byte
 	var err error
 
-	if result, err = ioutil.ReadFile(test.result); err != nil {
+	if result, err = ioutil.ReadFile(result_name); err != nil {
 		return
 	}
-	if reject, err = ioutil.ReadFile(test.reject); err != nil {
+	if reject, err = ioutil.ReadFile(reject_name); err != nil {
 		return
 	}
 	diff := difflib.UnifiedDiff{
 		A:        difflib.SplitLines(string(result)),
 		B:        difflib.SplitLines(string(reject)),
-		FromFile: palette.Path(test.result),
-		ToFile:   palette.Path(test.reject),
+		FromFile: palette.Path(result_name),
+		ToFile:   palette.Path(reject_name),
 		Context:  3,
 	}
 	if text, err := difflib.GetUnifiedDiffString(diff); err == nil {
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+)
+
+// Enable CDC on a table, optionally with pre- and post-images:
+//
+//	-- cdc-enable: <table> [preimage] [postimage]
+func cdcEnableDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	args := strings.Fields(stmt.text)
+	if len(args) == 0 {
+		return merry.New("cdc-enable: no table name")
+	}
+	var options = []string{"'enabled': true"}
+	for _, arg := range args[1:] {
+		switch arg {
+		case "preimage", "postimage":
+			options = append(options, fmt.Sprintf("'%s': true", arg))
+		default:
+			return merry.Errorf("cdc-enable: unknown option '%s'", arg)
+		}
+	}
+	cql := fmt.Sprintf("ALTER TABLE %s WITH cdc = {%s}", args[0], strings.Join(options, ", "))
+	result, err := run.c.Execute(cql, nil)
+	if err != nil {
+		return merry.Prepend(err, "cdc-enable")
+	}
+	if result.status != "OK" {
+		return merry.Errorf("cdc-enable: %s", result.message)
+	}
+	return nil
+}
+
+// Record the CDC log of a table in the test output:
+//
+//	-- cdc-log: <table>
+//
+// Stream ids and timestamps differ from run to run, so the log is
+// ordered by time and batch sequence number, stream ids are replaced
+// with stream numbers in the order of first appearance and times with
+// sequence numbers. Operations and column deltas are printed as is.
+func cdcLogDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	table := strings.TrimSpace(stmt.text)
+	if table == "" {
+		return merry.New("cdc-log: no table name")
+	}
+	var format = *run.test.format
+	// The log is printed as a table, see below
+	format.Rows = "table"
+	result, err := run.c.Execute("SELECT * FROM "+table+"_scylla_cdc_log",
+		&QueryOptions{format: &format})
+	if err != nil {
+		return merry.Prepend(err, "cdc-log")
+	}
+	if result.status == "OK" {
+		if err := normalizeCDCLog(result); err != nil {
+			return err
+		}
+	}
+	fmt.Fprint(run.output, result.String())
+	return nil
+}
+
+func normalizeCDCLog(result *CQLResult) error {
+	var stream, time, seq = -1, -1, -1
+	for i, name := range result.names {
+		switch name {
+		case "cdc$stream_id":
+			stream = i
+		case "cdc$time":
+			time = i
+		case "cdc$batch_seq_no":
+			seq = i
+		}
+	}
+	if stream < 0 || time < 0 || seq < 0 {
+		return merry.New("cdc-log: not a CDC log table")
+	}
+	type entry struct {
+		row  []string
+		time int64
+		seq  int
+	}
+	var entries []entry
+	for _, row := range result.rows {
+		uuid, err := gocql.ParseUUID(row[time])
+		if err != nil {
+			return merry.Prepend(err, "cdc-log: malformed cdc$time")
+		}
+		seqNo, _ := strconv.Atoi(row[seq])
+		entries = append(entries, entry{row: row, time: uuid.Time().UnixNano(), seq: seqNo})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return entries[i].seq < entries[j].seq
+	})
+	var streams = make(map[string]string)
+	var times = make(map[int64]string)
+	for i, e := range entries {
+		if _, found := streams[e.row[stream]]; !found {
+			streams[e.row[stream]] = fmt.Sprintf("stream%d", len(streams)+1)
+		}
+		if _, found := times[e.time]; !found {
+			times[e.time] = fmt.Sprintf("time%d", len(times)+1)
+		}
+		e.row[stream] = streams[e.row[stream]]
+		e.row[time] = times[e.time]
+		result.rows[i] = e.row
+	}
+	return nil
+}
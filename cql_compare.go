@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Lines of a result which precede its table, see CQLResult.String()
+var resultPreambleRE = regexp.MustCompile(`^(attempts|warning|payload): `)
+
+// A result table of the result file, as printed: column names in
+// the header and cells of the rows, without padding
+type expectedTable struct {
+	header []string
+	rows   [][]string
+}
+
+func tableCells(line string) []string {
+	var cells = strings.Split(strings.Trim(line, "|"), "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+// The result table which comes next in the result file, nil if there
+// is none or the output already differs from the result file. Lines
+// of the result file start with the prefix, see cqlStatement.Prefix().
+func (cw *compareWriter) ExpectedTable(prefix string) *expectedTable {
+	if cw.expected == nil || cw.file == nil || cw.diverged != 0 {
+		return nil
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(cw.file, cw.offset, math.MaxInt64-cw.offset))
+	scanner.Buffer(nil, 1024*1024)
+	var table *expectedTable
+	// Borders seen: above the header, under it and under the rows
+	var borders int
+	for scanner.Scan() {
+		var line = scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, prefix))
+		switch {
+		case strings.HasPrefix(line, "+"):
+			if borders++; borders == 3 {
+				return table
+			}
+		case strings.HasPrefix(line, "|") && borders == 1:
+			// The second line of a header, if any, has column types
+			if table == nil {
+				table = &expectedTable{header: tableCells(line)}
+			}
+		case strings.HasPrefix(line, "|") && borders == 2:
+			table.rows = append(table.rows, tableCells(line))
+		case borders == 0 && resultPreambleRE.MatchString(line):
+			continue
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Put the columns of the result in the order of the header, if it
+// has the same columns in another order, so that e.g. SELECT * which
+// returns columns in a different order doesn't change the output
+func (result *CQLResult) ReorderColumns(header []string) {
+	if len(header) != len(result.names) || len(result.rows) == 0 {
+		return
+	}
+	var positions = make(map[string]int)
+	for i, name := range result.names {
+		positions[tablewriter.Title(name)] = i
+	}
+	if len(positions) != len(result.names) {
+		// Names which print the same, the order is ambiguous
+		return
+	}
+	var order = make([]int, len(header))
+	var reordered bool
+	for i, title := range header {
+		j, found := positions[title]
+		if !found {
+			return
+		}
+		order[i] = j
+		reordered = reordered || i != j
+	}
+	if !reordered {
+		return
+	}
+	var permute = func(values []string) []string {
+		var permuted = make([]string, len(order))
+		for i, j := range order {
+			permuted[i] = values[j]
+		}
+		return permuted
+	}
+	result.names = permute(result.names)
+	if len(result.types) == len(order) {
+		result.types = permute(result.types)
+	}
+	for i, row := range result.rows {
+		if len(row) == len(order) {
+			result.rows[i] = permute(row)
+		}
+	}
+}
+
+// Print numbers of the result which are within the tolerance of the
+// numbers in the same cells of the expected rows as in the expected
+// rows, so that the output only differs if the numbers do. The
+// tolerance is absolute for numbers up to 1 and relative for larger
+// ones. Rows wrapped over several lines aren't compared.
+func (result *CQLResult) ApplyTolerance(expected [][]string, tolerance float64) {
+	if len(expected) != len(result.rows) {
+		return
+	}
+	for i, row := range result.rows {
+		if len(expected[i]) != len(row) {
+			continue
+		}
+		for j, cell := range row {
+			if cell == expected[i][j] {
+				continue
+			}
+			a, err := strconv.ParseFloat(cell, 64)
+			if err != nil {
+				continue
+			}
+			e, err := strconv.ParseFloat(expected[i][j], 64)
+			if err != nil {
+				continue
+			}
+			if math.Abs(a-e) <= tolerance*math.Max(1, math.Abs(e)) {
+				row[j] = expected[i][j]
+			}
+		}
+	}
+}
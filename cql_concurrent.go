@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ansel1/merry"
+)
+
+// Run a block of statements concurrently from several sessions:
+//
+//	-- concurrent: <sessions>
+//	UPDATE t SET v = 1 WHERE k = 0 IF v = 0;
+//	-- end:
+//
+// Every session opens its own connection and executes all statements
+// of the block in order. The connections use the default keyspace,
+// so qualify table names if the test switched keyspaces with USE.
+// Results are not comparable between runs, so instead of them the
+// output has the aggregate counts of successful statements, errors by
+// error code and, for conditional statements, of applied and not
+// applied ones.
+func concurrentDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	var block []*cqlStatement
+	var blockErr error
+	for {
+		next, err := run.scanner.Next()
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return merry.Errorf("concurrent: no end of the block started at %s",
+				stmt.Location())
+		}
+		if next.directive == "end" {
+			break
+		}
+		if next.directive != "" && blockErr == nil {
+			blockErr = merry.Errorf("concurrent: directive %s at %s is not allowed in a block",
+				next.directive, next.Location())
+		}
+		block = append(block, next)
+	}
+	if blockErr != nil {
+		return blockErr
+	}
+	sessions, err := strconv.Atoi(stmt.text)
+	if err != nil || sessions <= 0 {
+		return merry.Errorf("concurrent: malformed number of sessions '%s'", stmt.text)
+	}
+	var counts = make(map[string]int)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local = make(map[string]int)
+			err := func() error {
+				c, err := run.server.Connect()
+				if err != nil {
+					return err
+				}
+				defer c.Close()
+				for _, stmt := range block {
+					result, err := c.Execute(run.Expand(stmt.text), &QueryOptions{format: run.test.format})
+					if err != nil {
+						return err
+					}
+					if result.status != "OK" {
+						local[result.code]++
+						continue
+					}
+					local["OK"]++
+					if len(result.names) > 0 && result.names[0] == "[applied]" {
+						for _, row := range result.rows {
+							if row[0] == "true" {
+								local["applied"]++
+							} else {
+								local["not applied"]++
+							}
+						}
+					}
+				}
+				return nil
+			}()
+			mutex.Lock()
+			defer mutex.Unlock()
+			for k, v := range local {
+				counts[k] += v
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return merry.Prepend(firstErr, "concurrent")
+	}
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("  %s: %d\n", k, counts[k]))
+	}
+	fmt.Fprintf(run.output, "  concurrent: %d sessions, %d statements each\n%s",
+		sessions, len(block), strings.Join(lines, ""))
+	return nil
+}
+
+// The end of a block of statements, see concurrentDirective. The
+// block directive reads it, so here it's unpaired.
+func endDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	return merry.New("end: no block to end")
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 
@@ -15,6 +18,68 @@ import (
 
 type CQLConnection struct {
 	session *gocql.Session
+	// Used to reconnect to another keyspace on USE
+	cluster *gocql.ClusterConfig
+	// The keyspace set with USE, empty if it's the default one
+	keyspace string
+	// Keyspaces created via this connection are dropped by
+	// this artefact
+	keyspaces *CQLServerURI_artefact
+	// Records statements and responses, see --record
+	recorder *Recorder
+	// Refuse statements which may change data or schema
+	readOnly bool
+	// Speculative execution policy of statements, nil for none
+	speculative gocql.SpeculativeExecutionPolicy
+	// The only keyspace DESCRIBE SCHEMA shows, empty for all but
+	// system ones. Keyspaces of other runs sharing a server yacht
+	// didn't start come and go, as with check_schema.
+	schemaKeyspace string
+}
+
+var useRE = regexp.MustCompile(`(?is)^\s*USE\s+("[^"]+"|\w+)\s*;?\s*$`)
+
+// Statements allowed in read-only mode
+var readOnlyRE = regexp.MustCompile(`(?is)^\s*(SELECT|USE|DESCRIBE|DESC|LIST)\b`)
+
+// Returned for a statement which may change something in read-only
+// mode, see --read-only
+var ErrReadOnly = merry.New("read-only mode")
+
+// Speculative execution may apply a statement more than once, so it's
+// used only for reads and for writes which are safe to repeat: not
+// lightweight transactions, counter or collection updates, or writes
+// of values generated by the server. Counter and collection updates
+// are arithmetic on the column itself: c = c + 1, l = l - [1] or
+// l = [0] + l.
+var idempotentRE = regexp.MustCompile(`(?is)^\s*(SELECT|INSERT|UPDATE|DELETE)\b`)
+var notIdempotentRE = regexp.MustCompile(`(?is)\bIF\b|\b(now|uuid)\s*\(|` +
+	`\bSET\b.*("[^"]+"|[a-z_]\w*)\s*=\s*(("[^"]+"|[a-z_]\w*)\s*[-+]|(\[[^\]]*\]|\{[^}]*\}|\?)\s*\+\s*("[^"]+"|[a-z_]\w*))`)
+
+func idempotent(cql string) bool {
+	if readOnlyRE.MatchString(cql) {
+		return true
+	}
+	return idempotentRE.MatchString(cql) && !notIdempotentRE.MatchString(cql)
+}
+
+var createKeyspaceRE = regexp.MustCompile(`(?is)^\s*CREATE\s+KEYSPACE\s+(IF\s+NOT\s+EXISTS\s+)?("[^"]+"|\w+)`)
+
+// Whether a keyspace exists, by its name as written in a statement:
+// quoted names are case-sensitive, others are in lower case
+func keyspaceExists(session *gocql.Session, keyspace string) (bool, error) {
+	var name = strings.ToLower(keyspace)
+	if strings.HasPrefix(keyspace, `"`) {
+		name = strings.Trim(keyspace, `"`)
+	}
+	var found string
+	iter := session.Query("SELECT keyspace_name FROM system_schema.keyspaces WHERE keyspace_name = ?",
+		name).Iter()
+	var exists = iter.Scan(&found)
+	if err := iter.Close(); err != nil {
+		return false, merry.Prepend(err, "failed to check keyspace "+keyspace)
+	}
+	return exists, nil
 }
 
 var CassandraErrorMap = map[int]string{
@@ -39,33 +104,136 @@ var CassandraErrorMap = map[int]string{
 	0x2500: "Unprepared (0x2500)",
 }
 
+// Errors which may go away if the statement is retried: timeouts,
+// an overloaded or unavailable cluster, a lost connection, which
+// the driver re-establishes in background
+var transientErrorCodes = map[string]bool{
+	CassandraErrorMap[0x1000]: true,
+	CassandraErrorMap[0x1001]: true,
+	CassandraErrorMap[0x1002]: true,
+	CassandraErrorMap[0x1100]: true,
+	CassandraErrorMap[0x1200]: true,
+}
+
+var transientErrors = append([]error{gocql.ErrUnavailable}, connectionErrors...)
+
+// Errors of Execute() which abort the suite, since the following
+// tests can't run: the server or the connection to it is broken.
+// Errors returned by the server, including permission errors, are
+// a part of the test output instead.
+var ErrConnectionLost = merry.New("lost connection to the server")
+var ErrAccessDenied = merry.New("access denied")
+
+var connectionErrors = []error{
+	gocql.ErrTimeoutNoResponse,
+	gocql.ErrConnectionClosed,
+	gocql.ErrNoConnections,
+}
+
+// Whether the outcome of Execute() is a transient error
+func isTransient(result *CQLResult, err error) bool {
+	if err == nil {
+		return result.status != "OK" && transientErrorCodes[result.code]
+	}
+	for _, transient := range transientErrors {
+		if merry.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// Per-statement settings, set by test directives
+type QueryOptions struct {
+	// Values for bind markers, may include gocql.UnsetValue
+	values []interface{}
+	// Custom payload sent with the statement
+	payload map[string][]byte
+	// How to print the result
+	format *FormatConfig
+	// Consistency level of the statement, nil for the driver default
+	consistency *gocql.Consistency
+}
+
 // Result of execution of a CQL statement
 type CQLResult struct {
 	status   string
 	code     string
 	message  string
 	warnings []string
-	names    []string
-	types    []string
-	rows     [][]string
+	// Custom payload returned by the server
+	payload map[string][]byte
+	names   []string
+	types   []string
+	rows    [][]string
+	// Wrap values of the table wider than this, 0 for the default
+	columnWidth int
+	// Print column types under column names, see the column-types
+	// directive
+	columnTypes bool
+	// How many times the driver sent the statement, and whether to
+	// print it, see the attempts directive
+	attempts     int
+	showAttempts bool
+	// Print the values of the only column as is, separated with
+	// empty lines, instead of a table, see DESCRIBE
+	verbatim bool
+	// Rows as JSON objects, if the suite prints rows as JSON
+	json []string
 }
 
 func (result *CQLResult) String() string {
 	var offset = "  "
 	buf := new(bytes.Buffer)
+	if result.showAttempts {
+		fmt.Fprintf(buf, "%s%8s: %d\n", offset, "attempts", result.attempts)
+	}
 	if result.status != "OK" {
 		fmt.Fprintf(buf, "%s%7s: %s\n", offset, "status", result.status)
 		fmt.Fprintf(buf, "%s%7s: %s\n", offset, "code", result.code)
 		fmt.Fprintf(buf, "%s%7s: %s\n", offset, "message", result.message)
 		return string(buf.Bytes())
 	}
-	if len(result.warnings) != 0 {
-		fmt.Fprintf(buf, "%s%8s: %+v\n", offset, "warnings", result.warnings)
+	for _, warning := range normalizeWarnings(result.warnings) {
+		fmt.Fprintf(buf, "%s%7s: %s\n", offset, "warning", warning)
 	}
-	if len(result.rows) != 0 {
+	if len(result.payload) != 0 {
+		var payload = make(map[string]string)
+		for k, v := range result.payload {
+			payload[k] = string(v)
+		}
+		fmt.Fprintf(buf, "%s%8s: %s\n", offset, "payload", prettyPrint(payload))
+	}
+	if len(result.json) != 0 {
+		for _, row := range result.json {
+			fmt.Fprintf(buf, "%s%s\n", offset, row)
+		}
+	} else if result.verbatim {
+		for i, row := range result.rows {
+			if i > 0 {
+				fmt.Fprint(buf, "\n")
+			}
+			for _, line := range strings.Split(row[0], "\n") {
+				fmt.Fprintf(buf, "%s%s\n", offset, line)
+			}
+		}
+	} else if len(result.rows) != 0 {
 		fmt.Fprint(buf, offset)
 		table := tablewriter.NewWriter(buf)
-		table.SetHeader(result.names)
+		if result.columnTypes && len(result.types) == len(result.names) {
+			// Format the names as the table would, but not the types
+			var header = make([]string, len(result.names))
+			for i, name := range result.names {
+				header[i] = tablewriter.Title(name) + "\n" + result.types[i]
+			}
+			table.SetAutoFormatHeaders(false)
+			table.SetHeader(header)
+		} else {
+			table.SetHeader(result.names)
+		}
+		if result.columnWidth != 0 {
+			table.SetColWidth(result.columnWidth)
+		}
 		// Shift all rows by offset
 		table.SetNewLine("\n" + offset)
 		for _, v := range result.rows {
@@ -80,12 +248,40 @@ func (result *CQLResult) String() string {
 	return string(buf.Bytes())
 }
 
+// Addresses of nodes, with an optional port, in server warnings
+var hostRE = regexp.MustCompile(`\b(\d{1,3}(\.\d{1,3}){3}|localhost)(:\d+)?\b`)
+
+// Make warnings of a result independent of the cluster and of the
+// order they arrive in: mask node addresses, put each warning on one
+// line, and sort them
+func normalizeWarnings(warnings []string) []string {
+	var normalized []string
+	for _, warning := range warnings {
+		warning = hostRE.ReplaceAllString(warning, "<host>")
+		normalized = append(normalized, strings.Join(strings.Fields(warning), " "))
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
 // Go maps are unordered.
 // Pretty print them in string sorted order of key
 func prettyPrint(iface interface{}) string {
 
 	v := reflect.Indirect(reflect.ValueOf(iface))
-	// Todo: unwrap other composite types such as slices, structs and arrays
+	if v.IsValid() == false {
+		return "null"
+	}
+	// Todo: unwrap structs
+	if (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) &&
+		v.Type().Elem().Kind() != reflect.Uint8 {
+
+		var items = make([]string, v.Len())
+		for i := range items {
+			items[i] = prettyPrint(v.Index(i).Interface())
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
 	if v.Type().Kind() != reflect.Map {
 		return fmt.Sprint(v.Interface())
 	}
@@ -111,49 +307,301 @@ func prettyPrint(iface interface{}) string {
 	return string(buf.Bytes())
 }
 
-func (c *CQLConnection) Execute(cql string) (string, error) {
+// gocql doesn't support USE statements, since a session may have
+// many connections. Emulate USE by opening a new session.
+func (c *CQLConnection) Use(keyspace string) (*CQLResult, error) {
+	cluster := *c.cluster
+	if strings.HasPrefix(keyspace, `"`) {
+		cluster.Keyspace = strings.Trim(keyspace, `"`)
+	} else {
+		cluster.Keyspace = strings.ToLower(keyspace)
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return &CQLResult{
+			status:  "ERROR",
+			code:    "Client error",
+			message: fmt.Sprintf("%.80s", err.Error()),
+		}, nil
+	}
+	c.session.Close()
+	c.session = session
+	c.keyspace = cluster.Keyspace
+	return &CQLResult{status: "OK"}, nil
+}
+
+// A connection which knows which keyspace it uses
+type KeyspaceConnection interface {
+	Keyspace() string
+}
+
+// The keyspace unqualified names refer to: the one set with USE,
+// or the default one
+func (c *CQLConnection) Keyspace() string {
+	if c.keyspace != "" {
+		return c.keyspace
+	}
+	return c.cluster.Keyspace
+}
+
+// Switch back to the default keyspace, if USE switched
+// to another one
+func (c *CQLConnection) Reset() error {
+	if c.keyspace == "" || c.keyspace == c.cluster.Keyspace {
+		return nil
+	}
+	session, err := c.cluster.CreateSession()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	c.session.Close()
+	c.session = session
+	c.keyspace = ""
+	return nil
+}
+
+// Pretty print a value of the given CQL type. Lists are printed
+// as [a b], sets as lists sorted in string order, maps as map[k:v]
+// sorted by key, tuples as (a b) and UDTs as {field:value}, with
+// fields in the order of the type definition.
+func prettyPrintCQL(info gocql.TypeInfo, iface interface{}, format *FormatConfig) string {
+
+	v := reflect.ValueOf(iface)
+	// Dereference pointers, but print types like *inf.Dec, which
+	// only implement String() on a pointer, as is
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return format.NullString()
+		}
+		if _, ok := v.Interface().(fmt.Stringer); ok {
+			if _, ok := v.Elem().Interface().(fmt.Stringer); !ok {
+				return fmt.Sprint(v.Interface())
+			}
+		}
+		v = v.Elem()
+	}
+	if v.IsValid() == false {
+		return format.NullString()
+	}
+	var items []string
+	switch t := info.(type) {
+	case gocql.CollectionType:
+		switch t.Type() {
+		case gocql.TypeList, gocql.TypeSet:
+			for i := 0; i < v.Len(); i++ {
+				items = append(items, prettyPrintCQL(t.Elem, v.Index(i).Interface(), format))
+			}
+			if t.Type() == gocql.TypeSet {
+				sort.Strings(items)
+			}
+			return "[" + strings.Join(items, " ") + "]"
+		case gocql.TypeMap:
+			for _, key := range v.MapKeys() {
+				items = append(items, prettyPrintCQL(t.Key, key.Interface(), format)+":"+
+					prettyPrintCQL(t.Elem, v.MapIndex(key).Interface(), format))
+			}
+			sort.Strings(items)
+			return "map[" + strings.Join(items, " ") + "]"
+		}
+	case gocql.TupleTypeInfo:
+		for i, elem := range t.Elems {
+			if i < v.Len() {
+				items = append(items, prettyPrintCQL(elem, v.Index(i).Interface(), format))
+			}
+		}
+		return "(" + strings.Join(items, " ") + ")"
+	case gocql.UDTTypeInfo:
+		for _, field := range t.Elements {
+			var value interface{}
+			if fv := v.MapIndex(reflect.ValueOf(field.Name)); fv.IsValid() {
+				value = fv.Interface()
+			}
+			items = append(items, field.Name+":"+prettyPrintCQL(field.Type, value, format))
+		}
+		return "{" + strings.Join(items, " ") + "}"
+	}
+	if str, ok := format.Scalar(info, v); ok {
+		return str
+	}
+	return prettyPrint(v.Interface())
+}
+
+func (c *CQLConnection) Execute(cql string, opts *QueryOptions) (*CQLResult, error) {
+	if c.recorder == nil {
+		return c.execute(cql, opts, nil)
+	}
+	var exchange = recordedExchange{Query: cql}
+	result, err := c.execute(cql, opts, &exchange)
+	c.recorder.Add(&exchange, result, err)
+	return result, err
+}
+
+// Execute a statement, and save the raw result to the exchange, if
+// it's not nil
+func (c *CQLConnection) execute(cql string, opts *QueryOptions,
+	exchange *recordedExchange) (*CQLResult, error) {
 
 	var result CQLResult
+	var format *FormatConfig
+	if opts != nil {
+		format = opts.format
+	}
+
+	if c.readOnly && !readOnlyRE.MatchString(cql) {
+		return nil, merry.WithMessagef(ErrReadOnly, "read-only mode: refusing to execute '%.40s'",
+			strings.TrimSpace(cql))
+	}
+
+	if m := useRE.FindStringSubmatch(cql); m != nil {
+		return c.Use(m[1])
+	}
+
+	if m := describeRE.FindStringSubmatch(cql); m != nil {
+		return c.Describe(m, exchange)
+	}
+
+	// Keyspaces the test creates are dropped when the suite ends, but
+	// not a keyspace which existed before CREATE KEYSPACE IF NOT EXISTS,
+	// e.g. one of another user of the cluster in URI mode
+	var created string
+	if m := createKeyspaceRE.FindStringSubmatch(cql); m != nil && c.keyspaces != nil {
+		if m[1] == "" {
+			created = m[2]
+		} else if exists, err := keyspaceExists(c.session, m[2]); err != nil {
+			return nil, err
+		} else if !exists {
+			created = m[2]
+		}
+	}
 
 	query := c.session.Query(cql)
+	if opts != nil {
+		query.Bind(opts.values...)
+		if len(opts.payload) != 0 {
+			query.CustomPayload(opts.payload)
+		}
+		if opts.consistency != nil {
+			query.Consistency(*opts.consistency)
+		}
+	}
+	if c.speculative != nil && idempotent(cql) {
+		query.SetSpeculativeExecutionPolicy(c.speculative)
+		query.Idempotent(true)
+	}
 	iter := query.Iter()
+	// Including retries and speculative executions
+	result.attempts = query.Attempts()
 
 	row, err := iter.RowData()
 
 	if err == nil {
 		result.status = "OK"
 
+		if created != "" {
+			c.keyspaces.AddKeyspace(created)
+		}
+
 		result.warnings = iter.Warnings()
-		for _, column := range iter.Columns() {
-			result.names = append(result.names, column.Name)
-			result.types = append(result.types, column.TypeInfo.Type().String())
+		result.payload = iter.GetCustomPayload()
+		var columns = iter.Columns()
+		var next = func(values []interface{}) bool {
+			return iter.Scan(values...)
 		}
-		for {
-			if !iter.Scan(row.Values...) {
-				break
-			}
-			strrow := make([]string, len(row.Values))
-			for i, v := range row.Values {
-				strrow[i] = prettyPrint(v)
+		if exchange != nil {
+			exchange.SetColumns(columns)
+			next = func(values []interface{}) bool {
+				return iter.Scan(values...) && exchange.AddRow(columns, values) == nil
 			}
-			result.rows = append(result.rows, strrow)
+		}
+		if err := result.addRows(columns, row.Values, next, format); err != nil {
+			return nil, err
 		}
 	} else {
 		switch e := err.(type) {
 		case gocql.RequestError:
+			if e.Code() == 0x0100 {
+				return nil, merry.WithCause(ErrAccessDenied, err)
+			}
 			result.status = "ERROR"
 			result.code = CassandraErrorMap[e.Code()]
 			result.message = fmt.Sprintf("%.80s", strings.Split(e.Message(), "\n")[0])
 		default:
 			if err == io.EOF {
-				return "", merry.New("Got EOF from server: check out vardir, it has most probably crashed.")
+				return nil, merry.WithMessage(ErrConnectionLost,
+					"Got EOF from server: check out vardir, it has most probably crashed.")
 			}
-			ylog.Printf("got gocql error of type %v, %+v", e, err)
+			if _, ok := err.(net.Error); ok || merry.Is(err, connectionErrors...) {
+				return nil, merry.WithCause(ErrConnectionLost, err)
+			}
+			ylog.Warnf("got gocql error of type %v, %+v", e, err)
 			// Transport error or internal driver error, propagate up
-			return "", merry.Wrap(err)
+			return nil, merry.Wrap(err)
+		}
+	}
+	return &result, nil
+}
+
+// Format the rows of a result. next() scans the next row into values,
+// as allocated by gocql.Iter.RowData(), and returns false when there
+// are no more rows.
+func (result *CQLResult) addRows(columns []gocql.ColumnInfo, values []interface{},
+	next func(values []interface{}) bool, format *FormatConfig) error {
+
+	if format.DetectNulls() {
+		// gocql scans NULLs into pointers to pointers as nil
+		for i, v := range values {
+			values[i] = reflect.New(reflect.TypeOf(v)).Interface()
+		}
+	}
+	// A result of a conditional statement, which has the current
+	// values of the row after [applied]
+	var appliedOnly = format != nil && format.AppliedOnly &&
+		len(columns) > 0 && columns[0].Name == "[applied]"
+	for _, column := range columns {
+		if appliedOnly && column.Name != "[applied]" {
+			continue
+		}
+		result.names = append(result.names, column.Name)
+		result.types = append(result.types, cqlTypeName(column.TypeInfo))
+	}
+	if format != nil {
+		result.columnWidth = format.MaxColumnWidth
+	}
+	for {
+		if !next(values) {
+			break
+		}
+		strrow := make([]string, 0, len(columns))
+		jsonrow := make(map[string]interface{})
+		// gocql scans each element of a tuple column into
+		// a separate value, print them as a single cell
+		var i int
+		for _, column := range columns {
+			var value interface{} = values[i]
+			if tuple, ok := column.TypeInfo.(gocql.TupleTypeInfo); ok {
+				value = values[i : i+len(tuple.Elems)]
+				i += len(tuple.Elems)
+			} else {
+				i++
+			}
+			if appliedOnly && column.Name != "[applied]" {
+				continue
+			}
+			strrow = append(strrow, format.Truncate(prettyPrintCQL(column.TypeInfo, value, format)))
+			if format.JSON() {
+				jsonrow[column.Name] = jsonValue(column.TypeInfo, value, format)
+			}
+		}
+		result.rows = append(result.rows, strrow)
+		if format.JSON() {
+			text, err := json.Marshal(jsonrow)
+			if err != nil {
+				return merry.Wrap(err)
+			}
+			result.json = append(result.json, string(text))
 		}
 	}
-	return result.String(), nil
+	return nil
 }
 
 func (c *CQLConnection) Close() {
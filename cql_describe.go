@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+)
+
+// DESCRIBE statements are emulated by reading system_schema tables,
+// so that their output is the same for every server version, and
+// available where the server doesn't implement DESCRIBE:
+//
+//	DESCRIBE SCHEMA
+//	DESCRIBE KEYSPACE [name]
+//	DESCRIBE TABLE [keyspace.]name
+var describeRE = regexp.MustCompile(`(?is)^\s*DESC(?:RIBE)?\s+(SCHEMA|KEYSPACE|TABLE)(?:\s+("[^"]+"|\w+)(?:\.("[^"]+"|\w+))?)?\s*;?\s*$`)
+
+// Table options which are left out of CREATE TABLE if they have
+// these values. Other options are never printed, their defaults
+// change between server versions.
+const DEFAULT_GC_GRACE_SECONDS = 864000
+
+type schemaColumn struct {
+	name            string
+	kind            string
+	clusteringOrder string
+	position        int
+	cqlType         string
+}
+
+type schemaTable struct {
+	keyspace string
+	name     string
+	columns  []schemaColumn
+	comment  string
+	ttl      int
+	gcGrace  int
+	// Set for materialized views
+	baseTable   string
+	allColumns  bool
+	whereClause string
+}
+
+type schemaIndex struct {
+	name   string
+	table  string
+	target string
+}
+
+type schemaType struct {
+	name   string
+	fields []string
+	types  []string
+}
+
+// A keyspace, its types, tables, views and indexes, in name order
+type schemaKeyspace struct {
+	name          string
+	replication   map[string]string
+	durableWrites bool
+	types         []schemaType
+	tables        []schemaTable
+	views         []schemaTable
+	indexes       []schemaIndex
+}
+
+var lowerCaseIdentRE = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// Quote a name unless it's a lower case identifier
+func quoteName(name string) string {
+	if lowerCaseIdentRE.MatchString(name) {
+		return name
+	}
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// The name as stored in system_schema: as is if quoted, lower case
+// otherwise
+func unquoteName(name string) string {
+	if strings.HasPrefix(name, `"`) {
+		return strings.Trim(name, `"`)
+	}
+	return strings.ToLower(name)
+}
+
+func quoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func (ks *schemaKeyspace) createStatement() string {
+	var keys []string
+	for key := range ks.replication {
+		if key != "class" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var class = strings.TrimPrefix(ks.replication["class"], "org.apache.cassandra.locator.")
+	var options = []string{"'class': " + quoteString(class)}
+	for _, key := range keys {
+		options = append(options, quoteString(key)+": "+quoteString(ks.replication[key]))
+	}
+	return fmt.Sprintf("CREATE KEYSPACE %s WITH replication = {%s} AND durable_writes = %v;",
+		quoteName(ks.name), strings.Join(options, ", "), ks.durableWrites)
+}
+
+func (t *schemaType) createStatement(keyspace string) string {
+	var fields []string
+	for i := range t.fields {
+		fields = append(fields, fmt.Sprintf("    %s %s", quoteName(t.fields[i]), t.types[i]))
+	}
+	return fmt.Sprintf("CREATE TYPE %s.%s (\n%s\n);", quoteName(keyspace), quoteName(t.name),
+		strings.Join(fields, ",\n"))
+}
+
+// Partition key columns, clustering columns, and the rest in name
+// order
+func (t *schemaTable) sortedColumns() (partition, clustering, other []schemaColumn) {
+	for _, column := range t.columns {
+		switch column.kind {
+		case "partition_key":
+			partition = append(partition, column)
+		case "clustering":
+			clustering = append(clustering, column)
+		default:
+			other = append(other, column)
+		}
+	}
+	sort.Slice(partition, func(i, j int) bool { return partition[i].position < partition[j].position })
+	sort.Slice(clustering, func(i, j int) bool { return clustering[i].position < clustering[j].position })
+	sort.Slice(other, func(i, j int) bool { return other[i].name < other[j].name })
+	return
+}
+
+func (t *schemaTable) primaryKey(partition, clustering []schemaColumn) string {
+	var names []string
+	for _, column := range partition {
+		names = append(names, quoteName(column.name))
+	}
+	var key = strings.Join(names, ", ")
+	if len(partition) > 1 {
+		key = "(" + key + ")"
+	}
+	for _, column := range clustering {
+		key += ", " + quoteName(column.name)
+	}
+	return "PRIMARY KEY (" + key + ")"
+}
+
+func (t *schemaTable) options(clustering []schemaColumn) string {
+	var options []string
+	if len(clustering) != 0 {
+		var order []string
+		for _, column := range clustering {
+			order = append(order, quoteName(column.name)+" "+strings.ToUpper(column.clusteringOrder))
+		}
+		options = append(options, "CLUSTERING ORDER BY ("+strings.Join(order, ", ")+")")
+	}
+	if t.comment != "" {
+		options = append(options, "comment = "+quoteString(t.comment))
+	}
+	if t.ttl != 0 {
+		options = append(options, fmt.Sprintf("default_time_to_live = %d", t.ttl))
+	}
+	if t.gcGrace != DEFAULT_GC_GRACE_SECONDS {
+		options = append(options, fmt.Sprintf("gc_grace_seconds = %d", t.gcGrace))
+	}
+	if len(options) == 0 {
+		return ""
+	}
+	return "\n    WITH " + strings.Join(options, "\n    AND ")
+}
+
+func (t *schemaTable) createStatement() string {
+	partition, clustering, other := t.sortedColumns()
+	var name = quoteName(t.keyspace) + "." + quoteName(t.name)
+	if t.baseTable != "" {
+		var selected = "*"
+		if !t.allColumns {
+			var names []string
+			for _, column := range append(append(partition, clustering...), other...) {
+				names = append(names, quoteName(column.name))
+			}
+			selected = strings.Join(names, ", ")
+		}
+		return fmt.Sprintf("CREATE MATERIALIZED VIEW %s AS\n    SELECT %s\n    FROM %s.%s\n"+
+			"    WHERE %s\n    %s%s;", name, selected, quoteName(t.keyspace),
+			quoteName(t.baseTable), t.whereClause, t.primaryKey(partition, clustering),
+			t.options(clustering))
+	}
+	var lines []string
+	for _, column := range append(append(partition, clustering...), other...) {
+		var line = fmt.Sprintf("    %s %s", quoteName(column.name), column.cqlType)
+		if column.kind == "static" {
+			line += " static"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "    "+t.primaryKey(partition, clustering))
+	return fmt.Sprintf("CREATE TABLE %s (\n%s\n)%s;", name, strings.Join(lines, ",\n"),
+		t.options(clustering))
+}
+
+func (index *schemaIndex) createStatement(keyspace string) string {
+	return fmt.Sprintf("CREATE INDEX %s ON %s.%s (%s);", quoteName(index.name),
+		quoteName(keyspace), quoteName(index.table), index.target)
+}
+
+// Scylla implements secondary indexes with materialized views named
+// after the index, which are not to be described as views
+func (ks *schemaKeyspace) isIndexView(view *schemaTable) bool {
+	for i := range ks.indexes {
+		if ks.indexes[i].table == view.baseTable && ks.indexes[i].name+"_index" == view.name {
+			return true
+		}
+	}
+	return false
+}
+
+// CREATE statements of the keyspace and everything in it, or only of
+// the table and its indexes and views, if table is not empty
+func (ks *schemaKeyspace) createStatements(table string) []string {
+	var statements []string
+	if table == "" {
+		statements = append(statements, ks.createStatement())
+		for i := range ks.types {
+			statements = append(statements, ks.types[i].createStatement(ks.name))
+		}
+	}
+	for i := range ks.tables {
+		if table != "" && ks.tables[i].name != table {
+			continue
+		}
+		statements = append(statements, ks.tables[i].createStatement())
+		for j := range ks.indexes {
+			if ks.indexes[j].table == ks.tables[i].name {
+				statements = append(statements, ks.indexes[j].createStatement(ks.name))
+			}
+		}
+		for j := range ks.views {
+			if ks.views[j].baseTable == ks.tables[i].name && !ks.isIndexView(&ks.views[j]) {
+				statements = append(statements, ks.views[j].createStatement())
+			}
+		}
+	}
+	return statements
+}
+
+// Read the schema of a keyspace, nil if there is no such keyspace
+func (c *CQLConnection) readKeyspace(name string) (*schemaKeyspace, error) {
+	var ks = schemaKeyspace{name: name}
+	var found bool
+	iter := c.session.Query(`SELECT durable_writes, replication FROM system_schema.keyspaces
+		WHERE keyspace_name = ?`, name).Iter()
+	for iter.Scan(&ks.durableWrites, &ks.replication) {
+		found = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, merry.Prependf(err, "reading keyspace %s", name)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	var t schemaType
+	iter = c.session.Query(`SELECT type_name, field_names, field_types FROM system_schema.types
+		WHERE keyspace_name = ?`, name).Iter()
+	for iter.Scan(&t.name, &t.fields, &t.types) {
+		ks.types = append(ks.types, t)
+		t = schemaType{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, merry.Prependf(err, "reading types of keyspace %s", name)
+	}
+
+	var tables = make(map[string]*schemaTable)
+	var table schemaTable
+	iter = c.session.Query(`SELECT table_name, comment, default_time_to_live, gc_grace_seconds
+		FROM system_schema.tables WHERE keyspace_name = ?`, name).Iter()
+	for iter.Scan(&table.name, &table.comment, &table.ttl, &table.gcGrace) {
+		table.keyspace = name
+		ks.tables = append(ks.tables, table)
+		table = schemaTable{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, merry.Prependf(err, "reading tables of keyspace %s", name)
+	}
+	iter = c.session.Query(`SELECT view_name, base_table_name, include_all_columns, where_clause,
+		comment, default_time_to_live, gc_grace_seconds
+		FROM system_schema.views WHERE keyspace_name = ?`, name).Iter()
+	for iter.Scan(&table.name, &table.baseTable, &table.allColumns, &table.whereClause,
+		&table.comment, &table.ttl, &table.gcGrace) {
+		table.keyspace = name
+		ks.views = append(ks.views, table)
+		table = schemaTable{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, merry.Prependf(err, "reading views of keyspace %s", name)
+	}
+	for i := range ks.tables {
+		tables[ks.tables[i].name] = &ks.tables[i]
+	}
+	for i := range ks.views {
+		tables[ks.views[i].name] = &ks.views[i]
+	}
+
+	var column schemaColumn
+	var tableName string
+	iter = c.session.Query(`SELECT table_name, column_name, kind, clustering_order, position, type
+		FROM system_schema.columns WHERE keyspace_name = ?`, name).Iter()
+	for iter.Scan(&tableName, &column.name, &column.kind, &column.clusteringOrder,
+		&column.position, &column.cqlType) {
+		if t, found := tables[tableName]; found {
+			t.columns = append(t.columns, column)
+		}
+		column = schemaColumn{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, merry.Prependf(err, "reading columns of keyspace %s", name)
+	}
+
+	var index schemaIndex
+	var options map[string]string
+	iter = c.session.Query(`SELECT table_name, index_name, options FROM system_schema.indexes
+		WHERE keyspace_name = ?`, name).Iter()
+	for iter.Scan(&index.table, &index.name, &options) {
+		index.target = options["target"]
+		ks.indexes = append(ks.indexes, index)
+		index = schemaIndex{}
+		options = nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, merry.Prependf(err, "reading indexes of keyspace %s", name)
+	}
+
+	sort.Slice(ks.types, func(i, j int) bool { return ks.types[i].name < ks.types[j].name })
+	sort.Slice(ks.tables, func(i, j int) bool { return ks.tables[i].name < ks.tables[j].name })
+	sort.Slice(ks.views, func(i, j int) bool { return ks.views[i].name < ks.views[j].name })
+	sort.Slice(ks.indexes, func(i, j int) bool { return ks.indexes[i].name < ks.indexes[j].name })
+	return &ks, nil
+}
+
+// Keyspaces of tests, without system ones
+func (c *CQLConnection) userKeyspaces() ([]string, error) {
+	var keyspaces []string
+	var name string
+	iter := c.session.Query(`SELECT keyspace_name FROM system_schema.keyspaces`).Iter()
+	for iter.Scan(&name) {
+		if !strings.HasPrefix(name, "system") {
+			keyspaces = append(keyspaces, name)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, merry.Prepend(err, "reading keyspaces")
+	}
+	sort.Strings(keyspaces)
+	return keyspaces, nil
+}
+
+// The result of an emulated DESCRIBE, one CREATE statement per row,
+// printed as is
+func describeResult(statements []string) *CQLResult {
+	var result = CQLResult{
+		status:   "OK",
+		names:    []string{"create_statement"},
+		types:    []string{"text"},
+		verbatim: true,
+	}
+	for _, statement := range statements {
+		result.rows = append(result.rows, []string{statement})
+	}
+	return &result
+}
+
+func describeError(format string, args ...interface{}) *CQLResult {
+	return &CQLResult{
+		status:  "ERROR",
+		code:    CassandraErrorMap[0x2200],
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Emulate a DESCRIBE statement matched by describeRE
+func (c *CQLConnection) Describe(m []string, exchange *recordedExchange) (*CQLResult, error) {
+	var what = strings.ToUpper(m[1])
+	var keyspace, table = m[2], m[3]
+	if what == "TABLE" && table == "" {
+		keyspace, table = "", keyspace
+	}
+	if keyspace == "" {
+		keyspace = c.keyspace
+		if keyspace == "" {
+			keyspace = c.cluster.Keyspace
+		}
+	} else {
+		keyspace = unquoteName(keyspace)
+	}
+	table = unquoteName(table)
+	var keyspaces = []string{keyspace}
+	if what == "SCHEMA" && c.schemaKeyspace != "" {
+		keyspaces = []string{unquoteName(c.schemaKeyspace)}
+	} else if what == "SCHEMA" {
+		var err error
+		if keyspaces, err = c.userKeyspaces(); err != nil {
+			return nil, err
+		}
+	} else if keyspace == "" || (what == "TABLE" && table == "") {
+		return describeError("No keyspace specified and no current keyspace"), nil
+	}
+	var statements []string
+	for _, name := range keyspaces {
+		ks, err := c.readKeyspace(name)
+		if err != nil {
+			return nil, err
+		}
+		if ks == nil {
+			return describeError("Keyspace '%s' not found", name), nil
+		}
+		if what == "TABLE" {
+			var found bool
+			for i := range ks.tables {
+				found = found || ks.tables[i].name == table
+			}
+			if !found {
+				return describeError("Table '%s' not found in keyspace '%s'", table, name), nil
+			}
+			statements = append(statements, ks.createStatements(table)...)
+		} else {
+			statements = append(statements, ks.createStatements("")...)
+		}
+	}
+	if exchange != nil {
+		var columns = []gocql.ColumnInfo{{
+			Name:     "create_statement",
+			TypeInfo: gocql.NewNativeType(4, gocql.TypeVarchar, ""),
+		}}
+		exchange.SetColumns(columns)
+		for _, statement := range statements {
+			if err := exchange.AddRow(columns, []interface{}{statement}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return describeResult(statements), nil
+}
+
+// Schema objects which tests may create: keyspaces, tables, views
+// and types, e.g. "table yacht.t", of the keyspace, or of every
+// keyspace other than system ones if it's empty, sorted
+func schemaSnapshot(c Connection, keyspace string) ([]string, error) {
+	var objects = []string{}
+	for _, object := range []struct{ kind, query string }{
+		{"keyspace", "SELECT keyspace_name FROM system_schema.keyspaces"},
+		{"table", "SELECT keyspace_name, table_name FROM system_schema.tables"},
+		{"view", "SELECT keyspace_name, view_name FROM system_schema.views"},
+		{"type", "SELECT keyspace_name, type_name FROM system_schema.types"},
+	} {
+		result, err := c.Execute(object.query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if result.status != "OK" {
+			return nil, merry.Errorf("%s: %s", object.query, result.message)
+		}
+		for _, row := range result.rows {
+			if strings.HasPrefix(row[0], "system") || (keyspace != "" && row[0] != keyspace) {
+				continue
+			}
+			objects = append(objects, object.kind+" "+strings.Join(row, "."))
+		}
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
+
+// Describe how the schema changed from one snapshot to another, e.g.
+// "created table yacht.t"
+func schemaChanges(before []string, after []string) []string {
+	var changes []string
+	var existed = make(map[string]bool)
+	for _, object := range before {
+		existed[object] = true
+	}
+	for _, object := range after {
+		if existed[object] {
+			delete(existed, object)
+		} else {
+			changes = append(changes, "created "+object)
+		}
+	}
+	for _, object := range before {
+		if existed[object] {
+			changes = append(changes, "dropped "+object)
+		}
+	}
+	return changes
+}
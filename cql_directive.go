@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+)
+
+// A directive is a special comment in a test file, which instructs
+// the harness to do something besides sending the statement to the
+// server, e.g. check the result of the previous statement:
+//
+//	-- assert: rows 3
+//
+// A directive which returns an error fails the test.
+type cqlDirective func(run *cqlTestRun, stmt *cqlStatement) error
+
+var cqlDirectives map[string]cqlDirective
+
+func init() {
+	cqlDirectives = map[string]cqlDirective{
+		"assert":           assertDirective,
+		"sleep":            sleepDirective,
+		"wait-for":         waitForDirective,
+		"shell":            shellDirective,
+		"source":           sourceDirective,
+		"bind":             bindDirective,
+		"payload":          payloadDirective,
+		"repeat":           repeatDirective,
+		"applied":          appliedDirective,
+		"cdc-enable":       cdcEnableDirective,
+		"cdc-log":          cdcLogDirective,
+		"wait-for-view":    waitForViewDirective,
+		"check-view":       checkViewDirective,
+		"wait-for-index":   waitForIndexDirective,
+		"advance-time":     advanceTimeDirective,
+		"generate":         generateDirective,
+		"concurrent":       concurrentDirective,
+		"retry-transient":  retryTransientDirective,
+		"echo":             echoDirective,
+		"digest":           digestDirective,
+		"result-per-mode":  resultPerModeDirective,
+		"max-latency":      maxLatencyDirective,
+		"end":              endDirective,
+		"description":      metadataDirective,
+		"author":           metadataDirective,
+		"tags":             metadataDirective,
+		"issue":            metadataDirective,
+		"requires-feature": metadataDirective,
+		"mock":             mockDirective,
+		"replace-node":     replaceNodeDirective,
+		"pause-node":       pauseNodeDirective,
+		"resume-node":      pauseNodeDirective,
+		"wait-for-hints":   waitForHintsDirective,
+		"consistency":      consistencyDirective,
+		"column-types":     columnTypesDirective,
+		"any-column-order": anyColumnOrderDirective,
+		"float-tolerance":  floatToleranceDirective,
+		"mask-rows":        maskRowsDirective,
+		"attempts":         attemptsDirective,
+		"expect-warning":   expectWarningDirective,
+		"cleanup":          cleanupDirective,
+		"permissions":      permissionsDirective,
+		"shell-output": func(run *cqlTestRun, stmt *cqlStatement) error {
+			return runShell(run, stmt.text, true)
+		},
+	}
+}
+
+// Strip matching single or double quotes around a directive argument
+func unquote(arg string) string {
+	arg = strings.TrimSpace(arg)
+	if len(arg) >= 2 && (arg[0] == '\'' || arg[0] == '"') && arg[len(arg)-1] == arg[0] {
+		return arg[1 : len(arg)-1]
+	}
+	return arg
+}
+
+// Check the result of the previous statement:
+//
+//	-- assert: rows <count>
+//	-- assert: contains '<text>'
+func assertDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	if run.last == nil {
+		return merry.New("assert: no statement to check")
+	}
+	args := strings.SplitN(stmt.text, " ", 2)
+	if len(args) != 2 {
+		return merry.Errorf("assert: malformed assertion '%s'", stmt.text)
+	}
+	switch args[0] {
+	case "rows":
+		rows, err := strconv.Atoi(strings.TrimSpace(args[1]))
+		if err != nil {
+			return merry.Errorf("assert: malformed row count '%s'", args[1])
+		}
+		if len(run.lastResult.rows) != rows {
+			return merry.Errorf("assert rows %d failed for statement at %s: got %d rows",
+				rows, run.last.Location(), len(run.lastResult.rows))
+		}
+	case "contains":
+		text := unquote(args[1])
+		if strings.Contains(run.lastResult.String(), text) == false {
+			return merry.Errorf("assert contains '%s' failed for statement at %s",
+				text, run.last.Location())
+		}
+	default:
+		return merry.Errorf("assert: unknown assertion '%s'", args[0])
+	}
+	return nil
+}
+
+// Check that the server returned a warning matching the regular
+// expression for the previous statement. The warning is matched as
+// printed in the output, with node addresses masked as <host>:
+//
+//	-- expect-warning: <regex>
+func expectWarningDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	re, err := regexp.Compile(stmt.text)
+	if err != nil {
+		return merry.Prepend(err, "expect-warning")
+	}
+	if run.last == nil {
+		return merry.New("expect-warning: no statement to check")
+	}
+	var warnings = normalizeWarnings(run.lastResult.warnings)
+	for _, warning := range warnings {
+		if re.MatchString(warning) {
+			return nil
+		}
+	}
+	if len(warnings) == 0 {
+		return merry.Errorf("expect-warning '%s' failed for statement at %s: no warnings",
+			stmt.text, run.last.Location())
+	}
+	return merry.Errorf("expect-warning '%s' failed for statement at %s: got %s",
+		stmt.text, run.last.Location(), strings.Join(warnings, "; "))
+}
+
+// Begin the cleanup section of the test, which lasts till the end of
+// the file, and runs even if the test stops before it:
+//
+//	-- cleanup:
+func cleanupDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	if stmt.text != "" {
+		return merry.Errorf("cleanup: unexpected arguments '%s'", stmt.text)
+	}
+	if run.inCleanup {
+		return merry.New("cleanup: the test has a cleanup section already")
+	}
+	run.inCleanup = true
+	return nil
+}
+
+// Check that the previous conditional statement was applied, or not:
+//
+//	-- applied: true|false
+func appliedDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	expected, err := strconv.ParseBool(stmt.text)
+	if err != nil {
+		return merry.Errorf("applied: expected true or false, got '%s'", stmt.text)
+	}
+	if run.last == nil {
+		return merry.New("applied: no statement to check")
+	}
+	var result = run.lastResult
+	if result.status != "OK" {
+		return merry.Errorf("applied %v failed for statement at %s: %s",
+			expected, run.last.Location(), result.message)
+	}
+	if len(result.names) == 0 || result.names[0] != "[applied]" || len(result.rows) == 0 {
+		return merry.Errorf("applied: statement at %s is not conditional",
+			run.last.Location())
+	}
+	for _, row := range result.rows {
+		if row[0] != strconv.FormatBool(expected) {
+			return merry.Errorf("applied %v failed for statement at %s: got %s",
+				expected, run.last.Location(), row[0])
+		}
+	}
+	return nil
+}
+
+// Control what is recorded in the test output, e.g. to keep a noisy
+// setup section out of it:
+//
+//	-- echo: off|statements|on
+//
+// off records neither statements nor their results, statements
+// records statements but not results, on records both, which is the
+// default. Applies to the following statements of the test.
+func echoDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	switch stmt.text {
+	case "off":
+		run.scanner.quiet, run.quietResults = true, true
+	case "statements":
+		run.scanner.quiet, run.quietResults = false, true
+	case "on":
+		run.scanner.quiet, run.quietResults = false, false
+	default:
+		return merry.Errorf("echo: expected off, statements or on, got '%s'", stmt.text)
+	}
+	return nil
+}
+
+// Print column types under column names in result tables for the
+// rest of the test, or don't, regardless of the suite format:
+//
+//	-- column-types: on|off
+func columnTypesDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	var on bool
+	switch stmt.text {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return merry.Errorf("column-types: expected on or off, got '%s'", stmt.text)
+	}
+	run.columnTypes = &on
+	return nil
+}
+
+// Compare result tables of the rest of the test by column name
+// rather than position, or don't, regardless of the suite format:
+//
+//	-- any-column-order: on|off
+func anyColumnOrderDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	var on bool
+	switch stmt.text {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return merry.Errorf("any-column-order: expected on or off, got '%s'", stmt.text)
+	}
+	run.anyColumnOrder = &on
+	return nil
+}
+
+// Compare numbers in results of the rest of the test with the result
+// file within the tolerance rather than as text, so that e.g. sums of
+// doubles don't differ from platform to platform, 0 to stop:
+//
+//	-- float-tolerance: 1e-9
+func floatToleranceDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	tolerance, err := strconv.ParseFloat(stmt.text, 64)
+	if err != nil || tolerance < 0 {
+		return merry.Errorf("float-tolerance: malformed tolerance '%s'", stmt.text)
+	}
+	run.floatTolerance = tolerance
+	return nil
+}
+
+// Print the number of times the driver sent each statement of the
+// rest of the test, counting retries and speculative executions, see
+// retry_policy and speculative_attempts driver settings:
+//
+//	-- attempts: on|off
+func attemptsDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	switch stmt.text {
+	case "on":
+		run.showAttempts = true
+	case "off":
+		run.showAttempts = false
+	default:
+		return merry.Errorf("attempts: expected on or off, got '%s'", stmt.text)
+	}
+	return nil
+}
+
+// Pause the test:
+//
+//	-- sleep: <duration>
+func sleepDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	duration, err := time.ParseDuration(stmt.text)
+	if err != nil {
+		return merry.Prepend(err, "sleep")
+	}
+	time.Sleep(duration)
+	return nil
+}
+
+// cql statement; expected output [timeout duration]
+var waitForRE = regexp.MustCompile(`^(.*;)\s*(.*?)(\s+timeout\s+(\S+))?$`)
+
+// Poll a query until its output contains the expected text:
+//
+//	-- wait-for: <cql>; '<expected>' [timeout <duration>]
+//
+// The default timeout is 10 seconds. The query output is not
+// recorded in the test output.
+func waitForDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	m := waitForRE.FindStringSubmatch(stmt.text)
+	if m == nil || m[2] == "" {
+		return merry.Errorf("wait-for: malformed arguments '%s'", stmt.text)
+	}
+	var cql, expected = m[1], unquote(m[2])
+	var timeout = 10 * time.Second
+	if m[4] != "" {
+		var err error
+		if timeout, err = time.ParseDuration(m[4]); err != nil {
+			return merry.Prepend(err, "wait-for")
+		}
+	}
+	start := time.Now()
+	for {
+		result, err := run.c.Execute(cql, &QueryOptions{format: run.test.format})
+		if err != nil {
+			return merry.Prepend(err, "wait-for")
+		}
+		if strings.Contains(result.String(), expected) {
+			return nil
+		}
+		if time.Now().Sub(start) > timeout {
+			return merry.Errorf("wait-for: '%s' not found in output of '%s' after %v",
+				expected, cql, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Run a command in the lane directory:
+//
+//	-- shell: <command>
+//	-- shell-output: <command>
+//
+// The command environment describes the lane and the server, see
+// Lane.Environment() and Server.Environment(). shell-output records
+// the normalized standard output of the command in the test output.
+// A non-zero exit status fails the test.
+func shellDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	return runShell(run, stmt.text, false)
+}
+
+func runShell(run *cqlTestRun, command string, capture bool) error {
+	if command == "" {
+		return merry.New("shell: no command")
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = run.lane.Dir()
+	cmd.Env = append(os.Environ(), run.Environment()...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return merry.Errorf("shell '%s' failed: %v: %.80s", command, err,
+			strings.TrimSpace(stderr.String()))
+	}
+	if capture {
+		fmt.Fprint(run.output, normalizeShellOutput(string(out), run.lane.Dir()))
+	}
+	return nil
+}
+
+// Make command output independent of the lane location and
+// indent it like a statement result
+func normalizeShellOutput(out string, lanedir string) string {
+	out = strings.Replace(out, lanedir, "$YACHT_LANE_DIR", -1)
+	buf := new(bytes.Buffer)
+	for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+		fmt.Fprintf(buf, "  %s\n", strings.TrimRight(line, " \t"))
+	}
+	return buf.String()
+}
+
+// Read statements from another file, relative to the suite
+// directory, as if they were a part of the test file:
+//
+//	-- source: <file>
+func sourceDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	file := unquote(stmt.text)
+	if file == "" {
+		return merry.New("source: no file name")
+	}
+	if filepath.IsAbs(file) == false {
+		file = filepath.Join(filepath.Dir(run.test.path), file)
+	}
+	return run.scanner.Include(filepath.Clean(file))
+}
+
+// Split a comma-separated argument list, respecting quotes
+func splitArgs(args string) []string {
+	var res []string
+	var quote rune
+	var start int
+	for i, c := range args {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ',':
+			res = append(res, strings.TrimSpace(args[start:i]))
+			start = i + 1
+		}
+	}
+	if strings.TrimSpace(args) != "" {
+		res = append(res, strings.TrimSpace(args[start:]))
+	}
+	return res
+}
+
+// Convert a bind value literal to a value gocql can marshal
+func parseBindValue(arg string) interface{} {
+	switch strings.ToLower(arg) {
+	case "unset":
+		return gocql.UnsetValue
+	case "null":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if unquoted := unquote(arg); unquoted != arg {
+		return unquoted
+	}
+	if i, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(arg, 64); err == nil {
+		return f
+	}
+	return arg
+}
+
+// Set values of bind markers of the next statement:
+//
+//	-- bind: 1, 'text', null, unset
+//
+// unset sends an UNSET value, which leaves the column intact.
+func bindDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	run.next.values = nil
+	for _, arg := range splitArgs(stmt.text) {
+		run.next.values = append(run.next.values, parseBindValue(arg))
+	}
+	return nil
+}
+
+// Run the test the given number of times in a row against the same
+// server. The directive is read before the test starts, see
+// CQLTestFile.Repeat(), here it's only checked.
+//
+//	-- repeat: <count>
+func repeatDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	if n, err := strconv.Atoi(stmt.text); err != nil || n <= 0 {
+		return merry.Errorf("repeat: malformed count '%s'", stmt.text)
+	}
+	return nil
+}
+
+// Test header directives, see TestMetadata, are read before the test
+// runs
+func metadataDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	if stmt.text == "" {
+		return merry.Errorf("%s: missing value", stmt.directive)
+	}
+	return nil
+}
+
+// Register a canned response of the mock server for the rest of
+// the test, the response is in JSON with the fields of MockResponse:
+//
+//	-- mock: select \* from t => {"columns": ["a"], "rows": [["1"]]}
+//
+// Ignored in other modes, so that a test prototyped against the mock
+// server runs against Scylla as is.
+func mockDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	args := strings.SplitN(stmt.text, "=>", 2)
+	if len(args) != 2 {
+		return merry.Errorf("mock: malformed response '%s'", stmt.text)
+	}
+	var response MockResponse
+	if err := json.Unmarshal([]byte(args[1]), &response); err != nil {
+		return merry.Prependf(err, "mock: malformed response '%s'", args[1])
+	}
+	response.Query = strings.TrimSpace(args[0])
+	if err := response.Compile(); err != nil {
+		return merry.Prepend(err, "mock")
+	}
+	if server, ok := run.server.(*mockServer); ok {
+		server.Register(response)
+	}
+	return nil
+}
+
+// Retry statements failed with a transient error, such as a timeout,
+// an overloaded server or a lost connection, instead of failing the
+// test or aborting the suite:
+//
+//	-- retry-transient: <count> [delay <duration>]
+//
+// Applies to all following statements of the test. The delay before
+// the first retry is 100ms by default and doubles with every retry.
+// Retries are not recorded in the test output. Use 0 to stop retrying.
+func retryTransientDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	args := strings.Fields(stmt.text)
+	if len(args) != 1 && (len(args) != 3 || args[1] != "delay") {
+		return merry.Errorf("retry-transient: malformed arguments '%s'", stmt.text)
+	}
+	retries, err := strconv.Atoi(args[0])
+	if err != nil || retries < 0 {
+		return merry.Errorf("retry-transient: malformed count '%s'", args[0])
+	}
+	var delay = 100 * time.Millisecond
+	if len(args) == 3 {
+		if delay, err = time.ParseDuration(args[2]); err != nil {
+			return merry.Prepend(err, "retry-transient")
+		}
+	}
+	run.retries = retries
+	run.retryDelay = delay
+	return nil
+}
+
+// Compare the output of the test by its SHA-256 digest, stored in
+// the result file instead of the output, for tests with large but
+// deterministic outputs. The directive is read before the test
+// starts, see CQLTestFile.Digest(), here it's only checked.
+//
+//	-- digest:
+func digestDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	if stmt.text != "" {
+		return merry.Errorf("digest: unexpected arguments '%s'", stmt.text)
+	}
+	return nil
+}
+
+// Keep a result file per mode, e.g. foo.result.cluster, even where
+// the output is the same as in other modes. The directive is read
+// before the test starts, see CQLTestFile.ResultPerMode(), here it's
+// only checked.
+//
+//	-- result-per-mode:
+func resultPerModeDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	if stmt.text != "" {
+		return merry.Errorf("result-per-mode: unexpected arguments '%s'", stmt.text)
+	}
+	return nil
+}
+
+// Set the consistency level of the next statement:
+//
+//	-- consistency: <level>
+//
+// e.g. ONE, ANY or QUORUM. The following statements use the driver
+// default again.
+func consistencyDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	consistency, err := gocql.ParseConsistencyWrapper(strings.ToUpper(strings.TrimSpace(stmt.text)))
+	if err != nil {
+		return merry.Prepend(err, "consistency")
+	}
+	run.next.consistency = &consistency
+	return nil
+}
+
+// Send a custom payload with the next statement:
+//
+//	-- payload: key=value [key=value ...]
+func payloadDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	run.next.payload = make(map[string][]byte)
+	for _, pair := range strings.Fields(stmt.text) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return merry.Errorf("payload: malformed key=value pair '%s'", pair)
+		}
+		run.next.payload[kv[0]] = []byte(unquote(kv[1]))
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+	"github.com/pierrec/lz4/v4"
+)
+
+// gocql driver settings. Can be set in .yacht.yaml (applies to all
+// suites) and in suite.yaml (overrides .yacht.yaml for the suite).
+// Zero values mean "use the driver default".
+type DriverConfig struct {
+	// CQL native protocol version, e.g. 3 or 4
+	ProtocolVersion int `mapstructure:"protocol_version"`
+	// Request protocol version 5, which is beta in the driver.
+	// gocql sets the beta flag in every frame of v5 sessions.
+	BetaProtocol bool `mapstructure:"beta_protocol"`
+	// Frame compression: none, snappy or lz4
+	Compression string
+	// Query timeout, e.g. 30s
+	Timeout string
+	// Initial connection (dial) timeout, e.g. 5s
+	ConnectTimeout string `mapstructure:"connect_timeout"`
+	// Number of connections per host
+	NumConns int `mapstructure:"num_conns"`
+	// Retry policy: none, simple or exponential
+	RetryPolicy string `mapstructure:"retry_policy"`
+	// Number of retries for simple and exponential retry policies
+	Retries int
+	// Host selection policy: round-robin, token-aware, dc-aware or
+	// single-host, see hostSelectionPolicies
+	HostSelection string `mapstructure:"host_selection"`
+	// The local data center of dc-aware host selection
+	LocalDC string `mapstructure:"local_dc"`
+	// Executions of a statement the driver starts in addition to
+	// the first one, each after the delay, e.g. 100ms, if no
+	// response has arrived yet. Statements are then marked
+	// idempotent, which the driver requires to speculate.
+	SpeculativeAttempts int    `mapstructure:"speculative_attempts"`
+	SpeculativeDelay    string `mapstructure:"speculative_delay"`
+}
+
+// The delay of speculative executions if none is set
+const DEFAULT_SPECULATIVE_DELAY = 100 * time.Millisecond
+
+// Host selection policies, which decide the coordinator of each
+// statement
+var hostSelectionPolicies = []string{"round-robin", "token-aware", "dc-aware", "single-host"}
+
+// Driver settings of a mode in suite.yaml, e.g. host_selection:
+// token-aware next to type: cluster, which override the suite and
+// .yacht.yaml ones
+func modeDriver(mode map[string]string) (DriverConfig, error) {
+	var cfg = DriverConfig{
+		HostSelection:    mode["host_selection"],
+		LocalDC:          mode["local_dc"],
+		RetryPolicy:      mode["retry_policy"],
+		SpeculativeDelay: mode["speculative_delay"],
+	}
+	for key, value := range map[string]*int{
+		"retries":              &cfg.Retries,
+		"speculative_attempts": &cfg.SpeculativeAttempts,
+	} {
+		if s, found := mode[key]; found {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return cfg, merry.Errorf("malformed %s '%s'", key, s)
+			}
+			*value = n
+		}
+	}
+	return cfg, nil
+}
+
+// Return a copy of the configuration with all non-zero settings
+// of override applied on top of it.
+func (cfg DriverConfig) Merge(override DriverConfig) DriverConfig {
+	if override.ProtocolVersion != 0 {
+		cfg.ProtocolVersion = override.ProtocolVersion
+	}
+	if override.BetaProtocol {
+		cfg.BetaProtocol = true
+	}
+	if override.Compression != "" {
+		cfg.Compression = override.Compression
+	}
+	if override.Timeout != "" {
+		cfg.Timeout = override.Timeout
+	}
+	if override.ConnectTimeout != "" {
+		cfg.ConnectTimeout = override.ConnectTimeout
+	}
+	if override.NumConns != 0 {
+		cfg.NumConns = override.NumConns
+	}
+	if override.RetryPolicy != "" {
+		cfg.RetryPolicy = override.RetryPolicy
+	}
+	if override.Retries != 0 {
+		cfg.Retries = override.Retries
+	}
+	if override.HostSelection != "" {
+		cfg.HostSelection = override.HostSelection
+	}
+	if override.LocalDC != "" {
+		cfg.LocalDC = override.LocalDC
+	}
+	if override.SpeculativeAttempts != 0 {
+		cfg.SpeculativeAttempts = override.SpeculativeAttempts
+	}
+	if override.SpeculativeDelay != "" {
+		cfg.SpeculativeDelay = override.SpeculativeDelay
+	}
+	return cfg
+}
+
+// Set up a cluster configuration according to the driver settings
+func (cfg *DriverConfig) Apply(cluster *gocql.ClusterConfig) error {
+	var err error
+	if cfg.ProtocolVersion != 0 {
+		cluster.ProtoVersion = cfg.ProtocolVersion
+	}
+	if cfg.BetaProtocol {
+		if cfg.ProtocolVersion != 0 && cfg.ProtocolVersion != 5 {
+			return merry.Errorf("beta_protocol requires protocol version 5, not %d",
+				cfg.ProtocolVersion)
+		}
+		cluster.ProtoVersion = 5
+	}
+	switch strings.ToLower(cfg.Compression) {
+	case "", "none":
+	case "snappy":
+		cluster.Compressor = &gocql.SnappyCompressor{}
+	case "lz4":
+		cluster.Compressor = &lz4Compressor{}
+	default:
+		return merry.Errorf("unsupported driver compression '%s'", cfg.Compression)
+	}
+	if cfg.Timeout != "" {
+		if cluster.Timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return merry.Prepend(err, "driver timeout")
+		}
+	}
+	if cfg.ConnectTimeout != "" {
+		if cluster.ConnectTimeout, err = time.ParseDuration(cfg.ConnectTimeout); err != nil {
+			return merry.Prepend(err, "driver connect_timeout")
+		}
+	}
+	if cfg.NumConns != 0 {
+		cluster.NumConns = cfg.NumConns
+	}
+	switch strings.ToLower(cfg.RetryPolicy) {
+	case "":
+	case "none":
+		cluster.RetryPolicy = nil
+	case "simple":
+		cluster.RetryPolicy = &gocql.SimpleRetryPolicy{NumRetries: cfg.Retries}
+	case "exponential":
+		cluster.RetryPolicy = &gocql.ExponentialBackoffRetryPolicy{
+			NumRetries: cfg.Retries,
+			Min:        100 * time.Millisecond,
+			Max:        10 * time.Second,
+		}
+	default:
+		return merry.Errorf("unknown driver retry policy '%s'", cfg.RetryPolicy)
+	}
+	if cfg.SpeculativeDelay != "" {
+		if delay, err := time.ParseDuration(cfg.SpeculativeDelay); err != nil || delay <= 0 {
+			return merry.Errorf("malformed driver speculative_delay '%s'", cfg.SpeculativeDelay)
+		}
+	}
+	return cfg.applyHostSelection(cluster)
+}
+
+// The speculative execution policy of every statement, nil for none.
+// The driver has no cluster-wide setting for it.
+func (cfg *DriverConfig) Speculative() gocql.SpeculativeExecutionPolicy {
+	if cfg.SpeculativeAttempts <= 0 {
+		return nil
+	}
+	var delay = DEFAULT_SPECULATIVE_DELAY
+	if d, err := time.ParseDuration(cfg.SpeculativeDelay); err == nil && d > 0 {
+		delay = d
+	}
+	return &gocql.SimpleSpeculativeExecution{NumAttempts: cfg.SpeculativeAttempts,
+		TimeoutDelay: delay}
+}
+
+func (cfg *DriverConfig) applyHostSelection(cluster *gocql.ClusterConfig) error {
+	if cfg.LocalDC != "" && cfg.HostSelection == "" {
+		return merry.Errorf("driver local_dc requires dc-aware or token-aware host selection")
+	}
+	switch strings.ToLower(cfg.HostSelection) {
+	case "":
+	case "round-robin":
+		cluster.PoolConfig.HostSelectionPolicy = gocql.RoundRobinHostPolicy()
+	case "token-aware":
+		// Replicas in the local data center first, if it is set
+		var fallback = gocql.RoundRobinHostPolicy()
+		if cfg.LocalDC != "" {
+			fallback = gocql.DCAwareRoundRobinPolicy(cfg.LocalDC)
+		}
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(fallback)
+	case "dc-aware":
+		if cfg.LocalDC == "" {
+			return merry.Errorf("driver host_selection dc-aware requires local_dc")
+		}
+		cluster.PoolConfig.HostSelectionPolicy = gocql.DCAwareRoundRobinPolicy(cfg.LocalDC)
+	case "single-host":
+		// Every statement is coordinated by the first contact
+		// point, other nodes are not connected to
+		if len(cluster.Hosts) == 0 {
+			return merry.Errorf("driver host_selection single-host requires a host")
+		}
+		host := cluster.Hosts[0]
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return merry.Prepend(err, "driver host_selection single-host")
+		}
+		var accept = make(map[string]bool)
+		for _, addr := range addrs {
+			accept[net.ParseIP(addr).String()] = true
+		}
+		cluster.HostFilter = gocql.HostFilterFunc(func(host *gocql.HostInfo) bool {
+			return accept[host.ConnectAddress().String()]
+		})
+	default:
+		return merry.Errorf("unknown driver host_selection '%s', must be one of %s",
+			cfg.HostSelection, strings.Join(hostSelectionPolicies, ", "))
+	}
+	return nil
+}
+
+// LZ4 frame compression, as in gocql's lz4 package, which the driver
+// version yacht is built with predates: the frame body is the size
+// of the uncompressed data, 4 bytes big endian, and an LZ4 block
+type lz4Compressor struct{}
+
+func (c *lz4Compressor) Name() string {
+	return "lz4"
+}
+
+func (c *lz4Compressor) Encode(data []byte) ([]byte, error) {
+	var buf = make([]byte, 4+lz4.CompressBlockBound(len(data)))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	// Never fails with a buffer of the bound size
+	n, err := lz4.CompressBlock(data, buf[4:], nil)
+	if err != nil {
+		return nil, merry.Prepend(err, "lz4")
+	}
+	return buf[:4+n], nil
+}
+
+func (c *lz4Compressor) Decode(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, merry.Errorf("lz4: truncated frame of %d bytes", len(data))
+	}
+	var buf = make([]byte, binary.BigEndian.Uint32(data))
+	if len(buf) == 0 {
+		return buf, nil
+	}
+	n, err := lz4.UncompressBlock(data[4:], buf)
+	if err != nil {
+		return nil, merry.Prepend(err, "lz4")
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+	"github.com/mattn/go-runewidth"
+)
+
+func init() {
+	// Column widths of result tables depend on the display width of
+	// values, which must not depend on the locale or the platform,
+	// or result files with non-ASCII data would differ between hosts.
+	// Count ambiguous width characters as narrow, and emoji sequences
+	// joined with ZWJ as one character.
+	runewidth.DefaultCondition.EastAsianWidth = false
+	runewidth.DefaultCondition.ZeroWidthJoiner = true
+}
+
+// Result formatting settings, set in 'format' section of suite.yaml.
+// Zero values keep the default formatting.
+type FormatConfig struct {
+	// How to print NULL values. By default a NULL is printed as
+	// the zero value of the column type, e.g. 0 or an empty string.
+	Null string
+	// Print blobs in hex, truncated to this many bytes
+	BlobWidth int `mapstructure:"blob_width"`
+	// Time zone to print timestamps in, e.g. UTC
+	Timezone string
+	// Timestamp precision: s, ms, us or ns
+	TimestampPrecision string `mapstructure:"timestamp_precision"`
+	// Number of digits after the decimal point of floats and doubles
+	FloatPrecision *int `mapstructure:"float_precision"`
+	// How to print rows: table (default) or json, which prints every
+	// row as a JSON object with sorted keys
+	Rows string
+	// Prefix each statement and its result with the statement
+	// sequence number in the test
+	StatementIds bool `mapstructure:"statement_ids"`
+	// Only print [applied] column of results of conditional
+	// statements, and not the current values of the row
+	AppliedOnly bool `mapstructure:"applied_only"`
+	// How to echo statements: all (default) echoes statement text,
+	// ids only statement sequence numbers
+	Echo string
+	// Truncate values in result tables wider than this many
+	// characters, counting wide characters, e.g. CJK and emoji, as
+	// two, and end them with "...". Also the width at which values
+	// are wrapped, 30 by default.
+	MaxColumnWidth int `mapstructure:"max_column_width"`
+	// Print the CQL type of each column under its name in the table
+	// header, so that changes of result types show in result files
+	ColumnTypes bool `mapstructure:"column_types"`
+	// Compare result tables by column name rather than position:
+	// the columns of a result are printed in the order of the table
+	// in the result file, if it has the same columns
+	AnyColumnOrder bool `mapstructure:"any_column_order"`
+
+	location *time.Location
+	layout   string
+}
+
+var timestampPrecisionLayouts = map[string]string{
+	"s":  "",
+	"ms": ".000",
+	"us": ".000000",
+	"ns": ".000000000",
+}
+
+// Check the settings and prepare them for use
+func (format *FormatConfig) Init() error {
+	if format.Timezone != "" {
+		var err error
+		if format.location, err = time.LoadLocation(format.Timezone); err != nil {
+			return merry.Prepend(err, "format timezone")
+		}
+	}
+	if format.Timezone != "" || format.TimestampPrecision != "" {
+		var precision = format.TimestampPrecision
+		if precision == "" {
+			precision = "ms"
+		}
+		fraction, found := timestampPrecisionLayouts[precision]
+		if found == false {
+			return merry.Errorf("unknown format timestamp_precision '%s'", precision)
+		}
+		format.layout = "2006-01-02 15:04:05" + fraction + " -0700 MST"
+	}
+	switch format.Rows {
+	case "", "table", "json":
+	default:
+		return merry.Errorf("unknown format rows '%s'", format.Rows)
+	}
+	switch format.Echo {
+	case "", "all", "ids":
+	default:
+		return merry.Errorf("unknown format echo '%s'", format.Echo)
+	}
+	if format.BlobWidth < 0 {
+		return merry.Errorf("negative format blob_width %d", format.BlobWidth)
+	}
+	if format.MaxColumnWidth != 0 && format.MaxColumnWidth <= len(TRUNCATION_MARKER) {
+		return merry.Errorf("format max_column_width %d is too small, must be larger than %d",
+			format.MaxColumnWidth, len(TRUNCATION_MARKER))
+	}
+	return nil
+}
+
+const TRUNCATION_MARKER = "..."
+
+// Truncate each line of a value to the maximal column width. A wide
+// character which doesn't fit is dropped entirely.
+func (format *FormatConfig) Truncate(value string) string {
+	if format == nil || format.MaxColumnWidth == 0 ||
+		runewidth.StringWidth(value) <= format.MaxColumnWidth {
+		return value
+	}
+	var lines = strings.Split(value, "\n")
+	for i, line := range lines {
+		lines[i] = runewidth.Truncate(line, format.MaxColumnWidth, TRUNCATION_MARKER)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The CQL name of a type, e.g. map<text, int>. User defined types are
+// printed without the keyspace, which may vary.
+func cqlTypeName(info gocql.TypeInfo) string {
+	switch t := info.(type) {
+	case gocql.CollectionType:
+		switch t.Type() {
+		case gocql.TypeMap:
+			return "map<" + cqlTypeName(t.Key) + ", " + cqlTypeName(t.Elem) + ">"
+		case gocql.TypeList:
+			return "list<" + cqlTypeName(t.Elem) + ">"
+		case gocql.TypeSet:
+			return "set<" + cqlTypeName(t.Elem) + ">"
+		}
+	case gocql.TupleTypeInfo:
+		var elems []string
+		for _, elem := range t.Elems {
+			elems = append(elems, cqlTypeName(elem))
+		}
+		return "tuple<" + strings.Join(elems, ", ") + ">"
+	case gocql.UDTTypeInfo:
+		return t.Name
+	case gocql.NativeType:
+		if t.Type() == gocql.TypeCustom {
+			return t.Custom()
+		}
+	}
+	return info.Type().String()
+}
+
+func (format *FormatConfig) NullString() string {
+	if format == nil || format.Null == "" {
+		return "null"
+	}
+	return format.Null
+}
+
+// Whether NULLs must be told apart from zero values
+func (format *FormatConfig) DetectNulls() bool {
+	return format != nil && (format.Null != "" || format.JSON())
+}
+
+func (format *FormatConfig) JSON() bool {
+	return format != nil && format.Rows == "json"
+}
+
+// Convert a value of the given CQL type to a value which marshals to
+// canonical JSON: numbers and booleans as such, collections as arrays
+// and objects, everything else as strings
+func jsonValue(info gocql.TypeInfo, iface interface{}, format *FormatConfig) interface{} {
+	v := reflect.ValueOf(iface)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.IsValid() == false {
+		return nil
+	}
+	switch t := info.(type) {
+	case gocql.CollectionType:
+		switch t.Type() {
+		case gocql.TypeList, gocql.TypeSet:
+			var items = make([]interface{}, v.Len())
+			for i := range items {
+				items[i] = jsonValue(t.Elem, v.Index(i).Interface(), format)
+			}
+			if t.Type() == gocql.TypeSet {
+				sort.Slice(items, func(i, j int) bool {
+					a, _ := json.Marshal(items[i])
+					b, _ := json.Marshal(items[j])
+					return string(a) < string(b)
+				})
+			}
+			return items
+		case gocql.TypeMap:
+			// JSON object keys are strings, encoding/json sorts them
+			var items = make(map[string]interface{})
+			for _, key := range v.MapKeys() {
+				items[prettyPrintCQL(t.Key, key.Interface(), format)] =
+					jsonValue(t.Elem, v.MapIndex(key).Interface(), format)
+			}
+			return items
+		}
+	case gocql.TupleTypeInfo:
+		var items []interface{}
+		for i, elem := range t.Elems {
+			if i < v.Len() {
+				items = append(items, jsonValue(elem, v.Index(i).Interface(), format))
+			}
+		}
+		return items
+	case gocql.UDTTypeInfo:
+		var items = make(map[string]interface{})
+		for _, field := range t.Elements {
+			var value interface{}
+			if fv := v.MapIndex(reflect.ValueOf(field.Name)); fv.IsValid() {
+				value = fv.Interface()
+			}
+			items[field.Name] = jsonValue(field.Type, value, format)
+		}
+		return items
+	}
+	switch info.Type() {
+	case gocql.TypeInt, gocql.TypeBigInt, gocql.TypeCounter, gocql.TypeSmallInt,
+		gocql.TypeTinyInt, gocql.TypeBoolean:
+		return v.Interface()
+	case gocql.TypeFloat, gocql.TypeDouble:
+		// JSON has no NaN and infinity, print them as strings
+		if f := v.Float(); format.FloatPrecision == nil &&
+			math.IsNaN(f) == false && math.IsInf(f, 0) == false {
+			return v.Interface()
+		}
+	}
+	return prettyPrintCQL(info, v.Interface(), format)
+}
+
+// Format a scalar value according to the settings. Return false if
+// the value should be printed the default way.
+func (format *FormatConfig) Scalar(info gocql.TypeInfo, v reflect.Value) (string, bool) {
+	if format == nil {
+		return "", false
+	}
+	switch info.Type() {
+	case gocql.TypeBlob:
+		if format.BlobWidth > 0 && v.Kind() == reflect.Slice {
+			b := v.Bytes()
+			if len(b) > format.BlobWidth {
+				return "0x" + hex.EncodeToString(b[:format.BlobWidth]) + "...", true
+			}
+			return "0x" + hex.EncodeToString(b), true
+		}
+	case gocql.TypeTimestamp:
+		if t, ok := v.Interface().(time.Time); ok && format.layout != "" {
+			if format.location != nil {
+				t = t.In(format.location)
+			}
+			return t.Format(format.layout), true
+		}
+	case gocql.TypeFloat, gocql.TypeDouble:
+		if format.FloatPrecision != nil && (v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64) {
+			return strconv.FormatFloat(v.Float(), 'f', *format.FloatPrecision,
+				v.Type().Bits()), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+)
+
+// insert into table (columns) option=value ...
+var generateRE = regexp.MustCompile(`(?is)^insert\s+into\s+(\S+)\s*\(([^)]*)\)\s*(.*)$`)
+
+// Generate a value of the given CQL type for the n-th row. The first
+// column is usually the key, so its values are unique.
+func generateValue(cqlType string, rng *rand.Rand, n int, key bool) (interface{}, error) {
+	var i = rng.Int63()
+	if key {
+		i = int64(n)
+	}
+	switch cqlType {
+	case "int":
+		return int32(i), nil
+	case "bigint", "varint":
+		return i, nil
+	case "smallint":
+		return int16(i), nil
+	case "tinyint":
+		return int8(i), nil
+	case "text", "varchar", "ascii":
+		return strconv.FormatInt(i, 36), nil
+	case "float":
+		return float32(i) / (1 << 20), nil
+	case "double":
+		return float64(i) / (1 << 20), nil
+	case "boolean":
+		return i%2 == 0, nil
+	case "blob":
+		var b = make([]byte, 8)
+		for j := range b {
+			b[j] = byte(i >> (8 * uint(j)))
+		}
+		return b, nil
+	case "timestamp":
+		return time.Unix(1500000000+i%100000000, 0).UTC(), nil
+	case "uuid":
+		var u gocql.UUID
+		rng.Read(u[:])
+		u[6] = u[6]&0x0f | 0x40
+		u[8] = u[8]&0x3f | 0x80
+		return u, nil
+	case "timeuuid":
+		return gocql.UUIDFromTime(time.Unix(1500000000+int64(n), 0)), nil
+	}
+	return nil, merry.Errorf("can't generate values of type %s", cqlType)
+}
+
+// The number of distinct values of the integer types of key columns,
+// which are the row numbers, 0 and up
+var keyTypeRange = map[string]int64{
+	"tinyint":  math.MaxInt8 + 1,
+	"smallint": math.MaxInt16 + 1,
+	"int":      math.MaxInt32 + 1,
+}
+
+// Insert a large generated dataset:
+//
+//	-- generate: insert into t (k, v) rows=100000 [seed=42] [batch=100] [concurrency=8]
+//
+// Values are generated from the seed, so the data is the same in
+// every run. Rows are inserted in unlogged batches by concurrent
+// workers. The number of rows and a checksum of the generated data
+// are recorded in the test output.
+func generateDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	m := generateRE.FindStringSubmatch(strings.TrimSpace(stmt.text))
+	if m == nil {
+		return merry.Errorf("generate: malformed arguments '%s'", stmt.text)
+	}
+	var table = m[1]
+	var columns []string
+	for _, column := range strings.Split(m[2], ",") {
+		columns = append(columns, strings.ToLower(strings.TrimSpace(column)))
+	}
+	var options = map[string]int64{"rows": 0, "seed": 0, "batch": 100, "concurrency": 8}
+	for _, pair := range strings.Fields(m[3]) {
+		kv := strings.SplitN(pair, "=", 2)
+		if _, found := options[kv[0]]; !found || len(kv) != 2 {
+			return merry.Errorf("generate: unknown option '%s'", pair)
+		}
+		n, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil || n < 0 {
+			return merry.Errorf("generate: malformed option '%s'", pair)
+		}
+		options[kv[0]] = n
+	}
+	if options["rows"] == 0 || options["batch"] == 0 || options["concurrency"] == 0 {
+		return merry.New("generate: rows, batch and concurrency must be positive")
+	}
+	// Find out the column types
+	keyspace, name, err := qualifiedName(run, table, "tables", "table_name")
+	if err != nil {
+		return merry.Prepend(err, "generate")
+	}
+	result, err := run.c.Execute(
+		"SELECT column_name, type FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ?",
+		&QueryOptions{values: []interface{}{keyspace, name}})
+	if err != nil {
+		return merry.Prepend(err, "generate")
+	}
+	var types = make(map[string]string)
+	for _, row := range result.rows {
+		types[row[0]] = row[1]
+	}
+	// Key values are row numbers, which must not wrap around and
+	// repeat in a narrow integer type
+	if limit, found := keyTypeRange[types[columns[0]]]; found && options["rows"] > limit {
+		return merry.Errorf("generate: rows=%d is out of range of key column %s of type %s, "+
+			"at most %d", options["rows"], columns[0], types[columns[0]], limit)
+	}
+	// Generate all rows up front, so that the data and the checksum
+	// don't depend on the order in which the workers insert them
+	var rng = rand.New(rand.NewSource(options["seed"]))
+	var rows = make([][]interface{}, options["rows"])
+	var hash = fnv.New64a()
+	for n := range rows {
+		for i, column := range columns {
+			cqlType, found := types[column]
+			if !found {
+				return merry.Errorf("generate: no column %s in %s", column, table)
+			}
+			value, err := generateValue(cqlType, rng, n, i == 0)
+			if err != nil {
+				return merry.Prepend(err, "generate")
+			}
+			rows[n] = append(rows[n], value)
+		}
+		fmt.Fprintf(hash, "%v\n", rows[n])
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s);", table,
+		strings.Join(columns, ", "), strings.Repeat(", ?", len(columns)-1))
+
+	var batches = make(chan [][]interface{})
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	for w := int64(0); w < options["concurrency"]; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				var values []interface{}
+				for _, row := range batch {
+					values = append(values, row...)
+				}
+				cql := "BEGIN UNLOGGED BATCH " + strings.Repeat(insert, len(batch)) + " APPLY BATCH"
+				result, err := run.c.Execute(cql, &QueryOptions{values: values})
+				if err == nil && result.status != "OK" {
+					err = merry.New(result.message)
+				}
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for start := int64(0); start < options["rows"]; start += options["batch"] {
+		end := start + options["batch"]
+		if end > options["rows"] {
+			end = options["rows"]
+		}
+		batches <- rows[start:end]
+	}
+	close(batches)
+	wg.Wait()
+	if firstErr != nil {
+		return merry.Prepend(firstErr, "generate")
+	}
+	fmt.Fprintf(run.output, "  generated %d rows, checksum %016x\n", len(rows), hash.Sum64())
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// Upper bounds of latency histogram buckets, the last bucket has
+// no bound
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Latencies of the statements of a test run
+type latencyStats struct {
+	// Statements slower than the slow statement threshold
+	slow []string
+	// Number of statements per bucket, see latencyBuckets
+	histogram [5]int
+	max       time.Duration
+}
+
+func (stats *latencyStats) Add(stmt *cqlStatement, latency time.Duration, threshold time.Duration) {
+	var i int
+	for i < len(latencyBuckets) && latency >= latencyBuckets[i] {
+		i++
+	}
+	stats.histogram[i]++
+	if latency > stats.max {
+		stats.max = latency
+	}
+	if threshold > 0 && latency > threshold {
+		stats.slow = append(stats.slow, fmt.Sprintf("%s: slow statement took %v",
+			stmt.Location(), latency.Round(time.Millisecond)))
+	}
+}
+
+// Warn about slow statements
+func (stats *latencyStats) PrintSlow() {
+	for _, slow := range stats.slow {
+		fmt.Printf("%s\n", palette.Warn("%s", slow))
+	}
+}
+
+// Print the latency histogram, for --verbose
+func (stats *latencyStats) PrintHistogram() {
+	var cells []string
+	for i, count := range stats.histogram {
+		if count == 0 {
+			continue
+		}
+		var bucket string
+		if i < len(latencyBuckets) {
+			bucket = "<" + latencyBuckets[i].String()
+		} else {
+			bucket = ">=" + latencyBuckets[i-1].String()
+		}
+		cells = append(cells, fmt.Sprintf("%s: %d", bucket, count))
+	}
+	if len(cells) == 0 {
+		return
+	}
+	fmt.Printf("      latency %s, max %v\n", strings.Join(cells, ", "),
+		stats.max.Round(time.Microsecond))
+}
+
+// Fail the test if a following statement takes longer than the
+// given time:
+//
+//	-- max-latency: <duration>
+//
+// Use 0 to turn the check off.
+func maxLatencyDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	latency, err := time.ParseDuration(stmt.text)
+	if err != nil {
+		return merry.Prepend(err, "max-latency")
+	}
+	run.maxLatency = latency
+	return nil
+}
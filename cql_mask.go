@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// How to summarize the rows of the next statement, see the mask-rows
+// directive
+type rowMask struct {
+	// Columns to group rows by, empty for a single group
+	columns []string
+	// Group rows by the partition key of the table
+	partition bool
+}
+
+// Record only the number of rows and a checksum of the rows of the
+// next statement, for statements which return large or order-unstable
+// results, overall or per group of rows with the same values of the
+// columns:
+//
+//	-- mask-rows: [per <column>[, <column> ...]|per partition]
+//
+// The checksum doesn't depend on the order of rows. per partition
+// groups rows by the partition key of the table the statement selects
+// from.
+func maskRowsDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	var mask rowMask
+	if stmt.text != "" {
+		var fields = strings.Fields(stmt.text)
+		if fields[0] != "per" || len(fields) == 1 {
+			return merry.Errorf("mask-rows: expected per <columns> or per partition, got '%s'",
+				stmt.text)
+		}
+		var columns = strings.TrimSpace(strings.TrimPrefix(stmt.text, "per"))
+		if columns == "partition" {
+			mask.partition = true
+		} else {
+			for _, column := range strings.Split(columns, ",") {
+				if column = strings.TrimSpace(column); column != "" {
+					mask.columns = append(mask.columns, column)
+				}
+			}
+		}
+	}
+	run.mask = &mask
+	return nil
+}
+
+// The table a SELECT statement reads, with an optional keyspace
+var selectTableRE = regexp.MustCompile(`(?i)\bfrom\s+("?\w+"?)(\s*\.\s*("?\w+"?))?`)
+
+// Partition key columns of the table the statement selects from, in
+// key order. An unqualified table is looked up in the test keyspace.
+func (run *cqlTestRun) partitionKey(cql string) ([]string, error) {
+	var m = selectTableRE.FindStringSubmatch(cql)
+	if m == nil {
+		return nil, merry.New("mask-rows: per partition requires a SELECT")
+	}
+	var name = func(identifier string) string {
+		if strings.HasPrefix(identifier, `"`) {
+			return strings.Trim(identifier, `"`)
+		}
+		return strings.ToLower(identifier)
+	}
+	var keyspace, table = envValue(run.Environment(), "YACHT_KEYSPACE"), name(m[1])
+	if m[3] != "" {
+		keyspace, table = table, name(m[3])
+	}
+	result, err := run.c.Execute("SELECT column_name, kind, position FROM "+
+		"system_schema.columns WHERE keyspace_name = ? AND table_name = ?",
+		&QueryOptions{values: []interface{}{keyspace, table}})
+	if err != nil {
+		return nil, err
+	}
+	if result.status != "OK" {
+		return nil, merry.Errorf("mask-rows: %s", result.message)
+	}
+	var columns = make(map[int]string)
+	for _, row := range result.rows {
+		if len(row) == 3 && row[1] == "partition_key" {
+			position, _ := strconv.Atoi(row[2])
+			columns[position] = row[0]
+		}
+	}
+	if len(columns) == 0 {
+		return nil, merry.Errorf("mask-rows: no partition key of table %s.%s", keyspace, table)
+	}
+	var key = make([]string, len(columns))
+	for position, column := range columns {
+		if position < 0 || position >= len(key) {
+			return nil, merry.Errorf("mask-rows: malformed partition key of table %s.%s",
+				keyspace, table)
+		}
+		key[position] = column
+	}
+	return key, nil
+}
+
+// Replace the rows of the result with their number and checksum, per
+// group
+func (mask *rowMask) Apply(run *cqlTestRun, cql string, result *CQLResult) error {
+	if result.status != "OK" || len(result.names) == 0 {
+		return nil
+	}
+	var columns = mask.columns
+	if mask.partition {
+		var err error
+		if columns, err = run.partitionKey(cql); err != nil {
+			return err
+		}
+	}
+	var positions []int
+	for _, column := range columns {
+		var found bool
+		for i, name := range result.names {
+			if strings.EqualFold(name, column) {
+				positions = append(positions, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return merry.Errorf("mask-rows: no column %s in the result", column)
+		}
+	}
+	type group struct {
+		key      []string
+		rows     int
+		checksum uint64
+	}
+	var groups = make(map[string]*group)
+	for _, row := range result.rows {
+		var key []string
+		for _, i := range positions {
+			key = append(key, row[i])
+		}
+		var id = strings.Join(key, "\x00")
+		if groups[id] == nil {
+			groups[id] = &group{key: key}
+		}
+		var hash = fnv.New64a()
+		hash.Write([]byte(strings.Join(row, "\x00")))
+		// A sum of row hashes doesn't depend on the order of rows
+		groups[id].rows++
+		groups[id].checksum += hash.Sum64()
+	}
+	var ids []string
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var names []string
+	for _, i := range positions {
+		names = append(names, result.names[i])
+	}
+	result.names = append(names, "rows", "checksum")
+	result.types = nil
+	result.json = nil
+	result.rows = nil
+	for _, id := range ids {
+		var g = groups[id]
+		result.rows = append(result.rows, append(append([]string{}, g.key...),
+			strconv.Itoa(g.rows), fmt.Sprintf("%016x", g.checksum)))
+	}
+	if len(result.rows) == 0 && len(positions) == 0 {
+		result.rows = [][]string{{"0", fmt.Sprintf("%016x", 0)}}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// A statement of a test file together with the comments and
+// directives preceding it, as it appears in the file. Directives
+// such as bind apply to the next statement, so keep them with it.
+type cqlUnit struct {
+	text string
+	stmt *cqlStatement
+}
+
+// Split a test file into units, one per statement. Comments after
+// the last statement are dropped.
+func splitCQLUnits(test *CQLTestFile) ([]cqlUnit, error) {
+	file, err := os.Open(test.path)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer file.Close()
+
+	var units []cqlUnit
+	var buf bytes.Buffer
+	scanner := newCQLScanner(file, test.path, &buf)
+	for {
+		stmt, err := scanner.Next()
+		if err != nil {
+			return nil, err
+		}
+		if stmt == nil {
+			return units, nil
+		}
+		if stmt.directive == "" {
+			units = append(units, cqlUnit{text: buf.String(), stmt: stmt})
+			buf.Reset()
+		}
+	}
+}
+
+// The outcome of running a sequence of units
+type cqlTrace struct {
+	// Output of the test up to and including the result of
+	// each statement, as offsets in the output
+	ends []int
+	// Results of the statements
+	results []string
+	output  bytes.Buffer
+	// Harness error, e.g. a server crash, and the number of
+	// the statement which caused it
+	err     error
+	errUnit int
+}
+
+// Run the units against a freshly started server and trace the
+// results of every statement
+func (test *CQLTestFile) traceUnits(units []cqlUnit, lane *Lane, server Server,
+	suite TestSuite) (*cqlTrace, error) {
+
+	lane.CleanupBeforeNextSuite()
+	if err := suite.PrepareLane(lane, server); err != nil {
+		return nil, err
+	}
+	c, err := server.Connect()
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	defer c.Close()
+
+	var text strings.Builder
+	for _, unit := range units {
+		text.WriteString(unit.text)
+	}
+	var trace cqlTrace
+	output := bufio.NewWriter(&trace.output)
+	run := cqlTestRun{test: test, c: c, lane: lane, server: server, output: output}
+	run.trace = func(stmt *cqlStatement, result *CQLResult) {
+		if stmt.file != test.path {
+			// A statement of an included file
+			return
+		}
+		output.Flush()
+		trace.ends = append(trace.ends, trace.output.Len())
+		trace.results = append(trace.results, result.String())
+	}
+	scanner := newCQLScanner(strings.NewReader(text.String()), test.path, output)
+	scanner.ids = test.format.StatementIds
+	scanner.idsOnly = test.format.Echo == "ids"
+	if err := run.Run(scanner); err != nil {
+		trace.err = err
+		trace.errUnit = len(trace.results)
+	}
+	output.Flush()
+	return &trace, nil
+}
+
+// Find the smallest sequence of statements of a failing test which
+// reproduces the failure: the same output of the first mismatching
+// statement, or a harness error, e.g. a crash, at the same statement.
+// The sequence is written to a new test file in the lane directory,
+// where suite discovery doesn't pick it up.
+func (test *CQLTestFile) Minimize(lane *Lane, server Server, suite TestSuite) (string, error) {
+	units, err := splitCQLUnits(test)
+	if err != nil {
+		return "", err
+	}
+	if len(units) == 0 {
+		return "", merry.Errorf("%s has no statements", test.name)
+	}
+	fmt.Printf("Running %s with %d statements\n", palette.Path(test.name), len(units))
+	trace, err := test.traceUnits(units, lane, server, suite)
+	if err != nil {
+		return "", err
+	}
+	var target int
+	var expected string
+	var crash = trace.err != nil
+	if crash {
+		target = trace.errUnit
+		if target >= len(units) {
+			return "", merry.Prepend(trace.err, "failure after the last statement")
+		}
+		fmt.Printf("Statement %s fails with: %v\n",
+			units[target].stmt.Location(), palette.Crit("%v", trace.err))
+	} else {
+		result_name, _ := test.Golden(server.ModeName())
+		result, err := ioutil.ReadFile(result_name)
+		if err != nil {
+			return "", merry.Prepend(err, "nothing to compare the output with")
+		}
+		output := trace.output.Bytes()
+		var diff int
+		for diff < len(result) && diff < len(output) && result[diff] == output[diff] {
+			diff++
+		}
+		if diff == len(result) && diff == len(output) {
+			return "", merry.Errorf("%s passes, nothing to minimize", test.name)
+		}
+		for target < len(trace.ends)-1 && trace.ends[target] <= diff {
+			target++
+		}
+		expected = trace.results[target]
+		fmt.Printf("Output of statement %s doesn't match %s\n",
+			units[target].stmt.Location(), palette.Path(result_name))
+	}
+	// Does the sequence of units, ending with the target statement,
+	// reproduce the failure?
+	reproduces := func(candidate []cqlUnit) (bool, error) {
+		trace, err := test.traceUnits(candidate, lane, server, suite)
+		if err != nil {
+			return false, err
+		}
+		last := len(candidate) - 1
+		if crash {
+			return trace.err != nil && trace.errUnit == last, nil
+		}
+		return trace.err == nil && len(trace.results) == len(candidate) &&
+			trace.results[last] == expected, nil
+	}
+	// Remove chunks of statements preceding the target, halving
+	// the chunk size until single statements are tried
+	var prefix = units[:target]
+	for chunk := len(prefix) / 2; chunk >= 1; chunk /= 2 {
+		for i := 0; i < len(prefix); {
+			end := i + chunk
+			if end > len(prefix) {
+				end = len(prefix)
+			}
+			candidate := append(append([]cqlUnit{}, prefix[:i]...), prefix[end:]...)
+			ok, err := reproduces(append(candidate, units[target]))
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				prefix = candidate
+				fmt.Printf("... reproduced with %d statements\n", len(prefix)+1)
+			} else {
+				i = end
+			}
+		}
+	}
+	var text strings.Builder
+	for _, unit := range append(prefix, units[target]) {
+		text.WriteString(unit.text)
+	}
+	name := path.Join(lane.Dir(), strings.TrimSuffix(test.name, ".test.cql")+"_min.test.cql")
+	if err := ioutil.WriteFile(name, []byte(text.String()), 0644); err != nil {
+		return "", merry.Wrap(err)
+	}
+	return name, nil
+}
+
+// Minimize the first test of the suite
+func (suite *CQLTestSuite) Minimize(lane *Lane, server Server) error {
+	if len(suite.tests) > 1 {
+		fmt.Printf("%s matches %d tests, minimizing %s\n", suite.name,
+			len(suite.tests), palette.Path(suite.tests[0].name))
+	}
+	name, err := suite.tests[0].Minimize(lane, server, suite)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Minimized test written to %s\n", palette.Path(name))
+	return nil
+}
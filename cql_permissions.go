@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+)
+
+// A server which can be connected to as a given role
+type RoleConnector interface {
+	ConnectAs(role string, password string) (Connection, error)
+}
+
+func (server *CQLServerURI) ConnectAs(role string, password string) (Connection, error) {
+	var cluster = *server.cluster
+	cluster.Authenticator = gocql.PasswordAuthenticator{Username: role, Password: password}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, merry.Prependf(err, "when connecting to '%s' as %s", server.uri, role)
+	}
+	return server.newConnection(session, &cluster), nil
+}
+
+func (cluster *CQLCluster) ConnectAs(role string, password string) (Connection, error) {
+	return cluster.servers[0].ConnectAs(role, password)
+}
+
+// The mock server has no roles, its responses are the same for all
+func (server *mockServer) ConnectAs(role string, password string) (Connection, error) {
+	return server.Connect()
+}
+
+// Execute every statement of a block as every role and print which
+// of them each role may execute:
+//
+//	-- permissions: alice bob:secret
+//	SELECT * FROM ks.t;
+//	INSERT INTO ks.t (k) VALUES (1);
+//	-- end:
+//
+// A role logs in with the password after the colon, or with its name
+// if there is none. Each role executes all statements of the block in
+// order, on a connection of its own. The output is a table of the
+// outcomes, a row per statement and a column per role: OK, or the
+// error code without the number, e.g. Unauthorized.
+func permissionsDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	var block []*cqlStatement
+	var blockErr error
+	for {
+		next, err := run.scanner.Next()
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return merry.Errorf("permissions: no end of the block started at %s",
+				stmt.Location())
+		}
+		if next.directive == "end" {
+			break
+		}
+		if next.directive != "" && blockErr == nil {
+			blockErr = merry.Errorf("permissions: directive %s at %s is not allowed in a block",
+				next.directive, next.Location())
+		}
+		block = append(block, next)
+	}
+	if blockErr != nil {
+		return blockErr
+	}
+	var roles = strings.Fields(stmt.text)
+	if len(roles) == 0 {
+		return merry.New("permissions: no roles")
+	}
+	connector, ok := run.server.(RoleConnector)
+	if !ok {
+		return merry.Errorf("permissions: mode %s can't connect as a role",
+			run.server.ModeName())
+	}
+	var matrix = CQLResult{status: "OK", names: []string{"statement"}}
+	for _, s := range block {
+		matrix.rows = append(matrix.rows, []string{strings.Join(strings.Fields(s.text), " ")})
+	}
+	for _, role := range roles {
+		var password = role
+		if i := strings.Index(role, ":"); i >= 0 {
+			role, password = role[:i], role[i+1:]
+		}
+		matrix.names = append(matrix.names, role)
+		c, err := connector.ConnectAs(role, password)
+		if err != nil {
+			return merry.Prepend(err, "permissions")
+		}
+		for i, s := range block {
+			result, err := c.Execute(run.Expand(s.text), &QueryOptions{format: run.test.format})
+			if err != nil {
+				c.Close()
+				return merry.Prependf(err, "permissions: %s as %s", s.Location(), role)
+			}
+			var outcome = "OK"
+			if result.status != "OK" {
+				outcome = strings.SplitN(result.code, " (", 2)[0]
+			}
+			matrix.rows[i] = append(matrix.rows[i], outcome)
+			run.statements++
+		}
+		c.Close()
+	}
+	fmt.Fprint(run.output, matrix.String())
+	return nil
+}
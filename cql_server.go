@@ -7,6 +7,8 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -18,29 +20,90 @@ import (
 	"github.com/google/uuid"
 )
 
-const CREATE_KEYSPACE_TEMPLATE = `CREATE KEYSPACE IF NOT EXISTS yacht
+const CREATE_KEYSPACE_TEMPLATE = `CREATE KEYSPACE IF NOT EXISTS %s
 WITH REPLICATION = { 'class': '%s', 'replication_factor' : %d }
 AND DURABLE_WRITES=true`
 
 // A pre-installed CQL server to which we connect via a URI
 type CQLServerURI struct {
-	uri                 string
+	uri string
+	// The native transport port, 0 for the default one
+	port                int
 	replicationFactor   int
 	replicationStrategy string
-	cluster             *gocql.ClusterConfig
+	// The keyspace tests run in, by default "yacht" on servers
+	// started by the harness and a unique name per lane otherwise,
+	// so that runs can share a cluster
+	keyspace string
+	driver   DriverConfig
+	cluster  *gocql.ClusterConfig
+	// Translates node addresses the driver learns from the nodes,
+	// if they are not reachable, nil for no translation
+	translator gocql.AddressTranslator
+	// Drops keyspaces created by tests
+	keyspaces *CQLServerURI_artefact
+	// The server process artefact, if the server is started by
+	// the harness. Sessions must be closed before it's stopped.
+	process Artefact
+	// Drop an existing keyspace with tables, see --yes-wipe
+	yesWipe bool
+	// Only execute statements which don't change anything, and
+	// create no keyspace, see --read-only
+	readOnly bool
 }
 
 func (server *CQLServerURI) ModeName() string {
 	return "uri"
 }
 
-// Destroy yacht keyspace when done
-type CQLServerURI_artefact struct {
+func (server *CQLServerURI) Environment() []string {
+	return []string{
+		"YACHT_MODE=" + server.ModeName(),
+		"YACHT_URIS=" + server.uri,
+		"YACHT_KEYSPACE=" + server.keyspace,
+	}
+}
+
+func (server *CQLServerURI) LogFiles() []string {
+	return nil
+}
+
+// Close the administrative session
+type CQLSession_artefact struct {
 	session *gocql.Session
 }
 
-func (a *CQLServerURI_artefact) Remove() {
-	a.session.Query("DROP KEYSPACE IF EXISTS yacht").Exec()
+func (a *CQLSession_artefact) Remove() error {
+	a.session.Close()
+	return nil
+}
+
+// Destroy yacht keyspace and keyspaces created by tests when done
+type CQLServerURI_artefact struct {
+	session   *gocql.Session
+	keyspaces []string
+}
+
+func (a *CQLServerURI_artefact) AddKeyspace(keyspace string) {
+	for _, k := range a.keyspaces {
+		if k == keyspace {
+			return
+		}
+	}
+	a.keyspaces = append(a.keyspaces, keyspace)
+}
+
+func (a *CQLServerURI_artefact) Remove() error {
+	var failed []string
+	for _, keyspace := range a.keyspaces {
+		if err := a.session.Query("DROP KEYSPACE IF EXISTS " + keyspace).Exec(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", keyspace, err))
+		}
+	}
+	if len(failed) != 0 {
+		return merry.Errorf("failed to drop keyspaces %s", strings.Join(failed, ", "))
+	}
+	return nil
 }
 
 func (server *CQLServerURI) Start(lane *Lane) error {
@@ -51,26 +114,86 @@ func (server *CQLServerURI) Start(lane *Lane) error {
 	if server.replicationStrategy == "" {
 		server.replicationStrategy = "SimpleStrategy"
 	}
-	server.cluster = gocql.NewCluster(server.uri)
-	server.cluster.Timeout, _ = time.ParseDuration("30s")
+	if server.keyspace == "" && server.process != nil {
+		server.keyspace = "yacht"
+	} else if server.keyspace == "" && server.readOnly == false {
+		server.keyspace = fmt.Sprintf("yacht_%s_%s", lane.id,
+			strings.Replace(uuid.New().String(), "-", "", -1)[:8])
+	}
+	if err := server.newCluster(); err != nil {
+		return err
+	}
 	// Create an administrative session to prepare
 	// administrative server for testing
 	session, err := server.cluster.CreateSession()
 	if err != nil {
 		return merry.Wrap(err)
 	}
-	artefact := CQLServerURI_artefact{session: session}
+	if server.readOnly {
+		// Run in the configured keyspace, if any, as is
+		server.cluster.Keyspace = server.keyspace
+		lane.AddSuiteArtefact(&CQLSession_artefact{session: session})
+		return nil
+	}
+	if server.process == nil && server.yesWipe == false {
+		if err := checkKeyspaceIsEmpty(session, server.keyspace); err != nil {
+			session.Close()
+			return err
+		}
+	}
+	artefact := CQLServerURI_artefact{session: session, keyspaces: []string{server.keyspace}}
 	// Cleanup before running the suit
-	artefact.Remove()
+	if err := artefact.Remove(); err != nil {
+		return err
+	}
 	// Create a keyspace for testing
-	var create_keyspace = fmt.Sprintf(CREATE_KEYSPACE_TEMPLATE,
+	var create_keyspace = fmt.Sprintf(CREATE_KEYSPACE_TEMPLATE, server.keyspace,
 		server.replicationStrategy, server.replicationFactor)
 	err = session.Query(create_keyspace).Exec()
 	if err != nil {
 		return merry.Wrap(err)
 	}
-	server.cluster.Keyspace = "yacht"
-	lane.AddSuiteArtefact(&artefact)
+	server.cluster.Keyspace = server.keyspace
+	server.keyspaces = &artefact
+	// Drop the keyspaces while the session and the server are alive
+	var sessionArtefact = &CQLSession_artefact{session: session}
+	lane.AddSuiteArtefact(sessionArtefact, server.process)
+	lane.AddSuiteArtefact(&artefact, sessionArtefact)
+	return nil
+}
+
+// Configure the driver to connect to the server
+func (server *CQLServerURI) newCluster() error {
+	// A comma-separated list of contact points of one cluster
+	server.cluster = gocql.NewCluster(strings.Split(server.uri, ",")...)
+	if server.port != 0 {
+		server.cluster.Port = server.port
+	}
+	if server.translator != nil {
+		server.cluster.AddressTranslator = server.translator
+	}
+	server.cluster.Timeout, _ = time.ParseDuration("30s")
+	return server.driver.Apply(server.cluster)
+}
+
+// The keyspace of a server yacht didn't start is dropped before
+// the suite runs. Refuse to drop it if it has tables: it may hold
+// data which has nothing to do with yacht.
+func checkKeyspaceIsEmpty(session *gocql.Session, keyspace string) error {
+	var tables []string
+	var table string
+	iter := session.Query("SELECT table_name FROM system_schema.tables WHERE keyspace_name = ?",
+		strings.Trim(keyspace, `"`)).Iter()
+	for iter.Scan(&table) {
+		tables = append(tables, table)
+	}
+	if err := iter.Close(); err != nil {
+		return merry.Prepend(err, "failed to check keyspace "+keyspace)
+	}
+	if len(tables) != 0 {
+		return merry.Errorf("keyspace %s already exists and has tables %s, refusing to drop it, "+
+			"use --yes-wipe to drop it anyway", keyspace, strings.Join(tables, ", "))
+	}
 	return nil
 }
 
@@ -79,7 +202,23 @@ func (server *CQLServerURI) Connect() (Connection, error) {
 	if err != nil {
 		return nil, merry.Prepend(err, "when connecting to '"+server.uri+"'")
 	}
-	return &CQLConnection{session: session}, nil
+	return server.newConnection(session, server.cluster), nil
+}
+
+// A connection of a session to the server, see ConnectAs() too
+func (server *CQLServerURI) newConnection(session *gocql.Session,
+	cluster *gocql.ClusterConfig) *CQLConnection {
+	var conn = &CQLConnection{
+		session:     session,
+		cluster:     cluster,
+		keyspaces:   server.keyspaces,
+		readOnly:    server.readOnly,
+		speculative: server.driver.Speculative(),
+	}
+	if server.process == nil {
+		conn.schemaKeyspace = server.keyspace
+	}
+	return conn
 }
 
 // A single Scylla server
@@ -88,9 +227,23 @@ type CQLServerConfig struct {
 	Dir                       string
 	URI                       string
 	Seed                      string
-	SMP                       int
 	ClusterName               string
 	SkipWaitForGossipToSettle int
+	// Own ports of the server in "port" isolation, see Env,
+	// 0 to use the default ports
+	NativePort           int
+	NativeShardAwarePort int
+	APIPort              int
+	PrometheusPort       int
+	StoragePort          int
+	SSLStoragePort       int
+	// The address of a dead node the server replaces, see
+	// the replace-node directive
+	ReplaceAddressFirstBoot string
+	// Enable user-defined functions and experimental features, see
+	// Requirements
+	UDF                  bool
+	ExperimentalFeatures []string
 }
 
 var SCYLLA_CONF_TEMPLATE string = `
@@ -113,6 +266,27 @@ seed_provider:
       parameters:
           - seeds: {{.Seed}}
 
+{{- if .NativePort}}
+native_transport_port: {{.NativePort}}
+native_shard_aware_transport_port: {{.NativeShardAwarePort}}
+api_port: {{.APIPort}}
+prometheus_port: {{.PrometheusPort}}
+storage_port: {{.StoragePort}}
+ssl_storage_port: {{.SSLStoragePort}}
+{{- end}}
+{{- if .ReplaceAddressFirstBoot}}
+replace_address_first_boot: {{.ReplaceAddressFirstBoot}}
+{{- end}}
+{{- if .UDF}}
+enable_user_defined_functions: true
+{{- end}}
+{{- if .ExperimentalFeatures}}
+experimental_features:
+{{- range .ExperimentalFeatures}}
+    - {{.}}
+{{- end}}
+{{- end}}
+
 skip_wait_for_gossip_to_settle: {{.SkipWaitForGossipToSettle}}
 ring_delay_ms: 3000
 `
@@ -126,12 +300,95 @@ type CQLServer struct {
 	configFileName string
 	cmd            *exec.Cmd
 	logFile        *os.File
+	// Artefacts which must be removed after the server is stopped,
+	// such as the data directory
+	installed []Artefact
+	// CPUs and memory of the server, and the number of servers
+	// the lane runs at once, which share the host with it
+	resources ServerResources
+	instances int
+	// Levels of server loggers, see LoggerLevels
+	loggers LoggerLevels
+	// What the suite requires of the server, see Requirements
+	requires Requirements
+}
+
+// Log levels of Scylla loggers, set with 'loggers' in suite.yaml,
+// e.g. {paging: debug}, for suites which check server logs
+type LoggerLevels map[string]string
+
+var loggerLevelRE = regexp.MustCompile(`^(error|warn|info|debug|trace)$`)
+
+func (loggers LoggerLevels) Validate() error {
+	for name, level := range loggers {
+		if !loggerLevelRE.MatchString(level) {
+			return merry.Errorf("malformed level '%s' of logger '%s', expected "+
+				"error, warn, info, debug or trace", level, name)
+		}
+	}
+	return nil
+}
+
+// Scylla command line options which set the levels
+func (loggers LoggerLevels) Options() []string {
+	var names []string
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var options []string
+	for _, name := range names {
+		options = append(options, "--logger-log-level", name+"="+loggers[name])
+	}
+	return options
+}
+
+// Set the logger levels of servers started in the mode, if it
+// starts any
+func setLoggers(server Server, loggers LoggerLevels) {
+	switch s := server.(type) {
+	case *CQLServer:
+		s.loggers = loggers
+	case *CQLCluster:
+		s.loggers = loggers
+	case *K8sCluster:
+		s.loggers = loggers
+	}
 }
 
 func (server *CQLServer) ModeName() string {
 	return "single"
 }
 
+func (server *CQLServer) Environment() []string {
+	var env = []string{
+		"YACHT_MODE=" + server.ModeName(),
+		"YACHT_URIS=" + server.cfg.URI,
+		"YACHT_KEYSPACE=" + server.keyspace,
+		"YACHT_DATA_DIRS=" + server.cfg.Dir,
+		"YACHT_LOG_FILES=" + server.logFileName,
+	}
+	if server.cfg.NativePort != 0 {
+		env = append(env,
+			"YACHT_NATIVE_PORTS="+strconv.Itoa(server.cfg.NativePort),
+			"YACHT_API_PORTS="+strconv.Itoa(server.cfg.APIPort))
+	}
+	return env
+}
+
+// A name unique within the lane, for server files: the IP address,
+// with the native port in "port" isolation
+func (server *CQLServer) name() string {
+	if server.cfg.NativePort != 0 {
+		return fmt.Sprintf("%s-%d", server.cfg.URI, server.cfg.NativePort)
+	}
+	return server.cfg.URI
+}
+
+func (server *CQLServer) LogFiles() []string {
+	return []string{server.logFileName}
+}
+
 func (server *CQLServer) Start(lane *Lane) error {
 
 	if err := server.FindScyllaExecutable(); err != nil {
@@ -142,15 +399,16 @@ func (server *CQLServer) Start(lane *Lane) error {
 		return err
 	}
 
-	ylog.Printf("Starting server %s...", server.cfg.URI)
+	lane.Log().Printf("Starting server %s...", server.name())
 
 	if err := server.DoStart(lane); err != nil {
 		return err
 	}
 
-	ylog.Printf("Started server %s", server.cfg.URI)
+	lane.Log().Printf("Started server %s", server.name())
 
 	server.CQLServerURI.uri = server.cfg.URI
+	server.CQLServerURI.port = server.cfg.NativePort
 
 	return server.CQLServerURI.Start(lane)
 }
@@ -171,19 +429,45 @@ type ReleaseURI_artefact struct {
 	lane *Lane
 }
 
-func (a *ReleaseURI_artefact) Remove() {
+func (a *ReleaseURI_artefact) Remove() error {
 	if a.uri != "" {
 		a.lane.ReleaseURI(a.uri)
 	}
+	return nil
+}
+
+type ReleaseURIPrefix_artefact struct {
+	prefix string
+	lane   *Lane
+}
+
+func (a *ReleaseURIPrefix_artefact) Remove() error {
+	a.lane.ReleaseURIPrefix(a.prefix)
+	return nil
+}
+
+type ReleasePorts_artefact struct {
+	ports []int
+	lane  *Lane
+}
+
+func (a *ReleasePorts_artefact) Remove() error {
+	a.lane.ReleasePorts(a.ports)
+	return nil
 }
 
 type CQLServer_uninstall_artefact struct {
 	server *CQLServer
 }
 
-func (a *CQLServer_uninstall_artefact) Remove() {
-	os.RemoveAll(a.server.cfg.Dir)
-	os.Remove(a.server.logFileName)
+func (a *CQLServer_uninstall_artefact) Remove() error {
+	if err := os.RemoveAll(a.server.cfg.Dir); err != nil {
+		return merry.Wrap(err)
+	}
+	if err := os.Remove(a.server.logFileName); err != nil && !os.IsNotExist(err) {
+		return merry.Wrap(err)
+	}
+	return nil
 }
 
 func (server *CQLServer) Install(lane *Lane) error {
@@ -191,12 +475,31 @@ func (server *CQLServer) Install(lane *Lane) error {
 	var err error
 	// Scylla assumes all instances of a cluster use the same port,
 	// so each instance needs an own IP address. The IP address
-	// can be set by the cluster. Otherwise set it here.
-	if server.cfg.URI == "" {
+	// can be set by the cluster. Otherwise set it here, or, if
+	// extra loopback addresses are not available, give the server
+	// own ports.
+	if server.cfg.URI == "" && lane.isolation == "port" {
+		ports, err := lane.LeasePorts(6)
+		if err != nil {
+			return err
+		}
+		release := &ReleasePorts_artefact{ports: ports, lane: lane}
+		lane.AddSuiteArtefact(release)
+		server.installed = append(server.installed, release)
+		server.cfg.URI = "127.0.0.1"
+		server.cfg.NativePort = ports[0]
+		server.cfg.NativeShardAwarePort = ports[1]
+		server.cfg.APIPort = ports[2]
+		server.cfg.PrometheusPort = ports[3]
+		server.cfg.StoragePort = ports[4]
+		server.cfg.SSLStoragePort = ports[5]
+	} else if server.cfg.URI == "" {
 		if server.cfg.URI, err = lane.LeaseURI(); err != nil {
 			return err
 		}
-		lane.AddSuiteArtefact(&ReleaseURI_artefact{uri: server.cfg.URI, lane: lane})
+		release := &ReleaseURI_artefact{uri: server.cfg.URI, lane: lane}
+		lane.AddSuiteArtefact(release)
+		server.installed = append(server.installed, release)
 	}
 	// Set the seed if it has not been pre-set.
 	if server.cfg.Seed == "" {
@@ -206,18 +509,21 @@ func (server *CQLServer) Install(lane *Lane) error {
 	// Instance subdirectory is a directory inside the lane,
 	// so that each lane can run a cluster of instances
 	// Derive subdirectory name from URI
-	server.cfg.Dir = path.Join(lane.Dir(), server.cfg.URI)
-	server.cfg.SMP = 1
+	server.cfg.Dir = path.Join(lane.DataDir(), server.name())
 	// Only reset ClusterName if it was not provided
 	if server.cfg.ClusterName == "" {
 		server.cfg.ClusterName = uuid.New().String()
 	}
-	server.logFileName = path.Join(lane.Dir(), server.cfg.URI+".log")
+	server.cfg.UDF = server.requires.UDF
+	server.cfg.ExperimentalFeatures = server.requires.ExperimentalFeatures()
+	server.logFileName = path.Join(lane.Dir(), server.name()+".log")
 	// SCYLLA_CONF env variable is actually SCYLLA_CONF_DIR environment
 	// variable, and the configuration file name is assumed to be scylla.yaml
 	server.configFileName = path.Join(server.cfg.Dir, "scylla.yaml")
 
-	lane.AddSuiteArtefact(&CQLServer_uninstall_artefact{server: server})
+	uninstall := &CQLServer_uninstall_artefact{server: server}
+	lane.AddSuiteArtefact(uninstall)
+	server.installed = append(server.installed, uninstall)
 
 	if err := os.MkdirAll(server.cfg.Dir, 0750); err != nil {
 		return err
@@ -250,9 +556,17 @@ func (server *CQLServer) Install(lane *Lane) error {
 	// Do not confuse Scylla binary if we derived this from the parent process
 	os.Unsetenv("SCYLLA_HOME")
 
-	cmd := exec.Command(server.exe, fmt.Sprintf("--smp=%d", server.cfg.SMP))
+	var options = lane.ServerOptions(server.instances, server.resources)
+	cmd := exec.Command(server.exe, append(options, server.loggers.Options()...)...)
 	cmd.Dir = server.cfg.Dir
 	cmd.Env = append(cmd.Env, fmt.Sprintf("SCYLLA_CONF=%s", server.cfg.Dir))
+	if lane.coverageDir != "" {
+		cmd.Env = append(cmd.Env, "LLVM_PROFILE_FILE="+profileFilePattern(lane, server.name()))
+		// Profile files are written when the server exits
+		collect := &CollectCoverage_artefact{lane: lane, uri: server.name()}
+		lane.AddExitArtefact(collect)
+		server.installed = append(server.installed, collect)
+	}
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
 
@@ -262,20 +576,35 @@ func (server *CQLServer) Install(lane *Lane) error {
 }
 
 type CQLServer_stop_artefact struct {
-	cmd *exec.Cmd
+	cmd     *exec.Cmd
+	pidFile string
+	lane    *Lane
+	// Set once the server is stopped, e.g. by a test
+	stopped bool
 }
 
-func (a *CQLServer_stop_artefact) Remove() {
-	ylog.Printf("Stopping server %d", a.cmd.Process.Pid)
-	a.cmd.Process.Kill()
+func (a *CQLServer_stop_artefact) Remove() error {
+	if a.cmd.Process == nil || a.stopped {
+		// The server failed to start or is already stopped
+		return nil
+	}
+	a.lane.Log().Printf("Stopping server %d", a.cmd.Process.Pid)
+	if err := a.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return merry.Prepend(err, fmt.Sprintf("failed to stop server %d", a.cmd.Process.Pid))
+	}
 	// 3 seconds is enough for a good database to die gracefully:
 	// send SIGKILL if SIGTERM doesn't reach its target
 	timer := time.AfterFunc(3*time.Second, func() {
 		syscall.Kill(a.cmd.Process.Pid, syscall.SIGKILL)
 	})
-	timer.Stop()
-	a.cmd.Process.Wait()
-	ylog.Printf("Stopped server %d", a.cmd.Process.Pid)
+	defer timer.Stop()
+	if _, err := a.cmd.Process.Wait(); err != nil {
+		return merry.Prepend(err, fmt.Sprintf("failed to wait for server %d", a.cmd.Process.Pid))
+	}
+	a.lane.Log().Printf("Stopped server %d", a.cmd.Process.Pid)
+	a.stopped = true
+	os.Remove(a.pidFile)
+	return nil
 }
 
 func FindLogFilePattern(file *os.File, pattern string) bool {
@@ -291,10 +620,20 @@ func FindLogFilePattern(file *os.File, pattern string) bool {
 
 func (server *CQLServer) DoStart(lane *Lane) error {
 	const START_TIMEOUT = 300 * time.Second
-	lane.AddExitArtefact(&CQLServer_stop_artefact{cmd: server.cmd})
+	stop := &CQLServer_stop_artefact{
+		cmd:     server.cmd,
+		pidFile: path.Join(lane.Dir(), server.name()+".pid"),
+		lane:    lane,
+	}
+	lane.AddExitArtefact(stop, server.installed...)
+	server.CQLServerURI.process = stop
 	if err := server.cmd.Start(); err != nil {
 		return err
 	}
+	// Let the next run find the server if yacht crashes
+	if err := WritePidFile(stop.pidFile, server.cmd); err != nil {
+		return err
+	}
 	start := time.Now()
 	for _ = range time.Tick(time.Millisecond * 10) {
 		if FindLogFilePattern(server.logFile, "Scylla.*initialization completed") {
@@ -302,9 +641,23 @@ func (server *CQLServer) DoStart(lane *Lane) error {
 		}
 		if time.Now().Sub(start) > START_TIMEOUT {
 			return merry.Errorf("failed to start server %s on lane %s, check server log at %s",
-				server.cfg.URI, lane.id, palette.Path(server.logFileName))
+				server.name(), lane.id, palette.Path(server.logFileName))
 		}
 	}
+	if lane.profileDir != "" {
+		profile, err := startProfiling(lane, server.cmd.Process.Pid, server.name())
+		if err != nil {
+			return err
+		}
+		lane.AddExitArtefact(profile, stop)
+	}
+	if lane.monitor.Enabled() {
+		monitor, err := startMonitor(lane.monitor, lane, server.cmd.Process.Pid, server.name())
+		if err != nil {
+			return err
+		}
+		lane.AddExitArtefact(monitor, stop)
+	}
 	return nil
 }
 
@@ -313,14 +666,60 @@ type CQLCluster struct {
 	servers     [3]*CQLServer
 	builddir    string
 	clusterName string
+	driver      DriverConfig
+	// CPUs and memory of each node
+	resources ServerResources
+	// Levels of loggers of each node
+	loggers LoggerLevels
+	// What the suite requires of each node
+	requires Requirements
+	// See CQLServerURI
+	keyspace string
 }
 
 func (cluster *CQLCluster) ModeName() string {
 	return "cluster"
 }
 
+func (cluster *CQLCluster) Environment() []string {
+	var uris, dirs, logs []string
+	for _, server := range cluster.servers {
+		if server == nil {
+			continue
+		}
+		uris = append(uris, server.cfg.URI)
+		dirs = append(dirs, server.cfg.Dir)
+		logs = append(logs, server.logFileName)
+	}
+	return []string{
+		"YACHT_MODE=" + cluster.ModeName(),
+		"YACHT_URIS=" + strings.Join(uris, ","),
+		"YACHT_KEYSPACE=" + cluster.keyspace,
+		"YACHT_DATA_DIRS=" + strings.Join(dirs, ","),
+		"YACHT_LOG_FILES=" + strings.Join(logs, ","),
+	}
+}
+
+func (cluster *CQLCluster) LogFiles() []string {
+	var logs []string
+	for _, server := range cluster.servers {
+		if server != nil {
+			logs = append(logs, server.logFileName)
+		}
+	}
+	return logs
+}
+
 func (cluster *CQLCluster) Start(lane *Lane) error {
 
+	if lane.isolation == "port" {
+		return merry.New("cluster mode requires isolation: ip, Scylla nodes " +
+			"of a cluster must use the same storage port, see 'yacht setup-net'")
+	}
+
+	if cluster.keyspace == "" {
+		cluster.keyspace = "yacht"
+	}
 	var seeds = make([]string, len(cluster.servers))
 	var err error
 	for i, _ := range seeds {
@@ -346,17 +745,9 @@ func (cluster *CQLCluster) Start(lane *Lane) error {
 
 	cluster.clusterName = uuid.New().String()
 	for i, _ := range cluster.servers {
-		server := CQLServer{builddir: cluster.builddir}
-		// Set a shared cluster name
-		server.cfg.ClusterName = cluster.clusterName
-		server.cfg.URI = seeds[i]
-		server.cfg.Seed = seedsStr
-		server.CQLServerURI.replicationFactor = len(cluster.servers)
-		// We need gossip for clustered start
-		server.cfg.SkipWaitForGossipToSettle = 5
-
-		go startOne(&server)
-		cluster.servers[i] = &server
+		server := cluster.newServer(seeds[i], seedsStr)
+		go startOne(server)
+		cluster.servers[i] = server
 	}
 	wg.Wait()
 	select {
@@ -367,6 +758,29 @@ func (cluster *CQLCluster) Start(lane *Lane) error {
 	}
 }
 
+// A node of the cluster with the given address and seeds, set up
+// like every other node, both when the cluster starts and when a
+// node is replaced
+func (cluster *CQLCluster) newServer(uri string, seeds string) *CQLServer {
+	server := CQLServer{
+		builddir:  cluster.builddir,
+		resources: cluster.resources,
+		instances: len(cluster.servers),
+		loggers:   cluster.loggers,
+		requires:  cluster.requires,
+	}
+	// Set a shared cluster name
+	server.cfg.ClusterName = cluster.clusterName
+	server.cfg.URI = uri
+	server.cfg.Seed = seeds
+	server.CQLServerURI.replicationFactor = len(cluster.servers)
+	server.CQLServerURI.driver = cluster.driver
+	server.CQLServerURI.keyspace = cluster.keyspace
+	// We need gossip for clustered start
+	server.cfg.SkipWaitForGossipToSettle = 5
+	return &server
+}
+
 func (cluster *CQLCluster) Connect() (Connection, error) {
 	return cluster.servers[0].Connect()
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// CREATE TABLE [IF NOT EXISTS] [keyspace.]table
+var createTableRE = regexp.MustCompile(`(?is)^\s*CREATE\s+(TABLE|COLUMNFAMILY)\s+(IF\s+NOT\s+EXISTS\s+)?((\w+\.)?("[^"]+"|\w+))`)
+
+var gcGraceRE = regexp.MustCompile(`(?i)gc_grace_seconds`)
+
+// Apply the suite default gc_grace_seconds to a table created by
+// a successful CREATE TABLE statement, unless the statement sets
+// it explicitly
+func applyGcGrace(run *cqlTestRun, cql string) error {
+	if run.test.gcGraceSeconds == nil || gcGraceRE.MatchString(cql) {
+		return nil
+	}
+	m := createTableRE.FindStringSubmatch(cql)
+	if m == nil {
+		return nil
+	}
+	alter := fmt.Sprintf("ALTER TABLE %s WITH gc_grace_seconds = %d", m[3],
+		*run.test.gcGraceSeconds)
+	result, err := run.c.Execute(alter, nil)
+	if err != nil {
+		return merry.Prepend(err, "gc_grace_seconds")
+	}
+	if result.status != "OK" {
+		return merry.Errorf("gc_grace_seconds: %s", result.message)
+	}
+	return nil
+}
+
+// Scylla REST API port
+const SCYLLA_API_PORT = 10000
+
+// Let the given time pass for the data of a keyspace:
+//
+//	-- advance-time: <duration> [keyspace]
+//
+// Scylla can't move its clock forward, so the directive waits for
+// the duration and then flushes and compacts the keyspace, yacht
+// by default, on every server. After that expired cells are gone
+// and tombstones older than gc_grace_seconds are purged, which makes
+// TTL and tombstone tests deterministic. Use it with small TTLs and
+// gc_grace_seconds, see the suite gc_grace_seconds setting.
+func advanceTimeDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	args := strings.Fields(stmt.text)
+	if len(args) == 0 || len(args) > 2 {
+		return merry.Errorf("advance-time: malformed arguments '%s'", stmt.text)
+	}
+	duration, err := time.ParseDuration(args[0])
+	if err != nil {
+		return merry.Prepend(err, "advance-time")
+	}
+	var env = run.Environment()
+	var keyspace = envValue(env, "YACHT_KEYSPACE")
+	if len(args) == 2 {
+		keyspace = args[1]
+	}
+	// TTLs and gc_grace_seconds have a granularity of a second,
+	// make sure the whole last second has passed
+	time.Sleep(duration + time.Second)
+
+	// Servers have own API ports in "port" isolation
+	var apiPorts = strings.Split(envValue(env, "YACHT_API_PORTS"), ",")
+	for i, uri := range strings.Split(envValue(env, "YACHT_URIS"), ",") {
+		uri = strings.TrimSpace(uri)
+		if uri == "" {
+			continue
+		}
+		var port = SCYLLA_API_PORT
+		if i < len(apiPorts) && apiPorts[i] != "" {
+			port, _ = strconv.Atoi(apiPorts[i])
+		}
+		for _, op := range []string{"keyspace_flush", "keyspace_compaction"} {
+			url := fmt.Sprintf("http://%s/storage_service/%s/%s",
+				joinHostPort(uri, port), op, keyspace)
+			if err := postAPI(url); err != nil {
+				return merry.Prepend(err, "advance-time")
+			}
+		}
+	}
+	return nil
+}
+
+// Add the port to the host of an URI, unless it has one
+func joinHostPort(uri string, port int) string {
+	if i := strings.LastIndex(uri, ":"); i >= 0 && strings.Count(uri, ":") == 1 {
+		uri = uri[:i]
+	}
+	return uri + ":" + strconv.Itoa(port)
+}
+
+func postAPI(url string) error {
+	client := http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Post(url, "application/json", nil)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return merry.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
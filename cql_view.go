@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// Split a possibly qualified name of a view or table, looking up an
+// unqualified one in the current keyspace, or in all keyspaces if it
+// is unknown
+func qualifiedName(run *cqlTestRun, name string, schemaTable string,
+	column string) (string, string, error) {
+
+	if parts := strings.SplitN(name, ".", 2); len(parts) == 2 {
+		return parts[0], parts[1], nil
+	}
+	cql := fmt.Sprintf("SELECT keyspace_name FROM system_schema.%s WHERE %s = ? ALLOW FILTERING",
+		schemaTable, column)
+	var values = []interface{}{name}
+	if keyspace := run.Keyspace(); keyspace != "" {
+		// As in CQL, an unqualified name is in the current keyspace
+		cql = fmt.Sprintf("SELECT keyspace_name FROM system_schema.%s WHERE keyspace_name = ? "+
+			"AND %s = ? ALLOW FILTERING", schemaTable, column)
+		values = []interface{}{keyspace, name}
+	}
+	result, err := run.c.Execute(cql, &QueryOptions{values: values})
+	if err != nil {
+		return "", "", err
+	}
+	if result.status != "OK" {
+		return "", "", merry.New(result.message)
+	}
+	switch len(result.rows) {
+	case 0:
+		return "", "", merry.Errorf("'%s' not found", name)
+	case 1:
+		return result.rows[0][0], name, nil
+	}
+	return "", "", merry.Errorf("'%s' exists in more than one keyspace, qualify it", name)
+}
+
+// name [timeout duration]
+var waitTimeoutRE = regexp.MustCompile(`^(\S+)(\s+timeout\s+(\S+))?$`)
+
+// Poll a query with the given values until it returns rows
+func pollRows(run *cqlTestRun, cql string, timeout time.Duration,
+	values ...interface{}) (bool, error) {
+
+	start := time.Now()
+	for {
+		result, err := run.c.Execute(cql, &QueryOptions{values: values})
+		if err != nil {
+			return false, err
+		}
+		if result.status != "OK" {
+			return false, merry.New(result.message)
+		}
+		if len(result.rows) != 0 {
+			return true, nil
+		}
+		if time.Now().Sub(start) > timeout {
+			return false, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Wait until a materialized view is built:
+//
+//	-- wait-for-view: <view> [timeout <duration>]
+//
+// The default timeout is 60 seconds.
+func waitForViewDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	m := waitTimeoutRE.FindStringSubmatch(strings.TrimSpace(stmt.text))
+	if m == nil {
+		return merry.Errorf("wait-for-view: malformed arguments '%s'", stmt.text)
+	}
+	var timeout = 60 * time.Second
+	if m[3] != "" {
+		var err error
+		if timeout, err = time.ParseDuration(m[3]); err != nil {
+			return merry.Prepend(err, "wait-for-view")
+		}
+	}
+	keyspace, view, err := qualifiedName(run, m[1], "views", "view_name")
+	if err != nil {
+		return merry.Prepend(err, "wait-for-view")
+	}
+	built, err := pollRows(run,
+		"SELECT view_name FROM system.built_views WHERE keyspace_name = ? AND view_name = ?",
+		timeout, keyspace, view)
+	if err != nil {
+		return merry.Prepend(err, "wait-for-view")
+	}
+	if !built {
+		return merry.Errorf("wait-for-view: %s.%s is not built after %v", keyspace, view, timeout)
+	}
+	return nil
+}
+
+// view select-statement
+var checkViewRE = regexp.MustCompile(`(?is)^(\S+)\s+(SELECT\s.*?);?$`)
+
+// Check that a view has the same rows as the equivalent query of
+// the base table:
+//
+//	-- check-view: <view> SELECT ... FROM <base table> WHERE ...
+//
+// The query must return all columns of the view, the order of rows
+// and of columns doesn't matter. Rows missing from the view and
+// extra rows in it fail the test.
+func checkViewDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	m := checkViewRE.FindStringSubmatch(strings.TrimSpace(stmt.text))
+	if m == nil {
+		return merry.Errorf("check-view: malformed arguments '%s'", stmt.text)
+	}
+	query := func(cql string) (*CQLResult, error) {
+		result, err := run.c.Execute(cql, &QueryOptions{format: run.test.format})
+		if err != nil {
+			return nil, merry.Prepend(err, "check-view")
+		}
+		if result.status != "OK" {
+			return nil, merry.Errorf("check-view: '%s' failed: %s", cql, result.message)
+		}
+		return result, nil
+	}
+	view, err := query("SELECT * FROM " + m[1])
+	if err != nil {
+		return err
+	}
+	base, err := query(m[2])
+	if err != nil {
+		return err
+	}
+	// Positions of the view columns in the base query result
+	var columns []int
+	for _, name := range view.names {
+		var found = -1
+		for i, baseName := range base.names {
+			if baseName == name {
+				found = i
+			}
+		}
+		if found < 0 {
+			return merry.Errorf("check-view: column '%s' of %s is missing in '%s'",
+				name, m[1], m[2])
+		}
+		columns = append(columns, found)
+	}
+	var rows = make(map[string]int)
+	for _, row := range view.rows {
+		rows["("+strings.Join(row, ", ")+")"]++
+	}
+	var missing []string
+	for _, row := range base.rows {
+		var values []string
+		for _, i := range columns {
+			values = append(values, row[i])
+		}
+		key := "(" + strings.Join(values, ", ") + ")"
+		if rows[key] > 0 {
+			rows[key]--
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	var extra []string
+	for key, count := range rows {
+		for ; count > 0; count-- {
+			extra = append(extra, key)
+		}
+	}
+	if len(missing) == 0 && len(extra) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "check-view: %s doesn't match the base table", m[1])
+	if len(missing) != 0 {
+		fmt.Fprintf(&msg, "\nmissing rows %s: %s", strings.Join(view.names, ", "),
+			strings.Join(missing, " "))
+	}
+	if len(extra) != 0 {
+		fmt.Fprintf(&msg, "\nextra rows %s: %s", strings.Join(view.names, ", "),
+			strings.Join(extra, " "))
+	}
+	return merry.New(msg.String())
+}
+
+// CREATE [CUSTOM] INDEX [IF NOT EXISTS] [name] ON [keyspace.]table (column)
+var createIndexRE = regexp.MustCompile(`(?is)^\s*CREATE\s+(CUSTOM\s+)?INDEX\s+(IF\s+NOT\s+EXISTS\s+)?(\w*)\s*ON\s+((\w+)\.)?(\w+)\s*\(\s*(?:(\w+)\s*\))?`)
+
+// Wait until a secondary index is built. Scylla builds an index as a
+// materialized view named <index>_index. Indexes of other kinds, or
+// of other servers, have no such view and are not waited for.
+func waitForIndex(run *cqlTestRun, keyspace string, index string, timeout time.Duration) error {
+	view := strings.ToLower(index) + "_index"
+	exists, err := pollRows(run,
+		"SELECT view_name FROM system_schema.views WHERE keyspace_name = ? AND view_name = ?",
+		0, keyspace, view)
+	if err != nil || !exists {
+		return err
+	}
+	built, err := pollRows(run,
+		"SELECT view_name FROM system.built_views WHERE keyspace_name = ? AND view_name = ?",
+		timeout, keyspace, view)
+	if err != nil {
+		return err
+	}
+	if !built {
+		return merry.Errorf("index %s.%s is not built after %v", keyspace, index, timeout)
+	}
+	return nil
+}
+
+// Wait for the index created by a successful CREATE INDEX statement,
+// so that the following statements see all indexed rows
+func awaitCreatedIndex(run *cqlTestRun, cql string) error {
+	m := createIndexRE.FindStringSubmatch(cql)
+	if m == nil {
+		return nil
+	}
+	var index = m[3]
+	if index == "" {
+		if m[7] == "" {
+			// Can't guess the name of an index on keys(),
+			// values() or entries() of a collection
+			return nil
+		}
+		// The name Scylla gives an unnamed index
+		index = m[6] + "_" + m[7] + "_idx"
+	}
+	var keyspace = m[5]
+	if keyspace == "" {
+		var err error
+		if keyspace, _, err = qualifiedName(run, strings.ToLower(index),
+			"indexes", "index_name"); err != nil {
+			return err
+		}
+	}
+	return waitForIndex(run, strings.ToLower(keyspace), index, 60*time.Second)
+}
+
+// Wait until a secondary index is built:
+//
+//	-- wait-for-index: <index> [timeout <duration>]
+//
+// Indexes created by CREATE INDEX statements of the test are waited
+// for automatically, the directive is useful for indexes created
+// otherwise, e.g. by a shell command.
+func waitForIndexDirective(run *cqlTestRun, stmt *cqlStatement) error {
+	m := waitTimeoutRE.FindStringSubmatch(strings.TrimSpace(stmt.text))
+	if m == nil {
+		return merry.Errorf("wait-for-index: malformed arguments '%s'", stmt.text)
+	}
+	var timeout = 60 * time.Second
+	if m[3] != "" {
+		var err error
+		if timeout, err = time.ParseDuration(m[3]); err != nil {
+			return merry.Prepend(err, "wait-for-index")
+		}
+	}
+	keyspace, index, err := qualifiedName(run, m[1], "indexes", "index_name")
+	if err != nil {
+		return merry.Prepend(err, "wait-for-index")
+	}
+	return merry.Prepend(waitForIndex(run, keyspace, index, timeout), "wait-for-index")
+}
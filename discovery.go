@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Suites are discovered in the background while the found ones run,
+// so that the first suite starts right away rather than after every
+// suite directory is read, see discoverSuites()
+type suiteDiscovery struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// All suite directories are read
+	done bool
+	// What discovery printed, see discoveryPrintf()
+	output bytes.Buffer
+}
+
+// Start finding suites in the background. RunSuites() then takes
+// them as they are found, see nextSuite().
+func (yacht *Yacht) discoverSuites() {
+	var discovery = &suiteDiscovery{}
+	discovery.cond = sync.NewCond(&discovery.mutex)
+	yacht.discovery = discovery
+	go func() {
+		yacht.findSuites()
+		discovery.mutex.Lock()
+		discovery.done = true
+		discovery.mutex.Unlock()
+		discovery.cond.Broadcast()
+	}()
+}
+
+// Wait until discovery is over, e.g. if the run stopped early
+func (yacht *Yacht) waitDiscovery() {
+	if yacht.discovery == nil {
+		return
+	}
+	yacht.discovery.mutex.Lock()
+	defer yacht.discovery.mutex.Unlock()
+	for !yacht.discovery.done {
+		yacht.discovery.cond.Wait()
+	}
+	yacht.discovery.flush()
+}
+
+// Print a message of findSuites(). During background discovery it's
+// kept until RunSuites() takes the next suite, so that it doesn't
+// break into the results of the running one.
+func (yacht *Yacht) discoveryPrintf(format string, a ...interface{}) {
+	if yacht.discovery == nil {
+		fmt.Printf(format, a...)
+		return
+	}
+	yacht.discovery.mutex.Lock()
+	defer yacht.discovery.mutex.Unlock()
+	fmt.Fprintf(&yacht.discovery.output, format, a...)
+}
+
+// Print the kept messages, with the mutex held
+func (discovery *suiteDiscovery) flush() {
+	fmt.Print(discovery.output.String())
+	discovery.output.Reset()
+}
+
+// Add a found suite, waking up RunSuites() if it waits for one
+func (yacht *Yacht) addSuite(suite TestSuite) {
+	if yacht.discovery == nil {
+		yacht.suites = append(yacht.suites, suite)
+		return
+	}
+	yacht.discovery.mutex.Lock()
+	yacht.suites = append(yacht.suites, suite)
+	yacht.discovery.mutex.Unlock()
+	yacht.discovery.cond.Broadcast()
+}
+
+// The next suite to run, nil if all ran. Without background discovery
+// suites run in the order of sortSuites(). With it, the next suite is
+// the first in the same order of the suites found so far which didn't
+// run and whose dependencies ran. A suite which depends on a suite
+// not found yet waits till the end of discovery, as it may be found
+// later. Discovery is faster than running a suite, so all suites but
+// the first usually run in the usual order.
+func (yacht *Yacht) nextSuite(ran map[string]bool) TestSuite {
+	if yacht.discovery == nil {
+		for _, suite := range yacht.suites {
+			if !ran[suite.Name()] {
+				return suite
+			}
+		}
+		return nil
+	}
+	var discovery = yacht.discovery
+	discovery.mutex.Lock()
+	defer discovery.mutex.Unlock()
+	for {
+		discovery.flush()
+		var pending []TestSuite
+		var found = make(map[string]bool)
+		for _, suite := range yacht.suites {
+			found[suite.Name()] = true
+			if !ran[suite.Name()] {
+				pending = append(pending, suite)
+			}
+		}
+		sort.SliceStable(pending, func(i, j int) bool {
+			return yacht.runsBefore(pending[i], pending[j])
+		})
+		for _, suite := range pending {
+			var ready = true
+			for _, dep := range suite.DependsOn() {
+				if !ran[dep] && (found[dep] || !discovery.done) {
+					ready = false
+				}
+			}
+			if ready {
+				for _, dep := range suite.DependsOn() {
+					if !found[dep] {
+						fmt.Printf("%s %s\n", palette.Warn("Suite %s depends on suite %s,"+
+							" which is not selected to run:", suite.Name(), dep),
+							palette.Path("%s runs without it", suite.Name()))
+					}
+				}
+				return suite
+			}
+		}
+		if discovery.done {
+			if len(pending) == 0 {
+				return nil
+			}
+			// A dependency cycle: run the rest in the current order
+			fmt.Printf("%s %s\n", palette.Warn("Suite dependency cycle at"),
+				palette.Path(pending[0].Name()))
+			return pending[0]
+		}
+		discovery.cond.Wait()
+	}
+}
+
+// Where the run is: the number of the suite which starts, of the
+// suites found so far, and whether discovery goes on
+func (yacht *Yacht) suiteProgress(started int) string {
+	if yacht.discovery == nil {
+		return fmt.Sprintf("suite %d of %d", started, len(yacht.suites))
+	}
+	yacht.discovery.mutex.Lock()
+	defer yacht.discovery.mutex.Unlock()
+	if yacht.discovery.done {
+		return fmt.Sprintf("suite %d of %d", started, len(yacht.suites))
+	}
+	return fmt.Sprintf("suite %d of %d found so far, still looking for suites", started,
+		len(yacht.suites))
+}
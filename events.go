@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// Progress of the run as JSON lines, one event per line, for wrappers
+// and IDE integrations, see --events. Every event has "event", its
+// kind, and "time"; the rest of the fields depend on the kind:
+//
+//	run-start    patterns, mode
+//	suite-start  lane, suite, mode
+//	test-start   lane, test, mode
+//	statement    lane, test, location, status, latency_ms
+//	test-end     lane, test, mode, result, duration_ms
+//	suite-end    lane, suite, mode, rc
+//	run-end      status, passed, failed, failed_tests, not_run, duration_ms
+type EventStream struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+var events EventStream
+
+// Start writing events to the file, or to the standard output if
+// it's "-". The console output then goes to the standard error, so
+// that the standard output has nothing but events.
+func OpenEvents(name string) error {
+	if name == "" {
+		return nil
+	}
+	if name == "-" {
+		// See redirectConsole()
+		return nil
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	events.w = file
+	return nil
+}
+
+// With --events=- the console output must go to the standard error
+// before anything is printed, i.e. before the options are parsed
+func redirectConsole() {
+	for i, arg := range os.Args[1:] {
+		if arg == "--events=-" || (arg == "--events" && i+2 < len(os.Args) &&
+			os.Args[i+2] == "-") {
+			events.w = os.Stdout
+			os.Stdout = os.Stderr
+			return
+		}
+	}
+}
+
+// Write an event, it's safe to call from several lanes at once
+func (stream *EventStream) Emit(event string, fields map[string]interface{}) {
+	if stream.w == nil {
+		return
+	}
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["event"] = event
+	fields["time"] = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		ylog.Warnf("failed to encode %s event: %v", event, err)
+		return
+	}
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if _, err := stream.w.Write(append(line, '\n')); err != nil {
+		ylog.Warnf("failed to write %s event: %v", event, err)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,25 @@
+package main
+
+// Settings of an exe suite, see 'exe' in suite.yaml
+type ExeConfig struct {
+	// Arguments of every test
+	Args []string
+	// Compare the standard output of a test with its result file,
+	// e.g. foo.result for foo.test.sh
+	CompareOutput bool `mapstructure:"compare_output"`
+}
+
+// A suite of executable files named *.test or *.test.<ext>, e.g.
+// shell scripts running sstable tools or nodetool, each run with the
+// lane and server environment
+func newExeTestSuite(cfg ExeConfig) *ProcessTestSuite {
+	return &ProcessTestSuite{
+		kind:       "exe",
+		globs:      []string{"*.test", "*.test.*"},
+		executable: true,
+		compare:    cfg.CompareOutput,
+		command: func(test *ProcessTest) []string {
+			return append([]string{test.path}, cfg.Args...)
+		},
+	}
+}
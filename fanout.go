@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/ansel1/merry"
+)
+
+// Lanes to run n suites or modes at once: the main lane and lanes 2,
+// 3 and so on, created when first needed. Lanes lease addresses and
+// ports from the same pool, so that their servers don't collide.
+func (yacht *Yacht) parallelLanes(n int) ([]*Lane, error) {
+	for len(yacht.lanes) < n-1 {
+		lane := &Lane{count: n}
+		if err := yacht.initLane(lane, strconv.Itoa(len(yacht.lanes)+2)); err != nil {
+			return nil, err
+		}
+		// The time budget is of the whole run
+		lane.deadline = yacht.lane.deadline
+		lane.leases = yacht.lane.Leases()
+		yacht.lanes = append(yacht.lanes, lane)
+	}
+	var lanes = []*Lane{&yacht.lane}
+	for _, lane := range yacht.lanes[:n-1] {
+		lane.count = n
+		lanes = append(lanes, lane)
+	}
+	return lanes, nil
+}
+
+// Run uri mode suites against several independent clusters at once,
+// see --clusters. Each cluster gets an own lane: the first one runs
+// on the main lane, the rest on lanes 2, 3 and so on.
+func (yacht *Yacht) fanOutLanes() ([]*Lane, error) {
+	return yacht.parallelLanes(len(yacht.env.clusters))
+}
+
+// A copy of the suite to run on another lane at the same time as
+// the original. Its reject and result files go to the lane
+// directory, so that the copies don't overwrite each other's, and
+// it doesn't record test durations.
+func (suite *CQLTestSuite) Clone(outdir string) *CQLTestSuite {
+	var clone = *suite
+	clone.outdir = outdir
+	clone.history = nil
+	clone.tests = nil
+	if clone.recordDir != "" {
+		clone.recordDir = path.Join(outdir, "recordings")
+	}
+	for _, test := range suite.tests {
+		t := *test
+		t.outdir = outdir
+		t.format = &clone.format
+		t.Init()
+		clone.tests = append(clone.tests, &t)
+	}
+	return &clone
+}
+
+// Run the suite against each of --clusters in parallel, return the
+// combined exit code and the failed tests, annotated with the
+// cluster they failed against
+func (yacht *Yacht) FanOut(suite TestSuite, server *CQLServerURI) (int, []string, error) {
+	cqlSuite, ok := suite.(*CQLTestSuite)
+	if !ok {
+		return 0, nil, merry.Errorf("suite %s can't run against several clusters",
+			suite.Name())
+	}
+	lanes, err := yacht.fanOutLanes()
+	if err != nil {
+		return 0, nil, err
+	}
+	// The main lane prefixes its output with its id too, and its
+	// servers share the host with the others
+	var count = yacht.lane.count
+	yacht.lane.count = len(lanes)
+	defer func() { yacht.lane.count = count }()
+	var wg sync.WaitGroup
+	var rcs = make([]int, len(lanes))
+	var errs = make([]error, len(lanes))
+	for i, lane := range lanes {
+		var s = cqlSuite
+		var srv = server
+		if i > 0 {
+			s = cqlSuite.Clone(path.Join(lane.Dir(), "results", suite.Name()))
+			srv = &CQLServerURI{uri: yacht.env.clusters[i], driver: server.driver,
+				keyspace: yacht.env.keyspace, yesWipe: server.yesWipe,
+				readOnly: server.readOnly}
+		}
+		wg.Add(1)
+		go func(i int, lane *Lane, s *CQLTestSuite, srv *CQLServerURI) {
+			defer wg.Done()
+			lane.CleanupBeforeNextSuite()
+			if errs[i] = lane.CheckDiskSpace(); errs[i] != nil {
+				return
+			}
+			lane.Log().Section("suite %s, mode %s, cluster %s", s.Name(), srv.ModeName(),
+				srv.uri)
+			events.Emit("suite-start", map[string]interface{}{"lane": lane.id,
+				"suite": s.Name(), "mode": srv.ModeName(), "cluster": srv.uri})
+			if errs[i] = s.PrepareLane(lane, srv); errs[i] != nil {
+				errs[i] = merry.Prepend(errs[i], "cluster "+srv.uri)
+				return
+			}
+			rcs[i], errs[i] = s.RunSuite(yacht.env.force, lane, srv)
+			events.Emit("suite-end", map[string]interface{}{"lane": lane.id,
+				"suite": s.Name(), "mode": srv.ModeName(), "cluster": srv.uri,
+				"rc": rcs[i]})
+			if errs[i] != nil {
+				errs[i] = merry.Prepend(errs[i], "cluster "+srv.uri)
+			}
+		}(i, lane, s, srv)
+	}
+	wg.Wait()
+	var rc int
+	var failed []string
+	for i, lane := range lanes {
+		if errs[i] != nil {
+			return rc, failed, errs[i]
+		}
+		rc |= rcs[i]
+		for _, name := range lane.FailedTests() {
+			failed = append(failed, fmt.Sprintf("%s (uri %s)", name, yacht.env.clusters[i]))
+		}
+		yacht.passed += lane.PassedTests()
+	}
+	return rc, failed, nil
+}
+
+// Lanes which run the modes of a suite at once. They stop together:
+// without --force at the first failed test, as a single lane does,
+// and once --max-failures tests failed on all of them.
+type laneGroup struct {
+	mutex sync.Mutex
+	force bool
+	// Distinct tests failed in the run, including earlier suites
+	failedTests map[string]bool
+	maxFailures int
+	stopped     bool
+}
+
+func (group *laneGroup) addFailedTest(name string) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.failedTests[name] = true
+	if !group.force || (group.maxFailures > 0 && len(group.failedTests) >= group.maxFailures) {
+		group.stopped = true
+	}
+}
+
+func (group *laneGroup) Stopped() bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	return group.stopped
+}
+
+// Run the modes of a suite with parallel_modes at once, each on an
+// own lane: the first mode on the main lane, the rest on lanes 2, 3
+// and so on. Return the combined exit code and the failed tests,
+// annotated with the mode they failed in.
+func (yacht *Yacht) RunModes(suite *CQLTestSuite) (int, []string, error) {
+	var servers = suite.Servers()
+	lanes, err := yacht.parallelLanes(len(servers))
+	if err != nil {
+		return 0, nil, err
+	}
+	// Servers of the main lane share the host with the others too
+	var count = yacht.lane.count
+	yacht.lane.count = len(lanes)
+	defer func() { yacht.lane.count = count }()
+	var group = &laneGroup{
+		force:       yacht.env.force,
+		failedTests: make(map[string]bool),
+		maxFailures: yacht.env.max_failures,
+	}
+	for name := range yacht.lane.failedTests {
+		group.failedTests[name] = true
+	}
+	var wg sync.WaitGroup
+	var rcs = make([]int, len(lanes))
+	var errs = make([]error, len(lanes))
+	for i, lane := range lanes {
+		var s = suite
+		if i > 0 {
+			s = suite.Clone(path.Join(lane.Dir(), "results", suite.Name()))
+		}
+		lane.group = group
+		wg.Add(1)
+		go func(i int, lane *Lane, s *CQLTestSuite, server Server) {
+			defer wg.Done()
+			if lane.TimedOut() {
+				s.NotRun(lane, server)
+				return
+			}
+			lane.CleanupBeforeNextSuite()
+			if errs[i] = lane.CheckDiskSpace(); errs[i] != nil {
+				return
+			}
+			lane.Log().Section("suite %s, mode %s", s.Name(), server.ModeName())
+			events.Emit("suite-start", map[string]interface{}{"lane": lane.id,
+				"suite": s.Name(), "mode": server.ModeName()})
+			if errs[i] = s.PrepareLane(lane, server); errs[i] != nil {
+				errs[i] = merry.Prepend(errs[i], "mode "+server.ModeName())
+				return
+			}
+			rcs[i], errs[i] = s.RunSuite(yacht.env.force, lane, server)
+			events.Emit("suite-end", map[string]interface{}{"lane": lane.id,
+				"suite": s.Name(), "mode": server.ModeName(), "rc": rcs[i]})
+			if errs[i] != nil {
+				errs[i] = merry.Prepend(errs[i], "mode "+server.ModeName())
+			}
+		}(i, lane, s, servers[i])
+	}
+	wg.Wait()
+	defer func() {
+		for i, lane := range lanes {
+			lane.group = nil
+			// Stop the servers of the other lanes, which may not
+			// run anything until the end of the run
+			if i > 0 {
+				lane.CleanupBeforeNextSuite()
+			}
+		}
+	}()
+	// --max-failures counts the tests of all lanes
+	yacht.lane.failedTests = group.failedTests
+	var rc int
+	var failed []string
+	for i, lane := range lanes {
+		if errs[i] != nil {
+			return rc, failed, errs[i]
+		}
+		rc |= rcs[i]
+		var mode = servers[i].ModeName()
+		fmt.Printf("%sMode %s: %d passed, %d failed\n", lane.Prefix(), mode,
+			lane.PassedTests(), len(lane.FailedTests()))
+		for _, name := range lane.FailedTests() {
+			failed = append(failed, fmt.Sprintf("%s (mode %s)", name, mode))
+		}
+		yacht.passed += lane.PassedTests()
+	}
+	return rc, failed, nil
+}
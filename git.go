@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// A test file or one of its result files, e.g. foo.result.cluster
+var testFileRE = regexp.MustCompile(`^(.*)\.(test\.cql|result(\.\w+)?)$`)
+var rejectFileRE = regexp.MustCompile(`\.reject(\.\w+)?$`)
+
+func git(dir string, args ...string) ([]string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	out, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return nil, merry.Errorf("git %s failed: %s", strings.Join(args, " "),
+				strings.TrimSpace(string(e.Stderr)))
+		}
+		return nil, merry.Wrap(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// Find files in the git repository of dir which differ from the base
+// ref, or are new and not committed yet. Return absolute paths of
+// changed test files, with changed result files mapped to their
+// tests, and of other changed files, e.g. suite configurations, as is.
+func gitChangedFiles(dir string, base string) (map[string]bool, error) {
+	top, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	if len(top) == 0 {
+		return nil, merry.Errorf("%s is not in a git repository", dir)
+	}
+	changed, err := git(dir, "diff", "--name-only", base)
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git(dir, "ls-files", "--others", "--exclude-standard", "--full-name")
+	if err != nil {
+		return nil, err
+	}
+	var files = make(map[string]bool)
+	for _, file := range append(changed, untracked...) {
+		if rejectFileRE.MatchString(file) {
+			// Left by a failed run, not a change
+			continue
+		}
+		file = filepath.Join(top[0], file)
+		if m := testFileRE.FindStringSubmatch(file); m != nil {
+			file = m[1] + ".test.cql"
+		}
+		files[file] = true
+	}
+	return files, nil
+}
@@ -9,12 +9,12 @@ require (
 	github.com/gocql/gocql v0.0.0-20190717194327-8000ef36d79b
 	github.com/google/uuid v1.1.1
 	github.com/mattn/go-colorable v0.1.2 // indirect
-	github.com/mattn/go-runewidth v0.0.4 // indirect
+	github.com/mattn/go-runewidth v0.0.4
 	github.com/olekukonko/tablewriter v0.0.1
+	github.com/pierrec/lz4/v4 v4.1.8
 	github.com/pmezard/go-difflib v1.0.0
 	github.com/sergi/go-diff v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.4.0
-	github.com/udhos/equalfile v0.3.0
 	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7 // indirect
 )
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ansel1/merry"
+)
+
+// A canned response of the mock server, set in 'responses' section
+// of suite.yaml, or with -- mock: directive
+type MockResponse struct {
+	// A regular expression the statement must match, the first
+	// matching response is used
+	Query string
+	// OK (default) or ERROR
+	Status  string
+	Code    string
+	Message string
+	// Names of the columns and values of the rows of the result
+	Columns  []string
+	Rows     [][]string
+	Warnings []string
+	// Fail the statement with an error instead of a result:
+	// "connection-lost", "access-denied" or a message of a
+	// driver error
+	Error string
+
+	re *regexp.Regexp
+}
+
+// Compile the response pattern, statements are matched with trailing
+// whitespace and semicolon removed
+func (response *MockResponse) Compile() error {
+	re, err := regexp.Compile(`(?is)^\s*(` + response.Query + `)\s*;?\s*$`)
+	if err != nil {
+		return merry.Prependf(err, "malformed query pattern '%s'", response.Query)
+	}
+	response.re = re
+	return nil
+}
+
+func compileResponses(responses []MockResponse) error {
+	for i := range responses {
+		if err := responses[i].Compile(); err != nil {
+			return merry.Prepend(err, "responses")
+		}
+	}
+	return nil
+}
+
+// An in-process server which answers statements with canned
+// responses, to test the harness itself, prototype tests or run
+// them in CI without Scylla. Statements which match no response
+// succeed with an empty result.
+type mockServer struct {
+	responses []MockResponse
+	// Responses registered by the running test, checked first and
+	// dropped when the test ends
+	registered []MockResponse
+	mutex      sync.Mutex
+}
+
+func (server *mockServer) Register(response MockResponse) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.registered = append([]MockResponse{response}, server.registered...)
+}
+
+func (server *mockServer) find(cql string) *MockResponse {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, responses := range [][]MockResponse{server.registered, server.responses} {
+		for i := range responses {
+			if responses[i].re.MatchString(cql) {
+				return &responses[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (server *mockServer) Start(lane *Lane) error {
+	return nil
+}
+
+func (server *mockServer) Connect() (Connection, error) {
+	return &mockConnection{server: server}, nil
+}
+
+func (server *mockServer) ModeName() string {
+	return "mock"
+}
+
+func (server *mockServer) Environment() []string {
+	return nil
+}
+
+func (server *mockServer) LogFiles() []string {
+	return nil
+}
+
+type mockConnection struct {
+	server *mockServer
+}
+
+func (c *mockConnection) Execute(cql string, opts *QueryOptions) (*CQLResult, error) {
+	var result = CQLResult{status: "OK", attempts: 1}
+	var response = c.server.find(cql)
+	if response == nil {
+		return &result, nil
+	}
+	switch response.Error {
+	case "":
+	case "connection-lost":
+		return nil, merry.WithMessage(ErrConnectionLost, "mock: connection lost")
+	case "access-denied":
+		return nil, merry.WithMessage(ErrAccessDenied, "mock: access denied")
+	default:
+		return nil, merry.New(response.Error)
+	}
+	if strings.EqualFold(response.Status, "ERROR") {
+		result.status = "ERROR"
+		result.code = response.Code
+		result.message = response.Message
+		return &result, nil
+	}
+	result.warnings = response.Warnings
+	result.names = response.Columns
+	for range response.Columns {
+		result.types = append(result.types, "varchar")
+	}
+	for _, row := range response.Rows {
+		result.rows = append(result.rows, row)
+		if opts != nil && opts.format.JSON() {
+			var jsonrow = make(map[string]interface{})
+			for i, column := range response.Columns {
+				if i < len(row) {
+					jsonrow[column] = row[i]
+				}
+			}
+			text, err := json.Marshal(jsonrow)
+			if err != nil {
+				return nil, merry.Wrap(err)
+			}
+			result.json = append(result.json, string(text))
+		}
+	}
+	return &result, nil
+}
+
+func (c *mockConnection) Reset() error {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	c.server.registered = nil
+	return nil
+}
+
+func (c *mockConnection) Close() {
+}
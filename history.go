@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/ansel1/merry"
+)
+
+// Durations of suites and tests of previous runs, used to schedule
+// fast suites and long tests first. Stored in vardir, so it survives
+// lane cleanup.
+type History struct {
+	// Suite name -> duration of its last run, in seconds
+	Suites map[string]float64 `json:"suites"`
+	// suite/test name -> duration of its last run, in seconds
+	Tests map[string]float64 `json:"tests"`
+
+	file string
+}
+
+const HISTORY_FILE = "yacht_history.json"
+
+// Read the history from the directory. Missing or unreadable
+// history is not an error: the run goes on without it.
+func LoadHistory(dir string) *History {
+	var history = History{
+		Suites: make(map[string]float64),
+		Tests:  make(map[string]float64),
+		file:   path.Join(dir, HISTORY_FILE),
+	}
+	data, err := ioutil.ReadFile(history.file)
+	if err != nil {
+		if os.IsNotExist(err) == false {
+			ylog.Warnf("Failed to read run history: %v", err)
+		}
+		return &history
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		ylog.Warnf("Ignoring malformed run history %s: %v", history.file, err)
+	}
+	if history.Suites == nil {
+		history.Suites = make(map[string]float64)
+	}
+	if history.Tests == nil {
+		history.Tests = make(map[string]float64)
+	}
+	return &history
+}
+
+func (history *History) Save() error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	if err := ioutil.WriteFile(history.file, data, 0644); err != nil {
+		return merry.Prepend(err, "failed to save run history")
+	}
+	return nil
+}
+
+// Estimate durations of the tests: use the history when available,
+// and scale file sizes by the average time per byte of the tests with
+// history otherwise. If there is no history at all, file sizes are
+// the estimates.
+func (history *History) EstimateDurations(names []string, sizes []int64) []float64 {
+	var estimates = make([]float64, len(names))
+	var known, knownBytes float64
+	for i, name := range names {
+		if history != nil && history.Tests[name] > 0 {
+			known += history.Tests[name]
+			knownBytes += float64(sizes[i])
+		}
+	}
+	var perByte = 1.0
+	if known > 0 && knownBytes > 0 {
+		perByte = known / knownBytes
+	}
+	for i, name := range names {
+		if history != nil && history.Tests[name] > 0 {
+			estimates[i] = history.Tests[name]
+		} else {
+			estimates[i] = float64(sizes[i]) * perByte
+		}
+	}
+	return estimates
+}
+
+// Distribute jobs with the given durations among lanes to minimize
+// the total run time, using the longest processing time first
+// heuristic: take jobs longest first and give each to the lane which
+// is going to be free first. Return job indexes for every lane, in
+// the order of execution.
+func scheduleLPT(durations []float64, lanes int) [][]int {
+	var order = make([]int, len(durations))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return durations[order[i]] > durations[order[j]]
+	})
+	var queues = make([][]int, lanes)
+	var load = make([]float64, lanes)
+	for _, job := range order {
+		var lane int
+		for i := range load {
+			if load[i] < load[lane] {
+				lane = i
+			}
+		}
+		queues[lane] = append(queues[lane], job)
+		load[lane] += durations[job]
+	}
+	return queues
+}
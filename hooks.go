@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// Where and what to post when a run completes, set in 'notify'
+// section of .yacht.yaml
+type NotifyConfig struct {
+	// A webhook URL, e.g. of a Slack incoming webhook
+	Url string
+	// text/template of the request body, executed with RunSummary.
+	// The json function quotes a string for use in JSON.
+	Template string
+}
+
+// The default body is understood by Slack incoming webhooks
+const DEFAULT_NOTIFY_TEMPLATE = `{"text": {{printf "yacht %s: %d passed, %d failed in %v %v, log: %s" .Status .Passed .Failed .Duration .FailedTests .Log | json}}}`
+
+// The outcome of a run
+type RunSummary struct {
+	// "passed" or "failed"
+	Status      string
+	Passed      int
+	Failed      int
+	FailedTests []string
+	// Description, tags and issue links of failed tests, by name
+	Metadata map[string]TestMetadata
+	// Tests not run because the time budget of the run is over
+	NotRun   int
+	Duration time.Duration
+	// Path to yacht.log of the run
+	Log string
+}
+
+func newRunSummary(env *Env, passed int, failed []string, rc int, start time.Time) RunSummary {
+	var summary = RunSummary{
+		Status:      "passed",
+		Passed:      passed,
+		Failed:      len(failed),
+		FailedTests: failed,
+		Duration:    time.Now().Sub(start).Round(time.Second),
+		Log:         path.Join(env.vardir, "yacht.log"),
+	}
+	if rc != 0 {
+		summary.Status = "failed"
+	}
+	return summary
+}
+
+// Post the run summary to the configured webhook
+func (cfg *NotifyConfig) Notify(summary RunSummary) error {
+	if cfg.Url == "" {
+		return nil
+	}
+	var text = cfg.Template
+	if text == "" {
+		text = DEFAULT_NOTIFY_TEMPLATE
+	}
+	tmpl, err := template.New("notify").Funcs(template.FuncMap{
+		"json": func(s string) (string, error) {
+			b, err := json.Marshal(s)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return merry.Prepend(err, "malformed notify template")
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, summary); err != nil {
+		return merry.Prepend(err, "failed to execute notify template")
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cfg.Url, "application/json", &body)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return merry.Errorf("%s replied %s", cfg.Url, resp.Status)
+	}
+	ylog.Printf("Posted run summary to %s", cfg.Url)
+	return nil
+}
+
+// Post the summary and report, but ignore, a failure to do so:
+// it must not change the outcome of the run
+func notify(cfg *NotifyConfig, summary RunSummary) {
+	if err := cfg.Notify(summary); err != nil {
+		ylog.Warnf("Notification failed: %v", err)
+		fmt.Printf("%s%v\n", palette.Warn("notification failure: "), err)
+	}
+}
+
+// Run the on_failure command in the lane directory, e.g. to collect
+// artefacts or file a bug. Its output goes to the console. A failure
+// of the command doesn't change the outcome of the test.
+func runFailureHook(command string, env []string, dir string) {
+	ylog.Printf("Running on_failure command '%s'", command)
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		ylog.Warnf("on_failure command failed: %v", err)
+		fmt.Printf("%s%v\n", palette.Warn("on_failure command failed: "), err)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+)
+
+// Where and how k8s mode provisions Scylla, the 'k8s' section of
+// .yacht.yaml
+type K8sConfig struct {
+	// Path to kubectl, "kubectl" by default
+	Kubectl string
+	// The kubectl context, the current one if empty
+	Context string
+	// The namespace to create the pods in, "default" by default
+	Namespace string
+	// The Scylla image, scylladb/scylla:latest by default
+	Image string
+	// The number of nodes, 1 by default
+	Nodes int
+	// Create a ScyllaCluster of the Scylla operator instead of
+	// a StatefulSet
+	Operator bool
+	// How the driver reaches the nodes: port-forward, through a
+	// forwarded local port of each pod, or pod-ip, directly, when
+	// yacht runs inside the Kubernetes cluster
+	Access string
+	// How long to wait for the nodes to become ready, 10m by default
+	Timeout string
+
+	timeout time.Duration
+}
+
+const K8S_DEFAULT_TIMEOUT = 10 * time.Minute
+
+func (cfg *K8sConfig) Init() error {
+	if cfg.Kubectl == "" {
+		cfg.Kubectl = "kubectl"
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = "default"
+	}
+	if cfg.Image == "" {
+		cfg.Image = "scylladb/scylla:latest"
+	}
+	if cfg.Nodes == 0 {
+		cfg.Nodes = 1
+	} else if cfg.Nodes < 0 {
+		return merry.Errorf("k8s nodes: must be positive, got %d", cfg.Nodes)
+	}
+	if cfg.Access == "" {
+		cfg.Access = "port-forward"
+	} else if cfg.Access != "port-forward" && cfg.Access != "pod-ip" {
+		return merry.Errorf("k8s access: '%s', must be port-forward or pod-ip", cfg.Access)
+	}
+	cfg.timeout = K8S_DEFAULT_TIMEOUT
+	if cfg.Timeout != "" {
+		var err error
+		if cfg.timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return merry.Prepend(err, "k8s timeout")
+		}
+	}
+	return nil
+}
+
+func (cfg *K8sConfig) command(args ...string) *exec.Cmd {
+	var global = []string{"--namespace", cfg.Namespace}
+	if cfg.Context != "" {
+		global = append(global, "--context", cfg.Context)
+	}
+	return exec.Command(cfg.Kubectl, append(global, args...)...)
+}
+
+// Run kubectl with the given standard input, return its output
+func (cfg *K8sConfig) run(stdin string, args ...string) (string, error) {
+	cmd := cfg.command(args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	ylog.Debugf("running %s %s", cfg.Kubectl, strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", merry.Errorf("kubectl %s: %v: %s", strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// Scylla nodes in pods of a Kubernetes cluster, created for the suite
+// and deleted when it ends
+type K8sCluster struct {
+	CQLServerURI
+	cfg K8sConfig
+	// The name of the StatefulSet or ScyllaCluster and the label
+	// of its pods
+	name string
+	// Names and addresses of the pods, in the order of the names
+	pods []string
+	ips  []string
+	// CPUs and memory of each node
+	resources ServerResources
+	// Levels of loggers of each node
+	loggers LoggerLevels
+}
+
+// Settings of a k8s mode in suite.yaml which override the 'k8s'
+// section of .yacht.yaml, e.g. nodes: 3
+func (server *K8sCluster) Configure(mode map[string]string) error {
+	if nodes, found := mode["nodes"]; found {
+		n, err := strconv.Atoi(nodes)
+		if err != nil || n <= 0 {
+			return merry.Errorf("malformed nodes '%s'", nodes)
+		}
+		server.cfg.Nodes = n
+	}
+	if image, found := mode["image"]; found {
+		server.cfg.Image = image
+	}
+	if namespace, found := mode["namespace"]; found {
+		server.cfg.Namespace = namespace
+	}
+	if operator, found := mode["operator"]; found {
+		value, err := strconv.ParseBool(operator)
+		if err != nil {
+			return merry.Errorf("malformed operator '%s'", operator)
+		}
+		server.cfg.Operator = value
+	}
+	return nil
+}
+
+func (server *K8sCluster) ModeName() string {
+	return "k8s"
+}
+
+func (server *K8sCluster) Environment() []string {
+	return []string{
+		"YACHT_MODE=" + server.ModeName(),
+		"YACHT_URIS=" + strings.Join(server.ips, ","),
+		"YACHT_KEYSPACE=" + server.keyspace,
+		"YACHT_K8S_NAMESPACE=" + server.cfg.Namespace,
+		"YACHT_K8S_CLUSTER=" + server.name,
+		"YACHT_K8S_PODS=" + strings.Join(server.pods, ","),
+	}
+}
+
+// Pod logs are saved to the lane directory when the pods are deleted
+func (server *K8sCluster) LogFiles() []string {
+	return nil
+}
+
+const K8S_STATEFULSET_TEMPLATE = `apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    yacht/cluster: {{.Name}}
+spec:
+  clusterIP: None
+  publishNotReadyAddresses: true
+  selector:
+    yacht/cluster: {{.Name}}
+  ports:
+  - name: cql
+    port: 9042
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    yacht/cluster: {{.Name}}
+spec:
+  serviceName: {{.Name}}
+  replicas: {{.Nodes}}
+  selector:
+    matchLabels:
+      yacht/cluster: {{.Name}}
+  template:
+    metadata:
+      labels:
+        yacht/cluster: {{.Name}}
+    spec:
+      containers:
+      - name: scylla
+        image: {{.Image}}
+        args:
+        - --developer-mode=1
+        - --overprovisioned=1
+        - --smp={{.SMP}}
+        - --memory={{.Memory}}
+        - --seeds={{.Name}}-0.{{.Name}}.{{.Namespace}}.svc.cluster.local
+        {{- range .Args}}
+        - {{printf "%q" .}}
+        {{- end}}
+        ports:
+        - containerPort: 9042
+        readinessProbe:
+          tcpSocket:
+            port: 9042
+          periodSeconds: 5
+`
+
+const K8S_OPERATOR_TEMPLATE = `apiVersion: scylla.scylladb.com/v1
+kind: ScyllaCluster
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+spec:
+  repository: {{.Repository}}
+  version: {{.Version}}
+  developerMode: true
+  {{- if .Args}}
+  scyllaArgs: {{printf "%q" (join .Args " ")}}
+  {{- end}}
+  datacenter:
+    name: dc1
+    racks:
+    - name: rack1
+      members: {{.Nodes}}
+      storage:
+        capacity: 1Gi
+      resources:
+        requests:
+          cpu: {{.SMP}}
+          memory: {{.Memory}}
+        limits:
+          cpu: {{.SMP}}
+          memory: {{.Memory}}
+`
+
+// The manifest of the nodes, and the label selector of their pods
+func (server *K8sCluster) manifest() (string, string, error) {
+	var params = struct {
+		Name, Namespace, Image, Repository, Version, Memory string
+		Nodes, SMP                                          int
+		Args                                                []string
+	}{
+		Name:      server.name,
+		Namespace: server.cfg.Namespace,
+		Image:     server.cfg.Image,
+		Nodes:     server.cfg.Nodes,
+		SMP:       1,
+	}
+	if server.resources.SMP > 0 {
+		params.SMP = server.resources.SMP
+	}
+	var megabytes int64 = 1024
+	if server.resources.Memory > 0 {
+		megabytes = server.resources.Memory >> 20
+	}
+	params.Memory = fmt.Sprintf("%dM", megabytes)
+	var options = server.loggers.Options()
+	for i := 0; i+1 < len(options); i += 2 {
+		params.Args = append(params.Args, options[i]+"="+options[i+1])
+	}
+	var text = K8S_STATEFULSET_TEMPLATE
+	var selector = "yacht/cluster=" + server.name
+	if server.cfg.Operator {
+		text = K8S_OPERATOR_TEMPLATE
+		selector = "scylla/cluster=" + server.name
+		// The operator takes the image as a repository and a tag
+		params.Repository, params.Version = params.Image, "latest"
+		if i := strings.LastIndex(params.Image, ":"); i > strings.LastIndex(params.Image, "/") {
+			params.Repository, params.Version = params.Image[:i], params.Image[i+1:]
+		}
+		// Kubernetes quantities are in Mi, Scylla options in M
+		params.Memory = fmt.Sprintf("%dMi", megabytes)
+	}
+	tmpl, err := template.New("k8s").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+	if err != nil {
+		return "", "", merry.Wrap(err)
+	}
+	var manifest bytes.Buffer
+	if err := tmpl.Execute(&manifest, params); err != nil {
+		return "", "", merry.Wrap(err)
+	}
+	return manifest.String(), selector, nil
+}
+
+// Delete the nodes, saving the logs of their pods to the lane
+// directory first
+type K8sCluster_artefact struct {
+	cfg      *K8sConfig
+	manifest string
+	selector string
+	lane     *Lane
+}
+
+func (a *K8sCluster_artefact) Remove() error {
+	out, err := a.cfg.run("", "get", "pods", "-l", a.selector, "-o",
+		"jsonpath={.items[*].metadata.name}")
+	if err == nil {
+		for _, pod := range strings.Fields(out) {
+			logs, err := a.cfg.run("", "logs", "pod/"+pod, "--all-containers")
+			if err != nil {
+				a.lane.Log().Warnf("failed to save the log of pod %s: %v", pod, err)
+				continue
+			}
+			ioutil.WriteFile(path.Join(a.lane.Dir(), pod+".log"), []byte(logs), 0644)
+		}
+	}
+	a.lane.Log().Printf("Deleting k8s pods %s", a.selector)
+	if _, err := a.cfg.run(a.manifest, "delete", "--ignore-not-found", "--wait=false",
+		"-f", "-"); err != nil {
+		return err
+	}
+	// Volumes of a ScyllaCluster outlive it
+	_, err = a.cfg.run("", "delete", "pvc", "--ignore-not-found", "--wait=false",
+		"-l", a.selector)
+	return err
+}
+
+// Stop forwarding a local port to a pod
+type K8sPortForward_artefact struct {
+	cmd *exec.Cmd
+}
+
+func (a *K8sPortForward_artefact) Remove() error {
+	a.cmd.Process.Kill()
+	a.cmd.Wait()
+	return nil
+}
+
+// Translate node addresses to local ports forwarded or published to
+// the nodes, given by node address
+func localPortTranslator(ports map[string]int) gocql.AddressTranslator {
+	return gocql.AddressTranslatorFunc(func(addr net.IP, port int) (net.IP, int) {
+		if local, found := ports[addr.String()]; found {
+			return net.IPv4(127, 0, 0, 1), local
+		}
+		return addr, port
+	})
+}
+
+// Forwarding from 127.0.0.1:41235 -> 9042
+var portForwardRE = regexp.MustCompile(`^Forwarding from 127\.0\.0\.1:(\d+) ->`)
+
+// Forward a free local port to the CQL port of the pod, return the
+// local port
+func (server *K8sCluster) forward(lane *Lane, pod string, cluster Artefact) (int, error) {
+	cmd := server.cfg.command("port-forward", "pod/"+pod, ":9042")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, merry.Wrap(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, merry.Prepend(err, "kubectl port-forward")
+	}
+	// The pods must only be deleted once nothing is forwarded to
+	// them
+	lane.AddExitArtefact(&K8sPortForward_artefact{cmd: cmd}, cluster)
+	var ports = make(chan int, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if m := portForwardRE.FindStringSubmatch(scanner.Text()); m != nil {
+				port, _ := strconv.Atoi(m[1])
+				ports <- port
+				break
+			}
+		}
+		// Keep reading, or kubectl blocks on a full pipe
+		ioutil.ReadAll(stdout)
+	}()
+	select {
+	case port := <-ports:
+		return port, nil
+	case <-time.After(30 * time.Second):
+		return 0, merry.Errorf("kubectl port-forward to pod %s didn't start in 30s", pod)
+	}
+}
+
+func (server *K8sCluster) Start(lane *Lane) error {
+	server.name = fmt.Sprintf("yacht-%s-%s", lane.id,
+		strings.Replace(uuid.New().String(), "-", "", -1)[:8])
+	manifest, selector, err := server.manifest()
+	if err != nil {
+		return err
+	}
+	lane.Log().Printf("Creating k8s %s in namespace %s", server.name, server.cfg.Namespace)
+	if _, err := server.cfg.run(manifest, "apply", "-f", "-"); err != nil {
+		return err
+	}
+	var cluster = &K8sCluster_artefact{cfg: &server.cfg, manifest: manifest,
+		selector: selector, lane: lane}
+	lane.AddExitArtefact(cluster)
+	server.process = cluster
+
+	var timeout = "--timeout=" + server.cfg.timeout.String()
+	if server.cfg.Operator {
+		_, err = server.cfg.run("", "wait", "--for=condition=Available", timeout,
+			"scyllacluster/"+server.name)
+	} else {
+		_, err = server.cfg.run("", "rollout", "status", timeout, "statefulset/"+server.name)
+	}
+	if err != nil {
+		return merry.Prepend(err, "k8s nodes are not ready, their logs are saved to "+
+			lane.Dir())
+	}
+	out, err := server.cfg.run("", "get", "pods", "-l", selector, "-o",
+		`jsonpath={range .items[*]}{.metadata.name} {.status.podIP}{"\n"}{end}`)
+	if err != nil {
+		return err
+	}
+	server.pods, server.ips = nil, nil
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			server.pods = append(server.pods, fields[0])
+			server.ips = append(server.ips, fields[1])
+		}
+	}
+	if len(server.pods) == 0 {
+		return merry.Errorf("no k8s pods match %s", selector)
+	}
+	server.replicationFactor = len(server.pods)
+	server.uri = strings.Join(server.ips, ",")
+	if server.cfg.Access == "port-forward" {
+		// The driver learns node addresses from the nodes, and
+		// they are pod addresses: translate them to the local
+		// ports forwarded to the pods
+		var ports = make(map[string]int)
+		for i, pod := range server.pods {
+			if ports[server.ips[i]], err = server.forward(lane, pod, cluster); err != nil {
+				return err
+			}
+		}
+		server.uri = "127.0.0.1"
+		server.port = ports[server.ips[0]]
+		server.translator = localPortTranslator(ports)
+	}
+	return server.CQLServerURI.Start(lane)
+}
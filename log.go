@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// Verbosity of yacht.log, see --log-level
+const (
+	LOG_ERROR = iota
+	LOG_WARN
+	LOG_INFO
+	LOG_DEBUG
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, merry.Errorf("unknown log level '%s', must be one of %s", name,
+		strings.Join(logLevelNames, ", "))
+}
+
+// yacht.log: timestamped messages of the given level or more severe,
+// split into sections per suite and test. Every executed statement is
+// logged at debug level.
+type Logger struct {
+	*log.Logger
+	level int
+}
+
+func (l *Logger) logf(level int, format string, v ...interface{}) {
+	if l == nil || level > l.level {
+		return
+	}
+	// Report the caller of Printf and friends
+	l.Output(3, strings.ToUpper(logLevelNames[level])+" "+fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.logf(LOG_INFO, format, v...)
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.logf(LOG_DEBUG, format, v...)
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.logf(LOG_WARN, format, v...)
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.logf(LOG_ERROR, format, v...)
+}
+
+// Begin a section of the log, e.g. for a suite or a test, so that
+// its messages are easy to find
+func (l *Logger) Section(format string, v ...interface{}) {
+	l.logf(LOG_INFO, "==== %s ====", fmt.Sprintf(format, v...))
+}
+
+// How many rotated log files to keep, yacht.log.1 is the newest
+const LOG_FILES_KEPT = 3
+
+// A log file which is renamed to name.1, name.1 to name.2 and so on,
+// when it grows larger than the maximal size. log.Logger serializes
+// writes.
+type rotatingFile struct {
+	name    string
+	file    *os.File
+	size    int64
+	maxSize int64
+}
+
+func openRotatingFile(name string, maxSize int64) (*rotatingFile, error) {
+	// Rotated files of the previous run would be mistaken for
+	// this one's
+	for i := 1; i <= LOG_FILES_KEPT; i++ {
+		os.Remove(fmt.Sprintf("%s.%d", name, i))
+	}
+	f := &rotatingFile{name: name, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	f.file = file
+	f.size = 0
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := LOG_FILES_KEPT - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+	}
+	if err := os.Rename(f.name, f.name+".1"); err != nil {
+		return merry.Wrap(err)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func newLogger(name string, level int, maxSize int64) (*Logger, error) {
+	logFile, err := openRotatingFile(name, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{
+		Logger: log.New(logFile, "", log.Ldate|log.Lmicroseconds|log.Lshortfile),
+		level:  level,
+	}, nil
+}
+
+func OpenLog(dir string, level int, maxSize int64) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		fmt.Printf("Failed to create vardir %s", palette.Path(dir))
+		os.Exit(1)
+	}
+	var name = path.Join(dir, "yacht.log")
+	var err error
+	if ylog, err = newLogger(name, level, maxSize); err != nil {
+		fmt.Printf("%s %s\n", palette.Crit("Failed to open log file"),
+			palette.Path(name))
+		os.Exit(1)
+	}
+}
+
+// Open the log of the lane: yacht-<id>.log in vardir if several lanes
+// run at once, so that their messages don't interleave, or yacht.log
+func (lane *Lane) OpenLog(dir string, level int, maxSize int64) error {
+	if lane.Count() == 1 {
+		lane.log = ylog
+		return nil
+	}
+	var err error
+	lane.log, err = newLogger(path.Join(dir, "yacht-"+lane.id+".log"), level, maxSize)
+	return err
+}
+
+// The log of the lane, its servers, suites and tests
+func (lane *Lane) Log() *Logger {
+	if lane.log != nil {
+		return lane.log
+	}
+	return ylog
+}
+
+// A prefix of console lines of the lane which have no lane column,
+// such as suite blurbs, empty if the lane runs alone
+func (lane *Lane) Prefix() string {
+	if lane.Count() == 1 {
+		return ""
+	}
+	return fmt.Sprintf("[%3s] ", lane.id)
+}
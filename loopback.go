@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/ansel1/merry"
+)
+
+// Whether the address is configured on a local interface: Linux
+// routes the whole 127.0.0.0/8 to the loopback interface, but other
+// systems, e.g. macOS, only have 127.0.0.1 unless aliases are added
+func loopbackAvailable(uri string) bool {
+	listener, err := net.Listen("tcp", net.JoinHostPort(uri, "0"))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// Addresses leased to servers in "ip" isolation
+func loopbackPool() []string {
+	var uris []string
+	for i := 0; i < URI_POOL_SIZE; i++ {
+		uris = append(uris, fmt.Sprintf("127.0.0.%d", i+2))
+	}
+	return uris
+}
+
+// Check that servers can be given own loopback addresses in "ip"
+// isolation, and fall back to "port" isolation if they can't
+func (lane *Lane) CheckIsolation() {
+	if lane.isolation != "ip" {
+		return
+	}
+	for _, uri := range loopbackPool() {
+		if loopbackAvailable(uri) == false {
+			fmt.Printf("%s %s\n", palette.Warn("Loopback address %s is not configured,", uri),
+				palette.Path("using port isolation, run 'yacht setup-net' to add the addresses"))
+			lane.isolation = "port"
+			return
+		}
+	}
+}
+
+// The command to add a loopback address alias on this system
+func loopbackAliasCommand(uri string) []string {
+	if runtime.GOOS == "darwin" {
+		return []string{"ifconfig", "lo0", "alias", uri, "up"}
+	}
+	return []string{"ip", "addr", "add", uri + "/8", "dev", "lo"}
+}
+
+// Add loopback address aliases used in "ip" isolation, with sudo
+// unless yacht runs as root
+func (yacht *Yacht) SetupNet() int {
+	var added int
+	for _, uri := range loopbackPool() {
+		if loopbackAvailable(uri) {
+			continue
+		}
+		var args = loopbackAliasCommand(uri)
+		if os.Geteuid() != 0 {
+			args = append([]string{"sudo"}, args...)
+		}
+		fmt.Printf("Running %s\n", palette.Path("%v", args))
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Printf("%s%v\n", palette.Crit("setup-net failure: "),
+				merry.Prependf(err, "failed to add %s", uri))
+			return 1
+		}
+		added++
+	}
+	fmt.Printf("%d loopback addresses added, %d are configured\n", added, URI_POOL_SIZE)
+	return 0
+}
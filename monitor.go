@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// Resource monitoring of launched servers, set in 'monitor' section
+// of .yacht.yaml
+type MonitorConfig struct {
+	// How often to sample, e.g. 1s. Monitoring is off if empty.
+	Interval string
+	// Fail the run if a server RSS exceeds this size, e.g. 8G
+	MaxRss string `mapstructure:"max_rss"`
+
+	interval time.Duration
+	maxRSS   int64
+}
+
+func (cfg *MonitorConfig) Init() error {
+	var err error
+	if cfg.Interval != "" {
+		if cfg.interval, err = time.ParseDuration(cfg.Interval); err != nil {
+			return merry.Prepend(err, "monitor interval")
+		}
+	}
+	if cfg.MaxRss != "" {
+		if cfg.maxRSS, err = parseSize(cfg.MaxRss); err != nil {
+			return merry.Prepend(err, "monitor max_rss")
+		}
+	}
+	return nil
+}
+
+func (cfg *MonitorConfig) Enabled() bool {
+	return cfg != nil && cfg.interval > 0
+}
+
+// A sample of server resource usage
+type processSample struct {
+	time time.Time
+	rss  int64
+	fds  int
+	// User and system CPU time, in clock ticks
+	cpu int64
+}
+
+func sampleProcess(pid int) (processSample, error) {
+	var sample = processSample{time: time.Now()}
+	status, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return sample, err
+	}
+	defer status.Close()
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			sample.rss = kb * 1024
+		}
+	}
+	if fds, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", pid)); err == nil {
+		sample.fds = len(fds)
+	}
+	if stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		// Skip the command name, which may contain spaces
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if len(fields) > 12 {
+			utime, _ := strconv.ParseInt(fields[11], 10, 64)
+			stime, _ := strconv.ParseInt(fields[12], 10, 64)
+			sample.cpu = utime + stime
+		}
+	}
+	return sample, nil
+}
+
+// Sample resource usage of a server periodically and write the
+// samples to a CSV file in the lane
+type Monitor_artefact struct {
+	cfg     *MonitorConfig
+	lane    *Lane
+	uri     string
+	pid     int
+	file    *os.File
+	samples []processSample
+	stop    chan bool
+	done    sync.WaitGroup
+}
+
+func startMonitor(cfg *MonitorConfig, lane *Lane, pid int, uri string) (*Monitor_artefact, error) {
+	file, err := os.Create(path.Join(lane.Dir(), uri+".stats.csv"))
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	fmt.Fprintln(file, "time,rss,fds,cpu_ticks")
+	a := &Monitor_artefact{cfg: cfg, lane: lane, uri: uri, pid: pid, file: file,
+		stop: make(chan bool)}
+	a.done.Add(1)
+	go a.run()
+	return a, nil
+}
+
+func (a *Monitor_artefact) run() {
+	defer a.done.Done()
+	ticker := time.NewTicker(a.cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		sample, err := sampleProcess(a.pid)
+		if err != nil {
+			// The process is gone
+			return
+		}
+		a.samples = append(a.samples, sample)
+		fmt.Fprintf(a.file, "%s,%d,%d,%d\n", sample.time.Format(time.RFC3339),
+			sample.rss, sample.fds, sample.cpu)
+		if a.cfg.maxRSS > 0 && sample.rss > a.cfg.maxRSS {
+			a.lane.SetMonitorFailure(merry.Errorf("server %s RSS %s exceeds max_rss %s",
+				a.uri, formatSize(sample.rss), formatSize(a.cfg.maxRSS)))
+		}
+	}
+}
+
+// Stop sampling and warn if the server memory only grew while it ran,
+// which may be a leak
+func (a *Monitor_artefact) Remove() error {
+	close(a.stop)
+	a.done.Wait()
+	a.file.Close()
+	const MIN_SAMPLES = 10
+	if len(a.samples) < MIN_SAMPLES {
+		return nil
+	}
+	for i := 1; i < len(a.samples); i++ {
+		if a.samples[i].rss < a.samples[i-1].rss {
+			return nil
+		}
+	}
+	first, last := a.samples[0].rss, a.samples[len(a.samples)-1].rss
+	if last > first {
+		fmt.Printf("%s server %s RSS grew from %s to %s and never shrank, see %s\n",
+			palette.Warn("Possible memory leak:"), a.uri, formatSize(first),
+			formatSize(last), palette.Path(a.file.Name()))
+	}
+	return nil
+}
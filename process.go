@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// A suite of tests which are programs, e.g. pytest files, rather
+// than statements yacht executes. A test runs against the servers of
+// the suite mode, which it finds in the environment of the lane and
+// the server, and passes if it exits with status 0.
+type ProcessTestSuite struct {
+	description string
+	path        string
+	name        string
+	// The suite type, e.g. python
+	kind    string
+	tests   []*ProcessTest
+	servers []Server
+	// Where the test files are, the suite directory if empty
+	dir string
+	// Test file name patterns in the test directory, e.g. test_*.py
+	globs []string
+	// Only executable files matching the patterns are tests
+	executable bool
+	// Compare the standard output of a test with its result file
+	compare bool
+	// Where to store reject and newly generated result files,
+	// empty to store them next to the test in srcdir
+	outdir string
+	// The command line running a test. ${VAR} in arguments is
+	// replaced with the variable of the test environment.
+	command func(test *ProcessTest) []string
+	// Kill a test which runs longer, 0 for no limit, and limits of
+	// individual tests by test name
+	timeout  time.Duration
+	timeouts map[string]time.Duration
+	// How many tests to run at once
+	jobs int
+	// Run tests in the lane directory rather than the suite directory
+	runInLane bool
+	// A command to run after each failed test
+	onFailure string
+	// Suites with higher priority run first
+	priority int
+	// Suites which must run before this one
+	dependsOn []string
+	// How many times to run each test, see --repeat
+	repeat int
+	// Durations of the tests in previous runs
+	history *History
+	// Server capabilities the tests need
+	requires Requirements
+}
+
+type ProcessTest struct {
+	name string
+	path string
+	// Standard output and error of the last run, in the lane
+	// directory
+	output string
+	// Why the test failed
+	failures []string
+	// The result file with the expected standard output, the reject
+	// file with the output which differs from it, and where a new
+	// result file is written, see ProcessTestSuite.compare
+	result    string
+	reject    string
+	generated string
+	rejected  bool
+}
+
+// foo.test.sh or foo.test has result file foo.result
+var processTestRE = regexp.MustCompile(`\.test(\.[^./]*)?$`)
+
+func (test *ProcessTest) Init(outdir string) {
+	test.result = processTestRE.ReplaceAllString(test.path, `.result`)
+	test.reject = processTestRE.ReplaceAllString(test.path, `.reject`)
+	test.generated = test.result
+	if outdir != "" {
+		test.reject = path.Join(outdir, path.Base(test.reject))
+		test.generated = path.Join(outdir, path.Base(test.result))
+	}
+}
+
+func (suite *ProcessTestSuite) Name() string {
+	return suite.name
+}
+
+func (suite *ProcessTestSuite) Priority() int {
+	return suite.priority
+}
+
+func (suite *ProcessTestSuite) DependsOn() []string {
+	return suite.dependsOn
+}
+
+func (suite *ProcessTestSuite) Path() string {
+	return suite.path
+}
+
+func (suite *ProcessTestSuite) AddMode(server Server) {
+	suite.servers = append(suite.servers, server)
+}
+
+func (suite *ProcessTestSuite) Servers() []Server {
+	return suite.servers
+}
+
+func (suite *ProcessTestSuite) FindTests(suite_path string, patterns []string) error {
+	suite.path = suite_path
+	suite.name = path.Base(suite.path)
+
+	var dir = suite.dir
+	if dir == "" {
+		dir = suite.path
+	}
+	var files []string
+	for _, glob := range suite.globs {
+		matches, err := filepath.Glob(path.Join(dir, glob))
+		if err != nil {
+			return merry.Wrap(err)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	var found = make(map[string]bool)
+	for _, file := range files {
+		if suite.executable {
+			st, err := os.Stat(file)
+			if err != nil || st.Mode().IsRegular() == false || st.Mode()&0111 == 0 {
+				continue
+			}
+		}
+		for _, pattern := range patterns {
+			// Match test files outside srcdir as if they were in
+			// the suite directory
+			var name = path.Join(suite.path, path.Base(file))
+			if strings.Contains(name, pattern) && found[file] == false {
+				found[file] = true
+				test := &ProcessTest{name: path.Base(file), path: file}
+				if suite.compare {
+					test.Init(suite.outdir)
+				}
+				suite.tests = append(suite.tests, test)
+			}
+		}
+	}
+	return nil
+}
+
+// Only keep the tests for which keep() is true
+func (suite *ProcessTestSuite) Filter(keep func(path string) bool) {
+	var tests []*ProcessTest
+	for _, test := range suite.tests {
+		if keep(test.path) {
+			tests = append(tests, test)
+		}
+	}
+	suite.tests = tests
+}
+
+func (suite *ProcessTestSuite) Tests() []string {
+	var names []string
+	for _, test := range suite.tests {
+		names = append(names, test.name)
+	}
+	return names
+}
+
+func (suite *ProcessTestSuite) IsEmpty() bool {
+	return len(suite.tests) == 0
+}
+
+func (suite *ProcessTestSuite) PrepareLane(lane *Lane, server Server) error {
+	if err := server.Start(lane); err != nil {
+		return err
+	}
+	return waitHealthy(server)
+}
+
+// Longest tests first, as in CQLTestSuite.Schedule()
+func (suite *ProcessTestSuite) Schedule() []*ProcessTest {
+	var names = make([]string, len(suite.tests))
+	var sizes = make([]int64, len(suite.tests))
+	for i, test := range suite.tests {
+		names[i] = path.Join(suite.name, test.name)
+		if st, err := os.Stat(test.path); err == nil {
+			sizes[i] = st.Size()
+		}
+	}
+	durations := suite.history.EstimateDurations(names, sizes)
+	var tests []*ProcessTest
+	for _, i := range scheduleLPT(durations, 1)[0] {
+		tests = append(tests, suite.tests[i])
+	}
+	return tests
+}
+
+// A run of a test, one of --repeat
+type processRun struct {
+	test *ProcessTest
+	name string
+	rc   string
+	err  error
+	time time.Duration
+}
+
+// Run up to jobs tests at once, and report them in the order of the
+// schedule when all of them end. Runs of the same test don't overlap.
+func (suite *ProcessTestSuite) RunSuite(force bool, lane *Lane, server Server) (int, error) {
+	if reason, err := suite.requires.Unmet(server); err != nil {
+		return 0, err
+	} else if reason != "" {
+		skipSuite(lane, server, suite.name, suite.Tests(), reason)
+		return 0, nil
+	}
+	var suite_rc int = 0
+	var jobs = suite.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	var repeat = 1
+	if suite.repeat > 1 {
+		repeat = suite.repeat
+	}
+	var pending []*processRun
+	for _, test := range suite.Schedule() {
+		for iteration := 1; iteration <= repeat; iteration++ {
+			var name = path.Join(suite.name, test.name)
+			if repeat > 1 {
+				name = fmt.Sprintf("%s #%d", name, iteration)
+			}
+			pending = append(pending, &processRun{test: test, name: name})
+		}
+	}
+	// Tests with a failed run, the rest of their runs is skipped
+	var failed = make(map[*ProcessTest]bool)
+	for len(pending) > 0 {
+		var batch, rest []*processRun
+		var inBatch = make(map[*ProcessTest]bool)
+		for _, run := range pending {
+			if failed[run.test] {
+				continue
+			}
+			if len(batch) < jobs && inBatch[run.test] == false {
+				inBatch[run.test] = true
+				batch = append(batch, run)
+			} else {
+				rest = append(rest, run)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if lane.TimedOut() {
+			suite.notRun(lane, server, distinctTests(append(batch, rest...)))
+			break
+		}
+		if err := lane.CheckDiskSpace(); err != nil {
+			return 1, err
+		}
+		if err := checkHealth(server); err != nil {
+			suite.notRun(lane, server, distinctTests(append(batch, rest...)))
+			return 1, merry.Prepend(err, batch[0].name)
+		}
+		offsets := logOffsets(server)
+		var wg sync.WaitGroup
+		for _, run := range batch {
+			wg.Add(1)
+			go func(run *processRun) {
+				defer wg.Done()
+				lane.Log().Section("test %s, mode %s", run.name, server.ModeName())
+				events.Emit("test-start", map[string]interface{}{"lane": lane.id,
+					"test": run.name, "mode": server.ModeName()})
+				start := time.Now()
+				run.rc, run.err = suite.runTest(run.test, lane, server)
+				run.time = time.Now().Sub(start)
+			}(run)
+		}
+		wg.Wait()
+		for _, run := range batch {
+			var test = run.test
+			var full_name = path.Join(suite.name, test.name)
+			if run.err != nil {
+				return 0, merry.Prepend(run.err, full_name)
+			}
+			if suite.history != nil {
+				suite.history.Tests[full_name] = run.time.Seconds()
+			}
+			if err := lane.MonitorFailure(); err != nil {
+				return 1, err
+			}
+			lane.Log().Printf("%s: %s in %v", run.name, run.rc, run.time)
+			PrintTestBlurb(lane.id, run.name, server.ModeName(), run.rc)
+			events.Emit("test-end", map[string]interface{}{"lane": lane.id,
+				"test": run.name, "mode": server.ModeName(), "result": run.rc,
+				"duration_ms": milliseconds(run.time)})
+			if run.rc != "fail" {
+				lane.passed++
+				continue
+			}
+			test.PrintFailures()
+			if test.rejected {
+				printUniDiff(test.result, test.reject)
+			}
+			slices := printLogSlices(lane, test.name, offsets)
+			if suite.onFailure != "" {
+				env := append(lane.Environment(), server.Environment()...)
+				env = append(env,
+					"YACHT_TEST="+full_name,
+					"YACHT_TEST_PATH="+test.path,
+					"YACHT_TEST_STATUS="+run.rc,
+					"YACHT_TEST_OUTPUT="+test.output,
+					"YACHT_LOG_SLICES="+strings.Join(slices, ","))
+				if test.rejected {
+					env = append(env, "YACHT_REJECT_PATH="+test.reject)
+				}
+				runFailureHook(suite.onFailure, env, lane.Dir())
+			}
+			suite_rc = 1
+			failed[test] = true
+			lane.AddFailedTest(full_name)
+		}
+		if suite_rc != 0 && (force == false || lane.TooManyFailures()) {
+			return suite_rc, nil
+		}
+		pending = rest
+	}
+	return suite_rc, nil
+}
+
+// The tests of the runs, each once
+func distinctTests(runs []*processRun) []*ProcessTest {
+	var tests []*ProcessTest
+	var found = make(map[*ProcessTest]bool)
+	for _, run := range runs {
+		if found[run.test] == false {
+			found[run.test] = true
+			tests = append(tests, run.test)
+		}
+	}
+	return tests
+}
+
+// Run the test program with the environment of the lane and the
+// server, in the suite directory. Its output goes to a file in the
+// lane directory. An error is returned only if the program can't be
+// started at all.
+func (suite *ProcessTestSuite) runTest(test *ProcessTest, lane *Lane, server Server) (string, error) {
+	test.failures = nil
+	test.rejected = false
+	test.output = path.Join(lane.Dir(), suite.name, test.name+".log")
+	if err := os.MkdirAll(path.Dir(test.output), 0750); err != nil {
+		return "", merry.Wrap(err)
+	}
+	out, err := os.Create(test.output)
+	if err != nil {
+		return "", merry.Wrap(err)
+	}
+	defer out.Close()
+
+	var env = append(lane.Environment(), server.Environment()...)
+	env = append(env,
+		"YACHT_TEST="+path.Join(suite.name, test.name),
+		"YACHT_TEST_PATH="+test.path,
+		"YACHT_SUITE_DIR="+suite.path)
+	var args []string
+	for _, arg := range suite.command(test) {
+		args = append(args, os.Expand(arg, func(name string) string {
+			if value := envValue(env, name); value != "" {
+				return value
+			}
+			return os.Getenv(name)
+		}))
+	}
+	var timeout = suite.timeout
+	if t, found := suite.timeouts[test.name]; found {
+		timeout = t
+	}
+	lane.Log().Printf("Running %s", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	// A test which times out is killed with its children, e.g. the
+	// processes pytest or a script started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Dir = suite.path
+	if suite.runInLane {
+		cmd.Dir = lane.Dir()
+	}
+	cmd.Env = append(os.Environ(), env...)
+	var stdout bytes.Buffer
+	cmd.Stdout = out
+	if suite.compare {
+		cmd.Stdout = io.MultiWriter(out, &stdout)
+	}
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return "", merry.Prependf(err, "failed to run %s", args[0])
+	}
+	var timedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+	err = cmd.Wait()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		test.failures = append(test.failures, fmt.Sprintf("%s: killed after %v",
+			test.name, timeout))
+		return "fail", nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		test.failures = append(test.failures, fmt.Sprintf("%s: exited with status %d",
+			test.name, exitErr.ExitCode()))
+		return "fail", nil
+	} else if err != nil {
+		return "", merry.Prependf(err, "failed to run %s", args[0])
+	}
+	if suite.compare {
+		return test.compare(strings.Replace(stdout.String(), lane.Dir(), "$YACHT_LANE_DIR", -1))
+	}
+	return "pass", nil
+}
+
+// Compare the standard output of the test with its result file:
+// write a new result file if there is none, or a reject file if the
+// output differs
+func (test *ProcessTest) compare(output string) (string, error) {
+	expected, err := ioutil.ReadFile(test.result)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(path.Dir(test.generated), 0750); err != nil {
+			return "", merry.Wrap(err)
+		}
+		if err := ioutil.WriteFile(test.generated, []byte(output), 0644); err != nil {
+			return "", merry.Wrap(err)
+		}
+		return "new", nil
+	} else if err != nil {
+		return "", merry.Wrap(err)
+	}
+	if string(expected) == output {
+		os.Remove(test.reject)
+		return "pass", nil
+	}
+	if err := os.MkdirAll(path.Dir(test.reject), 0750); err != nil {
+		return "", merry.Wrap(err)
+	}
+	if err := ioutil.WriteFile(test.reject, []byte(output), 0644); err != nil {
+		return "", merry.Wrap(err)
+	}
+	test.rejected = true
+	test.failures = append(test.failures, fmt.Sprintf("%s: output differs from %s",
+		test.name, test.result))
+	return "fail", nil
+}
+
+// Print why the test failed and the last lines of its output
+func (test *ProcessTest) PrintFailures() {
+	for _, failure := range test.failures {
+		fmt.Printf("%s\n", palette.Crit("%s", failure))
+	}
+	data, err := ioutil.ReadFile(test.output)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > TAIL_LINES {
+		lines = lines[len(lines)-TAIL_LINES:]
+	}
+	fmt.Printf("Last lines of the test output, see %s:\n", palette.Path(test.output))
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+}
+
+func (suite *ProcessTestSuite) NotRun(lane *Lane, server Server) {
+	suite.notRun(lane, server, suite.tests)
+}
+
+func (suite *ProcessTestSuite) notRun(lane *Lane, server Server, tests []*ProcessTest) {
+	for _, test := range tests {
+		PrintTestBlurb(lane.id, path.Join(suite.name, test.name), server.ModeName(), "not-run")
+		lane.notRun++
+	}
+}
+
+// Replace result files with reject files left by failed tests, and
+// copy new result files generated out of tree
+func (suite *ProcessTestSuite) Accept(server Server) error {
+	if suite.compare == false {
+		return nil
+	}
+	for _, test := range suite.tests {
+		var from = test.reject
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			from = test.generated
+		}
+		if from == test.result {
+			continue
+		}
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			continue
+		}
+		if err := moveFile(from, test.result); err != nil {
+			return err
+		}
+		fmt.Printf("Accepted %s\n", palette.Path(test.result))
+	}
+	return nil
+}
+
+func (suite *ProcessTestSuite) Minimize(lane *Lane, server Server) error {
+	return merry.Errorf("can't minimize tests of %s suite %s", suite.kind, suite.name)
+}
+
+func (suite *ProcessTestSuite) Replay(lane *Lane, server Server, dir string,
+	summary regenSummary) error {
+	return nil
+}
+
+func (suite *ProcessTestSuite) Regen(lane *Lane, server Server, summary regenSummary) error {
+	return nil
+}
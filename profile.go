@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// Record a CPU profile of a launched server with perf
+func startProfiling(lane *Lane, pid int, uri string) (*Profile_artefact, error) {
+	var data = path.Join(lane.profileDir,
+		fmt.Sprintf("%s-%s.perf.data", uri, time.Now().Format("20060102-150405")))
+	cmd := exec.Command("perf", "record", "-g", "-p", fmt.Sprint(pid), "-o", data)
+	cmd.Dir = lane.Dir()
+	logFile, err := os.Create(path.Join(lane.Dir(), uri+".perf.log"))
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return nil, merry.Prepend(err, "failed to start perf")
+	}
+	lane.Log().Printf("Started perf %d for server %d", cmd.Process.Pid, pid)
+	return &Profile_artefact{cmd: cmd, data: data, log: logFile}, nil
+}
+
+// Stop perf, which writes the profile, and make a flame graph of it
+// if FlameGraph scripts are in PATH. Must be removed before the
+// server is stopped.
+type Profile_artefact struct {
+	cmd  *exec.Cmd
+	data string
+	log  *os.File
+}
+
+func (a *Profile_artefact) Remove() error {
+	defer a.log.Close()
+	if err := a.cmd.Process.Signal(syscall.SIGINT); err != nil {
+		return merry.Prepend(err, "failed to stop perf")
+	}
+	a.cmd.Wait()
+	fmt.Printf("Server profile written to %s\n", palette.Path(a.data))
+	if _, err := exec.LookPath("flamegraph.pl"); err != nil {
+		return nil
+	}
+	var svg = strings.TrimSuffix(a.data, ".perf.data") + ".svg"
+	cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf(
+		"perf script -i '%s' | stackcollapse-perf.pl | flamegraph.pl > '%s'", a.data, svg))
+	cmd.Stderr = a.log
+	if err := cmd.Run(); err != nil {
+		return merry.Prepend(err, "failed to make a flame graph")
+	}
+	fmt.Printf("Flame graph written to %s\n", palette.Path(svg))
+	return nil
+}
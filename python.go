@@ -0,0 +1,30 @@
+package main
+
+// Settings of a python suite, see 'python' in suite.yaml
+type PythonConfig struct {
+	// The interpreter running pytest, python3 by default
+	Interpreter string
+	// Arguments of pytest before the test file, e.g.
+	// --host=${YACHT_URIS}
+	Args []string
+}
+
+// pytest's default test file patterns
+var pythonTestGlobs = []string{"test_*.py", "*_test.py"}
+
+// A suite of pytest files, e.g. Scylla dtests, each run with
+// <interpreter> -m pytest <args> <file>
+func newPythonTestSuite(cfg PythonConfig) *ProcessTestSuite {
+	var interpreter = cfg.Interpreter
+	if interpreter == "" {
+		interpreter = "python3"
+	}
+	return &ProcessTestSuite{
+		kind:  "python",
+		globs: pythonTestGlobs,
+		command: func(test *ProcessTest) []string {
+			var args = append([]string{interpreter, "-m", "pytest"}, cfg.Args...)
+			return append(args, test.path)
+		},
+	}
+}
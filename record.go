@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ansel1/merry"
+	"github.com/gocql/gocql"
+)
+
+// A CQL type, in a form which survives a JSON round trip
+type recordedType struct {
+	Type     int
+	Version  byte
+	Custom   string          `json:",omitempty"`
+	Key      *recordedType   `json:",omitempty"`
+	Elem     *recordedType   `json:",omitempty"`
+	Elems    []recordedType  `json:",omitempty"`
+	Fields   []recordedField `json:",omitempty"`
+	Keyspace string          `json:",omitempty"`
+	Name     string          `json:",omitempty"`
+}
+
+type recordedField struct {
+	Name string
+	Type recordedType
+}
+
+func newRecordedType(info gocql.TypeInfo) recordedType {
+	var rt = recordedType{
+		Type:    int(info.Type()),
+		Version: info.Version(),
+		Custom:  info.Custom(),
+	}
+	switch t := info.(type) {
+	case gocql.CollectionType:
+		if t.Key != nil {
+			key := newRecordedType(t.Key)
+			rt.Key = &key
+		}
+		if t.Elem != nil {
+			elem := newRecordedType(t.Elem)
+			rt.Elem = &elem
+		}
+	case gocql.TupleTypeInfo:
+		for _, elem := range t.Elems {
+			rt.Elems = append(rt.Elems, newRecordedType(elem))
+		}
+	case gocql.UDTTypeInfo:
+		rt.Keyspace = t.KeySpace
+		rt.Name = t.Name
+		for _, field := range t.Elements {
+			rt.Fields = append(rt.Fields, recordedField{field.Name, newRecordedType(field.Type)})
+		}
+	}
+	return rt
+}
+
+func (rt *recordedType) TypeInfo() gocql.TypeInfo {
+	var native = gocql.NewNativeType(rt.Version, gocql.Type(rt.Type), rt.Custom)
+	switch gocql.Type(rt.Type) {
+	case gocql.TypeList, gocql.TypeSet, gocql.TypeMap:
+		var t = gocql.CollectionType{NativeType: native}
+		if rt.Key != nil {
+			t.Key = rt.Key.TypeInfo()
+		}
+		if rt.Elem != nil {
+			t.Elem = rt.Elem.TypeInfo()
+		}
+		return t
+	case gocql.TypeTuple:
+		var t = gocql.TupleTypeInfo{NativeType: native}
+		for i := range rt.Elems {
+			t.Elems = append(t.Elems, rt.Elems[i].TypeInfo())
+		}
+		return t
+	case gocql.TypeUDT:
+		var t = gocql.UDTTypeInfo{NativeType: native, KeySpace: rt.Keyspace, Name: rt.Name}
+		for i := range rt.Fields {
+			t.Elements = append(t.Elements, gocql.UDTField{
+				Name: rt.Fields[i].Name,
+				Type: rt.Fields[i].Type.TypeInfo(),
+			})
+		}
+		return t
+	}
+	return native
+}
+
+type recordedColumn struct {
+	Name string
+	Type recordedType
+}
+
+// A statement and the raw server response to it
+type recordedExchange struct {
+	Query    string
+	Status   string            `json:",omitempty"`
+	Code     string            `json:",omitempty"`
+	Message  string            `json:",omitempty"`
+	Warnings []string          `json:",omitempty"`
+	Payload  map[string][]byte `json:",omitempty"`
+	Columns  []recordedColumn  `json:",omitempty"`
+	Attempts int               `json:",omitempty"`
+	// Every value of every row in the protocol encoding, tuple
+	// elements as separate values, a NULL as null
+	Rows [][][]byte `json:",omitempty"`
+	// A harness or infrastructure error instead of a result
+	Err string `json:",omitempty"`
+	// Already replayed
+	used bool
+}
+
+func (exchange *recordedExchange) SetColumns(columns []gocql.ColumnInfo) {
+	for _, column := range columns {
+		exchange.Columns = append(exchange.Columns,
+			recordedColumn{column.Name, newRecordedType(column.TypeInfo)})
+	}
+}
+
+// Types of values of a row as scanned by gocql, which scans each
+// element of a tuple into a separate value
+func valueTypes(columns []gocql.ColumnInfo) []gocql.TypeInfo {
+	var types []gocql.TypeInfo
+	for _, column := range columns {
+		if tuple, ok := column.TypeInfo.(gocql.TupleTypeInfo); ok {
+			types = append(types, tuple.Elems...)
+		} else {
+			types = append(types, column.TypeInfo)
+		}
+	}
+	return types
+}
+
+func (exchange *recordedExchange) AddRow(columns []gocql.ColumnInfo, values []interface{}) error {
+	var row = make([][]byte, len(values))
+	for i, info := range valueTypes(columns) {
+		data, err := gocql.Marshal(info, values[i])
+		if err != nil {
+			return merry.Prependf(err, "recording column %d of '%.40s'", i, exchange.Query)
+		}
+		row[i] = data
+	}
+	exchange.Rows = append(exchange.Rows, row)
+	return nil
+}
+
+// Statements and responses of a test run, see --record
+type Recorder struct {
+	// Statements may be executed concurrently
+	mutex     sync.Mutex
+	exchanges []*recordedExchange
+}
+
+func (recorder *Recorder) Add(exchange *recordedExchange, result *CQLResult, err error) {
+	if err != nil {
+		exchange.Err = err.Error()
+	} else {
+		exchange.Status = result.status
+		exchange.Code = result.code
+		exchange.Message = result.message
+		exchange.Warnings = result.warnings
+		exchange.Payload = result.payload
+		exchange.Attempts = result.attempts
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.exchanges = append(recorder.exchanges, exchange)
+}
+
+func (recorder *Recorder) Save(name string) error {
+	if err := os.MkdirAll(path.Dir(name), 0750); err != nil {
+		return merry.Wrap(err)
+	}
+	text, err := json.MarshalIndent(recorder.exchanges, "", " ")
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	return merry.Wrap(ioutil.WriteFile(name, text, 0644))
+}
+
+// Start recording statements executed via the connection, nil if
+// the connection can't be recorded
+func startRecording(c Connection) *Recorder {
+	if conn, ok := c.(*CQLConnection); ok {
+		conn.recorder = &Recorder{}
+		return conn.recorder
+	}
+	return nil
+}
+
+func stopRecording(c Connection) {
+	if conn, ok := c.(*CQLConnection); ok {
+		conn.recorder = nil
+	}
+}
+
+// Where the recording of a test run in the given mode is kept
+func recordingPath(dir string, suite string, test string, mode string) string {
+	return path.Join(dir, suite, fmt.Sprintf("%s.%s.json",
+		strings.TrimSuffix(test, ".test.cql"), mode))
+}
+
+func loadRecording(name string) (*Recorder, error) {
+	text, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var recorder Recorder
+	if err := json.Unmarshal(text, &recorder.exchanges); err != nil {
+		return nil, merry.Prepend(err, name)
+	}
+	return &recorder, nil
+}
+
+// Take the first statement with the given text which was not
+// replayed yet
+func (recorder *Recorder) Take(query string) *recordedExchange {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	for _, exchange := range recorder.exchanges {
+		if exchange.used == false && exchange.Query == query {
+			exchange.used = true
+			return exchange
+		}
+	}
+	return nil
+}
+
+// A server which plays back a recorded run instead of executing
+// statements. It pretends to be the server the run was recorded
+// with, so that tests find their result files.
+type replayServer struct {
+	Server
+	recording *Recorder
+}
+
+func (server *replayServer) Start(lane *Lane) error {
+	return nil
+}
+
+func (server *replayServer) Connect() (Connection, error) {
+	return &replayConnection{recording: server.recording}, nil
+}
+
+func (server *replayServer) Environment() []string {
+	return nil
+}
+
+func (server *replayServer) LogFiles() []string {
+	return nil
+}
+
+type replayConnection struct {
+	recording *Recorder
+}
+
+func (c *replayConnection) Execute(cql string, opts *QueryOptions) (*CQLResult, error) {
+	exchange := c.recording.Take(cql)
+	if exchange == nil {
+		return nil, merry.Errorf("the statement is not in the recording: %.80s", cql)
+	}
+	if exchange.Err != "" {
+		return nil, merry.New(exchange.Err)
+	}
+	var result = CQLResult{
+		status:   exchange.Status,
+		code:     exchange.Code,
+		message:  exchange.Message,
+		warnings: exchange.Warnings,
+		payload:  exchange.Payload,
+		attempts: exchange.Attempts,
+	}
+	if result.status != "OK" {
+		return &result, nil
+	}
+	if describeRE.MatchString(cql) {
+		var statements []string
+		for _, row := range exchange.Rows {
+			statements = append(statements, string(row[0]))
+		}
+		return describeResult(statements), nil
+	}
+	var format *FormatConfig
+	if opts != nil {
+		format = opts.format
+	}
+	var columns []gocql.ColumnInfo
+	for i := range exchange.Columns {
+		columns = append(columns, gocql.ColumnInfo{
+			Name:     exchange.Columns[i].Name,
+			TypeInfo: exchange.Columns[i].Type.TypeInfo(),
+		})
+	}
+	var types = valueTypes(columns)
+	var values = make([]interface{}, len(types))
+	for i, info := range types {
+		values[i] = info.New()
+	}
+	var rows = exchange.Rows
+	var scanErr error
+	var next = func(values []interface{}) bool {
+		if len(rows) == 0 || scanErr != nil {
+			return false
+		}
+		for i, data := range rows[0] {
+			if scanErr = gocql.Unmarshal(types[i], data, values[i]); scanErr != nil {
+				return false
+			}
+		}
+		rows = rows[1:]
+		return true
+	}
+	if err := result.addRows(columns, values, next, format); err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, merry.Prependf(scanErr, "replaying '%.40s'", cql)
+	}
+	return &result, nil
+}
+
+func (c *replayConnection) Reset() error {
+	return nil
+}
+
+func (c *replayConnection) Close() {
+}
+
+// Run the tests against their recordings and make the output the new
+// results. Tests without a recording are skipped.
+func (suite *CQLTestSuite) Replay(lane *Lane, server Server, dir string,
+	summary regenSummary) error {
+	for _, test := range suite.tests {
+		var name = recordingPath(dir, suite.name, test.name, server.ModeName())
+		recording, err := loadRecording(name)
+		if os.IsNotExist(merry.Unwrap(err)) {
+			fmt.Printf("Skipping %s: %s\n", palette.Path(path.Join(suite.name, test.name)),
+				palette.Warn("no recording in %s mode", server.ModeName()))
+			continue
+		} else if err != nil {
+			return err
+		}
+		replay := &replayServer{Server: server, recording: recording}
+		c, _ := replay.Connect()
+		outcome, err := test.Regenerate(c, lane, replay)
+		if err != nil {
+			return merry.Prepend(err, path.Join(suite.name, test.name))
+		}
+		summary.Add(path.Join(suite.name, test.name), server.ModeName(), outcome)
+	}
+	return nil
+}
+
+// Regenerate result files of matching tests from recordings of
+// previous runs, see --record, without a server
+func (yacht *Yacht) Replay() int {
+	if err := yacht.InitLane(); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("lane failure: "), err)
+		return 1
+	}
+	yacht.findSuites()
+	var dir = path.Join(yacht.env.vardir, "recordings")
+	var summary = make(regenSummary)
+	for _, suite := range yacht.suites {
+		for _, server := range suite.Servers() {
+			if err := suite.Replay(&yacht.lane, server, dir, summary); err != nil {
+				fmt.Printf("%s%v\n", palette.Crit("replay failure: "), err)
+				return 1
+			}
+		}
+	}
+	summary.Print()
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/ansel1/merry"
+)
+
+// Run a test and make its output the new result, whether it matches
+// the result file or not. Return "changed", "unchanged" or "new", or
+// the test status if the test produced no usable output.
+func (test *CQLTestFile) Regenerate(c Connection, lane *Lane, server Server) (string, error) {
+	test_rc, err := test.RunTest(true, c, lane, server)
+	if err != nil {
+		return "", err
+	}
+	if test_rc == "broken" || test_rc == "too-large" {
+		return test_rc, nil
+	}
+	_, accepted, err := test.Accept(server.ModeName())
+	if err != nil {
+		return "", err
+	}
+	if test_rc == "new" {
+		return "new", nil
+	}
+	if accepted {
+		return "changed", nil
+	}
+	return "unchanged", nil
+}
+
+// Tests with regenerated results, by outcome
+type regenSummary map[string][]string
+
+func (summary regenSummary) Add(name string, mode string, outcome string) {
+	summary[outcome] = append(summary[outcome], name)
+	if outcome != "unchanged" {
+		PrintTestBlurb("1", name, mode, outcome)
+	}
+}
+
+func (summary regenSummary) Print() {
+	fmt.Printf("Regenerated results: %d changed, %d new, %d unchanged\n",
+		len(summary["changed"]), len(summary["new"]), len(summary["unchanged"]))
+	for _, outcome := range []string{"broken", "too-large"} {
+		for _, name := range summary[outcome] {
+			fmt.Printf("%s %s\n", palette.Warn("Not regenerated, %s:", outcome),
+				palette.Path(name))
+		}
+	}
+}
+
+// Re-record results of the tests from a running server
+func (suite *CQLTestSuite) Regen(lane *Lane, server Server, summary regenSummary) error {
+	c, err := server.Connect()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer c.Close()
+	var version = "unknown"
+	if result, err := c.Execute("SELECT release_version FROM system.local", nil); err == nil &&
+		len(result.rows) == 1 {
+		version = result.rows[0][0]
+	}
+	fmt.Printf("Regenerating results of %s in %s mode with server version %s\n",
+		palette.Path(suite.name), palette.Warn(server.ModeName()), palette.Path(version))
+	for _, test := range suite.tests {
+		outcome, err := test.Regenerate(c, lane, server)
+		if err != nil {
+			return merry.Prepend(err, path.Join(suite.name, test.name))
+		}
+		if err := c.Reset(); err != nil {
+			return merry.Wrap(err)
+		}
+		summary.Add(path.Join(suite.name, test.name), server.ModeName(), outcome)
+	}
+	return nil
+}
+
+// Re-record result files of matching tests in one pass. Refuses to
+// overwrite uncommitted changes unless --force-regen is given.
+func (yacht *Yacht) Regen() int {
+	if yacht.env.force_regen == false {
+		changed, err := git(yacht.env.srcdir, "status", "--porcelain", "--untracked-files=no", ".")
+		if err != nil {
+			fmt.Printf("%s%v\n", palette.Crit("regen failure: "), err)
+			return 1
+		}
+		if len(changed) != 0 {
+			fmt.Printf("%s%s\n", palette.Crit("regen failure: "),
+				"uncommitted changes in the source tree, commit them or use --force-regen")
+			return 1
+		}
+	}
+	if err := yacht.InitLane(); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("lane failure: "), err)
+		return 1
+	}
+	yacht.history = LoadHistory(yacht.env.vardir)
+	yacht.findSuites()
+	var summary = make(regenSummary)
+	for _, suite := range yacht.suites {
+		for _, server := range suite.Servers() {
+			yacht.lane.CleanupBeforeNextSuite()
+			if err := suite.PrepareLane(&yacht.lane, server); err != nil {
+				fmt.Printf("%s%v\n", palette.Crit("lane failure: "), err)
+				return 1
+			}
+			if err := suite.Regen(&yacht.lane, server, summary); err != nil {
+				fmt.Printf("%s%v\n", palette.Crit("regen failure: "), err)
+				return 1
+			}
+		}
+	}
+	summary.Print()
+	if len(summary["changed"]) != 0 {
+		fmt.Printf("Review the changes with %s\n",
+			palette.Path("git -C %s diff", filepath.Clean(yacht.env.srcdir)))
+	}
+	return 0
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// Server capabilities a suite requires, set with 'requires' in
+// suite.yaml, e.g. requires: [udf] or requires: [udf:lua]. Modes
+// which start servers enable them, in other modes the server is
+// probed and the suite is skipped if the server lacks them.
+type Requirements struct {
+	// User-defined functions, in any language if Languages is empty
+	UDF       bool
+	Languages []string
+	// Experimental features tests of the suite declare with
+	// -- requires-feature:, e.g. cdc, see CQLTestFile.RequiredFeatures()
+	Features []string
+}
+
+// Values of experimental_features Scylla accepts, including those of
+// features which are no longer experimental. Scylla refuses to start
+// with any other value in scylla.yaml.
+var KNOWN_EXPERIMENTAL_FEATURES = []string{"alternator-streams", "alternator-ttl",
+	"broadcast-tables", "cdc", "consistent-topology-changes", "keyspace-storage-options",
+	"lwt", "raft", "tablets", "udf", "views-with-tablets"}
+
+func knownFeature(name string) bool {
+	for _, feature := range KNOWN_EXPERIMENTAL_FEATURES {
+		if feature == strings.Replace(name, "_", "-", -1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Experimental features to enable in scylla.yaml
+func (req Requirements) ExperimentalFeatures() []string {
+	var features = append([]string{}, req.Features...)
+	if req.UDF {
+		for _, feature := range features {
+			if feature == "udf" {
+				return features
+			}
+		}
+		features = append(features, "udf")
+	}
+	return features
+}
+
+func parseRequirements(requires []string) (Requirements, error) {
+	var req Requirements
+	for _, entry := range requires {
+		name, language := strings.TrimSpace(entry), ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, language = name[:i], strings.ToLower(name[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "udf":
+			req.UDF = true
+			if language != "" {
+				req.Languages = append(req.Languages, language)
+			}
+		default:
+			return req, merry.Errorf("unknown requirement '%s', expected udf or "+
+				"udf:<language>", entry)
+		}
+	}
+	return req, nil
+}
+
+// Enable what the suite requires in servers started in the mode, if
+// it starts any
+func setRequirements(server Server, req Requirements) {
+	switch s := server.(type) {
+	case *CQLServer:
+		s.requires = req
+	case *CQLCluster:
+		s.requires = req
+	case *CCMCluster:
+		s.requires = req
+	}
+}
+
+// Why the server of the mode can't run the suite, empty if it can
+func (req Requirements) Unmet(server Server) (string, error) {
+	if !req.UDF {
+		return "", nil
+	}
+	// The mock server answers whatever the suite tells it to
+	if _, mock := server.(*mockServer); mock {
+		return "", nil
+	}
+	c, err := server.Connect()
+	if err != nil {
+		return "", merry.Wrap(err)
+	}
+	defer c.Close()
+	languages, err := udfLanguages(c)
+	if err != nil {
+		return "", err
+	}
+	if len(languages) == 0 {
+		return "user-defined functions are disabled", nil
+	}
+	for _, language := range req.Languages {
+		var supported bool
+		for _, l := range languages {
+			supported = supported || l == language
+		}
+		if !supported {
+			return fmt.Sprintf("user-defined functions in %s are not supported, only in %s",
+				language, strings.Join(languages, ", ")), nil
+		}
+	}
+	return "", nil
+}
+
+// Languages of user-defined functions the server accepts, none if
+// they are disabled
+func udfLanguages(c Connection) ([]string, error) {
+	value, found, err := serverSetting(c, "system.config", "enable_user_defined_functions")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		// Scylla
+		if value != "true" {
+			return nil, nil
+		}
+		return []string{"lua", "wasm"}, nil
+	}
+	// Cassandra, the names of 4.1 and of 4.0
+	value, found, err = serverSetting(c, "system_views.settings",
+		"user_defined_functions_enabled", "enable_user_defined_functions")
+	if err != nil || !found || value != "true" {
+		return nil, err
+	}
+	var languages = []string{"java"}
+	value, _, err = serverSetting(c, "system_views.settings",
+		"scripted_user_defined_functions_enabled", "enable_scripted_user_defined_functions")
+	if value == "true" {
+		languages = append(languages, "javascript")
+	}
+	return languages, err
+}
+
+// The value of a server setting in a system table, by any of its
+// names, not found if the server has no such table or setting
+func serverSetting(c Connection, table string, names ...string) (string, bool, error) {
+	for _, name := range names {
+		result, err := c.Execute(fmt.Sprintf("SELECT value FROM %s WHERE name = '%s'",
+			table, name), nil)
+		if err != nil {
+			return "", false, err
+		}
+		if result.status == "OK" && len(result.rows) > 0 {
+			return strings.ToLower(strings.Trim(result.rows[0][0], `"' `)), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Report the tests of a suite the server can't run as skipped
+func skipSuite(lane *Lane, server Server, suite string, tests []string, reason string) {
+	fmt.Printf("%sSkipping suite %s in mode %s: %s\n", lane.Prefix(), palette.Path(suite),
+		server.ModeName(), palette.Warn("%s", reason))
+	for _, test := range tests {
+		PrintTestBlurb(lane.id, path.Join(suite, test), server.ModeName(), "skip")
+	}
+}
+
+func skipTest(lane *Lane, server Server, test string, reason string) {
+	fmt.Printf("%sSkipping test %s in mode %s: %s\n", lane.Prefix(), palette.Path(test),
+		server.ModeName(), palette.Warn("%s", reason))
+	PrintTestBlurb(lane.id, test, server.ModeName(), "skip")
+}
+
+// Experimental and cluster features a server has enabled, in lower
+// case, e.g. cdc, or all of them if it runs with experimental: true
+type serverFeatures struct {
+	all     bool
+	enabled map[string]bool
+}
+
+// Ask the server which features it has enabled. Servers other than
+// Scylla have none, the mock server all.
+func probeFeatures(c Connection, server Server) (*serverFeatures, error) {
+	var features = &serverFeatures{enabled: make(map[string]bool)}
+	if _, mock := server.(*mockServer); mock {
+		features.all = true
+		return features, nil
+	}
+	value, _, err := serverSetting(c, "system.config", "experimental")
+	if err != nil {
+		return nil, err
+	}
+	features.all = value == "true"
+	value, found, err := serverSetting(c, "system.config", "experimental_features")
+	if err != nil || !found {
+		return features, err
+	}
+	var names = strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(`[]"', `, r)
+	})
+	// Features which are no longer experimental, e.g. CDC, are only
+	// listed among the features the cluster has enabled
+	result, err := c.Execute("SELECT value FROM system.scylla_local WHERE key = 'enabled_features'", nil)
+	if err != nil {
+		return nil, err
+	}
+	if result.status == "OK" && len(result.rows) > 0 {
+		names = append(names, strings.Split(strings.ToLower(result.rows[0][0]), ",")...)
+	}
+	for _, name := range names {
+		features.enabled[strings.Replace(strings.TrimSpace(name), "_", "-", -1)] = true
+	}
+	return features, nil
+}
+
+// Features of the list which the server doesn't have enabled
+func (features *serverFeatures) Missing(required []string) []string {
+	var missing []string
+	for _, feature := range required {
+		if !features.all && !features.enabled[strings.Replace(feature, "_", "-", -1)] {
+			missing = append(missing, feature)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// CPUs and memory of each server of a mode, set in the mode entry
+// of suite.yaml:
+//
+//	mode:
+//	    - type: cluster
+//	      smp: 2
+//	      memory: 1G
+//
+// A server gets 1 CPU unless smp is set, and zero memory divides the
+// host memory evenly between all servers running at once.
+type ServerResources struct {
+	SMP    int
+	Memory int64
+}
+
+func parseResources(mode map[string]string) (ServerResources, error) {
+	var resources ServerResources
+	if smp, found := mode["smp"]; found {
+		n, err := strconv.Atoi(smp)
+		if err != nil || n <= 0 {
+			return resources, merry.Errorf("malformed smp '%s'", smp)
+		}
+		resources.SMP = n
+	}
+	if memory, found := mode["memory"]; found {
+		size, err := parseSize(memory)
+		if err != nil || size <= 0 {
+			return resources, merry.Errorf("malformed memory '%s'", memory)
+		}
+		resources.Memory = size
+	}
+	return resources, nil
+}
+
+// Set the resources of servers started in the mode, if it starts any
+func setResources(server Server, resources ServerResources) {
+	switch s := server.(type) {
+	case *CQLServer:
+		s.resources = resources
+	case *CQLCluster:
+		s.resources = resources
+	case *K8sCluster:
+		s.resources = resources
+	}
+}
+
+// Memory left for the system and yacht itself
+const RESERVED_MEMORY = 1 << 30
+
+// Total memory of the host, 0 if unknown
+func hostMemory() int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+// The share of the host of each of the servers of a lane, given the
+// number of servers the lane runs at once. Return Scylla command line
+// options: --smp, 1 unless set, --memory, unless the host memory is
+// unknown, and --overprovisioned if the servers of all lanes have
+// more CPUs than the host, so that Scylla doesn't pin its threads to
+// CPUs.
+func (lane *Lane) ServerOptions(servers int, resources ServerResources) []string {
+	var total = servers * lane.Count()
+	var cpus = runtime.NumCPU()
+	var smp = resources.SMP
+	if smp == 0 {
+		smp = 1
+	}
+	var options = []string{fmt.Sprintf("--smp=%d", smp)}
+	var memory = resources.Memory
+	if memory == 0 {
+		if host := hostMemory(); host > RESERVED_MEMORY {
+			memory = (host - RESERVED_MEMORY) / int64(total)
+		}
+	}
+	if memory > 0 {
+		options = append(options, fmt.Sprintf("--memory=%dM", memory>>20))
+	}
+	if smp*total > cpus {
+		options = append(options, "--overprovisioned")
+	}
+	return options
+}
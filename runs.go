@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/spf13/pflag"
+)
+
+// Each run keeps its lanes in an own directory in vardir, named after
+// the time the run started and a few random characters, so that a
+// run never reuses the lanes of another one. vardir/latest links to
+// the directory of the most recent run.
+const RUN_DIR_PREFIX = "run-"
+const RUN_DIR_LATEST = "latest"
+
+// Create the directory of a new run and point vardir/latest at it
+func newRunDir(vardir string) (string, error) {
+	var stamp = time.Now().Format("20060102-150405.000")
+	for attempt := 0; ; attempt++ {
+		var dir = path.Join(vardir, fmt.Sprintf("%s%s-%04x", RUN_DIR_PREFIX, stamp,
+			rand.Intn(0x10000)))
+		err := os.Mkdir(dir, 0750)
+		if os.IsExist(err) && attempt < 10 {
+			continue
+		} else if err != nil {
+			return "", merry.Prependf(err, "failed to create run directory")
+		}
+		// Replace the link atomically, so that it's never missing
+		var link = path.Join(vardir, RUN_DIR_LATEST)
+		os.Remove(link + ".new")
+		if err := os.Symlink(path.Base(dir), link+".new"); err != nil {
+			return "", merry.Wrap(err)
+		}
+		if err := os.Rename(link+".new", link); err != nil {
+			return "", merry.Wrap(err)
+		}
+		return dir, nil
+	}
+}
+
+// Directories of runs in vardir, oldest first
+func listRuns(vardir string) []string {
+	runs, _ := filepath.Glob(path.Join(vardir, RUN_DIR_PREFIX+"*"))
+	// The names start with the time of the run
+	sort.Strings(runs)
+	return runs
+}
+
+// Remove all runs but the keep most recent ones, none if keep is -1,
+// and vardir/latest if its run is removed. Return the number of
+// removed runs.
+func pruneRuns(vardir string, keep int) (int, error) {
+	var runs = listRuns(vardir)
+	if keep < 0 || len(runs) <= keep {
+		return 0, nil
+	}
+	var removed int
+	for _, dir := range runs[:len(runs)-keep] {
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, merry.Prependf(err, "failed to remove run directory %s", dir)
+		}
+		removed++
+	}
+	var link = path.Join(vardir, RUN_DIR_LATEST)
+	if _, err := os.Stat(link); os.IsNotExist(err) {
+		os.Remove(link)
+	}
+	return removed, nil
+}
+
+// yacht clean [--keep N]: remove the directories of all runs in vardir
+// but the N most recent ones, by default as many as a run keeps
+func (yacht *Yacht) Clean() int {
+	var keep = yacht.env.keep
+	if !pflag.CommandLine.Changed("keep") {
+		keep = yacht.env.keep_runs
+	} else if keep < 0 {
+		fmt.Println("--keep must not be negative")
+		return 1
+	}
+	if err := reapOrphans(yacht.env.vardir, yacht.env.kill_orphans); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("clean failure: "), err)
+		return 1
+	}
+	removed, err := pruneRuns(yacht.env.vardir, keep)
+	if err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("clean failure: "), err)
+		return 1
+	}
+	fmt.Printf("Removed %d runs from %s, kept %d\n", removed, palette.Path(yacht.env.vardir),
+		len(listRuns(yacht.env.vardir)))
+	return 0
+}
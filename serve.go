@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// yacht serve: an HTTP control server for IDEs and CI dashboards. It
+// lists suites, queues runs of matching tests and streams their
+// results. Each run is a child yacht process with its own vardir,
+// vardir-serve-<id>, whose files the server hands out as artefacts.
+// Runs execute one at a time, in the order they are submitted.
+type controlServer struct {
+	yacht *Yacht
+	mutex sync.Mutex
+	// Signalled whenever a run changes its state or gets a result
+	cond  *sync.Cond
+	runs  []*serveRun
+	queue chan *serveRun
+	// findSuites() isn't reentrant
+	suitesMutex sync.Mutex
+}
+
+// A test-end event of the run, see EventStream
+type serveResult struct {
+	Lane       string  `json:"lane"`
+	Test       string  `json:"test"`
+	Mode       string  `json:"mode"`
+	Result     string  `json:"result"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type serveRun struct {
+	ID       int           `json:"id"`
+	Patterns []string      `json:"patterns"`
+	Mode     string        `json:"mode,omitempty"`
+	Force    bool          `json:"force"`
+	State    string        `json:"state"`
+	ExitCode int           `json:"exit_code"`
+	Error    string        `json:"error,omitempty"`
+	Started  *time.Time    `json:"started,omitempty"`
+	Finished *time.Time    `json:"finished,omitempty"`
+	Results  []serveResult `json:"results"`
+	vardir   string
+	// Everything the run printed
+	output bytes.Buffer
+}
+
+type serveSuite struct {
+	Name  string   `json:"name"`
+	Path  string   `json:"path"`
+	Modes []string `json:"modes"`
+	Tests []string `json:"tests"`
+}
+
+func (yacht *Yacht) Serve() int {
+	var srv = &controlServer{yacht: yacht, queue: make(chan *serveRun, 1024)}
+	srv.cond = sync.NewCond(&srv.mutex)
+	go srv.worker()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/suites", srv.handleSuites)
+	mux.HandleFunc("/runs", srv.handleRuns)
+	mux.HandleFunc("/runs/", srv.handleRun)
+	fmt.Printf("Serving on %s\n", palette.Path("http://%s", yacht.env.listen))
+	if err := http.ListenAndServe(yacht.env.listen, mux); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("serve failure: "), err)
+		return 1
+	}
+	return 0
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// GET /suites: suites found in srcdir, with their modes and tests
+func (srv *controlServer) handleSuites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, merry.New("use GET"))
+		return
+	}
+	srv.suitesMutex.Lock()
+	defer srv.suitesMutex.Unlock()
+	var yacht = srv.yacht
+	yacht.suites = nil
+	yacht.findSuites()
+	var suites = []serveSuite{}
+	for _, suite := range yacht.suites {
+		var s = serveSuite{Name: suite.Name(), Path: suite.Path(), Modes: []string{},
+			Tests: suite.Tests()}
+		for _, server := range suite.Servers() {
+			s.Modes = append(s.Modes, server.ModeName())
+		}
+		suites = append(suites, s)
+	}
+	writeJSON(w, http.StatusOK, suites)
+}
+
+// GET /runs: all runs, without their results
+// POST /runs {"patterns": [...], "mode": "...", "force": true}:
+// queue a new run
+func (srv *controlServer) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		srv.mutex.Lock()
+		var runs = []serveRun{}
+		for _, run := range srv.runs {
+			runs = append(runs, serveRun{ID: run.ID, Patterns: run.Patterns,
+				Mode: run.Mode, Force: run.Force, State: run.State,
+				ExitCode: run.ExitCode, Error: run.Error, Started: run.Started,
+				Finished: run.Finished})
+		}
+		srv.mutex.Unlock()
+		writeJSON(w, http.StatusOK, runs)
+	case http.MethodPost:
+		var run serveRun
+		if err := json.NewDecoder(r.Body).Decode(&run); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, merry.Prepend(err, "malformed run request"))
+			return
+		}
+		if len(run.Patterns) > 0 && isCommand(run.Patterns[0]) {
+			writeError(w, http.StatusBadRequest,
+				merry.Errorf("pattern '%s' is a yacht command", run.Patterns[0]))
+			return
+		}
+		srv.mutex.Lock()
+		run.ID = len(srv.runs) + 1
+		run.State = "queued"
+		run.Results = []serveResult{}
+		run.vardir = fmt.Sprintf("%s-serve-%d", srv.yacht.env.vardir, run.ID)
+		srv.runs = append(srv.runs, &run)
+		srv.mutex.Unlock()
+		srv.queue <- &run
+		w.Header().Set("Location", fmt.Sprintf("/runs/%d", run.ID))
+		writeJSON(w, http.StatusCreated, map[string]int{"id": run.ID})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, merry.New("use GET or POST"))
+	}
+}
+
+// GET /runs/<id>: the state and results of a run
+// GET /runs/<id>/results: stream the results as JSON lines until the
+// run ends
+// GET /runs/<id>/output: everything the run printed
+// GET /runs/<id>/artefacts/<path>: a file or directory listing of
+// the run vardir, e.g. artefacts/yacht.log
+func (srv *controlServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, merry.New("use GET"))
+		return
+	}
+	var parts = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/runs/"), "/", 2)
+	id, err := strconv.Atoi(parts[0])
+	srv.mutex.Lock()
+	if err != nil || id < 1 || id > len(srv.runs) {
+		srv.mutex.Unlock()
+		writeError(w, http.StatusNotFound, merry.Errorf("no run '%s'", parts[0]))
+		return
+	}
+	var run = srv.runs[id-1]
+	var what string
+	if len(parts) > 1 {
+		what = parts[1]
+	}
+	switch {
+	case what == "":
+		var snapshot = *run
+		snapshot.Results = append([]serveResult{}, run.Results...)
+		snapshot.output = bytes.Buffer{}
+		srv.mutex.Unlock()
+		writeJSON(w, http.StatusOK, &snapshot)
+	case what == "results":
+		srv.mutex.Unlock()
+		srv.streamResults(w, r, run)
+	case what == "output":
+		var output = append([]byte{}, run.output.Bytes()...)
+		srv.mutex.Unlock()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(output)
+	case what == "artefacts" || strings.HasPrefix(what, "artefacts/"):
+		srv.mutex.Unlock()
+		http.StripPrefix(fmt.Sprintf("/runs/%d/artefacts", id),
+			http.FileServer(http.Dir(run.vardir))).ServeHTTP(w, r)
+	default:
+		srv.mutex.Unlock()
+		writeError(w, http.StatusNotFound, merry.Errorf("unknown resource '%s'", what))
+	}
+}
+
+func (srv *controlServer) streamResults(w http.ResponseWriter, r *http.Request, run *serveRun) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	var sent int
+	// Wake up when the client goes away too, not only on results
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			srv.mutex.Lock()
+			srv.cond.Broadcast()
+			srv.mutex.Unlock()
+		case <-done:
+		}
+	}()
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for {
+		for ; sent < len(run.Results); sent++ {
+			if err := enc.Encode(run.Results[sent]); err != nil {
+				// The client went away
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if run.State == "done" || r.Context().Err() != nil {
+			return
+		}
+		srv.cond.Wait()
+	}
+}
+
+func (srv *controlServer) worker() {
+	for run := range srv.queue {
+		srv.execute(run)
+	}
+}
+
+// Run yacht with the options yacht serve got, so that the run finds
+// the same configuration, and the settings of the request
+func (srv *controlServer) execute(run *serveRun) {
+	var suffix = fmt.Sprintf("serve-%d", run.ID)
+	if srv.yacht.env.vardir_suffix != "" {
+		suffix = srv.yacht.env.vardir_suffix + "-" + suffix
+	}
+	var args []string
+	var skipped bool
+	for i := 1; i < len(os.Args); i++ {
+		var arg = os.Args[i]
+		if arg == "serve" && !skipped {
+			skipped = true
+			continue
+		}
+		// The child writes its events to the server
+		if arg == "--events" {
+			i++
+			continue
+		} else if strings.HasPrefix(arg, "--events=") {
+			continue
+		}
+		args = append(args, arg)
+	}
+	args = append(args, "--vardir-suffix", suffix, "--mode", run.Mode, "--events=-")
+	if run.Force {
+		args = append(args, "--force")
+	}
+	args = append(args, run.Patterns...)
+
+	srv.pruneVardirs(run.ID)
+
+	srv.mutex.Lock()
+	var started = time.Now()
+	run.State = "running"
+	run.Started = &started
+	srv.cond.Broadcast()
+	srv.mutex.Unlock()
+
+	err := srv.runChild(run, args)
+
+	srv.mutex.Lock()
+	var finished = time.Now()
+	run.State = "done"
+	run.Finished = &finished
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		run.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		run.ExitCode = -1
+		run.Error = err.Error()
+	}
+	srv.cond.Broadcast()
+	srv.mutex.Unlock()
+}
+
+func (srv *controlServer) runChild(run *serveRun, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	ylog.Printf("run %d: %s %s", run.ID, exe, strings.Join(args, " "))
+	cmd := exec.Command(exe, args...)
+	// With --events=- the child writes events to the standard output
+	// and the console output to the standard error
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	cmd.Stderr = &serveOutput{srv: srv, run: run}
+	if err := cmd.Start(); err != nil {
+		return merry.Wrap(err)
+	}
+	dec := json.NewDecoder(stdout)
+	for {
+		var event struct {
+			serveResult
+			Event string `json:"event"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if err != io.EOF {
+				ylog.Warnf("run %d: malformed event: %v", run.ID, err)
+			}
+			// The child blocks if the pipe is full
+			io.Copy(ioutil.Discard, stdout)
+			break
+		}
+		if event.Event == "test-end" {
+			srv.mutex.Lock()
+			run.Results = append(run.Results, event.serveResult)
+			srv.cond.Broadcast()
+			srv.mutex.Unlock()
+		}
+	}
+	return cmd.Wait()
+}
+
+// Collects the console output of a run
+type serveOutput struct {
+	srv *controlServer
+	run *serveRun
+}
+
+func (output *serveOutput) Write(p []byte) (int, error) {
+	output.srv.mutex.Lock()
+	defer output.srv.mutex.Unlock()
+	return output.run.output.Write(p)
+}
+
+// Remove the vardirs of earlier runs but the keep_runs most recent
+// ones, as a run does with its run directories. Runs execute in
+// order, so only one vardir is over the limit at a time.
+func (srv *controlServer) pruneVardirs(id int) {
+	var keep = srv.yacht.env.keep_runs
+	if keep < 0 || id-keep-1 < 1 {
+		return
+	}
+	srv.mutex.Lock()
+	var vardir = srv.runs[id-keep-2].vardir
+	srv.mutex.Unlock()
+	if err := os.RemoveAll(vardir); err != nil {
+		ylog.Warnf("failed to remove the vardir of a run: %v", err)
+	}
+}
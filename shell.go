@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// Prints a prompt before every read from the terminal. The results
+// of the statements read before are printed first.
+type promptReader struct {
+	r      io.Reader
+	prompt func()
+}
+
+func (pr *promptReader) Read(p []byte) (int, error) {
+	pr.prompt()
+	return pr.r.Read(p)
+}
+
+// Start a server of the given mode the same way a suite does, or
+// connect to one in uri mode, and execute statements and directives
+// typed in the terminal, printing results the way a test records
+// them
+func (yacht *Yacht) Shell() int {
+	var mode = yacht.env.mode
+	if mode == "" {
+		mode = "uri"
+	}
+	server := yacht.newServer(mode, yacht.env.driver)
+	if server == nil {
+		fmt.Printf("%s%s\n", palette.Crit("shell failure: unknown mode "), mode)
+		return 1
+	}
+	if err := yacht.InitLane(); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("lane failure: "), err)
+		return 1
+	}
+	if err := yacht.shell(server); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("shell failure: "), err)
+		return 1
+	}
+	return 0
+}
+
+func (yacht *Yacht) shell(server Server) error {
+	if err := server.Start(&yacht.lane); err != nil {
+		return err
+	}
+	return interactiveShell(server, &yacht.lane)
+}
+
+// Execute statements and directives typed in the terminal against
+// a running server
+func interactiveShell(server Server, lane *Lane) error {
+	c, err := server.Connect()
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer c.Close()
+
+	fmt.Printf("Connected to %s server, type statements ending with ';' or directives, "+
+		"Ctrl-D to exit\n", palette.Warn("%s", server.ModeName()))
+	var format FormatConfig
+	format.Init()
+	test := &CQLTestFile{name: "shell", path: "shell", format: &format}
+	output := bufio.NewWriter(os.Stdout)
+	run := cqlTestRun{test: test, c: c, lane: lane, server: server, output: output}
+	input := &promptReader{r: os.Stdin, prompt: func() {
+		output.Flush()
+		for _, failure := range test.failures {
+			fmt.Printf("%s\n", palette.Crit("%s", failure))
+		}
+		test.failures = nil
+		fmt.Print("yacht> ")
+	}}
+	// The statements are already on the terminal, don't echo them
+	scanner := newCQLScanner(input, test.path, ioutil.Discard)
+	err = run.Run(scanner)
+	output.Flush()
+	fmt.Println()
+	return err
+}
+
+// Drop into a shell connected to the server after a test failure,
+// see --on-fail: cqlsh, if it's installed, or the internal shell.
+// The run goes on when the shell exits.
+func failureShell(server Server, lane *Lane) {
+	if st, err := os.Stdin.Stat(); err != nil || st.Mode()&os.ModeCharDevice == 0 {
+		fmt.Printf("%s\n", palette.Warn("--on-fail=shell: not a terminal, no shell"))
+		return
+	}
+	fmt.Printf("Starting a shell connected to the server, exit it to resume the run\n")
+	// Connect to the first server of a cluster
+	uris := strings.Split(envValue(server.Environment(), "YACHT_URIS"), ",")
+	cqlsh, err := exec.LookPath("cqlsh")
+	if err != nil || uris[0] == "" {
+		if err := interactiveShell(server, lane); err != nil {
+			fmt.Printf("%s%v\n", palette.Warn("shell failure: "), err)
+		}
+		return
+	}
+	var args = []string{uris[0]}
+	if port := envValue(server.Environment(), "YACHT_NATIVE_PORTS"); port != "" {
+		args = append(args, strings.Split(port, ",")[0])
+	}
+	cmd := exec.Command(cqlsh, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = lane.Dir()
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("%s%v\n", palette.Warn("cqlsh failure: "), err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// Settings of a unit suite, see 'unit' in suite.yaml
+type UnitConfig struct {
+	// The directory of test binaries, relative to builddir,
+	// test by default
+	Dir string
+	// Test binary name patterns, all executables in the directory
+	// by default
+	Binaries []string
+	// Arguments of every test binary, e.g. -- --smp 2
+	Args []string
+	// How many binaries to run at once, 1 by default
+	Jobs int
+	// Time limits of individual binaries by name, overriding the
+	// suite timeout
+	Timeouts map[string]string
+}
+
+// A suite of server unit test binaries found in builddir. They need
+// no server, and run in the lane directory.
+func newUnitTestSuite(cfg UnitConfig, builddir string) (*ProcessTestSuite, error) {
+	var dir = cfg.Dir
+	if dir == "" {
+		dir = "test"
+	}
+	if filepath.IsAbs(dir) == false {
+		dir = filepath.Join(builddir, dir)
+	}
+	var globs = cfg.Binaries
+	if len(globs) == 0 {
+		globs = []string{"*"}
+	}
+	if cfg.Jobs < 0 {
+		return nil, merry.Errorf("unit: malformed jobs %d", cfg.Jobs)
+	}
+	var timeouts = make(map[string]time.Duration)
+	for name, value := range cfg.Timeouts {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, merry.Errorf("unit: malformed timeout '%s' of %s", value, name)
+		}
+		timeouts[name] = timeout
+	}
+	return &ProcessTestSuite{
+		kind:       "unit",
+		dir:        dir,
+		globs:      globs,
+		executable: true,
+		jobs:       cfg.Jobs,
+		timeouts:   timeouts,
+		runInLane:  true,
+		command: func(test *ProcessTest) []string {
+			return append([]string{test.path}, cfg.Args...)
+		},
+	}, nil
+}
+
+// The mode of unit suites: no server, tests only get the lane
+// environment
+type unitServer struct{}
+
+func (server *unitServer) Start(lane *Lane) error {
+	return nil
+}
+
+func (server *unitServer) Connect() (Connection, error) {
+	return nil, merry.New("unit tests have no server to connect to")
+}
+
+func (server *unitServer) ModeName() string {
+	return "unit"
+}
+
+func (server *unitServer) Environment() []string {
+	return []string{"YACHT_MODE=unit"}
+}
+
+func (server *unitServer) LogFiles() []string {
+	return nil
+}
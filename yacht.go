@@ -2,35 +2,66 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"hash/crc32"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ansel1/merry"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-var ylog *log.Logger
+var ylog *Logger
 
 // A directory with tests
 type TestSuite interface {
+	Name() string
+	// Suites with higher priority run first
+	Priority() int
+	// Names of suites which must run before this one
+	DependsOn() []string
+	// The suite directory
+	Path() string
+	// Only keep the tests for which keep() is true
+	Filter(keep func(path string) bool)
+	// Names of the tests, relative to the suite directory
+	Tests() []string
 	FindTests(path string, patterns []string) error
 	IsEmpty() bool
 	AddMode(server Server)
 	Servers() []Server
 	PrepareLane(*Lane, Server) error
 	RunSuite(force bool, lane *Lane, server Server) (int, error)
+	// Report all tests of the suite as not run
+	NotRun(lane *Lane, server Server)
+	Accept(server Server) error
+	Minimize(lane *Lane, server Server) error
+	// Regenerate result files from recordings in dir
+	Replay(lane *Lane, server Server, dir string, summary regenSummary) error
+	// Re-record result files from a running server
+	Regen(lane *Lane, server Server, summary regenSummary) error
 }
 
 // A single test
 type TestFile interface {
 	Init()
-	RunTest(force bool, c Connection, lane *Lane) (string, error)
+	RunTest(force bool, c Connection, lane *Lane, server Server) (string, error)
+	Accept(mode string) (string, bool, error)
 }
 
 // An artefact is anything left by a test or suite while
@@ -41,13 +72,17 @@ type TestFile interface {
 // Artefacts such as server data diretory or log file
 // are removed when a test starts, not when it ends, to
 // be able to inspect them in case of a crash or test failure.
+// A failure to remove one artefact doesn't stop removal of others.
 type Artefact interface {
-	Remove()
+	Remove() error
 }
 
 // A connection is used by a test file to execute queries
 type Connection interface {
-	Execute(query string) (string, error)
+	Execute(query string, opts *QueryOptions) (*CQLResult, error)
+	// Restore the connection state changed by a test, e.g.
+	// the current keyspace
+	Reset() error
 	Close()
 }
 
@@ -57,6 +92,11 @@ type Server interface {
 	Start(lane *Lane) error
 	Connect() (Connection, error)
 	ModeName() string
+	// Environment variables describing the server, such as node
+	// URIs, for commands run by the harness
+	Environment() []string
+	// Log files of server processes started by the harness
+	LogFiles() []string
 }
 
 type StartAndExit struct {
@@ -74,8 +114,45 @@ func (server *StartAndExit) Start(lane *Lane) error {
 
 // Yacht running environment.
 type Env struct {
+	// A subcommand, e.g. "accept", or empty to run tests
+	command string
+	// The action of a command which has several, e.g. "validate"
+	// of "config"
+	subcommand string
+	// The configuration file used, if any, and the effective
+	// configuration, see yacht config show
+	configFile string
+	settings   []configSetting
+	// Print the effective configuration before the run
+	show_config bool
+	// Print the version and exit
+	version bool
 	// Continue running tests even if a single test fails
 	force bool
+	// Stop the run after this many tests failed, 0 for no limit
+	max_failures int
+	// Time budget of the run, 0 for no limit
+	max_time time.Duration
+	// Stop a test at the first statement which output differs from
+	// the result file
+	stop_at_diff bool
+	// Print more details about each test, e.g. statement latencies
+	verbose bool
+	// --on-fail: what to do after a failed test, "shell" to start
+	// a shell connected to the server
+	on_fail string
+	// Record statements and server responses of every test to
+	// vardir/recordings, for replay
+	record bool
+	// Let regen overwrite result files with uncommitted changes
+	force_regen bool
+	// Warn about statements which take longer, 0 for no warnings
+	slow_statement time.Duration
+	// Run each test this many times in a row
+	repeat int
+	// Only run tests changed relative to git ref base
+	changed_only bool
+	base         string
 	// Run only tests matching the given patterns. The patterns are
 	// separated by space. If multiple
 	// patterns are provided, every test name is matched against every
@@ -92,9 +169,146 @@ type Env struct {
 	// Where to look for server binaries
 	builddir string
 	// --uri option, if provided, or uri: in the configuration file,
-	// or "127.0.0.1"
-	uri            string
+	// or "127.0.0.1". A comma-separated list is contact points of
+	// one cluster, see hosts: in the configuration file.
+	uri string
+	// --clusters or clusters: in the configuration file: URIs of
+	// independent clusters to run uri mode suites against at once
+	clusters       []string
 	start_and_exit bool
+	// The keyspace tests run in, empty for the default, see
+	// CQLServerURI
+	keyspace string
+	// Drop the keyspace in uri mode even if it has tables
+	yes_wipe bool
+	// Only run statements which change nothing in uri mode
+	read_only bool
+	// Store reject and newly generated result files under
+	// vardir/results instead of srcdir
+	out_of_tree bool
+	// gocql settings, shared by all suites unless overridden
+	// in suite.yaml
+	driver DriverConfig
+	// Minimal free space on the vardir file system, in bytes,
+	// required to start and go on with a run
+	min_free_space int64
+	// Maximal size of the lane directory, in bytes, 0 for no limit
+	lane_quota int64
+	// The number of most recent runs to keep in vardir, 0 for all
+	keep_runs int
+	// --keep: the number of most recent runs yacht clean keeps
+	keep int
+	// Maximal size of the output of a test, in bytes, 0 for no limit
+	max_output_size int64
+	// Where to keep server data directories
+	tmpfs TmpfsConfig
+	// Kill servers left running by a crashed run without asking
+	kill_orphans bool
+	// How servers started by the harness are told apart: "ip" gives
+	// each server an own loopback address, "port" own ports on
+	// 127.0.0.1
+	isolation string
+	// Post a run summary when done
+	notify NotifyConfig
+	// A shell command to run after each failed test
+	on_failure string
+	// Coverage collection settings
+	coverage CoverageConfig
+	// Record CPU profiles of launched servers with perf
+	profile bool
+	// Resource monitoring of launched servers
+	monitor MonitorConfig
+	// Where and how k8s mode creates Scylla pods
+	k8s K8sConfig
+	// Named build directories, e.g. dev, release
+	builds map[string]string
+	// --build-profile: the name of the build to use, or "all"
+	// to run tests with every build
+	build_profile string
+	// Appended to vardir, to run several instances at once
+	vardir_suffix string
+	// The address yacht serve listens on
+	listen string
+	// Where to write the JSON event stream, "-" for the standard
+	// output, empty for nowhere
+	events string
+	// Verbosity of yacht.log, see LOG_INFO and others
+	log_level      int
+	log_level_name string
+	// Rotate yacht.log when it grows larger, in bytes, 0 for
+	// no rotation
+	log_max_size int64
+}
+
+// Server data directories location, set in 'tmpfs' section
+// of .yacht.yaml
+type TmpfsConfig struct {
+	// A directory on tmpfs, e.g. /dev/shm
+	Dir string
+	// If set, mount a tmpfs of this size, e.g. 4G, at Dir
+	Size string
+}
+
+// Parse a size such as 512M or 10G into bytes
+func parseSize(size string) (int64, error) {
+	var units = map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	var unit int64 = 1
+	size = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(size), "B"))
+	if len(size) > 0 {
+		if u, found := units[size[len(size)-1:]]; found {
+			unit = u
+			size = size[:len(size)-1]
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, merry.Errorf("malformed size '%s'", size)
+	}
+	return n * unit, nil
+}
+
+// Print a size in bytes in human readable form
+func formatSize(size int64) string {
+	const unit = 1 << 10
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	var exp int
+	var n = float64(size)
+	for n >= unit && exp < 4 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", n, "BKMGT"[exp])
+}
+
+var envVarRE = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// Replace ${VAR} with the value of environment variable VAR, to be
+// able to use the same configuration on different hosts. Variables
+// which are not set are left intact, as well as $VAR, so that
+// commands in the configuration can refer to variables set by yacht.
+func expandEnv(text string) string {
+	return envVarRE.ReplaceAllStringFunc(text, func(ref string) string {
+		if value, found := os.LookupEnv(envVarRE.FindStringSubmatch(ref)[1]); found {
+			return value
+		}
+		return ref
+	})
+}
+
+// Find and read a configuration file, expanding environment
+// variables in it
+func readConfig(cfg *viper.Viper) error {
+	if err := cfg.ReadInConfig(); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(cfg.ConfigFileUsed())
+	if err != nil {
+		return err
+	}
+	cfg.SetConfigType(strings.TrimPrefix(filepath.Ext(cfg.ConfigFileUsed()), "."))
+	return cfg.ReadConfig(strings.NewReader(expandEnv(string(content))))
 }
 
 // Look up a configuration file and load it if found
@@ -116,10 +330,31 @@ func (env *Env) configure() {
 		Builddir string
 		Srcdir   string
 		Uri      string
+		Hosts    []string
+		Clusters []string
 	}
 	type Configuration struct {
-		Scylla Scylla
-		Vardir string
+		Scylla        Scylla
+		Vardir        string
+		OutOfTree     bool `mapstructure:"out_of_tree"`
+		Driver        DriverConfig
+		MinFreeSpace  string `mapstructure:"min_free_space"`
+		LaneQuota     string `mapstructure:"lane_quota"`
+		KeepRuns      int    `mapstructure:"keep_runs"`
+		MaxOutputSize string `mapstructure:"max_output_size"`
+		SlowStatement string `mapstructure:"slow_statement"`
+		Tmpfs         TmpfsConfig
+		Notify        NotifyConfig
+		OnFailure     string `mapstructure:"on_failure"`
+		Builds        map[string]string
+		Coverage      CoverageConfig
+		Monitor       MonitorConfig
+		K8s           K8sConfig
+		Palette       PaletteConfig
+		Isolation     string
+		Keyspace      string
+		LogLevel      string `mapstructure:"log_level"`
+		LogMaxSize    string `mapstructure:"log_max_size"`
 	}
 
 	cwd, _ := os.Getwd()
@@ -132,14 +367,32 @@ func (env *Env) configure() {
 			Srcdir:   path.Join(os.Getenv("HOME"), "scylla/tests"),
 			Uri:      "127.0.0.1",
 		},
+		MaxOutputSize: "5M",
+		SlowStatement: "1s",
+		Isolation:     defaultIsolation(),
+		LogLevel:      "info",
+		LogMaxSize:    "100M",
+		KeepRuns:      10,
 	}
 	// Check if a config file is present
-	if err := env_cfg.ReadInConfig(); err == nil {
-		fmt.Printf("Using configuration file %s\n",
-			palette.Path(env_cfg.ConfigFileUsed()))
+	if err := readConfig(env_cfg); err == nil {
+		if !quietCommand() {
+			fmt.Printf("Using configuration file %s\n",
+				palette.Path(env_cfg.ConfigFileUsed()))
+		}
 		// Parse the config file
 		if err := env_cfg.Unmarshal(&configuration); err != nil {
-			fmt.Printf("Parsing configuration failed: %v", err)
+			fmt.Printf("Parsing configuration file %s failed: %v\n",
+				palette.Path(env_cfg.ConfigFileUsed()), err)
+			os.Exit(1)
+		}
+		if problems := unknownKeys(env_cfg.AllSettings(),
+			reflect.TypeOf(configuration), ""); len(problems) != 0 {
+			fmt.Printf("Incorrect configuration file %s:\n",
+				palette.Path(env_cfg.ConfigFileUsed()))
+			for _, problem := range problems {
+				fmt.Printf("  %s\n", palette.Crit("%s", problem))
+			}
 			os.Exit(1)
 		}
 	} else if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -156,12 +409,91 @@ func (env *Env) configure() {
 		configPath := filepath.Dir(env_cfg.ConfigFileUsed())
 		os.Chdir(configPath)
 	}
+	flattenConfig(reflect.ValueOf(configuration), "", &env.settings)
+	if env.configFile = env_cfg.ConfigFileUsed(); env.configFile != "" {
+		raw := viper.New()
+		raw.SetConfigFile(env.configFile)
+		raw.ReadInConfig()
+		configSources(env.settings, env_cfg, raw)
+	} else {
+		configSources(env.settings, env_cfg, nil)
+	}
 	env.builddir, _ = filepath.Abs(configuration.Scylla.Builddir)
 	env.srcdir, _ = filepath.Abs(configuration.Scylla.Srcdir)
 	env.vardir, _ = filepath.Abs(configuration.Vardir)
+	env.builds = make(map[string]string)
+	for name, dir := range configuration.Builds {
+		env.builds[name], _ = filepath.Abs(dir)
+	}
+	env.tmpfs = configuration.Tmpfs
+	if env.tmpfs.Dir != "" {
+		env.tmpfs.Dir, _ = filepath.Abs(env.tmpfs.Dir)
+	}
 	// Restore the original current working directory, if it was changed
 	os.Chdir(cwd)
 	env.uri = configuration.Scylla.Uri
+	if len(configuration.Scylla.Hosts) > 0 {
+		env.uri = strings.Join(configuration.Scylla.Hosts, ",")
+	}
+	env.clusters = configuration.Scylla.Clusters
+	env.driver = configuration.Driver
+	env.out_of_tree = configuration.OutOfTree
+	env.notify = configuration.Notify
+	env.on_failure = configuration.OnFailure
+	env.coverage = configuration.Coverage
+	env.monitor = configuration.Monitor
+	env.k8s = configuration.K8s
+	if p, err := NewPalette(configuration.Palette); err != nil {
+		fmt.Printf("Incorrect configuration setting for %v\n", err)
+		os.Exit(1)
+	} else {
+		palette = p
+	}
+	if err := env.monitor.Init(); err != nil {
+		fmt.Printf("Incorrect configuration setting for %v\n", err)
+		os.Exit(1)
+	}
+	if err := env.k8s.Init(); err != nil {
+		fmt.Printf("Incorrect configuration setting for %v\n", err)
+		os.Exit(1)
+	}
+	var check_size = func(name string, value string) int64 {
+		if value == "" {
+			return 0
+		}
+		size, err := parseSize(value)
+		if err != nil {
+			fmt.Printf("Incorrect configuration setting for %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return size
+	}
+	env.keyspace = configuration.Keyspace
+	env.isolation = configuration.Isolation
+	if env.isolation != "ip" && env.isolation != "port" {
+		fmt.Printf("Incorrect configuration setting for isolation: '%s', must be ip or port\n",
+			env.isolation)
+		os.Exit(1)
+	}
+	env.min_free_space = check_size("min_free_space", configuration.MinFreeSpace)
+	env.lane_quota = check_size("lane_quota", configuration.LaneQuota)
+	if env.keep_runs = configuration.KeepRuns; env.keep_runs < -1 {
+		fmt.Printf("Incorrect configuration setting for keep_runs: %d, must be -1 or more\n",
+			env.keep_runs)
+		os.Exit(1)
+	}
+	env.max_output_size = check_size("max_output_size", configuration.MaxOutputSize)
+	env.log_max_size = check_size("log_max_size", configuration.LogMaxSize)
+	env.log_level_name = configuration.LogLevel
+	if configuration.SlowStatement != "" {
+		var err error
+		env.slow_statement, err = time.ParseDuration(configuration.SlowStatement)
+		if err != nil {
+			fmt.Printf("Incorrect configuration setting for slow_statement: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	check_size("tmpfs.size", env.tmpfs.Size)
 	var check_dir = func(name string, value string) {
 		var msg string = "Incorrect configuration setting for %s: %v\n"
 		st, err := os.Stat(value)
@@ -188,23 +520,150 @@ func (env *Env) Usage() {
 	pflag.BoolVar(&env.force, "force", false,
 		`Go on with other tests in case of an individual
 test failure. Default: false`)
+	pflag.IntVar(&env.max_failures, "max-failures", 0,
+		`Go on with other tests after a test failure, but
+stop the run after this many distinct tests failed.
+Implies --force. Default: 0, no limit.`)
+	pflag.BoolVar(&env.stop_at_diff, "stop-at-diff", false,
+		`Stop a test at the first statement which output
+differs from the result file, instead of running it
+to the end. Default: false.`)
+	pflag.StringVar(&env.log_level_name, "log-level", env.log_level_name,
+		`Verbosity of yacht.log: error, warn, info or debug,
+which also logs every executed statement. Default:
+log_level in the configuration file, or info.`)
+	pflag.StringVar(&env.on_fail, "on-fail", "",
+		`What to do after a failed test. 'shell' starts cqlsh,
+or the internal shell if there is no cqlsh, connected
+to the server, in modes which start servers, and
+resumes the run when the shell exits.`)
+	pflag.BoolVar(&env.record, "record", false,
+		`Record statements and server responses of every
+test in vardir/recordings, so that 'replay' can
+regenerate result files without a server. Default: false.`)
+	pflag.BoolVar(&env.force_regen, "force-regen", false,
+		`Let 'regen' run in a source tree with uncommitted
+changes. Default: false.`)
+	pflag.BoolVarP(&env.verbose, "verbose", "v", false,
+		`Print more details about each test, e.g. a histogram
+of statement latencies. Default: false.`)
+	pflag.DurationVar(&env.max_time, "max-time", 0,
+		`Time budget of the run, e.g. 30m. When it is
+exceeded, finish the current test, report the rest
+as not run and exit with status 3. Default: no limit.`)
+	pflag.IntVar(&env.repeat, "repeat", 1,
+		`Run each test this many times in a row against
+the same server, to catch leaks and non-determinism.
+Multiplies the count of '-- repeat:' directive.`)
+	pflag.BoolVar(&env.changed_only, "changed-only", false,
+		`Only run tests which test or result files differ
+from --base in git, or are new, and whole suites
+with changed configuration or included files.
+Suites they depend on are run too. Default: false.`)
+	pflag.StringVar(&env.base, "base", "origin/master",
+		`Git ref to compare with for --changed-only`)
+	pflag.BoolVar(&env.profile, "profile", false,
+		`Record CPU profiles of servers started for the
+selected suites with 'perf record' and store them,
+and flame graphs if FlameGraph scripts are in PATH,
+in vardir/profiles. Default: false.`)
 	pflag.StringVar(&env.uri, "uri", env.uri,
-		"Server URI to connect to in URI mode")
+		`Server URI to connect to in URI mode, or a
+comma-separated list of contact points of a cluster`)
+	pflag.StringArrayVar(&env.clusters, "clusters", env.clusters,
+		`URIs of independent clusters to run URI mode suites
+against in parallel, one per lane. Repeat the option
+for each cluster. Overrides --uri.`)
+	pflag.BoolVar(&env.yes_wipe, "yes-wipe", false,
+		`In URI mode, drop the test keyspace before a suite
+even if it exists and has tables. Default: refuse.`)
+	pflag.BoolVar(&env.read_only, "read-only", false,
+		`In URI mode, create no keyspace and refuse to execute
+statements other than SELECT, USE, DESCRIBE and LIST,
+to run read-only suites against production-like
+clusters. Default: false.`)
 	pflag.BoolVar(&env.start_and_exit, "start-and-exit", env.start_and_exit,
 		`Configure the cluster according to the first
 matching suite/mode combo and exit. For example:
 ./yacht --mode=cluster --start-and-exit.
 Default: false.`)
+	pflag.BoolVar(&env.out_of_tree, "out-of-tree", env.out_of_tree,
+		`Store reject files and new result files in
+vardir/results instead of the suite directory.
+Use 'accept' to copy them to the suite directory.
+Default: false.`)
+	pflag.BoolVar(&env.kill_orphans, "kill-orphans", false,
+		`Kill servers left running by a previous crashed
+run without asking. Default: false.`)
+	pflag.IntVar(&env.keep, "keep", 0,
+		`The number of most recent runs 'clean' keeps
+in vardir, 0 removes all. Default: keep_runs.`)
+	pflag.BoolVar(&env.version, "version", false,
+		`Print the commit yacht is built from, the Go
+version, and supported suite types and modes.`)
+	pflag.BoolVar(&env.show_config, "show-config", false,
+		`Print the effective configuration before the run,
+see 'config show'. Default: false.`)
+	pflag.StringVar(&env.vardir_suffix, "vardir-suffix", "",
+		`Use vardir-<suffix> instead of vardir, to run
+several instances of yacht at once. Default: none.`)
+	pflag.StringVar(&env.events, "events", "",
+		`Write progress of the run as JSON lines, one event
+per line, to the file, or to the standard output
+if '-', moving the console output to the standard
+error. Default: none.`)
+	pflag.StringVar(&env.listen, "listen", "127.0.0.1:8080",
+		`The address 'serve' listens on.
+Default: 127.0.0.1:8080.`)
+	pflag.StringVar(&env.build_profile, "build-profile", "",
+		`Use the build with the given name from 'builds'
+section of the configuration file, or 'all' to run
+tests with every build and compare the results.
+Default: scylla.builddir.`)
 	pflag.StringVar(&env.mode, "mode", "",
 		`Only run tests in the specified mode. The mode
 must be among the modes in the suite config.
-Supported modes: uri, single, cluser.
+Supported modes: uri, single, cluster, mock, k8s,
+compose, ccm.
 Default: use all modes from the suite config.`)
 	pflag.Usage = func() {
 		fmt.Println("yacht - a Yet Another Scylla Harness for Testing")
-		fmt.Printf("\nUsage: %v [--force] [pattern [...]]\n", os.Args[0])
+		fmt.Printf("\nUsage: %v [--force] [%s] [pattern [...]]\n", os.Args[0], strings.Join(commands, "|"))
 		fmt.Println(
 			`
+Commands:
+accept          Overwrite result files of matching tests with reject
+                files left by their last failed run.
+minimize        Find the smallest sequence of statements of a failing
+                test which reproduces the failure, and write it to
+                testname_min.test.cql in the lane directory.
+replay          Regenerate result files of matching tests from the
+                recordings of a previous run with --record, without
+                a server, e.g. after a change of result formatting.
+regen           Re-record result files of matching tests from a server
+                of the given --mode, or of every mode of the suite,
+                and print a summary of changed files.
+setup-net       Add loopback addresses servers are given with
+                isolation: ip, where they are not configured by
+                default, e.g. on macOS. Uses sudo.
+config validate Check the configuration file and suite files for
+                unknown keys, wrong types and missing settings
+                without running tests.
+config show     Print the effective configuration: every setting
+                and command line option with its value and source,
+                default, configuration file, environment variable
+                or command line.
+serve           Run an HTTP control server on --listen, which lists
+                suites, starts runs of matching tests in a given
+                mode, streams their results and serves the files
+                they leave in vardir, see README.
+clean           Remove the directories of previous runs from vardir,
+                all but the --keep, or keep_runs, most recent ones.
+completion      Print a completion script for bash, zsh or fish,
+                which completes commands, options, modes, suite
+                names and test names found in srcdir, e.g.
+                source <(yacht completion bash)
+
 Positional arguments:
 [pattrn [...]]  List of test name patterns to look for in suites.
                 Each name is used as a substring to look for in the
@@ -217,7 +676,78 @@ Positional arguments:
 		os.Exit(0)
 	}
 	pflag.Parse()
+	if env.version {
+		printVersion()
+		os.Exit(0)
+	}
+	if env.max_failures > 0 {
+		env.force = true
+	}
+	if env.vardir_suffix != "" {
+		env.vardir += "-" + env.vardir_suffix
+	}
+	if env.tmpfs.Dir == "" && env.tmpfs.Size != "" {
+		env.tmpfs.Dir = path.Join(env.vardir, "tmpfs")
+	}
+	env.setConfigValue("scylla.srcdir", env.srcdir, "")
+	env.setConfigValue("vardir", env.vardir, "vardir-suffix")
+	env.setConfigValue("scylla.uri", env.uri, "uri")
+	env.setConfigValue("scylla.clusters", fmt.Sprintf("%v", env.clusters), "clusters")
+	if len(env.clusters) == 1 {
+		// A single cluster needs no fan-out
+		env.uri = env.clusters[0]
+		env.clusters = nil
+	}
+	env.setConfigValue("out_of_tree", fmt.Sprintf("%v", env.out_of_tree), "out-of-tree")
+	env.setConfigValue("log_level", env.log_level_name, "log-level")
+	if env.repeat < 1 {
+		fmt.Println("--repeat must be positive")
+		os.Exit(1)
+	}
+	if env.build_profile != "" && env.build_profile != "all" {
+		builddir, found := env.builds[env.build_profile]
+		if found == false {
+			fmt.Printf("Unknown build profile '%s', see 'builds' in the configuration file\n",
+				env.build_profile)
+			os.Exit(1)
+		}
+		env.builddir = builddir
+	}
+	env.setConfigValue("scylla.builddir", env.builddir, "build-profile")
+	if env.build_profile == "all" && len(env.builds) == 0 {
+		fmt.Println("--build-profile=all requires 'builds' in the configuration file")
+		os.Exit(1)
+	}
+	if level, err := parseLogLevel(env.log_level_name); err != nil {
+		fmt.Printf("Incorrect --log-level: %v\n", err)
+		os.Exit(1)
+	} else {
+		env.log_level = level
+	}
+	if env.on_fail != "" && env.on_fail != "shell" {
+		fmt.Printf("Unknown --on-fail action '%s'\n", env.on_fail)
+		os.Exit(1)
+	}
 	env.patterns = pflag.Args()
+	if len(env.patterns) > 0 && isCommand(env.patterns[0]) {
+		env.command = env.patterns[0]
+		env.patterns = env.patterns[1:]
+	}
+	if env.command == "shell" && len(env.patterns) > 0 {
+		// yacht shell [mode]
+		env.mode = env.patterns[0]
+		env.patterns = env.patterns[1:]
+	}
+	if env.command == "config" {
+		// yacht config validate|show
+		if len(env.patterns) == 0 ||
+			(env.patterns[0] != "validate" && env.patterns[0] != "show") {
+			fmt.Println("Usage: yacht config validate|show")
+			os.Exit(1)
+		}
+		env.subcommand = env.patterns[0]
+		env.patterns = env.patterns[1:]
+	}
 	if len(env.patterns) == 0 {
 		// Add a wildcard if there are no user defined patterns
 		env.patterns = append(env.patterns, "")
@@ -227,116 +757,662 @@ Positional arguments:
 // Test lane is a directory on disk containing
 // data of a running server, log files and so on.
 type Lane struct {
-	// Artefacts which must be removed before a test starts
-	removeBeforeNextSuite []Artefact
-	// Artefacts which must be removed at harness exit
-	removeBeforeExit []Artefact
+	// Artefacts which must be removed before the next suite starts,
+	// some of them also at harness exit. Servers start in parallel,
+	// so access is protected by mutex.
+	artefacts []*laneArtefact
+	mutex     sync.Mutex
 	// Lane data directory
 	dir string
+	// Where servers store their data: the lane directory or
+	// a directory on tmpfs
+	dataDir string
 	// Unique lane id, used as a subdirectory within the directory
 	id string
 	// The list of failed tests
-	failed     []string
-	leasedURIs map[string]bool
+	failed []string
+	// Distinct tests failed in all suites, and how many may fail
+	// before the run stops, 0 for no limit
+	failedTests map[string]bool
+	maxFailures int
+	// Lanes running at once with this one, see RunModes(), nil if
+	// the lane runs alone
+	group *laneGroup
+	// Headers of failed tests, see TestMetadata
+	metadata map[string]TestMetadata
+	// When the time budget of the run is over, zero if there
+	// is no budget
+	deadline time.Time
+	// Where to collect coverage data of servers, empty if
+	// coverage is not collected
+	coverageDir string
+	// Where to store CPU profiles of servers, empty if they
+	// are not profiled
+	profileDir string
+	// Resource monitoring of servers, and the first failure
+	// it detected
+	monitor        *MonitorConfig
+	monitorFailure error
+	// The number of tests which passed
+	passed int
+	// The number of tests not run because the time budget is over
+	notRun int
+	// Addresses and ports leased to servers, see Leases()
+	leases *laneLeases
+	// See Env.isolation
+	isolation string
+	// Disk space limits, see Env
+	minFreeSpace int64
+	quota        int64
+	// yacht.log, or an own log if several lanes run at once
+	log *Logger
+	// The number of lanes running at once, see Count()
+	count int
+}
+
+// An artefact registered in the lane
+type laneArtefact struct {
+	Artefact
+	// Artefacts which must only be removed after this one, e.g.
+	// a server data directory is removed after the server is stopped.
+	// nil entries are ignored.
+	dependsOn []Artefact
+	// Must be removed at harness exit too
+	exit bool
 }
 
-func (lane *Lane) AddExitArtefact(artefact Artefact) {
-	lane.removeBeforeExit = append(lane.removeBeforeExit, artefact)
+func (lane *Lane) addArtefact(artefact Artefact, exit bool, dependsOn []Artefact) {
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+	lane.artefacts = append(lane.artefacts,
+		&laneArtefact{Artefact: artefact, dependsOn: dependsOn, exit: exit})
 }
 
-func (lane *Lane) AddSuiteArtefact(artefact Artefact) {
-	lane.removeBeforeNextSuite = append(lane.removeBeforeNextSuite, artefact)
+// Add an artefact which must be removed at exit, e.g. a running
+// server, and before the next suite
+func (lane *Lane) AddExitArtefact(artefact Artefact, dependsOn ...Artefact) {
+	lane.addArtefact(artefact, true, dependsOn)
 }
 
-// Used as server working directory
+// Add an artefact which must be removed before the next suite
+func (lane *Lane) AddSuiteArtefact(artefact Artefact, dependsOn ...Artefact) {
+	lane.addArtefact(artefact, false, dependsOn)
+}
+
+// Used for server log files and test artefacts
 func (lane *Lane) Dir() string {
 	return lane.dir
 }
 
+// Used as server working and data directory
+func (lane *Lane) DataDir() string {
+	return lane.dataDir
+}
+
+// The number of lanes running at once, each with own servers
+func (lane *Lane) Count() int {
+	if lane.count > 1 {
+		return lane.count
+	}
+	return 1
+}
+
+// The number of loopback addresses servers are given in "ip"
+// isolation, 127.0.0.2 and on
+const URI_POOL_SIZE = 30
+
+// Loopback addresses and ports leased to servers, shared by lanes
+// which run at once, so that their servers don't get the same ones
+type laneLeases struct {
+	mutex    sync.Mutex
+	uris     map[string]bool
+	prefixes map[string]bool
+	ports    map[int]bool
+}
+
+func (lane *Lane) Leases() *laneLeases {
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+	if lane.leases == nil {
+		lane.leases = &laneLeases{uris: make(map[string]bool),
+			prefixes: make(map[string]bool), ports: make(map[int]bool)}
+	}
+	return lane.leases
+}
+
 // With multiple servers we need to be careful all of them do
 // not share the same host/port
 func (lane *Lane) LeaseURI() (string, error) {
 
-	const POOL_SIZE = 30
+	const POOL_SIZE = URI_POOL_SIZE
 
-	if lane.leasedURIs == nil {
-		lane.leasedURIs = make(map[string]bool)
-	}
+	var leases = lane.Leases()
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
 
-	if len(lane.leasedURIs) >= POOL_SIZE*3/4 {
+	if len(leases.uris) >= POOL_SIZE*3/4 {
 		return "", merry.Errorf("IP address pool has exhaused, current size is %d",
-			len(lane.leasedURIs))
+			len(leases.uris))
 	}
 
 	for {
 		var uri = fmt.Sprintf("127.0.0.%d", rand.Intn(POOL_SIZE)+2)
-		if _, found := lane.leasedURIs[uri]; found == false {
-			lane.leasedURIs[uri] = true
-			ylog.Printf("Leased uri %s at lane %s", uri, lane.id)
+		if _, found := leases.uris[uri]; found == false {
+			leases.uris[uri] = true
+			lane.Log().Printf("Leased uri %s at lane %s", uri, lane.id)
 			return uri, nil
 		}
 	}
 }
 
 func (lane *Lane) ReleaseURI(uri string) {
-	ylog.Printf("Released uri %s at lane %s", uri, lane.id)
-	delete(lane.leasedURIs, uri)
+	var leases = lane.Leases()
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+	lane.Log().Printf("Released uri %s at lane %s", uri, lane.id)
+	delete(leases.uris, uri)
+}
+
+// The number of address prefixes of clusters which assign node
+// addresses themselves, 127.0.1. and on
+const URI_PREFIX_POOL_SIZE = 254
+
+// Lease a prefix of loopback addresses, e.g. 127.0.1., for a cluster
+// which gives its nodes addresses <prefix>1, <prefix>2 and so on, such
+// as ccm. Addresses of LeaseURI() are all in 127.0.0., so the two
+// don't collide.
+func (lane *Lane) LeaseURIPrefix() (string, error) {
+	var leases = lane.Leases()
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+
+	for i := 1; i <= URI_PREFIX_POOL_SIZE; i++ {
+		var prefix = fmt.Sprintf("127.0.%d.", i)
+		if leases.prefixes[prefix] == false {
+			leases.prefixes[prefix] = true
+			lane.Log().Printf("Leased uri prefix %s at lane %s", prefix, lane.id)
+			return prefix, nil
+		}
+	}
+	return "", merry.Errorf("IP address prefix pool has exhausted, current size is %d",
+		len(leases.prefixes))
+}
+
+func (lane *Lane) ReleaseURIPrefix(prefix string) {
+	var leases = lane.Leases()
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+	lane.Log().Printf("Released uri prefix %s at lane %s", prefix, lane.id)
+	delete(leases.prefixes, prefix)
+}
+
+// Ports of servers in "port" isolation are leased from this range
+const (
+	PORT_POOL_START = 20000
+	PORT_POOL_SIZE  = 10000
+)
+
+// Lease count ports on 127.0.0.1, which are neither leased by the
+// lane nor used by other processes
+func (lane *Lane) LeasePorts(count int) ([]int, error) {
+	var leases = lane.Leases()
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+
+	var ports []int
+	for attempt := 0; len(ports) < count; attempt++ {
+		if attempt >= PORT_POOL_SIZE {
+			for _, port := range ports {
+				delete(leases.ports, port)
+			}
+			return nil, merry.Errorf("port pool has exhausted, %d ports are leased",
+				len(leases.ports))
+		}
+		var port = PORT_POOL_START + rand.Intn(PORT_POOL_SIZE)
+		if leases.ports[port] {
+			continue
+		}
+		// Check that no other process listens on the port
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		listener.Close()
+		leases.ports[port] = true
+		ports = append(ports, port)
+	}
+	lane.Log().Printf("Leased ports %v at lane %s", ports, lane.id)
+	return ports, nil
+}
+
+func (lane *Lane) ReleasePorts(ports []int) {
+	var leases = lane.Leases()
+	leases.mutex.Lock()
+	defer leases.mutex.Unlock()
+	lane.Log().Printf("Released ports %v at lane %s", ports, lane.id)
+	for _, port := range ports {
+		delete(leases.ports, port)
+	}
+}
+
+// Extra loopback addresses are not configured on macOS by default
+func defaultIsolation() string {
+	if runtime.GOOS == "darwin" {
+		return "port"
+	}
+	return "ip"
+}
+
+// The value of a variable of an environment, such as the one of
+// Lane.Environment() or Server.Environment()
+func envValue(env []string, name string) string {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return kv[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// Environment variables describing the lane, for commands run
+// by the harness
+func (lane *Lane) Environment() []string {
+	return []string{
+		"YACHT_LANE_ID=" + lane.id,
+		"YACHT_LANE_DIR=" + lane.dir,
+	}
+}
+
+// Check that the file system of the lane has enough free space
+// and the lane directory doesn't exceed its quota. Scylla fails
+// obscurely when it runs out of disk space, so it's better to
+// stop early with a clear message.
+func (lane *Lane) CheckDiskSpace() error {
+	var dirs = []string{lane.dir}
+	if lane.dataDir != lane.dir {
+		dirs = append(dirs, lane.dataDir)
+	}
+	if lane.minFreeSpace > 0 {
+		for _, dir := range dirs {
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(dir, &fs); err != nil {
+				return merry.Prepend(err, "failed to check free disk space")
+			}
+			free := int64(fs.Bavail) * int64(fs.Bsize)
+			if free < lane.minFreeSpace {
+				return merry.Errorf("only %s free at %s, min_free_space is %s",
+					formatSize(free), dir, formatSize(lane.minFreeSpace))
+			}
+		}
+	}
+	if lane.quota > 0 {
+		var size int64
+		for _, dir := range dirs {
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					size += info.Size()
+				}
+				return nil
+			})
+		}
+		if size > lane.quota {
+			return merry.Errorf("lane directory %s uses %s, lane_quota is %s",
+				lane.dir, formatSize(size), formatSize(lane.quota))
+		}
+	}
+	return nil
 }
 
 func (lane *Lane) FailedTests() []string {
 	return lane.failed
 }
 
+func (lane *Lane) AddFailedTest(name string) {
+	lane.failed = append(lane.failed, name)
+	if lane.failedTests == nil {
+		lane.failedTests = make(map[string]bool)
+	}
+	lane.failedTests[name] = true
+	if lane.group != nil {
+		lane.group.addFailedTest(name)
+	}
+}
+
+// Whether another lane running at once stopped the run, see laneGroup
+func (lane *Lane) Stopped() bool {
+	return lane.group != nil && lane.group.Stopped()
+}
+
+// Remember the header of a failed test, for the run summary
+func (lane *Lane) AddTestMetadata(name string, md TestMetadata) {
+	if lane.metadata == nil {
+		lane.metadata = make(map[string]TestMetadata)
+	}
+	lane.metadata[name] = md
+}
+
+// Whether so many tests failed that the run must stop
+func (lane *Lane) TooManyFailures() bool {
+	return lane.maxFailures > 0 && len(lane.failedTests) >= lane.maxFailures
+}
+
+// Whether the time budget of the run is over
+func (lane *Lane) TimedOut() bool {
+	return lane.deadline.IsZero() == false && time.Now().After(lane.deadline)
+}
+
+func (lane *Lane) NotRunTests() int {
+	return lane.notRun
+}
+
+func (lane *Lane) SetMonitorFailure(err error) {
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+	if lane.monitorFailure == nil {
+		lane.monitorFailure = err
+	}
+}
+
+// Return a resource limit violation detected by monitoring, if any
+func (lane *Lane) MonitorFailure() error {
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+	return lane.monitorFailure
+}
+
+func (lane *Lane) PassedTests() int {
+	return lane.passed
+}
+
+func (lane *Lane) SetDiskLimits(minFreeSpace int64, quota int64) {
+	lane.minFreeSpace = minFreeSpace
+	lane.quota = quota
+}
+
+// Use a subdirectory of the run directory, which is new for every
+// run, see newRunDir()
 func (lane *Lane) Init(id string, dir string) {
-	// @todo add random characters
 	lane.id = id
 	lane.dir, _ = filepath.Abs(path.Join(dir, id))
-	// Create the directory if it doesn't exist or clear
-	// it if it does
-	if _, err := os.Stat(lane.dir); err != nil && !os.IsNotExist(err) {
+	lane.dataDir = lane.dir
+	initLaneDir(lane.dir)
+}
+
+// Create the directory if it doesn't exist or clear
+// it if it does
+func initLaneDir(dir string) {
+	if _, err := os.Stat(dir); err != nil && !os.IsNotExist(err) {
 		fmt.Printf("Failed to access temporary directory %s",
-			palette.Path(lane.dir))
+			palette.Path(dir))
 		os.Exit(1)
 	} else if err == nil {
-		if err := os.RemoveAll(lane.dir); err != nil {
+		if err := os.RemoveAll(dir); err != nil {
 			fmt.Printf("Failed to remove temporary directory %s",
-				palette.Path(lane.dir))
+				palette.Path(dir))
 			os.Exit(1)
 		}
 	}
-	if err := os.MkdirAll(lane.dir, 0750); err != nil {
+	if err := os.MkdirAll(dir, 0750); err != nil {
 		fmt.Printf("Failed to create temporary directory %s",
-			palette.Path(lane.dir))
+			palette.Path(dir))
 		os.Exit(1)
 	}
 }
 
-// Clear the lane beween two test suite invocations
-func (lane *Lane) CleanupBeforeNextSuite() {
-	// Clear the "suite" artefacts first, they may depend on "exit"
-	// artefacts, e.g. a running server may depend on the data in
-	// the data directory
-	for _, artefact := range lane.removeBeforeExit {
-		artefact.Remove()
+// Keep server data directories of the lane on tmpfs, which is much
+// faster for write-heavy suites. Mount a new tmpfs if the size is
+// set and the directory is not a mount point yet. The mount is not
+// removed at exit, to be able to inspect the data after a failure.
+// The directory of the lane is named after vardir too: runs with
+// different vardirs may share the tmpfs, and runs with the same one
+// never run at once, see lockVardir().
+func (lane *Lane) InitTmpfs(cfg TmpfsConfig, vardir string) error {
+	if cfg.Dir == "" {
+		return nil
 	}
-	// Clear the artefacts array, the artefacts are now gone
-	lane.removeBeforeExit = nil
+	dir, _ := filepath.Abs(cfg.Dir)
+	if cfg.Size != "" {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return merry.Wrap(err)
+		}
+		var st, parent syscall.Stat_t
+		if err := syscall.Stat(dir, &st); err != nil {
+			return merry.Wrap(err)
+		}
+		if err := syscall.Stat(filepath.Dir(dir), &parent); err != nil {
+			return merry.Wrap(err)
+		}
+		if st.Dev == parent.Dev {
+			size, _ := parseSize(cfg.Size)
+			ylog.Printf("Mounting tmpfs of size %d at %s", size, dir)
+			out, err := exec.Command("mount", "-t", "tmpfs",
+				"-o", fmt.Sprintf("size=%d", size), "tmpfs", dir).CombinedOutput()
+			if err != nil {
+				return merry.Errorf("failed to mount tmpfs at %s: %v: %s", dir, err,
+					strings.TrimSpace(string(out)))
+			}
+		}
+	}
+	lane.dataDir = path.Join(dir, fmt.Sprintf("yacht-%08x-%s",
+		crc32.ChecksumIEEE([]byte(vardir)), lane.id))
+	initLaneDir(lane.dataDir)
+	return nil
+}
+
+// Record a process started by the harness, to be able to find it
+// if the harness crashes and leaves it running
+func WritePidFile(name string, cmd *exec.Cmd) error {
+	var content = fmt.Sprintf("%d %s\n", cmd.Process.Pid, cmd.Args[0])
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		return merry.Prepend(err, "failed to write pid file")
+	}
+	return nil
+}
+
+// A process left running by a previous harness run
+type orphan struct {
+	pid     int
+	exe     string
+	pidFile string
+}
+
+// Find processes recorded in pid files of lanes in the directory
+// which are still running. A pid is only considered alive if it
+// still runs the same executable, since pids are reused.
+func findOrphans(dir string) []orphan {
+	var orphans []orphan
+	files, _ := filepath.Glob(path.Join(dir, "*", "*.pid"))
+	// Lanes of runs, see newRunDir()
+	lanes, _ := filepath.Glob(path.Join(dir, RUN_DIR_PREFIX+"*", "*", "*.pid"))
+	files = append(files, lanes...)
+	for _, file := range files {
+		var o = orphan{pidFile: file}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(string(content)), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if o.pid, err = strconv.Atoi(fields[0]); err != nil {
+			continue
+		}
+		o.exe = fields[1]
+		cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", o.pid))
+		if err != nil || strings.SplitN(string(cmdline), "\x00", 2)[0] != o.exe {
+			continue
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans
+}
 
-	for _, artefact := range lane.removeBeforeNextSuite {
-		artefact.Remove()
+// Kill servers left by a crashed harness run in vardir, so that they
+// do not hold the addresses the lane leases. Ask for confirmation
+// unless kill is set, and refuse to go on if it isn't given.
+func reapOrphans(dir string, kill bool) error {
+	orphans := findOrphans(dir)
+	if len(orphans) == 0 {
+		return nil
+	}
+	fmt.Printf("%s\n", palette.Warn("Found processes left by a previous run:"))
+	for _, o := range orphans {
+		fmt.Printf("  %d %s (%s)\n", o.pid, o.exe, palette.Path(o.pidFile))
+	}
+	if kill == false {
+		if st, err := os.Stdin.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+			fmt.Print("Kill them? [y/N] ")
+			var answer string
+			fmt.Scanln(&answer)
+			kill = strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+		}
+	}
+	if kill == false {
+		return merry.New("processes of a previous run are still running, use --kill-orphans to kill them")
 	}
+	for _, o := range orphans {
+		ylog.Printf("Killing orphaned process %d", o.pid)
+		syscall.Kill(o.pid, syscall.SIGKILL)
+		os.Remove(o.pidFile)
+	}
+	// Wait until the processes are gone and release their addresses
+	deadline := time.Now().Add(10 * time.Second)
+	for _, o := range orphans {
+		for syscall.Kill(o.pid, 0) == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// Take an advisory lock on vardir, so that two runs don't remove
+// each other's lanes or kill each other's servers. The lock file
+// holds the pid of the run, and the lock is released when the
+// process exits, even if it crashes.
+func lockVardir(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	var name = path.Join(dir, "yacht.lock")
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		content, _ := ioutil.ReadAll(file)
+		file.Close()
+		var owner = "another yacht run"
+		if pid := strings.TrimSpace(string(content)); pid != "" {
+			owner += ", pid " + pid
+		}
+		return nil, merry.Errorf("vardir %s is in use by %s, use --vardir-suffix "+
+			"to run another one", dir, owner)
+	}
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	return file, nil
+}
+
+// Clear the lane beween two test suite invocations
+func (lane *Lane) CleanupBeforeNextSuite() {
+	lane.mutex.Lock()
+	var artefacts = lane.artefacts
 	// Clear the artefacts array, the artefacts are now gone
-	lane.removeBeforeNextSuite = nil
+	lane.artefacts = nil
+	lane.mutex.Unlock()
+
+	removeArtefacts(artefacts)
 	lane.failed = nil
+	lane.passed = 0
 }
 
 // Remove all artefacts, such as running servers, on an abnormal exit
 // Keep the test artefacts for inspection.
 func (lane *Lane) CleanupBeforeExit() {
-	for _, artefact := range lane.removeBeforeExit {
-		artefact.Remove()
+	lane.mutex.Lock()
+	var artefacts, keep []*laneArtefact
+	for _, artefact := range lane.artefacts {
+		if artefact.exit {
+			artefacts = append(artefacts, artefact)
+		} else {
+			keep = append(keep, artefact)
+		}
+	}
+	lane.artefacts = keep
+	lane.mutex.Unlock()
+
+	removeArtefacts(artefacts)
+}
+
+// How long to wait for removal of an exit artefact, e.g. a server
+// shutdown, before giving up on it
+const EXIT_ARTEFACT_TIMEOUT = 60 * time.Second
+
+// Remove the artefacts, each one only after all artefacts which
+// depend on it are gone. Independent artefacts, e.g. servers of
+// a cluster, are removed concurrently.
+func removeArtefacts(artefacts []*laneArtefact) {
+	var pending = make(map[Artefact]*laneArtefact)
+	for _, artefact := range artefacts {
+		pending[artefact.Artefact] = artefact
+	}
+	for len(pending) > 0 {
+		var blocked = make(map[Artefact]bool)
+		for _, artefact := range pending {
+			for _, dep := range artefact.dependsOn {
+				if dep != nil {
+					blocked[dep] = true
+				}
+			}
+		}
+		var ready []*laneArtefact
+		for _, artefact := range artefacts {
+			if pending[artefact.Artefact] != nil && blocked[artefact.Artefact] == false {
+				ready = append(ready, artefact)
+			}
+		}
+		if len(ready) == 0 {
+			// A dependency cycle: remove everything left
+			for _, artefact := range pending {
+				ready = append(ready, artefact)
+			}
+		}
+		var wg sync.WaitGroup
+		wg.Add(len(ready))
+		for _, artefact := range ready {
+			delete(pending, artefact.Artefact)
+			go func(artefact *laneArtefact) {
+				defer wg.Done()
+				removeArtefact(artefact)
+			}(artefact)
+		}
+		wg.Wait()
+	}
+}
+
+// Remove an artefact and log the failure. Do not wait for removal of
+// an exit artefact longer than a timeout, so that a stuck server
+// doesn't block removal of the rest.
+func removeArtefact(artefact *laneArtefact) {
+	var err error
+	if artefact.exit == false {
+		err = artefact.Remove()
+	} else {
+		done := make(chan error, 1)
+		go func() {
+			done <- artefact.Remove()
+		}()
+		select {
+		case err = <-done:
+		case <-time.After(EXIT_ARTEFACT_TIMEOUT):
+			err = merry.Errorf("timed out after %v", EXIT_ARTEFACT_TIMEOUT)
+		}
+	}
+	if err != nil {
+		ylog.Warnf("Failed to remove %T: %v", artefact.Artefact, err)
+		fmt.Printf("%s%v\n", palette.Warn("cleanup failure: "), err)
 	}
-	lane.removeBeforeExit = nil
 }
 
 // The main testing harness state
@@ -345,8 +1421,25 @@ type Yacht struct {
 	env Env
 	// Execution environemnt, @todo: have many
 	lane Lane
+	// Lanes of the clusters other than the first one, when uri mode
+	// suites run against several clusters at once, see FanOut()
+	lanes []*Lane
 	// List of suites to run, in different configurations
 	suites []TestSuite
+	// Suites being found while the found ones run, nil if all suites
+	// are found before any runs
+	discovery *suiteDiscovery
+	// The number of tests which passed in all suites
+	passed int
+	// Durations of previous runs
+	history *History
+	// The vardir lock, held while the process runs
+	lock *os.File
+	// Suites and modes skipped because of configuration errors
+	configProblems int
+	// The directory of this run in vardir, with a subdirectory per
+	// lane, see newRunDir()
+	runDir string
 }
 
 // Kill running servers on SIGINT but leave the data directory
@@ -356,7 +1449,7 @@ func setSignalAction(yacht *Yacht) {
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		for sig := range c {
-			yacht.lane.CleanupBeforeExit()
+			yacht.CleanupBeforeExit()
 			fmt.Printf("Got signal %v, exiting", sig)
 			os.Exit(1)
 		}
@@ -371,16 +1464,16 @@ func setSignalAction(yacht *Yacht) {
 // directory to the suite inventory
 func (yacht *Yacht) findSuites() {
 
-	fmt.Printf("Looking for suites at %s\n", palette.Path(yacht.env.srcdir))
+	yacht.discoveryPrintf("Looking for suites at %s\n", palette.Path(yacht.env.srcdir))
 	files, err := filepath.Glob(path.Join(yacht.env.srcdir, "*"))
 	if err != nil {
-		fmt.Printf("Failed to find suites in %s: %v", yacht.env.srcdir, err)
+		fmt.Printf("Failed to find suites in %s: %v\n", yacht.env.srcdir, err)
 		os.Exit(1)
 	}
 	for _, path := range files {
 		st, err := os.Stat(path)
 		if err != nil {
-			fmt.Printf("Skipping broken suite %s: %s",
+			yacht.discoveryPrintf("Skipping broken suite %s: %s\n",
 				palette.Path("%s", path), palette.Warn("%v", err))
 			continue
 		}
@@ -397,36 +1490,208 @@ func (yacht *Yacht) findSuites() {
 			Type        string
 			Description string
 			Mode        []map[string]string
+			Driver      DriverConfig
+			Format      FormatConfig
+			Priority    int
+			DependsOn   []string `mapstructure:"depends_on"`
+			// Default gc_grace_seconds of tables created by tests
+			GcGraceSeconds *int `mapstructure:"gc_grace_seconds"`
+			// Canned responses of the mock server
+			Responses []MockResponse
+			// Queries which must return the same on every node
+			// after a repair at the end of the suite
+			ConsistencyCheck []string `mapstructure:"consistency_check"`
+			// Fail tests which don't drop schema objects they create
+			CheckSchema bool `mapstructure:"check_schema"`
+			// Server capabilities the tests need, e.g. udf
+			Requires []string
+			// Run the modes of the suite at once, each on an own lane
+			ParallelModes bool `mapstructure:"parallel_modes"`
+			// Levels of server loggers
+			Loggers LoggerLevels
+			// Kill a test which runs longer, in suites of programs,
+			// e.g. python
+			Timeout string
+			// How to run pytest in a python suite
+			Python PythonConfig
+			// How to run tests of an exe suite
+			Exe ExeConfig
+			// Where to find and how to run binaries of a unit suite
+			Unit UnitConfig
 		}
-		// Skip files which can not be read
-		if err := suite_cfg.ReadInConfig(); err == nil {
+		// Skip directories without a suite file
+		if err := readConfig(suite_cfg); err == nil {
 			var cfg BasicSuiteConfiguration
 			if err := suite_cfg.Unmarshal(&cfg); err != nil {
-				fmt.Printf("Failed to read suite configuration at %s: %s",
-					palette.Path("%s", path), palette.Warn("%v", err))
+				yacht.discoveryPrintf("Failed to read suite configuration at %s: %s\n",
+					palette.Path("%s", suite_cfg.ConfigFileUsed()), palette.Warn("%v", err))
+				yacht.configProblems++
+				continue
+			}
+			if problems := unknownKeys(suite_cfg.AllSettings(),
+				reflect.TypeOf(cfg), ""); len(problems) != 0 {
+				yacht.discoveryPrintf("Skipping suite at %s:\n", palette.Path("%s", suite_cfg.ConfigFileUsed()))
+				for _, problem := range problems {
+					yacht.discoveryPrintf("  %s\n", palette.Crit("%s", problem))
+				}
+				yacht.configProblems++
 				continue
 			}
 			if cfg.Type == "" {
-				// There is no configuration file
+				yacht.discoveryPrintf("Skipping suite at %s: %s\n",
+					palette.Path("%s", suite_cfg.ConfigFileUsed()),
+					palette.Crit("missing required key 'type', e.g. type: cql"))
+				yacht.configProblems++
 				continue
 			}
-			if strings.EqualFold(cfg.Type, "cql") != true {
-				fmt.Printf("Skipping unknown suite type '%s' at %s",
+			var kind = strings.ToLower(cfg.Type)
+			var harness = kind == "harness"
+			if kind != "cql" && kind != "python" && kind != "exe" && kind != "unit" &&
+				harness == false {
+				yacht.discoveryPrintf("Skipping unknown suite type '%s' at %s\n",
 					palette.Crit("%s", cfg.Type), palette.Path("%s", path))
+				yacht.configProblems++
+				continue
+			}
+			if err := cfg.Format.Init(); err != nil {
+				yacht.discoveryPrintf("Skipping suite at %s: %s\n",
+					palette.Path("%s", path), palette.Crit("%v", err))
+				yacht.configProblems++
+				continue
+			}
+			if err := cfg.Loggers.Validate(); err != nil {
+				yacht.discoveryPrintf("Skipping suite at %s: %s\n",
+					palette.Path("%s", path), palette.Crit("loggers: %v", err))
+				yacht.configProblems++
+				continue
+			}
+			if err := compileResponses(cfg.Responses); err != nil {
+				yacht.discoveryPrintf("Skipping suite at %s: %s\n",
+					palette.Path("%s", path), palette.Crit("%v", err))
+				yacht.configProblems++
+				continue
+			}
+			requires, err := parseRequirements(cfg.Requires)
+			if err != nil {
+				yacht.discoveryPrintf("Skipping suite at %s: %s\n",
+					palette.Path("%s", path), palette.Crit("requires: %v", err))
+				yacht.configProblems++
 				continue
 			}
-			suite := CQLTestSuite{
-				description: cfg.Description,
+			var timeout time.Duration
+			if cfg.Timeout != "" {
+				if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+					yacht.discoveryPrintf("Skipping suite at %s: %s\n", palette.Path("%s", path),
+						palette.Crit("malformed timeout '%s'", cfg.Timeout))
+					yacht.configProblems++
+					continue
+				}
+			}
+			var suite TestSuite
+			var process *ProcessTestSuite
+			switch kind {
+			case "python":
+				process = newPythonTestSuite(cfg.Python)
+			case "exe":
+				process = newExeTestSuite(cfg.Exe)
+			case "unit":
+				if process, err = newUnitTestSuite(cfg.Unit, yacht.env.builddir); err != nil {
+					yacht.discoveryPrintf("Skipping suite at %s: %s\n",
+						palette.Path("%s", path), palette.Crit("%v", err))
+					yacht.configProblems++
+					continue
+				}
+			}
+			if process != nil {
+				process.description = cfg.Description
+				process.onFailure = yacht.env.on_failure
+				process.priority = cfg.Priority
+				process.dependsOn = cfg.DependsOn
+				process.repeat = yacht.env.repeat
+				process.history = yacht.history
+				process.timeout = timeout
+				process.requires = requires
+				if yacht.env.out_of_tree {
+					process.outdir = filepath.Join(yacht.env.vardir, "results",
+						filepath.Base(path))
+				}
+				suite = process
+			} else {
+				cqlSuite := CQLTestSuite{
+					description: cfg.Description,
+					format:      cfg.Format,
+					onFailure:   yacht.env.on_failure,
+					priority:    cfg.Priority,
+					dependsOn:   cfg.DependsOn,
+					repeat:      yacht.env.repeat,
+					history:     yacht.history,
+
+					gcGraceSeconds: cfg.GcGraceSeconds,
+					maxOutputSize:  yacht.env.max_output_size,
+					stopAtDiff:     yacht.env.stop_at_diff,
+					slowStatement:  yacht.env.slow_statement,
+					verbose:        yacht.env.verbose,
+					failureShell:   yacht.env.on_fail == "shell",
+
+					consistencyCheck: cfg.ConsistencyCheck,
+					checkSchema:      cfg.CheckSchema,
+					requires:         requires,
+					parallelModes:    cfg.ParallelModes,
+					modeRejects:      len(cfg.Mode) > 1,
+				}
+				if yacht.env.record {
+					cqlSuite.recordDir = filepath.Join(yacht.env.vardir, "recordings")
+				}
+				if yacht.env.out_of_tree {
+					cqlSuite.outdir = filepath.Join(yacht.env.vardir, "results",
+						filepath.Base(path))
+				}
+				suite = &cqlSuite
+			}
+			// Harness and unit suites have a mode of their own, and
+			// only run with --mode mock or --mode unit if it's set
+			var fixed Server
+			if harness {
+				fixed = &mockServer{responses: cfg.Responses}
+			} else if kind == "unit" {
+				fixed = &unitServer{}
+			}
+			if fixed != nil && len(yacht.env.mode) > 0 &&
+				strings.EqualFold(fixed.ModeName(), yacht.env.mode) == false {
+				continue
 			}
 			if err := suite.FindTests(path, yacht.env.patterns); err != nil {
-				fmt.Printf("Failed to initialize a suite at %s: %v",
+				yacht.discoveryPrintf("Failed to initialize a suite at %s: %v\n",
 					palette.Path("%s", path), palette.Crit("%v", err))
 				continue
 			}
+			yacht.discoveryPrintf("Collecting tests in %-14s (Found %3d tests): %.26s\n",
+				fmt.Sprintf("'%.12s'", suite.Name()), len(suite.Tests()), cfg.Description)
 			// Only append the siute if it is not empty
 			if suite.IsEmpty() == true {
 				continue
 			}
+			if cqlSuite, ok := suite.(*CQLTestSuite); ok {
+				requires.Features = nil
+				for _, feature := range cqlSuite.RequiredFeatures() {
+					if knownFeature(feature) {
+						requires.Features = append(requires.Features, feature)
+						continue
+					}
+					// Scylla wouldn't start with it in scylla.yaml
+					yacht.discoveryPrintf("Unknown experimental feature '%s' in suite '%s', expected %s\n",
+						palette.Crit("%s", feature), suite.Name(),
+						strings.Join(KNOWN_EXPERIMENTAL_FEATURES, ", "))
+					yacht.configProblems++
+				}
+			}
+			if fixed != nil {
+				// A harness suite tests yacht itself against the
+				// mock server, unit tests need no server
+				suite.AddMode(fixed)
+				yacht.addSuite(suite)
+				continue
+			}
 			if len(cfg.Mode) == 0 {
 				cfg.Mode = append(cfg.Mode, map[string]string{"type": "uri"})
 			}
@@ -435,33 +1700,139 @@ func (yacht *Yacht) findSuites() {
 					strings.EqualFold(mode_cfg["type"], yacht.env.mode) == false {
 					continue
 				}
-				var server Server
-				if strings.EqualFold(mode_cfg["type"], "uri") == true {
-					server = &CQLServerURI{uri: yacht.env.uri}
-				} else if strings.EqualFold(mode_cfg["type"], "single") == true {
-					server = &CQLServer{builddir: yacht.env.builddir}
-				} else if strings.EqualFold(mode_cfg["type"], "cluster") == true {
-					server = &CQLCluster{builddir: yacht.env.builddir}
-				} else {
-					fmt.Printf("Skipping unknown mode '%s' in suite '%s' at %s\n",
+				override, err := modeDriver(mode_cfg)
+				if err != nil {
+					yacht.discoveryPrintf("Skipping mode '%s' in suite '%s': %s\n",
+						mode_cfg["type"], suite.Name(), palette.Crit("%v", err))
+					yacht.configProblems++
+					continue
+				}
+				var driver = yacht.env.driver.Merge(cfg.Driver).Merge(override)
+				var server = yacht.newServer(mode_cfg["type"], driver)
+				if server == nil {
+					yacht.discoveryPrintf("Skipping unknown mode '%s' in suite '%s' at %s\n",
 						palette.Crit("%s", mode_cfg["type"]),
-						palette.Crit("%s", suite.name),
+						palette.Crit("%s", suite.Name()),
 						palette.Path("%s", suite_cfg.ConfigFileUsed()))
+					yacht.configProblems++
 					continue
 				}
+				if mock, ok := server.(*mockServer); ok {
+					mock.responses = cfg.Responses
+				}
+				var configured error
+				switch s := server.(type) {
+				case *K8sCluster:
+					configured = s.Configure(mode_cfg)
+				case *ComposeCluster:
+					configured = s.Configure(mode_cfg, path)
+				case *CCMCluster:
+					configured = s.Configure(mode_cfg)
+				}
+				if configured != nil {
+					yacht.discoveryPrintf("Skipping mode '%s' in suite '%s': %s\n",
+						mode_cfg["type"], suite.Name(), palette.Crit("%v", configured))
+					yacht.configProblems++
+					continue
+				}
+				resources, err := parseResources(mode_cfg)
+				if err != nil {
+					yacht.discoveryPrintf("Skipping mode '%s' in suite '%s': %s\n",
+						mode_cfg["type"], suite.Name(), palette.Crit("%v", err))
+					yacht.configProblems++
+					continue
+				}
+				setResources(server, resources)
+				setLoggers(server, cfg.Loggers)
+				setRequirements(server, requires)
 				if yacht.env.start_and_exit == true {
 					server = &StartAndExit{server}
 				}
 				suite.AddMode(server)
 			}
 			if len(suite.Servers()) > 0 {
-				yacht.suites = append(yacht.suites, &suite)
+				yacht.addSuite(suite)
 			}
 		}
 	}
+	if yacht.env.changed_only {
+		if err := yacht.selectChanged(); err != nil {
+			fmt.Printf("%s%v\n", palette.Crit("--changed-only failure: "), err)
+			os.Exit(1)
+		}
+	}
 	if len(yacht.suites) == 0 {
-		fmt.Printf(" ... found no matching suites\n")
+		yacht.discoveryPrintf(" ... found no matching suites\n")
+	}
+}
+
+// Only keep tests changed relative to the git base ref, whole suites
+// if their other files changed, and suites they depend on
+func (yacht *Yacht) selectChanged() error {
+	changed, err := gitChangedFiles(yacht.env.srcdir, yacht.env.base)
+	if err != nil {
+		return err
+	}
+	var realpath = func(file string) string {
+		if real, err := filepath.EvalSymlinks(file); err == nil {
+			return real
+		}
+		return file
+	}
+	// Suites with changed tests, and suites which must run entirely
+	var selected = make(map[string]bool)
+	var entire = make(map[string]bool)
+	var byName = make(map[string]TestSuite)
+	for _, suite := range yacht.suites {
+		byName[suite.Name()] = suite
+		dir := realpath(suite.Path())
+		for file := range changed {
+			if filepath.Dir(file) != dir {
+				continue
+			}
+			if testFileRE.MatchString(file) {
+				selected[suite.Name()] = true
+			} else {
+				entire[suite.Name()] = true
+			}
+		}
+	}
+	// Dependencies of selected suites run entirely
+	var queue []string
+	for name := range selected {
+		queue = append(queue, name)
+	}
+	for name := range entire {
+		queue = append(queue, name)
 	}
+	for len(queue) > 0 {
+		suite, found := byName[queue[0]]
+		queue = queue[1:]
+		if found == false {
+			continue
+		}
+		for _, dep := range suite.DependsOn() {
+			if entire[dep] == false {
+				entire[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+	var suites []TestSuite
+	for _, suite := range yacht.suites {
+		if entire[suite.Name()] == false {
+			suite.Filter(func(path string) bool {
+				return changed[realpath(path)]
+			})
+		}
+		if entire[suite.Name()] || suite.IsEmpty() == false {
+			suites = append(suites, suite)
+		}
+	}
+	fmt.Printf("Selected %d suites with changes relative to %s\n", len(suites),
+		palette.Path(yacht.env.base))
+	yacht.suites = suites
+	return nil
 }
 
 // Run found suites. Return the list of failed test and result
@@ -469,41 +1840,464 @@ func (yacht *Yacht) RunSuites() ([]string, int) {
 
 	var rc int = 0
 	var failed []string
-	for _, suite := range yacht.suites {
-		PrintSuiteBeginBlurb()
-		for _, server := range suite.Servers() {
+	if yacht.discovery == nil {
+		yacht.sortSuites()
+	}
+	// Suites which failed or were skipped
+	var failedSuites = make(map[string]bool)
+	// Suites which ran, failed or were skipped, see nextSuite()
+	var ran = make(map[string]bool)
+	for suite := yacht.nextSuite(ran); suite != nil; suite = yacht.nextSuite(ran) {
+		ran[suite.Name()] = true
+		var skip bool
+		for _, dep := range suite.DependsOn() {
+			if failedSuites[dep] {
+				fmt.Printf("Skipping suite %s: %s\n", palette.Path(suite.Name()),
+					palette.Warn("suite %s it depends on failed", dep))
+				skip = true
+				break
+			}
+		}
+		if skip {
+			failedSuites[suite.Name()] = true
+			continue
+		}
+		start := time.Now()
+		var suite_failed bool
+		fmt.Printf("%sStarting %s: %s\n", yacht.lane.Prefix(), yacht.suiteProgress(len(ran)),
+			palette.Path(suite.Name()))
+		PrintSuiteBeginBlurb(yacht.lane.Prefix())
+		var servers = suite.Servers()
+		if cqlSuite, ok := suite.(*CQLTestSuite); ok && cqlSuite.parallelModes &&
+			len(servers) > 1 && len(yacht.env.clusters) <= 1 {
+			suite_rc, modes_failed, err := yacht.RunModes(cqlSuite)
+			if err != nil && merry.Is(err, ErrConnectionLost, ErrAccessDenied, ErrNodeDown) {
+				fmt.Printf("%s%v\n", palette.Crit("infrastructure failure: "), err)
+				return failed, 1
+			} else if err != nil {
+				fmt.Printf("%s%+v\n", palette.Crit("yacht failure: "), err)
+				return failed, 1
+			}
+			rc |= suite_rc
+			suite_failed = suite_rc != 0
+			failed = append(failed, modes_failed...)
+			// The modes already ran
+			servers = nil
+		}
+		for _, server := range servers {
+			if yacht.lane.TimedOut() {
+				suite.NotRun(&yacht.lane, server)
+				continue
+			}
+			if uri, ok := server.(*CQLServerURI); ok && len(yacht.env.clusters) > 1 {
+				suite_rc, lanes_failed, err := yacht.FanOut(suite, uri)
+				if err != nil && merry.Is(err, ErrConnectionLost, ErrAccessDenied, ErrNodeDown) {
+					fmt.Printf("%s%v\n", palette.Crit("infrastructure failure: "), err)
+					return failed, 1
+				} else if err != nil {
+					fmt.Printf("%s%+v\n", palette.Crit("yacht failure: "), err)
+					return failed, 1
+				}
+				rc |= suite_rc
+				suite_failed = suite_failed || suite_rc != 0
+				failed = append(failed, lanes_failed...)
+				if rc != 0 && yacht.env.force == false {
+					break
+				}
+				continue
+			}
 			// Clear the lane between test suites
 			// Note, it's done before the suite is started,
 			// not after, to preserve important artefacts
 			// between runs
 			yacht.lane.CleanupBeforeNextSuite()
+			if err := yacht.lane.CheckDiskSpace(); err != nil {
+				fmt.Printf("%s%v\n", palette.Crit("lane failure: "), err)
+				return failed, 1
+			}
+			yacht.lane.Log().Section("suite %s, mode %s", suite.Name(), server.ModeName())
+			events.Emit("suite-start", map[string]interface{}{"lane": yacht.lane.id,
+				"suite": suite.Name(), "mode": server.ModeName()})
 			if err := suite.PrepareLane(&yacht.lane, server); err != nil {
 				fmt.Printf("%s%v\n", palette.Crit("lane failure: "), err)
 				return failed, 1
 			}
-			if suite_rc, err := suite.RunSuite(yacht.env.force, &yacht.lane, server); err != nil {
-				fmt.Printf("%s%+v\n", palette.Crit("yacht failure: "), err)
+			suite_rc, err := suite.RunSuite(yacht.env.force, &yacht.lane, server)
+			events.Emit("suite-end", map[string]interface{}{"lane": yacht.lane.id,
+				"suite": suite.Name(), "mode": server.ModeName(), "rc": suite_rc})
+			if err != nil {
+				if merry.Is(err, ErrConnectionLost, ErrAccessDenied, ErrNodeDown) {
+					fmt.Printf("%s%v\n", palette.Crit("infrastructure failure: "), err)
+				} else {
+					fmt.Printf("%s%+v\n", palette.Crit("yacht failure: "), err)
+				}
 				return failed, 1
-			} else {
-				rc |= suite_rc
-				failed = append(failed, yacht.lane.FailedTests()...)
-				if rc != 0 && yacht.env.force == false {
-					break
+			}
+			rc |= suite_rc
+			suite_failed = suite_failed || suite_rc != 0
+			failed = append(failed, yacht.lane.FailedTests()...)
+			yacht.passed += yacht.lane.PassedTests()
+			if (rc != 0 && yacht.env.force == false) || yacht.lane.TooManyFailures() {
+				break
+			}
+		}
+		PrintSuiteEndBlurb(yacht.lane.Prefix())
+		if yacht.lane.TimedOut() {
+			// The suite didn't run to the end
+			continue
+		}
+		yacht.history.Suites[suite.Name()] = time.Now().Sub(start).Seconds()
+		if suite_failed {
+			failedSuites[suite.Name()] = true
+		}
+		if yacht.lane.TooManyFailures() {
+			fmt.Printf("%s\n", palette.Crit("Stopping after %d failed tests",
+				yacht.env.max_failures))
+			break
+		}
+	}
+	return failed, rc
+}
+
+// Order suites by priority, then by the duration of their last run,
+// fastest first, then by name, so that quick smoke suites run first
+// and catastrophic failures show up early
+func (yacht *Yacht) sortSuites() {
+	sort.SliceStable(yacht.suites, func(i, j int) bool {
+		return yacht.runsBefore(yacht.suites[i], yacht.suites[j])
+	})
+	// Move suites after the suites they depend on, keeping the
+	// order otherwise
+	var found = make(map[string]bool)
+	for _, suite := range yacht.suites {
+		found[suite.Name()] = true
+	}
+	var sorted []TestSuite
+	var done = make(map[string]bool)
+	for len(sorted) < len(yacht.suites) {
+		var progress bool
+		for _, suite := range yacht.suites {
+			if done[suite.Name()] {
+				continue
+			}
+			var ready = true
+			for _, dep := range suite.DependsOn() {
+				if found[dep] && done[dep] == false {
+					ready = false
+				}
+			}
+			if ready {
+				sorted = append(sorted, suite)
+				done[suite.Name()] = true
+				progress = true
+				// Restart from the beginning to keep the order
+				break
+			}
+		}
+		if progress == false {
+			// A dependency cycle: keep the rest in the current order
+			for _, suite := range yacht.suites {
+				if done[suite.Name()] == false {
+					fmt.Printf("%s %s\n", palette.Warn("Suite dependency cycle at"),
+						palette.Path(suite.Name()))
+					sorted = append(sorted, suite)
+					done[suite.Name()] = true
 				}
 			}
 		}
-		PrintSuiteEndBlurb()
+	}
+	for _, suite := range sorted {
+		for _, dep := range suite.DependsOn() {
+			if found[dep] == false {
+				fmt.Printf("%s %s\n", palette.Warn("Suite %s depends on suite %s,"+
+					" which is not selected to run:", suite.Name(), dep),
+					palette.Path("%s runs without it", suite.Name()))
+			}
+		}
+	}
+	yacht.suites = sorted
+}
+
+// Whether suite a runs before suite b, dependencies aside
+func (yacht *Yacht) runsBefore(a TestSuite, b TestSuite) bool {
+	if a.Priority() != b.Priority() {
+		return a.Priority() > b.Priority()
+	}
+	da, db := yacht.history.Suites[a.Name()], yacht.history.Suites[b.Name()]
+	if da != db {
+		return da < db
+	}
+	return a.Name() < b.Name()
+}
+
+// Run found suites with every build from the configuration file and
+// report tests which failed with some of the builds only
+func (yacht *Yacht) RunBuilds() ([]string, int) {
+
+	var names []string
+	for name := range yacht.env.builds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rc int
+	var failed []string
+	// Builds with which a test failed
+	var failedWith = make(map[string][]string)
+	var tests []string
+	for _, name := range names {
+		yacht.env.builddir = yacht.env.builds[name]
+		fmt.Printf("Using build %s at %s\n", palette.Path(name),
+			palette.Path(yacht.env.builddir))
+		yacht.suites = nil
+		yacht.findSuites()
+		build_failed, build_rc := yacht.RunSuites()
+		rc |= build_rc
+		for _, test := range build_failed {
+			if len(failedWith[test]) == 0 {
+				tests = append(tests, test)
+			}
+			failedWith[test] = append(failedWith[test], name)
+			failed = append(failed, fmt.Sprintf("%s (%s)", test, name))
+		}
+		if build_rc != 0 && yacht.env.force == false {
+			break
+		}
+	}
+	for _, test := range tests {
+		if len(failedWith[test]) < len(names) {
+			fmt.Printf("%s %s\n", palette.Warn("Result differs between builds:"),
+				palette.Path("%s failed with %s only", test,
+					strings.Join(failedWith[test], ", ")))
+		}
 	}
 	return failed, rc
 }
 
-func (yacht *Yacht) Run() int {
+// Create a server of the given mode, nil if the mode is unknown
+func (yacht *Yacht) newServer(mode string, driver DriverConfig) Server {
+	switch strings.ToLower(mode) {
+	case "uri":
+		var uri = yacht.env.uri
+		if len(yacht.env.clusters) > 0 {
+			uri = yacht.env.clusters[0]
+		}
+		return &CQLServerURI{uri: uri, driver: driver, keyspace: yacht.env.keyspace,
+			yesWipe: yacht.env.yes_wipe, readOnly: yacht.env.read_only}
+	case "single":
+		return &CQLServer{
+			CQLServerURI: CQLServerURI{driver: driver, keyspace: yacht.env.keyspace},
+			builddir:     yacht.env.builddir,
+			instances:    1,
+		}
+	case "cluster":
+		return &CQLCluster{builddir: yacht.env.builddir, driver: driver,
+			keyspace: yacht.env.keyspace}
+	case "mock":
+		return &mockServer{}
+	case "k8s":
+		return &K8sCluster{
+			CQLServerURI: CQLServerURI{driver: driver, keyspace: yacht.env.keyspace},
+			cfg:          yacht.env.k8s,
+		}
+	case "compose":
+		return &ComposeCluster{
+			CQLServerURI: CQLServerURI{driver: driver, keyspace: yacht.env.keyspace},
+		}
+	case "ccm":
+		return &CCMCluster{
+			CQLServerURI: CQLServerURI{driver: driver, keyspace: yacht.env.keyspace},
+		}
+	}
+	return nil
+}
 
-	yacht.lane.Init("1", yacht.env.vardir)
+// Accept the output of the last failed run of matching tests
+// as the new result
+func (yacht *Yacht) Accept() int {
 
 	yacht.findSuites()
 
-	failed, rc := yacht.RunSuites()
+	for _, suite := range yacht.suites {
+		for _, server := range suite.Servers() {
+			if err := suite.Accept(server); err != nil {
+				fmt.Printf("%s%v\n", palette.Crit("accept failure: "), err)
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+func (yacht *Yacht) InitLane() error {
+	if err := reapOrphans(yacht.env.vardir, yacht.env.kill_orphans); err != nil {
+		return err
+	}
+	if _, err := pruneRuns(yacht.env.vardir, yacht.env.keep_runs); err != nil {
+		ylog.Warnf("%v", err)
+	}
+	runDir, err := newRunDir(yacht.env.vardir)
+	if err != nil {
+		return err
+	}
+	yacht.runDir = runDir
+	if err := yacht.initLane(&yacht.lane, "1"); err != nil {
+		return err
+	}
+	if yacht.env.profile {
+		yacht.lane.profileDir = path.Join(yacht.env.vardir, "profiles")
+		if err := os.MkdirAll(yacht.lane.profileDir, 0750); err != nil {
+			return merry.Wrap(err)
+		}
+	}
+	if yacht.env.coverage.Enabled(yacht.env.builddir) {
+		yacht.lane.coverageDir = path.Join(yacht.env.vardir, "coverage")
+		initLaneDir(yacht.lane.coverageDir)
+	}
+	return nil
+}
+
+// Settings shared by all lanes, profiles and coverage are only
+// collected on the first one
+func (yacht *Yacht) initLane(lane *Lane, id string) error {
+	lane.Init(id, yacht.runDir)
+	if err := lane.OpenLog(yacht.env.vardir, yacht.env.log_level,
+		yacht.env.log_max_size); err != nil {
+		return err
+	}
+	lane.SetDiskLimits(yacht.env.min_free_space, yacht.env.lane_quota)
+	lane.maxFailures = yacht.env.max_failures
+	lane.isolation = yacht.env.isolation
+	lane.CheckIsolation()
+	lane.monitor = &yacht.env.monitor
+	if yacht.env.max_time > 0 {
+		lane.deadline = time.Now().Add(yacht.env.max_time)
+	}
+	return lane.InitTmpfs(yacht.env.tmpfs, yacht.env.vardir)
+}
+
+// Remove exit artefacts of all lanes
+func (yacht *Yacht) CleanupBeforeExit() {
+	yacht.lane.CleanupBeforeExit()
+	for _, lane := range yacht.lanes {
+		lane.CleanupBeforeExit()
+	}
+}
+
+// Minimize the first matching test in the first matching mode
+func (yacht *Yacht) Minimize() int {
+
+	if err := yacht.InitLane(); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("lane failure: "), err)
+		return 1
+	}
+
+	yacht.findSuites()
+
+	if len(yacht.suites) == 0 {
+		return 1
+	}
+	suite := yacht.suites[0]
+	if err := suite.Minimize(&yacht.lane, suite.Servers()[0]); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("minimize failure: "), err)
+		return 1
+	}
+	return 0
+}
+
+// Exit status of a run which exceeded --max-time
+const EXIT_TIMEOUT = 3
+
+func (yacht *Yacht) Run() int {
+
+	if yacht.env.command == "accept" {
+		return yacht.Accept()
+	}
+	if yacht.env.command == "minimize" {
+		return yacht.Minimize()
+	}
+	if yacht.env.command == "shell" {
+		return yacht.Shell()
+	}
+	if yacht.env.command == "replay" {
+		return yacht.Replay()
+	}
+	if yacht.env.command == "regen" {
+		return yacht.Regen()
+	}
+	if yacht.env.command == "setup-net" {
+		return yacht.SetupNet()
+	}
+	if yacht.env.command == "config" {
+		return yacht.Config()
+	}
+	if yacht.env.command == "serve" {
+		return yacht.Serve()
+	}
+	if yacht.env.command == "clean" {
+		return yacht.Clean()
+	}
+	if yacht.env.show_config {
+		yacht.env.ShowConfig()
+	}
+
+	if err := yacht.InitLane(); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("lane failure: "), err)
+		return 1
+	}
+
+	start := time.Now()
+	events.Emit("run-start", map[string]interface{}{"patterns": yacht.env.patterns,
+		"mode": yacht.env.mode})
+	yacht.history = LoadHistory(yacht.env.vardir)
+	var failed []string
+	var rc int
+	if yacht.env.build_profile == "all" {
+		failed, rc = yacht.RunBuilds()
+	} else if yacht.env.changed_only {
+		// Selecting changed tests needs all suites
+		yacht.findSuites()
+		failed, rc = yacht.RunSuites()
+	} else {
+		yacht.discoverSuites()
+		failed, rc = yacht.RunSuites()
+		yacht.waitDiscovery()
+	}
+	if yacht.configProblems != 0 {
+		// Some suites, modes or tests were skipped or misconfigured,
+		// so the run is not a success
+		fmt.Printf("%s\n", palette.Crit("Found %d configuration problems, see "+
+			"'yacht config validate'", yacht.configProblems))
+		if rc == 0 {
+			rc = 1
+		}
+	}
+	if err := yacht.history.Save(); err != nil {
+		ylog.Warnf("%v", err)
+	}
+	if yacht.lane.coverageDir != "" && yacht.env.coverage.Merge {
+		// Servers write coverage data on exit
+		yacht.lane.CleanupBeforeExit()
+		if err := mergeCoverage(yacht.lane.coverageDir,
+			path.Join(yacht.env.builddir, "scylla")); err != nil {
+			fmt.Printf("%s%v\n", palette.Warn("coverage failure: "), err)
+		}
+	}
+	if yacht.lane.TimedOut() {
+		fmt.Printf("%s\n", palette.Crit("Time budget of %v is over, %d tests not run",
+			yacht.env.max_time, yacht.lane.NotRunTests()))
+		if rc == 0 {
+			rc = EXIT_TIMEOUT
+		}
+	}
+	summary := newRunSummary(&yacht.env, yacht.passed, failed, rc, start)
+	summary.NotRun = yacht.lane.NotRunTests()
+	summary.Metadata = yacht.lane.metadata
+	notify(&yacht.env.notify, summary)
+	events.Emit("run-end", map[string]interface{}{"status": summary.Status,
+		"passed": summary.Passed, "failed": summary.Failed,
+		"failed_tests": summary.FailedTests, "not_run": summary.NotRun,
+		"duration_ms": milliseconds(time.Now().Sub(start))})
 	if len(failed) != 0 {
 		if yacht.env.force == true {
 			fmt.Printf("%s %s\n", palette.Warn("Not all tests executed successfully: "),
@@ -515,34 +2309,42 @@ func (yacht *Yacht) Run() int {
 	return rc
 }
 
-func OpenLog(dir string) {
-	if err := os.MkdirAll(dir, 0750); err != nil {
-		fmt.Printf("Failed to create vardir %s", palette.Path(dir))
-		os.Exit(1)
+func main() {
+	if len(os.Args) == 2 && os.Args[1] == "--version" {
+		// Don't require a valid configuration
+		printVersion()
+		os.Exit(0)
 	}
-	var name = path.Join(dir, "yacht.log")
-	logFile, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		fmt.Printf("%s %s\n", palette.Crit("Failed to open log file"),
-			palette.Path(name))
-		os.Exit(1)
+	redirectConsole()
+	if !quietCommand() {
+		fmt.Println("Started", strings.Join(os.Args[:], " "))
 	}
-	ylog = log.New(logFile, "", log.Ldate|log.Lmicroseconds|log.Lshortfile)
-}
-
-func main() {
-	fmt.Println("Started", strings.Join(os.Args[:], " "))
 
 	var env Env
 	env.Usage()
 
-	OpenLog(env.vardir)
+	if env.command == "completion" || env.command == "__complete" {
+		os.Exit(env.Completion())
+	}
+
+	lock, err := lockVardir(env.vardir)
+	if err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("vardir failure: "), err)
+		os.Exit(1)
+	}
+
+	OpenLog(env.vardir, env.log_level, env.log_max_size)
+	if err := OpenEvents(env.events); err != nil {
+		fmt.Printf("%s%v\n", palette.Crit("events failure: "), err)
+		os.Exit(1)
+	}
 
 	yacht := Yacht{
-		env: env,
+		env:  env,
+		lock: lock,
 	}
 	setSignalAction(&yacht)
 	rc := yacht.Run()
-	yacht.lane.CleanupBeforeExit()
+	yacht.CleanupBeforeExit()
 	os.Exit(rc)
 }